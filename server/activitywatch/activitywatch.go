@@ -0,0 +1,182 @@
+// Package activitywatch reads the data of aw-server, the ActivityWatch server
+// TimelyGator is modeled on, so that it can be imported.
+//
+// aw-server exports buckets as JSON in the format of /v1/export, and stores
+// them in a SQLite database written by its peewee storage. Bucket IDs and
+// clients of the ActivityWatch watchers are renamed to those of the
+// TimelyGator observers that replace them, so aw-watcher-window_laptop
+// becomes tg-observer-window_laptop. Bucket types are the same in both.
+package activitywatch
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+)
+
+const (
+	watcherPrefix  = "aw-watcher-"
+	observerPrefix = "tg-observer-"
+)
+
+// Rename returns the TimelyGator name of an ActivityWatch bucket ID or client.
+// Names not of a watcher are kept.
+func Rename(name string) string {
+	if rest, ok := strings.CutPrefix(name, watcherPrefix); ok {
+		return observerPrefix + rest
+	}
+	return name
+}
+
+// sqliteHeader begins every SQLite database file.
+const sqliteHeader = "SQLite format 3\x00"
+
+// HeaderSize is the number of bytes IsDatabase needs.
+const HeaderSize = len(sqliteHeader)
+
+// IsDatabase reports whether a file beginning with header is a SQLite
+// database rather than a JSON export.
+func IsDatabase(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(sqliteHeader))
+}
+
+// DB is an aw-server peewee database opened for reading.
+type DB struct {
+	db *sql.DB
+}
+
+// Bucket is a bucket of an aw-server database.
+type Bucket struct {
+	key      int64
+	ID       string
+	Name     *string
+	Type     string
+	Client   string
+	Hostname string
+	Created  time.Time
+	Data     map[string]interface{}
+}
+
+// Event is an event of an aw-server database.
+type Event struct {
+	Timestamp time.Time
+	Duration  float64
+	Data      json.RawMessage
+}
+
+// Open opens the aw-server database at path read only.
+func Open(path string) (*DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	var tables int
+	err = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'table' AND name IN ('bucketmodel', 'eventmodel')`).Scan(&tables)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("reading ActivityWatch database: %w", err)
+	}
+	if tables != 2 {
+		db.Close()
+		return nil, fmt.Errorf("not an ActivityWatch database: missing bucketmodel or eventmodel table")
+	}
+	return &DB{db: db}, nil
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+// Buckets returns the buckets of the database ordered by ID, with their IDs
+// and clients as stored.
+func (db *DB) Buckets() ([]*Bucket, error) {
+	// Bucket data was only added in later versions of aw-server
+	dataColumn := "'{}'"
+	var hasData int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('bucketmodel') WHERE name = 'datastr'`).Scan(&hasData); err != nil {
+		return nil, err
+	}
+	if hasData > 0 {
+		dataColumn = "datastr"
+	}
+	rows, err := db.db.Query(`SELECT key, id, name, type, client, hostname, CAST(created AS TEXT), ` +
+		dataColumn + ` FROM bucketmodel ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var buckets []*Bucket
+	for rows.Next() {
+		b := &Bucket{}
+		var name sql.NullString
+		var created, data string
+		if err := rows.Scan(&b.key, &b.ID, &name, &b.Type, &b.Client, &b.Hostname, &created, &data); err != nil {
+			return nil, err
+		}
+		if name.Valid {
+			b.Name = &name.String
+		}
+		if b.Created, err = parseTime(created); err != nil {
+			return nil, fmt.Errorf("bucket %s: %w", b.ID, err)
+		}
+		if err := json.Unmarshal([]byte(data), &b.Data); err != nil {
+			return nil, fmt.Errorf("bucket %s: invalid data: %w", b.ID, err)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// Events calls fn with the events of a bucket one by one, oldest first.
+func (db *DB) Events(bucket *Bucket, fn func(*Event) error) error {
+	rows, err := db.db.Query(`SELECT CAST(timestamp AS TEXT), CAST(duration AS REAL), datastr
+		FROM eventmodel WHERE bucket_id = ? ORDER BY timestamp, id`, bucket.key)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var timestamp, data string
+		e := &Event{}
+		if err := rows.Scan(&timestamp, &e.Duration, &data); err != nil {
+			return err
+		}
+		if e.Timestamp, err = parseTime(timestamp); err != nil {
+			return fmt.Errorf("bucket %s: %w", bucket.ID, err)
+		}
+		if !json.Valid([]byte(data)) {
+			return fmt.Errorf("bucket %s: event at %s has invalid data", bucket.ID, timestamp)
+		}
+		e.Data = json.RawMessage(data)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// timeFormats are the formats peewee stores times in, with and without time
+// zone and fractional seconds.
+var timeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+// parseTime parses a time stored by peewee. Times without zone are UTC, as
+// aw-server stores.
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
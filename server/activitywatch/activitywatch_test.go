@@ -0,0 +1,106 @@
+package activitywatch
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRename(t *testing.T) {
+	for name, want := range map[string]string{
+		"aw-watcher-window_laptop": "tg-observer-window_laptop",
+		"aw-watcher-afk":           "tg-observer-afk",
+		"aw-server":                "aw-server",
+		"my-aw-watcher-web":        "my-aw-watcher-web",
+	} {
+		if got := Rename(name); got != want {
+			t.Errorf("Rename(%q) = %q, expected %q", name, got, want)
+		}
+	}
+}
+
+// createDatabase creates a database as aw-server's peewee storage does, with
+// the bucket data column of later versions if withData.
+func createDatabase(t *testing.T, withData bool) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "peewee-sqlite.v2.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dataColumn := ""
+	if withData {
+		dataColumn = ", datastr VARCHAR(255) NOT NULL DEFAULT '{}'"
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE bucketmodel (key INTEGER NOT NULL PRIMARY KEY, id VARCHAR(255) NOT NULL,
+			created DATETIME NOT NULL, name VARCHAR(255), type VARCHAR(255) NOT NULL,
+			client VARCHAR(255) NOT NULL, hostname VARCHAR(255) NOT NULL` + dataColumn + `)`,
+		`CREATE TABLE eventmodel (id INTEGER NOT NULL PRIMARY KEY, bucket_id INTEGER NOT NULL,
+			timestamp DATETIME NOT NULL, duration DECIMAL(10, 5) NOT NULL, datastr VARCHAR(255) NOT NULL)`,
+		`INSERT INTO bucketmodel (key, id, created, name, type, client, hostname) VALUES
+			(1, 'aw-watcher-window_laptop', '2024-01-01 09:00:00.123456+00:00', NULL, 'currentwindow', 'aw-watcher-window', 'laptop'),
+			(2, 'aw-watcher-afk_laptop', '2024-01-01 09:00:00', 'AFK', 'afkstatus', 'aw-watcher-afk', 'laptop')`,
+		`INSERT INTO eventmodel (bucket_id, timestamp, duration, datastr) VALUES
+			(1, '2024-01-01 10:01:00+00:00', 30.5, '{"app": "Browser", "title": "News"}'),
+			(1, '2024-01-01 10:00:00.5+00:00', 60, '{"app": "Editor", "title": "main.go"}'),
+			(2, '2024-01-01 10:00:00+00:00', 90, '{"status": "not-afk"}')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestDatabase(t *testing.T) {
+	for _, withData := range []bool{false, true} {
+		db, err := Open(createDatabase(t, withData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		buckets, err := db.Buckets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) != 2 || buckets[0].ID != "aw-watcher-afk_laptop" || *buckets[0].Name != "AFK" ||
+			buckets[1].Name != nil || buckets[1].Type != "currentwindow" || buckets[1].Hostname != "laptop" {
+			t.Fatalf("unexpected buckets %+v %+v", buckets[0], buckets[1])
+		}
+		if want := time.Date(2024, 1, 1, 9, 0, 0, 123456000, time.UTC); !buckets[1].Created.Equal(want) {
+			t.Errorf("expected bucket created at %s, got %s", want, buckets[1].Created)
+		}
+
+		var events []*Event
+		err = db.Events(buckets[1], func(e *Event) error {
+			events = append(events, e)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || events[0].Duration != 60 || events[1].Duration != 30.5 ||
+			string(events[1].Data) != `{"app": "Browser", "title": "News"}` {
+			t.Fatalf("unexpected events %+v", events)
+		}
+		if want := time.Date(2024, 1, 1, 10, 0, 0, 5e8, time.UTC); !events[0].Timestamp.Equal(want) {
+			t.Errorf("expected the first event at %s, got %s", want, events[0].Timestamp)
+		}
+	}
+}
+
+func TestOpenOther(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "other.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec(`CREATE TABLE buckets (id TEXT)`)
+	db.Close()
+	if _, err := Open(path); err == nil {
+		t.Errorf("expected a database without ActivityWatch tables to be refused")
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"time"
+
+	"timelygator/server/activitywatch"
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+	"timelygator/server/utils"
+)
+
+// ImportActivityWatch imports an aw-server JSON export or database read from
+// r. The buckets of ActivityWatch watchers are renamed to those of the
+// TimelyGator observers, and existing buckets are handled as onConflict says.
+func (s *API) ImportActivityWatch(r io.Reader, onConflict string) (*ImportResult, error) {
+	if err := database.CheckConflict(onConflict); err != nil {
+		return &ImportResult{Buckets: []ImportedBucket{}}, err
+	}
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(activitywatch.HeaderSize)
+	if !activitywatch.IsDatabase(header) {
+		return s.importStream(br, onConflict, activitywatch.Rename)
+	}
+
+	// SQLite reads databases from files only
+	f, err := os.CreateTemp("", "tg-activitywatch-*.db")
+	if err != nil {
+		return &ImportResult{Buckets: []ImportedBucket{}}, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, br)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return &ImportResult{Buckets: []ImportedBucket{}}, err
+	}
+	return s.ImportActivityWatchDB(f.Name(), onConflict)
+}
+
+// ImportActivityWatchDB imports the buckets of the aw-server database at path
+// as ImportActivityWatch does.
+func (s *API) ImportActivityWatchDB(path, onConflict string) (*ImportResult, error) {
+	result := &ImportResult{Buckets: []ImportedBucket{}}
+	if err := database.CheckConflict(onConflict); err != nil {
+		return result, err
+	}
+	db, err := activitywatch.Open(path)
+	if err != nil {
+		return result, invalidImport("%v", err)
+	}
+	defer db.Close()
+	buckets, err := db.Buckets()
+	if err != nil {
+		return result, invalidImport("%v", err)
+	}
+	for _, b := range buckets {
+		bucket := &models.Bucket{
+			ID:       activitywatch.Rename(b.ID),
+			Name:     b.Name,
+			Type:     b.Type,
+			Client:   activitywatch.Rename(b.Client),
+			Hostname: b.Hostname,
+			Created:  b.Created,
+		}
+		if bucket.Data, err = utils.MapToJSON(b.Data); err != nil {
+			return result, err
+		}
+		imported, err := s.importBucket(bucket, onConflict, func(add func(*models.Event) error) error {
+			var addErr error
+			err := db.Events(b, func(e *activitywatch.Event) error {
+				if e.Duration < 0 {
+					return invalidEvent("event at %s has a negative duration", e.Timestamp.Format(time.RFC3339Nano))
+				}
+				addErr = add(&models.Event{Timestamp: e.Timestamp, Duration: e.Duration, Data: []byte(e.Data)})
+				return addErr
+			})
+			if err != nil && addErr == nil && !utils.IsBadRequest(err) {
+				return invalidImport("%v", err)
+			}
+			return err
+		})
+		if err != nil && !utils.IsBadRequest(err) {
+			return result, err
+		}
+		if err != nil {
+			imported.Error = err.Error()
+		}
+		result.add(imported)
+	}
+	return result, nil
+}
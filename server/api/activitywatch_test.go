@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportActivityWatch(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1"
+	post := func(body []byte, status int) ImportResult {
+		t.Helper()
+		res, err := http.Post(base+"/import/activitywatch", "application/octet-stream", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var result ImportResult
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != status {
+			t.Fatalf("import: expected %d, got %d: %+v", status, res.StatusCode, result)
+		}
+		return result
+	}
+	metadata := func(bucketID string) map[string]interface{} {
+		t.Helper()
+		var meta map[string]interface{}
+		json.NewDecoder(doJSON(t, http.MethodGet, base+"/buckets/"+bucketID, nil).Body).Decode(&meta)
+		return meta
+	}
+
+	// A JSON export of aw-server, with its nested event data
+	export := `{"buckets": {"aw-watcher-window_laptop": {
+		"id": "aw-watcher-window_laptop", "type": "currentwindow", "client": "aw-watcher-window",
+		"hostname": "laptop", "created": "2024-01-01T09:00:00+00:00",
+		"events": [
+			{"id": 7, "timestamp": "2024-01-01T10:00:00+00:00", "duration": 60, "data": {"app": "Editor", "title": "a"}},
+			{"id": 8, "timestamp": "2024-01-01T10:01:00+00:00", "duration": 60, "data": {"app": "Browser", "title": "b"}}
+		]}}}`
+	result := post([]byte(export), http.StatusOK)
+	if result.Imported != 2 || result.Buckets[0].ID != "tg-observer-window_laptop" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if got := eventApps(t, base+"/buckets/tg-observer-window_laptop"); got != "00:Editor,01:Browser" {
+		t.Errorf("unexpected events %s", got)
+	}
+	if meta := metadata("tg-observer-window_laptop"); meta["client"] != "tg-observer-window" || meta["hostname"] != "laptop" {
+		t.Errorf("unexpected metadata %v", meta)
+	}
+
+	// The database of aw-server, which has the same events and one more
+	path := filepath.Join(t.TempDir(), "peewee-sqlite.v2.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE bucketmodel (key INTEGER NOT NULL PRIMARY KEY, id VARCHAR(255) NOT NULL,
+			created DATETIME NOT NULL, name VARCHAR(255), type VARCHAR(255) NOT NULL,
+			client VARCHAR(255) NOT NULL, hostname VARCHAR(255) NOT NULL, datastr VARCHAR(255) NOT NULL)`,
+		`CREATE TABLE eventmodel (id INTEGER NOT NULL PRIMARY KEY, bucket_id INTEGER NOT NULL,
+			timestamp DATETIME NOT NULL, duration DECIMAL(10, 5) NOT NULL, datastr VARCHAR(255) NOT NULL)`,
+		`INSERT INTO bucketmodel VALUES
+			(1, 'aw-watcher-window_laptop', '2024-01-01 09:00:00+00:00', NULL, 'currentwindow', 'aw-watcher-window', 'laptop', '{}'),
+			(2, 'aw-watcher-afk_laptop', '2024-01-01 09:00:00+00:00', NULL, 'afkstatus', 'aw-watcher-afk', 'laptop', '{}')`,
+		`INSERT INTO eventmodel (bucket_id, timestamp, duration, datastr) VALUES
+			(1, '2024-01-01 10:00:00+00:00', 60, '{"title": "a", "app": "Editor"}'),
+			(1, '2024-01-01 10:01:00+00:00', 60, '{"app": "Browser", "title": "b"}'),
+			(1, '2024-01-01 10:02:00+00:00', 60, '{"app": "Terminal", "title": "c"}'),
+			(2, '2024-01-01 10:00:00+00:00', 180, '{"status": "not-afk"}')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = post(file, http.StatusOK)
+	if result.Imported != 2 || result.Skipped != 2 || len(result.Buckets) != 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if got := eventApps(t, base+"/buckets/tg-observer-window_laptop"); got != "00:Editor,01:Browser,02:Terminal" {
+		t.Errorf("unexpected events after importing the database %s", got)
+	}
+	if meta := metadata("tg-observer-afk_laptop"); meta["type"] != "afkstatus" || meta["client"] != "tg-observer-afk" {
+		t.Errorf("unexpected metadata %v", meta)
+	}
+
+	// Other SQLite databases are refused
+	other := filepath.Join(t.TempDir(), "other.db")
+	db, _ = sql.Open("sqlite3", other)
+	db.Exec(`CREATE TABLE buckets (id TEXT)`)
+	db.Close()
+	file, _ = os.ReadFile(other)
+	if result := post(file, http.StatusBadRequest); !strings.Contains(result.Error, "not an ActivityWatch database") {
+		t.Errorf("unclear error %q", result.Error)
+	}
+}
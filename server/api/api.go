@@ -5,19 +5,189 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"timelygator/server/categories"
 	"timelygator/server/database"
 	"timelygator/server/database/models"
+	"timelygator/server/metrics"
+	"timelygator/server/middleware/auth"
+	"timelygator/server/query"
+	"timelygator/server/stream"
 	"timelygator/server/utils"
 	"timelygator/server/utils/types"
+	"timelygator/server/webhooks"
 )
 
 type API struct {
 	config    *types.Config
 	ds        *database.Datastore
-	lastEvent map[string]*models.Event
+	lastEvent *lastEvents
+	cache     *query.Cache
+	broker    *stream.Broker
+	webhooks  *webhooks.Dispatcher
+	login     *webLogin // nil unless Google sign in is configured
+	// bucketChanges counts the buckets created, changed, moved and deleted,
+	// so that lookups of which buckets are visible can be expired
+	bucketChanges *atomic.Uint64
+
+	authenticator *auth.Authenticator // nil unless requests are authenticated
+}
+
+// lastEvents keeps the last event of every bucket heartbeats were sent to, so
+// that heartbeats can be merged without reading it back. It is shared by the
+// copies of the API made for requests and safe for concurrent use.
+type lastEvents struct {
+	mu     sync.Mutex
+	events map[string]*models.Event
+}
+
+func newLastEvents() *lastEvents {
+	return &lastEvents{events: make(map[string]*models.Event)}
+}
+
+func (l *lastEvents) get(bucketID string) *models.Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.events[bucketID]
+}
+
+func (l *lastEvents) set(bucketID string, event *models.Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[bucketID] = event
+}
+
+// forget drops the last event of buckets, after their events changed.
+func (l *lastEvents) forget(bucketIDs ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range bucketIDs {
+		delete(l.events, id)
+	}
+}
+
+// forgetEvents drops the last event of a bucket if it is one of eventIDs, so
+// that heartbeats do not merge into a stale copy.
+func (l *lastEvents) forgetEvents(bucketID string, eventIDs ...uint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	last := l.events[bucketID]
+	if last != nil && slices.Contains(eventIDs, last.ID) {
+		delete(l.events, bucketID)
+	}
+}
+
+// forRequest returns the API as seen by the user of an authenticated request,
+// in which only their buckets exist. Handlers shadow the global api with it.
+// Without authentication, or for tokens without owner, every bucket is visible.
+// Requests to public routes of a server that authenticates others have no
+// grant, and only see buckets without owner.
+func (s *API) forRequest(r *http.Request) *API {
+	grant := auth.FromContext(r.Context())
+	if grant == nil && s.authenticator == nil {
+		return s
+	}
+	if grant != nil && grant.Owner() == nil {
+		return s
+	}
+	scoped := *s
+	if grant == nil {
+		scoped.ds = s.ds.Unowned()
+	} else {
+		scoped.ds = s.ds.ForOwner(*grant.Owner(), grant.User != nil && grant.User.Admin)
+	}
+	return &scoped
+}
+
+// bucketFilter returns whether the buckets of stream messages are visible,
+// or nil if all are.
+func (s *API) bucketFilter() func(bucketID string) bool {
+	if s.ds.Owner() == nil {
+		return nil
+	}
+	// Bucket IDs are unique, but are freed by renames, merges and deletes and
+	// can be taken by another owner, so lookups are kept until a bucket changes
+	visible := map[string]bool{}
+	changes := s.bucketChanges.Load()
+	return func(bucketID string) bool {
+		if current := s.bucketChanges.Load(); current != changes {
+			clear(visible)
+			changes = current
+		}
+		ok, seen := visible[bucketID]
+		if !seen {
+			ok = s.checkBucketExists(bucketID) == nil
+			visible[bucketID] = ok
+		}
+		return ok
+	}
+}
+
+// eventsChanged is called after events of a bucket were inserted, updated or
+// deleted so that derived state can be refreshed and subscribers notified.
+func (s *API) eventsChanged(bucketID string, kind stream.Kind, events ...*models.Event) {
+	if len(events) == 0 {
+		return
+	}
+	for _, e := range events {
+		s.broker.Publish(kind, bucketID, e.ToJSONDict())
+	}
+	s.notifyWebhooks(bucketID, kind, events)
+	start, end := events[0].Timestamp, events[0].Timestamp
+	for _, e := range events {
+		if e.Timestamp.Before(start) {
+			start = e.Timestamp
+		}
+		if eEnd := e.Timestamp.Add(time.Duration(e.Duration * float64(time.Second))); eEnd.After(end) {
+			end = eEnd
+		}
+	}
+	s.cache.InvalidateEvents(bucketID, start, end)
+}
+
+// bucketChanged is called after a bucket was created, updated or deleted.
+func (s *API) bucketChanged(bucketID string) {
+	s.bucketChanges.Add(1)
+	s.cache.InvalidateBucket(bucketID)
+}
+
+// categorizeOnIngest tags events with their $category before they are stored,
+// if enabled in the config and the bucket holds categorizable events.
+func (s *API) categorizeOnIngest(bucketID string, events ...*models.Event) {
+	if !s.config.CategorizeOnIngest {
+		return
+	}
+	bucketType := database.NewBucket(s.ds, bucketID).Type()
+	classifier := s.ingestClassifier(bucketID, bucketType)
+	if classifier == nil {
+		return
+	}
+	for _, e := range events {
+		if err := classifier.TagEvent(e); err != nil {
+			log.Printf("Could not categorize event in '%s': %v\n", bucketID, err)
+		}
+	}
+}
+
+// ingestClassifier returns the classifier events of a bucket of the given
+// type are tagged with on ingest, or nil if they are not.
+func (s *API) ingestClassifier(bucketID, bucketType string) *categories.Classifier {
+	if !s.config.CategorizeOnIngest || !categories.IngestBucketTypes[bucketType] {
+		return nil
+	}
+	classifier, err := categories.Load(s.ds)
+	if err != nil {
+		log.Printf("Could not load classes, storing events in '%s' uncategorized: %v\n", bucketID, err)
+		return nil
+	}
+	return classifier
 }
 
 // checkBucketExists is a helper that checks if a bucket is known, else returns NotFound.
@@ -78,112 +248,6 @@ func (s *API) GetBucketMetadata(bucketID string) (map[string]interface{}, error)
 	return bucket.Metadata(), nil
 }
 
-func (s *API) ExportBucket(bucketID string) (map[string]interface{}, error) {
-	if err := s.checkBucketExists(bucketID); err != nil {
-		return nil, err
-	}
-
-	bucketMeta, err := s.GetBucketMetadata(bucketID)
-	if err != nil {
-		return nil, err
-	}
-	allEvents, err := s.GetEvents(bucketID, -1, nil, nil)
-	if err != nil {
-		return nil, err
-	}
-	bucketMeta["events"] = allEvents
-
-	// Scrub event IDs
-	if events, ok := bucketMeta["events"].([]map[string]interface{}); ok {
-		for _, e := range events {
-			delete(e, "id")
-		}
-	}
-	return bucketMeta, nil
-}
-
-func (s *API) ExportAll() (map[string]interface{}, error) {
-	buckets, err := s.GetBuckets()
-	if err != nil {
-		return nil, err
-	}
-	exported := make(map[string]interface{})
-	for bID := range buckets {
-		bExport, err := s.ExportBucket(bID)
-		if err != nil {
-			log.Printf("Error exporting bucket '%s': %v\n", bID, err)
-			continue
-		}
-		exported[bID] = bExport
-	}
-	return exported, nil
-}
-
-func (s *API) ImportBucket(bucketData map[string]interface{}) error {
-	bucketID, ok := bucketData["id"].(string)
-	if !ok {
-		return errors.New("invalid bucket data: missing 'id'")
-	}
-	log.Printf("Importing bucket %s", bucketID)
-
-	bucketType, _ := bucketData["type"].(string)
-	client, _ := bucketData["client"].(string)
-	hostname, _ := bucketData["hostname"].(string)
-
-	createdRaw, _ := bucketData["created"]
-	var created time.Time
-	switch v := createdRaw.(type) {
-	case time.Time:
-		created = v
-	case string:
-		t, err := utils.ParseIso8601(v)
-		if err != nil {
-			return err
-		}
-		created = t
-	default:
-		created = time.Now()
-	}
-
-	// Create the bucket in the DB
-	_, err := s.CreateBucket(bucketID, bucketType, client, hostname, &created, nil)
-	if err != nil {
-		return err
-	}
-
-	// Insert events
-	evtsRaw, ok := bucketData["events"].([]interface{})
-	if !ok {
-		return errors.New("invalid bucket data: events not an array")
-	}
-	var evts []*models.Event
-	for _, e := range evtsRaw {
-		switch evtMap := e.(type) {
-		case map[string]interface{}:
-			delete(evtMap, "id") // remove ID
-			evts = append(evts, MapToEvent(evtMap))
-		default:
-			return errors.New("invalid event format in import")
-		}
-	}
-	_, err = s.CreateEvents(bucketID, evts)
-	return err
-}
-
-func (s *API) ImportAll(buckets map[string]interface{}) error {
-	for bucketID, bucketRaw := range buckets {
-		bucketData, ok := bucketRaw.(map[string]interface{})
-		if !ok {
-			log.Printf("Skipping malformed bucket: %s\n", bucketID)
-			continue
-		}
-		if err := s.ImportBucket(bucketData); err != nil {
-			log.Printf("Error importing bucket '%s': %v\n", bucketID, err)
-		}
-	}
-	return nil
-}
-
 // CreateBucket
 func (s *API) CreateBucket(
 	bucketID, eventType, client, hostname string,
@@ -216,6 +280,7 @@ func (s *API) CreateBucket(
 	if err != nil {
 		return false, err
 	}
+	s.bucketChanged(bucketID)
 	return true, nil
 }
 
@@ -241,16 +306,40 @@ func (s *API) UpdateBucket(
 	if data != nil {
 		updates["datastr"] = data // or "data"
 	}
-	return s.ds.UpdateBucket(bucketID, updates)
+	if err := s.ds.UpdateBucket(bucketID, updates); err != nil {
+		return err
+	}
+	s.bucketChanged(bucketID)
+	return nil
 }
 
-func (s *API) DeleteBucket(bucketID string) error {
+// DeleteBucket deletes a bucket with its events. With a trash it is moved
+// there to be restored or purged later, unless purge is set. Purging also
+// deletes buckets that are already in the trash.
+func (s *API) DeleteBucket(bucketID string, purge bool) error {
 	if err := s.checkBucketExists(bucketID); err != nil {
-		return err
+		if !purge {
+			return err
+		}
+		// Empty the bucket from the trash, it is hidden already
+		if err := s.ds.DeleteBucket(bucketID); err != nil {
+			return err
+		}
+		log.Printf("Purged bucket '%s' from the trash\n", bucketID)
+		return nil
+	}
+	bucketType := database.NewBucket(s.ds, bucketID).Type()
+	var err error
+	if s.config.TrashDays > 0 && !purge {
+		err = s.ds.TrashBucket(bucketID)
+	} else {
+		err = s.ds.DeleteBucket(bucketID)
 	}
-	err := s.ds.DeleteBucket(bucketID)
 	if err == nil {
 		log.Printf("Deleted bucket '%s'\n", bucketID)
+		s.lastEvent.forget(bucketID)
+		s.bucketChanged(bucketID)
+		s.webhooks.Notify(webhooks.BucketDeleted, bucketID, bucketType, nil)
 	}
 	return err
 }
@@ -272,7 +361,10 @@ func (s *API) GetEvent(bucketID string, eventID int) (map[string]interface{}, er
 	return event.ToJSONDict(), nil
 }
 
-func (s *API) GetEvents(bucketID string, limit int, start, end *time.Time) ([]map[string]interface{}, error) {
+// GetEvents returns up to limit events of a bucket overlapping the time
+// between start and end that pass the filter, which may be nil, newest first.
+// With clip, events are trimmed to the time between start and end.
+func (s *API) GetEvents(bucketID string, limit int, start, end *time.Time, filter *database.EventFilter, clip bool) ([]map[string]interface{}, error) {
 	if err := s.checkBucketExists(bucketID); err != nil {
 		return nil, err
 	}
@@ -285,18 +377,91 @@ func (s *API) GetEvents(bucketID string, limit int, start, end *time.Time) ([]ma
 	if err != nil {
 		return nil, err
 	}
-	events, err := bucket.Get(limit, start, end)
+	// Bucket.Get rounds the times it is given in place
+	window := clipWindow(clip, start, end)
+	events, err := bucket.Filtered(filter).Get(limit, start, end)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("Number of events: %d", len(events))
 	var results []map[string]interface{}
 	for _, e := range events {
-		results = append(results, e.ToJSONDict())
+		results = append(results, window(e).ToJSONDict())
 	}
 	return results, nil
 }
 
+// GetEventsPage returns a page of the events of a bucket that pass the
+// filter, newest first, and the cursor of the next page, which is empty after
+// the last one. If fields is not empty, only those keys of the event data are
+// returned. Start, end and clip are as for GetEvents.
+func (s *API) GetEventsPage(bucketID, cursor string, pageSize int, start, end *time.Time, filter *database.EventFilter, clip bool, fields []string) ([]map[string]interface{}, string, error) {
+	if err := s.checkBucketExists(bucketID); err != nil {
+		return nil, "", err
+	}
+	var after *database.EventCursor
+	if cursor != "" {
+		var err error
+		if after, err = database.DecodeEventCursor(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	bucket, err := s.ds.GetBucket(bucketID)
+	if err != nil {
+		return nil, "", err
+	}
+	events, next, err := bucket.Filtered(filter).Page(after, pageSize, start, end)
+	if err != nil {
+		return nil, "", err
+	}
+	window := clipWindow(clip, start, end)
+	results := make([]map[string]interface{}, 0, len(events))
+	for _, e := range events {
+		results = append(results, projectFields(window(e).ToJSONDict(), fields))
+	}
+	if next == nil {
+		return results, "", nil
+	}
+	return results, next.Encode(), nil
+}
+
+// clipWindow returns a function that trims events to the time between start
+// and end if clip is set, and returns them unchanged otherwise.
+func clipWindow(clip bool, start, end *time.Time) func(*models.Event) *models.Event {
+	if !clip {
+		return func(e *models.Event) *models.Event { return e }
+	}
+	var s, e *time.Time
+	if start != nil && !start.IsZero() {
+		t := *start
+		s = &t
+	}
+	if end != nil && !end.IsZero() {
+		t := *end
+		e = &t
+	}
+	return func(event *models.Event) *models.Event { return event.Clip(s, e) }
+}
+
+// projectFields removes the data keys of an event not in fields, keeping its
+// id, timestamp and duration. Without fields the event is returned as is.
+func projectFields(event map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return event
+	}
+	projected := map[string]interface{}{
+		"id":        event["id"],
+		"timestamp": event["timestamp"],
+		"duration":  event["duration"],
+	}
+	for _, f := range fields {
+		if v, ok := event[f]; ok {
+			projected[f] = v
+		}
+	}
+	return projected
+}
+
 func (s *API) CreateEvents(bucketID string, events []*models.Event) (*models.Event, error) {
 	if err := s.checkBucketExists(bucketID); err != nil {
 		return nil, err
@@ -308,14 +473,18 @@ func (s *API) CreateEvents(bucketID string, events []*models.Event) (*models.Eve
 	for _, event := range events {
 		event.BucketID = bucketID
 	}
+	s.categorizeOnIngest(bucketID, events...)
 	insertedEvent, err := bucket.Insert(events) // Insert(interface{})
 	if err != nil {
 		return nil, err
 	}
+	s.eventsChanged(bucketID, stream.Inserted, events...)
 	return insertedEvent, nil
 }
 
-func (s *API) GetEventCount(bucketID string, start, end *time.Time) (int, error) {
+// GetEventCount returns the number of events of a bucket between start and
+// end that pass the filter, which may be nil.
+func (s *API) GetEventCount(bucketID string, start, end *time.Time, filter *database.EventFilter) (int, error) {
 	if err := s.checkBucketExists(bucketID); err != nil {
 		return 0, err
 	}
@@ -325,7 +494,7 @@ func (s *API) GetEventCount(bucketID string, start, end *time.Time) (int, error)
 	if err != nil {
 		return 0, err
 	}
-	return bucket.GetEventCount(start, end)
+	return bucket.Filtered(filter).GetEventCount(start, end)
 }
 
 func (s *API) DeleteEvent(bucketID string, eventID int) (bool, error) {
@@ -336,7 +505,89 @@ func (s *API) DeleteEvent(bucketID string, eventID int) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return bucket.Delete(eventID)
+	event, err := bucket.GetByID(eventID)
+	if err != nil {
+		event = nil
+	}
+	deleted, err := bucket.Delete(eventID)
+	if err != nil {
+		return false, err
+	}
+	s.lastEvent.forgetEvents(bucketID, uint(eventID))
+	if event != nil {
+		s.eventsChanged(bucketID, stream.Deleted, event)
+	}
+	return deleted, nil
+}
+
+func invalidEvent(format string, args ...interface{}) error {
+	return &types.BadRequest{Code: "InvalidEvent", Message: fmt.Sprintf(format, args...)}
+}
+
+// UpdateEvent edits the timestamp, duration or data of an event in place,
+// keeping its ID, and records the change as a revision by changedBy. Data
+// without a $category is categorized again if categorizing on ingest.
+func (s *API) UpdateEvent(bucketID string, eventID int, p types.EventUpdatePayload, changedBy string) (map[string]interface{}, error) {
+	if err := s.checkBucketExists(bucketID); err != nil {
+		return nil, err
+	}
+	bucket, err := s.ds.GetBucket(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	event, err := bucket.GetByID(eventID)
+	if err != nil {
+		return nil, err
+	}
+	if p.Timestamp != nil {
+		t, err := utils.ParseIso8601(*p.Timestamp)
+		if err != nil {
+			return nil, invalidEvent("invalid timestamp %q", *p.Timestamp)
+		}
+		event.Timestamp = t
+	}
+	if p.Duration != nil {
+		if *p.Duration < 0 {
+			return nil, invalidEvent("duration must not be negative")
+		}
+		event.Duration = *p.Duration
+	}
+	if p.Data != nil {
+		raw, err := json.Marshal(p.Data)
+		if err != nil {
+			return nil, invalidEvent("invalid data: %v", err)
+		}
+		event.Data = raw
+		if _, tagged := p.Data[categories.Key]; !tagged {
+			s.categorizeOnIngest(bucketID, event)
+		}
+	}
+
+	before, _, err := bucket.Revise(eventID, event, changedBy)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Updated event %d in bucket '%s'\n", eventID, bucketID)
+	// Heartbeats must not merge into the event as it was before
+	s.lastEvent.forgetEvents(bucketID, event.ID)
+	s.cache.InvalidateEvents(bucketID, before.Timestamp, before.End())
+	s.eventsChanged(bucketID, stream.Updated, event)
+	return event.ToJSONDict(), nil
+}
+
+// GetEventRevisions returns the recorded edits of an event, oldest first.
+func (s *API) GetEventRevisions(bucketID string, eventID int) ([]*models.EventRevision, error) {
+	if err := s.checkBucketExists(bucketID); err != nil {
+		return nil, err
+	}
+	bucket, err := s.ds.GetBucket(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bucket.GetByID(eventID); err != nil {
+		return nil, err
+	}
+	return bucket.Revisions(eventID)
 }
 
 // Heartbeat merges consecutive heartbeats in memory or inserts new if needed.
@@ -346,10 +597,12 @@ func (s *API) Heartbeat(bucketID string, heartbeat *models.Event, pulseTime floa
 	}
 	log.Printf("Received heartbeat in bucket '%s'\n\ttimestamp: %v, duration: %v, pulsetime: %f\n\tdata: %+v\n",
 		bucketID, heartbeat.Timestamp, heartbeat.Duration, pulseTime, heartbeat.Data)
+	// Categorize before comparing, the last event was stored with its category
+	s.categorizeOnIngest(bucketID, heartbeat)
 
 	var lastEvent *models.Event
 	// Try to get the last event from memory first.
-	lastEvent = s.lastEvent[bucketID]
+	lastEvent = s.lastEvent.get(bucketID)
 	if lastEvent == nil {
 		// Load the last event from DB that occurred at or before the heartbeat's timestamp.
 		bucket, err := s.ds.GetBucket(bucketID)
@@ -369,7 +622,7 @@ func (s *API) Heartbeat(bucketID string, heartbeat *models.Event, pulseTime floa
 			merged := utils.HeartbeatMerge(*lastEvent, *heartbeat, pulseTime)
 			if merged != nil {
 				log.Printf("Merging heartbeat in bucket '%s'\n", bucketID)
-				s.lastEvent[bucketID] = merged
+				s.lastEvent.set(bucketID, merged)
 
 				// Update the last event in the DB.
 				bucket, err := s.ds.GetBucket(bucketID)
@@ -379,6 +632,8 @@ func (s *API) Heartbeat(bucketID string, heartbeat *models.Event, pulseTime floa
 				if err := bucket.ReplaceLast(merged); err != nil {
 					return nil, err
 				}
+				s.eventsChanged(bucketID, stream.Merged, merged)
+				metrics.Heartbeats.WithLabelValues(metrics.Merged).Inc()
 				return merged, nil
 			}
 			log.Printf("Heartbeat outside pulse window, inserting new event. (bucket: %s)\n", bucketID)
@@ -398,39 +653,53 @@ func (s *API) Heartbeat(bucketID string, heartbeat *models.Event, pulseTime floa
 	if _, insertErr := bucket.Insert([]*models.Event{heartbeat}); insertErr != nil {
 		return nil, insertErr
 	}
-	s.lastEvent[bucketID] = heartbeat
+	s.lastEvent.set(bucketID, heartbeat)
+	s.eventsChanged(bucketID, stream.Inserted, heartbeat)
+	metrics.Heartbeats.WithLabelValues(metrics.Inserted).Inc()
 	return heartbeat, nil
 }
 
-// MapToEvent is a helper to create an Event from map[string]interface{}.
-func MapToEvent(m map[string]interface{}) *models.Event {
-	evt := &models.Event{}
-
-	// If “id” is present:
-	if idVal, ok := m["id"].(float64); ok {
-		evt.ID = uint(idVal)
-	}
-
-	// If “timestamp” is a string:
-	if tsStr, ok := m["timestamp"].(string); ok {
-		t, err := time.Parse(time.RFC3339, tsStr)
-		if err == nil {
-			evt.Timestamp = t
+// Query evaluates a query script once for every time period and returns the
+// results in the same order as the periods. With cache set, results for
+// periods that have already ended are reused between calls with the same name.
+func (s *API) Query(name string, lines []string, timeperiods []string, cache bool) ([]interface{}, error) {
+	log.Printf("Received query '%s' for %d time period(s)\n", name, len(timeperiods))
+	if cache && name == "" {
+		return nil, &types.BadRequest{
+			Code:    "MissingQueryName",
+			Message: "Not allowed to cache a query without a name",
 		}
 	}
 
-	// If “duration” is a float => interpret as seconds
-	if durVal, ok := m["duration"].(float64); ok {
-		evt.Duration = durVal // already in seconds
+	script, err := query.Parse(name, lines)
+	if err != nil {
+		return nil, err
 	}
-
-	// If “data” is a map => marshal to JSON
-	if dataVal, ok := m["data"].(map[string]interface{}); ok {
-		b, err := json.Marshal(dataVal)
-		if err == nil {
-			evt.Data = b
+	results := make([]interface{}, 0, len(timeperiods))
+	for _, period := range timeperiods {
+		start, end, err := query.ParsePeriod(period)
+		if err != nil {
+			return nil, err
+		}
+		var result interface{}
+		evalStart := time.Now()
+		if cache {
+			result, err = s.cache.Eval(script, s.ds, start, end)
+		} else {
+			result, err = script.Eval(s.ds, start, end)
+		}
+		metrics.QueryDuration.WithLabelValues(strconv.FormatBool(cache)).Observe(time.Since(evalStart).Seconds())
+		if err != nil {
+			return nil, err
 		}
+		results = append(results, result)
 	}
+	return results, nil
+}
 
-	return evt
+// IsQueryError reports whether err was caused by an invalid query rather than
+// a server failure.
+func IsQueryError(err error) bool {
+	var qerr *query.Error
+	return errors.As(err, &qerr)
 }
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+	"timelygator/server/stream"
+	"timelygator/server/utils"
+	"timelygator/server/utils/types"
+)
+
+// BulkResponse reports how many events a bulk operation changed, or would
+// change on a dry run.
+type BulkResponse struct {
+	Count  int  `json:"count"`
+	DryRun bool `json:"dry_run"`
+}
+
+// bulkRange reads the time range of a bulk operation. Unlike reads, invalid
+// times are an error rather than ignored, as they would widen the operation
+// to the whole bucket.
+func bulkRange(q url.Values) (start, end *time.Time, err error) {
+	if start, err = bulkTime(q, "start"); err != nil {
+		return nil, nil, err
+	}
+	if end, err = bulkTime(q, "end"); err != nil {
+		return nil, nil, err
+	}
+	return start, end, nil
+}
+
+func bulkTime(q url.Values, param string) (*time.Time, error) {
+	s := q.Get(param)
+	if s == "" {
+		return nil, nil
+	}
+	t, err := utils.ParseIso8601(s)
+	if err != nil {
+		return nil, &types.BadRequest{Code: "InvalidTime", Message: fmt.Sprintf("invalid %s time %q", param, s)}
+	}
+	return &t, nil
+}
+
+// bulkBucket returns the bucket events are selected from for a bulk
+// operation. At least a time or a filter is needed, deleting a whole bucket
+// has its own route.
+func (s *API) bulkBucket(bucketID string, start, end *time.Time, filter *database.EventFilter) (*database.Bucket, error) {
+	if start == nil && end == nil && filter.IsEmpty() {
+		return nil, &types.BadRequest{
+			Code:    "MissingFilter",
+			Message: "bulk operations need a start, end or data filter",
+		}
+	}
+	if err := s.checkBucketExists(bucketID); err != nil {
+		return nil, err
+	}
+	bucket, err := s.ds.GetBucket(bucketID)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.Filtered(filter), nil
+}
+
+// forgetLastEvents drops the cached last event of a bucket if it is one of
+// events, so that heartbeats do not merge into a stale copy.
+func (s *API) forgetLastEvents(bucketID string, events []*models.Event) {
+	ids := make([]uint, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+	s.lastEvent.forgetEvents(bucketID, ids...)
+}
+
+// DeleteEvents deletes the events of a bucket that overlap the time between
+// start and end and pass the filter. On a dry run nothing is deleted and only
+// the number of events that would be is returned.
+func (s *API) DeleteEvents(bucketID string, start, end *time.Time, filter *database.EventFilter, dryRun bool) (*BulkResponse, error) {
+	bucket, err := s.bulkBucket(bucketID, start, end, filter)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		count, err := bucket.GetEventCount(start, end)
+		if err != nil {
+			return nil, err
+		}
+		return &BulkResponse{Count: count, DryRun: true}, nil
+	}
+	deleted, err := bucket.DeleteMatching(start, end)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Deleted %d events in bucket '%s'\n", len(deleted), bucketID)
+	s.forgetLastEvents(bucketID, deleted)
+	s.eventsChanged(bucketID, stream.Deleted, deleted...)
+	return &BulkResponse{Count: len(deleted)}, nil
+}
+
+// RewriteEvents sets a data key to the same value on the events of a bucket
+// that overlap the time between start and end and pass the filter. On a dry
+// run nothing is changed and only the number of events that would be is
+// returned.
+func (s *API) RewriteEvents(bucketID string, start, end *time.Time, filter *database.EventFilter, p types.EventRewritePayload, dryRun bool) (*BulkResponse, error) {
+	bucket, err := s.bulkBucket(bucketID, start, end, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := database.CheckKey(p.Key); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		count, err := bucket.GetEventCount(start, end)
+		if err != nil {
+			return nil, err
+		}
+		return &BulkResponse{Count: count, DryRun: true}, nil
+	}
+	rewritten, err := bucket.RewriteMatching(start, end, p.Key, p.Value)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Rewrote %s of %d events in bucket '%s'\n", p.Key, len(rewritten), bucketID)
+	s.forgetLastEvents(bucketID, rewritten)
+	s.eventsChanged(bucketID, stream.Updated, rewritten...)
+	return &BulkResponse{Count: len(rewritten)}, nil
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestBulkEvents(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1/buckets/bulk"
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	if res := doJSON(t, http.MethodPost, base, bucket); res.StatusCode != http.StatusOK {
+		t.Fatalf("creating bucket: expected 200, got %d", res.StatusCode)
+	}
+	other := ts.URL + "/api/v1/v1/buckets/other"
+	doJSON(t, http.MethodPost, other, bucket)
+
+	events := []map[string]interface{}{
+		{"timestamp": "2024-01-01T00:00:00Z", "duration": 60, "data": map[string]interface{}{"app": "Firefox", "title": "My Bank - Accounts"}},
+		{"timestamp": "2024-01-01T00:01:00Z", "duration": 60, "data": map[string]interface{}{"app": "Firefox", "title": "My Bank - Transfer"}},
+		{"timestamp": "2024-01-01T00:02:00Z", "duration": 60, "data": map[string]interface{}{"app": "Firefox", "title": "News"}},
+		{"timestamp": "2024-01-01T00:03:00Z", "duration": 60, "data": map[string]interface{}{"app": "Terminal", "title": "My Bank notes"}},
+		{"timestamp": "2024-01-02T00:00:00Z", "duration": 60, "data": map[string]interface{}{"app": "Firefox", "title": "My Bank - Accounts"}},
+	}
+	if res := doJSON(t, http.MethodPost, base+"/events", events); res.StatusCode != http.StatusOK {
+		t.Fatalf("inserting events: expected 200, got %d", res.StatusCode)
+	}
+	doJSON(t, http.MethodPost, other+"/events", events)
+
+	bulk := func(method, url string, body interface{}, status int) BulkResponse {
+		t.Helper()
+		res := doJSON(t, method, url, body)
+		if res.StatusCode != status {
+			t.Fatalf("%s %s: expected %d, got %d", method, url, status, res.StatusCode)
+		}
+		var got BulkResponse
+		if status == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return got
+	}
+	titles := func(url string) map[string]int {
+		t.Helper()
+		var got []map[string]interface{}
+		json.NewDecoder(doJSON(t, http.MethodGet, url, nil).Body).Decode(&got)
+		counts := map[string]int{}
+		for _, e := range got {
+			counts[e["title"].(string)]++
+		}
+		return counts
+	}
+
+	// Rewrite titles of the bank on the first day, counting first
+	rewrite := "/events/rewrite?data.app=Firefox&data.title~=My%20Bank&end=2024-01-01T23:59:59Z"
+	redact := map[string]interface{}{"key": "title", "value": "[redacted]"}
+	if got := bulk(http.MethodPost, base+rewrite+"&dry_run=true", redact, http.StatusOK); got.Count != 2 || !got.DryRun {
+		t.Fatalf("expected a dry run matching 2 events, got %+v", got)
+	}
+	if got := titles(base + "/events"); got["[redacted]"] != 0 {
+		t.Fatalf("dry run changed events: %v", got)
+	}
+	if got := bulk(http.MethodPost, base+rewrite, redact, http.StatusOK); got.Count != 2 || got.DryRun {
+		t.Fatalf("expected 2 rewritten events, got %+v", got)
+	}
+	got := titles(base + "/events")
+	if got["[redacted]"] != 2 || got["My Bank - Accounts"] != 1 || got["My Bank notes"] != 1 || got["News"] != 1 {
+		t.Fatalf("unexpected titles after rewrite: %v", got)
+	}
+
+	// Delete the rest of the bank's events, which the other bucket keeps
+	remove := base + "/events?data.title~=^My%20Bank"
+	if got := bulk(http.MethodDelete, remove+"&dry_run=1", nil, http.StatusOK); got.Count != 2 || !got.DryRun {
+		t.Fatalf("expected a dry run matching 2 events, got %+v", got)
+	}
+	if got := bulk(http.MethodDelete, remove, nil, http.StatusOK); got.Count != 2 {
+		t.Fatalf("expected 2 deleted events, got %+v", got)
+	}
+	got = titles(base + "/events")
+	if len(got) != 2 || got["[redacted]"] != 2 || got["News"] != 1 {
+		t.Fatalf("unexpected titles after delete: %v", got)
+	}
+	if got := titles(other + "/events"); got["My Bank - Accounts"] != 2 {
+		t.Fatalf("expected the other bucket to be untouched, got %v", got)
+	}
+	// Events running into the range are deleted
+	if got := bulk(http.MethodDelete, base+"/events?start=2024-01-01T00:00:30Z&end=2024-01-01T00:01:30Z", nil, http.StatusOK); got.Count != 2 {
+		t.Fatalf("expected 2 overlapping events deleted, got %+v", got)
+	}
+
+	// Bulk operations never widen to the whole bucket by mistake
+	bulk(http.MethodDelete, base+"/events", nil, http.StatusBadRequest)
+	bulk(http.MethodDelete, base+"/events?start=yesterday", nil, http.StatusBadRequest)
+	bulk(http.MethodDelete, base+"/events?data.app=Firefox&dry_run=maybe", nil, http.StatusBadRequest)
+	bulk(http.MethodPost, base+"/events/rewrite", redact, http.StatusBadRequest)
+	bulk(http.MethodPost, base+"/events/rewrite?data.app=Firefox", map[string]interface{}{"key": "", "value": 1}, http.StatusBadRequest)
+	bulk(http.MethodDelete, ts.URL+"/api/v1/v1/buckets/missing/events?data.app=Firefox", nil, http.StatusNotFound)
+	if got := titles(base + "/events"); len(got) != 1 || got["News"] != 1 {
+		t.Fatalf("expected only the news left, got %v", got)
+	}
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"timelygator/server/categories"
+	"timelygator/server/utils/types"
+)
+
+// TestCategories categorizes a sample event and explains which rule matched.
+// Unless classes are given, the rule set stored in the settings is used.
+func (s *API) TestCategories(sample map[string]interface{}, classes interface{}) (*categories.Result, error) {
+	var classifier *categories.Classifier
+	if classes == nil {
+		c, err := categories.Load(s.ds)
+		if err != nil {
+			return nil, err
+		}
+		classifier = c
+	} else {
+		parsed, err := categories.Parse(classes)
+		if err != nil {
+			return nil, &types.BadRequest{Code: "InvalidClasses", Message: err.Error()}
+		}
+		c, err := categories.Compile(parsed)
+		if err != nil {
+			return nil, &types.BadRequest{Code: "InvalidClasses", Message: err.Error()}
+		}
+		classifier = c
+	}
+	if len(sample) == 0 {
+		return nil, &types.BadRequest{Code: "EmptySample", Message: "Sample has no data to categorize"}
+	}
+	res := classifier.Explain(sample)
+	return &res, nil
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"timelygator/server/utils/types"
+)
+
+var testClasses = []interface{}{
+	map[string]interface{}{"name": []string{"Work"}, "rule": map[string]interface{}{"type": "regex", "regex": "Code"}},
+	map[string]interface{}{"name": []string{"Work", "Programming"}, "rule": map[string]interface{}{"type": "regex", "regex": "github", "ignore_case": true}},
+}
+
+func TestCategoriesTest(t *testing.T) {
+	ts := newTestRouter(t)
+	url := ts.URL + "/api/v1/v1/categories/test"
+	sample := map[string]interface{}{"app": "Code", "title": "GitHub - timelygator"}
+
+	var res struct {
+		Category []string `json:"category"`
+		Matched  bool     `json:"matched"`
+		Match    struct {
+			Index int    `json:"index"`
+			Field string `json:"field"`
+			Text  string `json:"match_text"`
+		} `json:"match"`
+		Candidates []json.RawMessage `json:"candidates"`
+	}
+
+	// Without stored classes everything is Uncategorized
+	r := doJSON(t, http.MethodPost, url, sample)
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", r.StatusCode)
+	}
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if res.Matched || !reflect.DeepEqual(res.Category, []string{"Uncategorized"}) {
+		t.Errorf("expected Uncategorized without classes, got %v", res.Category)
+	}
+
+	if r := doJSON(t, http.MethodPost, ts.URL+"/api/v1/v1/settings/classes", testClasses); r.StatusCode != http.StatusOK {
+		t.Fatalf("failed to store classes: %d", r.StatusCode)
+	}
+	r = doJSON(t, http.MethodPost, url, sample)
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if !reflect.DeepEqual(res.Category, []string{"Work", "Programming"}) {
+		t.Errorf("expected Work > Programming, got %v", res.Category)
+	}
+	if res.Match.Index != 1 || res.Match.Field != "title" || res.Match.Text != "GitHub" {
+		t.Errorf("unexpected match explanation %+v", res.Match)
+	}
+	if len(res.Candidates) != 2 {
+		t.Errorf("expected both rules as candidates, got %d", len(res.Candidates))
+	}
+
+	// Classes in the request override the stored ones
+	withClasses := map[string]interface{}{
+		"app":     "Code",
+		"classes": []interface{}{[]interface{}{[]string{"Editing"}, map[string]interface{}{"type": "regex", "regex": "^Code$"}}},
+	}
+	r = doJSON(t, http.MethodPost, url, withClasses)
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if !reflect.DeepEqual(res.Category, []string{"Editing"}) {
+		t.Errorf("expected request classes to be used, got %v", res.Category)
+	}
+
+	bad := map[string]interface{}{"app": "Code", "classes": []interface{}{map[string]interface{}{"name": []string{"X"}, "rule": map[string]interface{}{"type": "regex", "regex": "("}}}}
+	if r := doJSON(t, http.MethodPost, url, bad); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid regex, got %d", r.StatusCode)
+	}
+	if r := doJSON(t, http.MethodPost, url, map[string]interface{}{}); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for empty sample, got %d", r.StatusCode)
+	}
+}
+
+func TestCategorizeOnIngest(t *testing.T) {
+	ts := newTestRouterWithConfig(t, types.Config{Environment: "testing", CategorizeOnIngest: true})
+	base := ts.URL + "/api/v1/v1"
+
+	if r := doJSON(t, http.MethodPost, base+"/settings/classes", testClasses); r.StatusCode != http.StatusOK {
+		t.Fatalf("failed to store classes: %d", r.StatusCode)
+	}
+	for id, typ := range map[string]string{"window": "currentwindow", "afk": "afkstatus"} {
+		bucket := map[string]string{"client": "test", "type": typ, "hostname": "host"}
+		if r := doJSON(t, http.MethodPost, base+"/buckets/"+id, bucket); r.StatusCode != http.StatusOK {
+			t.Fatalf("failed to create bucket %s: %d", id, r.StatusCode)
+		}
+	}
+
+	ts0 := time.Date(2024, 3, 20, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		hb := map[string]interface{}{
+			"timestamp": ts0.Add(time.Duration(i) * time.Second).Format(time.RFC3339),
+			"duration":  0,
+			"data":      map[string]interface{}{"app": "Code", "title": "GitHub"},
+		}
+		if r := doJSON(t, http.MethodPost, base+"/buckets/window/heartbeat?pulsetime=5", hb); r.StatusCode != http.StatusOK {
+			t.Fatalf("heartbeat failed: %d", r.StatusCode)
+		}
+	}
+	afk := []map[string]interface{}{{"timestamp": ts0.Format(time.RFC3339), "duration": 1, "data": map[string]interface{}{"status": "not-afk"}}}
+	if r := doJSON(t, http.MethodPost, base+"/buckets/afk/events", afk); r.StatusCode != http.StatusOK {
+		t.Fatalf("failed to insert afk event: %d", r.StatusCode)
+	}
+
+	var events []map[string]interface{}
+	r := doJSON(t, http.MethodGet, base+"/buckets/window/events", nil)
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		t.Fatalf("failed to decode events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected categorized heartbeats to merge into 1 event, got %d", len(events))
+	}
+	if got := events[0]["$category"]; !reflect.DeepEqual(got, []interface{}{"Work", "Programming"}) {
+		t.Errorf("expected stored category, got %v", got)
+	}
+
+	events = nil
+	r = doJSON(t, http.MethodGet, base+"/buckets/afk/events", nil)
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		t.Fatalf("failed to decode events: %v", err)
+	}
+	if len(events) != 1 || events[0]["$category"] != nil {
+		t.Errorf("expected afk events to stay uncategorized, got %v", events)
+	}
+}
@@ -0,0 +1,432 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"timelygator/server/categories"
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+	"timelygator/server/utils/types"
+)
+
+// Export formats. JSON is a single document that can be imported again, the
+// others are written event by event for use in other tools.
+const (
+	ExportJSON   = "json"
+	ExportNDJSON = "ndjson"
+	ExportCSV    = "csv"
+	ExportICS    = "ics"
+)
+
+// ExportContentTypes maps export formats to the content type of their files.
+var ExportContentTypes = map[string]string{
+	ExportJSON:   "application/json",
+	ExportNDJSON: "application/x-ndjson",
+	ExportCSV:    "text/csv; charset=utf-8",
+	ExportICS:    "text/calendar; charset=utf-8",
+}
+
+// ExportOptions selects what is exported. Events overlapping the time between
+// Start and End that pass Filter are exported, trimmed to that time with
+// Clip. Exports of all buckets only include those whose ID matches
+// BucketPattern, a path.Match pattern, if it is set.
+type ExportOptions struct {
+	Start, End    *time.Time
+	Clip          bool
+	Filter        *database.EventFilter
+	BucketPattern string
+}
+
+// CheckExportOptions returns a BadRequest for an unknown format or an invalid
+// bucket pattern.
+func CheckExportOptions(format string, opts ExportOptions) error {
+	if _, ok := ExportContentTypes[format]; !ok {
+		return &types.BadRequest{
+			Code:    "InvalidFormat",
+			Message: fmt.Sprintf("unknown export format %q, expected json, ndjson, csv or ics", format),
+		}
+	}
+	if _, err := path.Match(opts.BucketPattern, ""); err != nil {
+		return &types.BadRequest{Code: "InvalidPattern", Message: fmt.Sprintf("invalid bucket_pattern %q", opts.BucketPattern)}
+	}
+	return nil
+}
+
+// ExportBucketIDs returns the IDs of the buckets matching the bucket pattern
+// of opts in order.
+func (s *API) ExportBucketIDs(opts ExportOptions) ([]string, error) {
+	buckets, err := s.GetBuckets()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(buckets))
+	for id := range buckets {
+		if opts.BucketPattern != "" {
+			if ok, _ := path.Match(opts.BucketPattern, id); !ok {
+				continue
+			}
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// exportPageSize is the number of events read at once when exporting.
+const exportPageSize = 1000
+
+// eachExportPage calls fn with the pages of events of a bucket selected by
+// opts, newest first.
+func (s *API) eachExportPage(bucketID string, opts ExportOptions, fn func([]*models.Event) error) error {
+	if err := s.checkBucketExists(bucketID); err != nil {
+		return err
+	}
+	bucket, err := s.ds.GetBucket(bucketID)
+	if err != nil {
+		return err
+	}
+	window := clipWindow(opts.Clip, opts.Start, opts.End)
+	var after *database.EventCursor
+	for {
+		events, next, err := bucket.Filtered(opts.Filter).Page(after, exportPageSize, opts.Start, opts.End)
+		if err != nil {
+			return err
+		}
+		for i, e := range events {
+			events[i] = window(e)
+		}
+		if err := fn(events); err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		after = next
+	}
+}
+
+// WriteExport writes the events of the given buckets to w. Output is flushed
+// after every page so large exports are streamed rather than held in memory.
+func (s *API) WriteExport(w io.Writer, format string, bucketIDs []string, opts ExportOptions) error {
+	switch format {
+	case ExportJSON:
+		return s.writeJSON(w, bucketIDs, opts)
+	case ExportNDJSON:
+		return s.writeNDJSON(w, bucketIDs, opts)
+	case ExportCSV:
+		return s.writeCSV(w, bucketIDs, opts)
+	case ExportICS:
+		return s.writeICS(w, bucketIDs, opts)
+	}
+	return CheckExportOptions(format, opts)
+}
+
+func flush(w io.Writer) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeJSON writes the buckets with their events as a document that can be
+// imported again, {"buckets": {"<id>": {<metadata>, "events": [...]}}}. The
+// events are written as they are read, without their IDs.
+func (s *API) writeJSON(w io.Writer, bucketIDs []string, opts ExportOptions) error {
+	if _, err := io.WriteString(w, `{"buckets":{`); err != nil {
+		return err
+	}
+	for i, id := range bucketIDs {
+		metadata, err := s.GetBucketMetadata(id)
+		if err != nil {
+			return err
+		}
+		delete(metadata, "events")
+		key, _ := json.Marshal(id)
+		fields, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		// The metadata object is left open for the events
+		var head []byte
+		if i > 0 {
+			head = append(head, ',')
+		}
+		head = append(append(append(head, key...), ':'), fields[:len(fields)-1]...)
+		if len(metadata) > 0 {
+			head = append(head, ',')
+		}
+		if _, err := w.Write(append(head, `"events":[`...)); err != nil {
+			return err
+		}
+		sep := ""
+		err = s.eachExportPage(id, opts, func(events []*models.Event) error {
+			for _, e := range events {
+				event := e.ToJSONDict()
+				delete(event, "id")
+				data, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+				if _, err := io.WriteString(w, sep+string(data)); err != nil {
+					return err
+				}
+				sep = ","
+			}
+			flush(w)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "]}"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}}\n")
+	return err
+}
+
+// exportLine is an event in an NDJSON export.
+type exportLine struct {
+	BucketID  string          `json:"bucket_id"`
+	Timestamp string          `json:"timestamp"`
+	Duration  float64         `json:"duration"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func (s *API) writeNDJSON(w io.Writer, bucketIDs []string, opts ExportOptions) error {
+	enc := json.NewEncoder(w)
+	for _, id := range bucketIDs {
+		err := s.eachExportPage(id, opts, func(events []*models.Event) error {
+			for _, e := range events {
+				data := json.RawMessage(e.Data)
+				if len(data) == 0 {
+					data = json.RawMessage("{}")
+				}
+				line := exportLine{BucketID: id, Timestamp: e.Timestamp.UTC().Format(time.RFC3339Nano), Duration: e.Duration, Data: data}
+				if err := enc.Encode(line); err != nil {
+					return err
+				}
+			}
+			flush(w)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvColumns are the columns of a CSV export before the data columns.
+var csvColumns = []string{"bucket_id", "timestamp", "end", "duration"}
+
+// writeCSV writes a row per event. Data keys become data.<key> columns, with
+// nested keys joined by dots, so the events are read twice: once to learn the
+// columns and once to write them.
+func (s *API) writeCSV(w io.Writer, bucketIDs []string, opts ExportOptions) error {
+	seen := map[string]bool{}
+	for _, id := range bucketIDs {
+		err := s.eachExportPage(id, opts, func(events []*models.Event) error {
+			for _, e := range events {
+				for key := range flattenData(e) {
+					seen[key] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	cw := csv.NewWriter(w)
+	header := append([]string{}, csvColumns...)
+	for _, key := range keys {
+		header = append(header, "data."+key)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, id := range bucketIDs {
+		err := s.eachExportPage(id, opts, func(events []*models.Event) error {
+			for _, e := range events {
+				data := flattenData(e)
+				row := []string{
+					id,
+					e.Timestamp.UTC().Format(time.RFC3339Nano),
+					e.End().Format(time.RFC3339Nano),
+					strconv.FormatFloat(e.Duration, 'f', -1, 64),
+				}
+				for _, key := range keys {
+					row = append(row, data[key])
+				}
+				if err := cw.Write(row); err != nil {
+					return err
+				}
+			}
+			cw.Flush()
+			flush(w)
+			return cw.Error()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// flattenData returns the data of an event as strings by key, with the keys
+// of nested objects joined by dots. Lists are kept as JSON.
+func flattenData(e *models.Event) map[string]string {
+	var data map[string]interface{}
+	flat := map[string]string{}
+	if err := json.Unmarshal(e.Data, &data); err != nil {
+		return flat
+	}
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, nested := range v {
+				walk(prefix+"."+k, nested)
+			}
+		default:
+			flat[prefix] = dataString(v)
+		}
+	}
+	for k, v := range data {
+		walk(k, v)
+	}
+	return flat
+}
+
+// dataString formats a data value for CSV and calendar exports.
+func dataString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// icsTime is the UTC time format of iCalendar.
+const icsTime = "20060102T150405Z"
+
+// icsSummaryKeys are the data keys tried in order for the summary of a
+// calendar entry.
+var icsSummaryKeys = []string{"title", "app", "status", categories.Key}
+
+// writeICS writes an iCalendar (RFC 5545) calendar with an entry per event.
+func (s *API) writeICS(w io.Writer, bucketIDs []string, opts ExportOptions) error {
+	ic := &icsWriter{w: w}
+	ic.line("BEGIN:VCALENDAR")
+	ic.line("VERSION:2.0")
+	ic.line("PRODID:-//TimelyGator//TimelyGator " + types.ModuleVersion + "//EN")
+	ic.line("CALSCALE:GREGORIAN")
+	stamp := time.Now().UTC().Format(icsTime)
+	for _, id := range bucketIDs {
+		err := s.eachExportPage(id, opts, func(events []*models.Event) error {
+			for _, e := range events {
+				data := flattenData(e)
+				summary := id
+				for _, key := range icsSummaryKeys {
+					if v := data[key]; v != "" {
+						summary = v
+						break
+					}
+				}
+				keys := make([]string, 0, len(data))
+				for key := range data {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				description := []string{"bucket: " + id}
+				for _, key := range keys {
+					description = append(description, key+": "+data[key])
+				}
+
+				ic.line("BEGIN:VEVENT")
+				ic.line(fmt.Sprintf("UID:%s-%d@timelygator", icsEscape(id), e.ID))
+				ic.line("DTSTAMP:" + stamp)
+				ic.line("DTSTART:" + e.Timestamp.UTC().Format(icsTime))
+				ic.line("DTEND:" + e.End().Format(icsTime))
+				ic.line("SUMMARY:" + icsEscape(summary))
+				ic.line("DESCRIPTION:" + icsEscape(strings.Join(description, "\n")))
+				if category := data[categories.Key]; category != "" {
+					ic.line("CATEGORIES:" + icsEscape(category))
+				}
+				ic.line("END:VEVENT")
+			}
+			if ic.err == nil {
+				flush(w)
+			}
+			return ic.err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	ic.line("END:VCALENDAR")
+	return ic.err
+}
+
+// icsWriter writes content lines, folded to 75 octets and ended by CRLF as
+// RFC 5545 requires, keeping the first error.
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ic *icsWriter) line(s string) {
+	if ic.err != nil {
+		return
+	}
+	var b strings.Builder
+	limit := 75
+	for len(s) > limit {
+		// Never fold inside a UTF-8 sequence
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+		// Continuation lines start with a space
+		limit = 74
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+	_, ic.err = io.WriteString(ic.w, b.String())
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icsEscape escapes an iCalendar text value.
+func icsEscape(s string) string {
+	return icsEscaper.Replace(s)
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExportFormats(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1/buckets/"
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	events := []map[string]interface{}{
+		{"timestamp": "2024-01-01T09:00:00Z", "duration": 3600, "data": map[string]interface{}{"app": "Editor", "title": "Notes, draft; v2"}},
+		{"timestamp": "2024-01-01T11:00:00Z", "duration": 60, "data": map[string]interface{}{"app": "Browser", "url": map[string]interface{}{"host": "example.com"}}},
+		{"timestamp": "2024-01-02T09:00:00Z", "duration": 60, "data": map[string]interface{}{"app": "Editor", "title": strings.Repeat("long title ", 10)}},
+	}
+	for _, id := range []string{"tg-window_host", "tg-window_laptop", "tg-afk_host"} {
+		if res := doJSON(t, http.MethodPost, base+id, bucket); res.StatusCode != http.StatusOK {
+			t.Fatalf("creating bucket %s: expected 200, got %d", id, res.StatusCode)
+		}
+		if res := doJSON(t, http.MethodPost, base+id+"/events", events); res.StatusCode != http.StatusOK {
+			t.Fatalf("inserting events into %s: expected 200, got %d", id, res.StatusCode)
+		}
+	}
+	export := func(url, contentType string) string {
+		t.Helper()
+		res := doJSON(t, http.MethodGet, url, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d", url, res.StatusCode)
+		}
+		if got := res.Header.Get("Content-Type"); !strings.HasPrefix(got, contentType) {
+			t.Errorf("GET %s: expected content type %s, got %s", url, contentType, got)
+		}
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	day := "start=2024-01-01T00:00:00Z&end=2024-01-01T23:59:59Z"
+
+	// NDJSON has a line per event of the matching buckets
+	body := export(ts.URL+"/api/v1/v1/export?format=ndjson&bucket_pattern=tg-window_*&"+day, "application/x-ndjson")
+	perBucket := map[string]int{}
+	lines := bufio.NewScanner(strings.NewReader(body))
+	for lines.Scan() {
+		var line exportLine
+		if err := json.Unmarshal(lines.Bytes(), &line); err != nil {
+			t.Fatalf("invalid line %q: %v", lines.Text(), err)
+		}
+		perBucket[line.BucketID]++
+	}
+	if len(perBucket) != 2 || perBucket["tg-window_host"] != 2 || perBucket["tg-window_laptop"] != 2 {
+		t.Errorf("unexpected ndjson events per bucket %v", perBucket)
+	}
+
+	// CSV has a column per flattened data key
+	body = export(base+"tg-window_host/export?format=csv&data.app=Browser", "text/csv")
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := strings.Join(rows[0], ",")
+	if header != "bucket_id,timestamp,end,duration,data.app,data.url.host" {
+		t.Errorf("unexpected csv header %s", header)
+	}
+	if len(rows) != 2 || rows[1][0] != "tg-window_host" || rows[1][2] != "2024-01-01T11:01:00Z" || rows[1][5] != "example.com" {
+		t.Errorf("unexpected csv rows %v", rows)
+	}
+
+	// Clipped calendar entries with escaped and folded text
+	body = export(base+"tg-window_host/export?format=ics&clip=true&start=2024-01-01T09:30:00Z&end=2024-01-01T12:00:00Z", "text/calendar")
+	if !strings.HasPrefix(body, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(body, "END:VCALENDAR\r\n") {
+		t.Errorf("unexpected calendar %q", body)
+	}
+	if n := strings.Count(body, "BEGIN:VEVENT"); n != 2 {
+		t.Errorf("expected 2 calendar entries, got %d", n)
+	}
+	for _, want := range []string{"DTSTART:20240101T093000Z\r\n", "DTEND:20240101T100000Z\r\n", `SUMMARY:Notes\, draft\; v2`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected calendar to contain %q", want)
+		}
+	}
+	for _, line := range strings.Split(body, "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("calendar line longer than 75 octets: %q", line)
+		}
+	}
+	body = export(base+"tg-window_host/export?format=ics&start=2024-01-02T00:00:00Z", "text/calendar")
+	unfolded := strings.ReplaceAll(body, "\r\n ", "")
+	if unfolded == body || !strings.Contains(unfolded, "SUMMARY:"+strings.Repeat("long title ", 10)+"\r\n") {
+		t.Errorf("expected the long summary to be folded, got %q", body)
+	}
+
+	// The JSON export takes the same filters
+	type jsonExport struct {
+		Buckets map[string]struct {
+			ID     string                   `json:"id"`
+			Type   string                   `json:"type"`
+			Events []map[string]interface{} `json:"events"`
+		} `json:"buckets"`
+	}
+	var exported jsonExport
+	body = export(ts.URL+"/api/v1/v1/export?bucket_pattern=tg-afk_*&"+day, "application/json")
+	if err := json.Unmarshal([]byte(body), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Buckets) != 1 || len(exported.Buckets["tg-afk_host"].Events) != 2 {
+		t.Errorf("unexpected json export %v", exported)
+	}
+	exported = jsonExport{}
+	body = export(ts.URL+"/api/v1/v1/export?bucket_pattern=tg-window_*", "application/json")
+	if err := json.Unmarshal([]byte(body), &exported); err != nil {
+		t.Fatalf("invalid json export %q: %v", body, err)
+	}
+	for _, id := range []string{"tg-window_host", "tg-window_laptop"} {
+		b := exported.Buckets[id]
+		if b.ID != id || b.Type != "currentwindow" || len(b.Events) != 3 {
+			t.Errorf("%s: expected the metadata and 3 events, got %+v", id, b)
+		}
+		for _, e := range b.Events {
+			if _, ok := e["id"]; ok {
+				t.Errorf("%s: expected event IDs to be scrubbed, got %v", id, e)
+			}
+		}
+	}
+	body = export(base+"tg-window_host/export?start=2030-01-01T00:00:00Z", "application/json")
+	if !strings.Contains(body, `"events":[]`) || !json.Valid([]byte(body)) {
+		t.Errorf("expected a bucket without events, got %s", body)
+	}
+
+	for _, url := range []string{
+		ts.URL + "/api/v1/v1/export?format=xml",
+		ts.URL + "/api/v1/v1/export?format=csv&bucket_pattern=[",
+		ts.URL + "/api/v1/v1/export?format=csv&start=yesterday",
+		base + "tg-window_host/export?format=ics&clip=maybe",
+	} {
+		if res := doJSON(t, http.MethodGet, url, nil); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s: expected 400, got %d", url, res.StatusCode)
+		}
+	}
+	if res := doJSON(t, http.MethodGet, base+"missing/export?format=csv", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("export of missing bucket: expected 404, got %d", res.StatusCode)
+	}
+}
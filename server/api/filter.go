@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"timelygator/server/database"
+	"timelygator/server/utils/types"
+)
+
+// dataParamPrefix starts query parameters that filter on event data.
+const dataParamPrefix = "data."
+
+// eventFilter reads the event filters of a request: data.<key>=<value> for
+// equal values, data.<key>~=<regexp> for values matching a regular
+// expression and min_duration=<seconds>. It returns nil without filters.
+func eventFilter(q url.Values) (*database.EventFilter, error) {
+	filter := &database.EventFilter{}
+	for param, values := range q {
+		key, ok := strings.CutPrefix(param, dataParamPrefix)
+		if !ok {
+			continue
+		}
+		op := database.OpEquals
+		if k, match := strings.CutSuffix(key, "~"); match {
+			key, op = k, database.OpMatch
+		}
+		for _, v := range values {
+			if err := filter.Add(key, op, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s := q.Get("min_duration"); s != "" {
+		d, err := strconv.ParseFloat(s, 64)
+		if err != nil || d < 0 {
+			return nil, &types.BadRequest{Code: "InvalidFilter", Message: "min_duration must be a number of seconds"}
+		}
+		filter.MinDuration = d
+	}
+	if filter.IsEmpty() {
+		return nil, nil
+	}
+	return filter, nil
+}
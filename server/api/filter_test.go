@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestEventFilters(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1/buckets/filters"
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	if res := doJSON(t, http.MethodPost, base, bucket); res.StatusCode != http.StatusOK {
+		t.Fatalf("creating bucket: expected 200, got %d", res.StatusCode)
+	}
+	other := ts.URL + "/api/v1/v1/buckets/other"
+	doJSON(t, http.MethodPost, other, bucket)
+
+	events := []map[string]interface{}{
+		{"timestamp": "2024-01-01T00:00:00Z", "duration": 30, "data": map[string]interface{}{"app": "Firefox", "title": "Zoom pricing"}},
+		{"timestamp": "2024-01-01T00:01:00Z", "duration": 600, "data": map[string]interface{}{"app": "zoom.us", "title": "Zoom Meeting"}},
+		{"timestamp": "2024-01-01T00:11:00Z", "duration": 120, "data": map[string]interface{}{"app": "Terminal", "title": "vim", "pinned": true, "tab": map[string]interface{}{"id": 7}}},
+		{"timestamp": "2024-01-01T00:13:00Z", "duration": 5, "data": map[string]interface{}{"$category": "Work", "app": "Firefox"}},
+	}
+	if res := doJSON(t, http.MethodPost, base+"/events", events); res.StatusCode != http.StatusOK {
+		t.Fatalf("inserting events: expected 200, got %d", res.StatusCode)
+	}
+	doJSON(t, http.MethodPost, other+"/events", events[:1])
+
+	cases := []struct {
+		query string
+		want  string // timestamps' minutes of the matching events
+	}{
+		{"data.app=Firefox", "00,13"},
+		{"data.app=firefox", ""},
+		{"data.title~=(?i)zoom", "00,01"},
+		{"data.title~=^Zoom&data.app=zoom.us", "01"},
+		{"data.app=Firefox&data.app=zoom.us", ""},
+		{"min_duration=100", "01,11"},
+		{"data.app=Firefox&min_duration=10", "00"},
+		{"data.pinned=true", "11"},
+		{"data.tab.id=7", "11"},
+		{"data.$category=Work", "13"},
+		{"data.missing~=.*", ""},
+		{"data.app~=Fire&start=2024-01-01T00:05:00Z", "13"},
+	}
+	for _, c := range cases {
+		q, _ := url.ParseQuery(c.query)
+		for _, mode := range []string{"", "&page_size=2"} {
+			res := doJSON(t, http.MethodGet, base+"/events?"+q.Encode()+mode, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("%s%s: expected 200, got %d", c.query, mode, res.StatusCode)
+			}
+			var got []map[string]interface{}
+			json.NewDecoder(res.Body).Decode(&got)
+			if mode != "" && res.Header.Get(nextCursorHeader) != "" {
+				// The filter must carry over to the next page
+				next := doJSON(t, http.MethodGet, base+"/events?"+q.Encode()+mode+"&cursor="+res.Header.Get(nextCursorHeader), nil)
+				var more []map[string]interface{}
+				json.NewDecoder(next.Body).Decode(&more)
+				got = append(got, more...)
+			}
+			var minutes []string
+			for _, e := range got {
+				minutes = append(minutes, e["timestamp"].(string)[14:16])
+			}
+			sort.Strings(minutes)
+			if strings.Join(minutes, ",") != c.want {
+				t.Errorf("%s%s: expected events %q, got %q", c.query, mode, c.want, strings.Join(minutes, ","))
+			}
+		}
+
+		res := doJSON(t, http.MethodGet, base+"/events/count?"+q.Encode(), nil)
+		var count int
+		json.NewDecoder(res.Body).Decode(&count)
+		if want := len(strings.Split(c.want, ",")); c.want != "" && count != want || c.want == "" && count != 0 {
+			t.Errorf("%s: expected count for %q, got %d", c.query, c.want, count)
+		}
+	}
+
+	for _, query := range []string{"data.title~=%28", "min_duration=-1", "min_duration=long", "data.=x", `data.a%22b=x`} {
+		if res := doJSON(t, http.MethodGet, base+"/events?"+query, nil); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, res.StatusCode)
+		}
+		if res := doJSON(t, http.MethodGet, base+"/events/count?"+query, nil); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("count %s: expected 400, got %d", query, res.StatusCode)
+		}
+	}
+}
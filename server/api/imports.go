@@ -0,0 +1,513 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+	"timelygator/server/utils"
+	"timelygator/server/utils/types"
+)
+
+const (
+	// importBatchSize is the number of events inserted at once when importing.
+	importBatchSize = 1000
+	// importProgressEvery is how many imported events are logged at a time.
+	importProgressEvery = 100 * importBatchSize
+)
+
+// ImportedBucket reports the import of a bucket.
+type ImportedBucket struct {
+	ID       string `json:"id"`
+	Imported int64  `json:"imported"` // events stored
+	Skipped  int64  `json:"skipped"`  // events the bucket had or that were skipped with it
+	Replaced int64  `json:"replaced"` // events of the bucket deleted to replace them
+	Error    string `json:"error,omitempty"`
+}
+
+// ImportResult reports an import with the total of its buckets. Buckets are
+// imported one by one, each either completely or not at all.
+type ImportResult struct {
+	Imported int64            `json:"imported"`
+	Skipped  int64            `json:"skipped"`
+	Replaced int64            `json:"replaced"`
+	Buckets  []ImportedBucket `json:"buckets"`
+	Error    string           `json:"error,omitempty"`
+}
+
+func (r *ImportResult) add(b ImportedBucket) {
+	r.Imported += b.Imported
+	r.Skipped += b.Skipped
+	r.Replaced += b.Replaced
+	r.Buckets = append(r.Buckets, b)
+}
+
+func invalidImport(format string, args ...interface{}) error {
+	return &types.BadRequest{Code: "InvalidImport", Message: fmt.Sprintf(format, args...)}
+}
+
+// importBucket imports the events read by read into a bucket in one
+// transaction, creating the bucket unless it exists, in which case it is
+// handled as onConflict says. read may fill in the metadata of bucket as it
+// goes. Imported events are categorized on ingest but not published to
+// subscribers.
+func (s *API) importBucket(bucket *models.Bucket, onConflict string, readEvents func(add func(*models.Event) error) error) (ImportedBucket, error) {
+	imported := ImportedBucket{ID: bucket.ID}
+	read := 0
+	err := s.ds.ImportBucket(bucket, onConflict, func(imp *database.BucketImport) error {
+		batch := make([]*models.Event, 0, importBatchSize)
+		insert := func() error {
+			if err := imp.Insert(batch); err != nil {
+				return err
+			}
+			read += len(batch)
+			if read/importProgressEvery != (read-len(batch))/importProgressEvery {
+				log.Printf("Read %d events of bucket '%s'\n", read, bucket.ID)
+			}
+			batch = batch[:0]
+			return nil
+		}
+		err := readEvents(func(e *models.Event) error {
+			batch = append(batch, e)
+			if len(batch) < importBatchSize {
+				return nil
+			}
+			return insert()
+		})
+		if err != nil {
+			return err
+		}
+		if err := insert(); err != nil {
+			return err
+		}
+		imported.Imported, imported.Skipped, imported.Replaced = imp.Imported, imp.Skipped, imp.Replaced
+		// The bucket type may only be known once all events were read
+		classifier := s.ingestClassifier(bucket.ID, imp.Bucket().Type)
+		if classifier == nil {
+			return nil
+		}
+		return imp.Update(func(events []*models.Event) {
+			for _, e := range events {
+				if err := classifier.TagEvent(e); err != nil {
+					log.Printf("Could not categorize event in '%s': %v\n", bucket.ID, err)
+				}
+			}
+		})
+	})
+	if err != nil {
+		return ImportedBucket{ID: bucket.ID}, err
+	}
+	log.Printf("Imported %d events into bucket '%s', skipped %d and replaced %d\n",
+		imported.Imported, bucket.ID, imported.Skipped, imported.Replaced)
+	// Heartbeats must not extend an event that was replaced
+	s.lastEvent.forget(bucket.ID)
+	s.bucketChanged(bucket.ID)
+	return imported, nil
+}
+
+// newImportedBucket returns the bucket an import creates before its metadata
+// is read.
+func newImportedBucket(bucketID string) *models.Bucket {
+	return &models.Bucket{ID: bucketID, Created: time.Now().UTC(), Data: []byte("{}")}
+}
+
+// setBucketField sets a metadata field of an imported bucket. Unknown fields
+// are ignored.
+func setBucketField(bucket *models.Bucket, key string, value interface{}) error {
+	switch key {
+	case "id":
+		if id, _ := value.(string); id != bucket.ID {
+			return invalidImport("bucket id %v does not match its key %q", value, bucket.ID)
+		}
+	case "type", "client", "hostname":
+		str, ok := value.(string)
+		if !ok && value != nil {
+			return invalidImport("bucket %s: %s must be a string", bucket.ID, key)
+		}
+		switch key {
+		case "type":
+			bucket.Type = str
+		case "client":
+			bucket.Client = str
+		default:
+			bucket.Hostname = str
+		}
+	case "name":
+		str, ok := value.(string)
+		if !ok && value != nil {
+			return invalidImport("bucket %s: name must be a string", bucket.ID)
+		}
+		bucket.Name = nil
+		if ok {
+			bucket.Name = &str
+		}
+	case "created":
+		if value == nil {
+			return nil
+		}
+		str, _ := value.(string)
+		t, err := utils.ParseIso8601(str)
+		if err != nil {
+			return invalidImport("bucket %s: invalid created time %v", bucket.ID, value)
+		}
+		bucket.Created = t.UTC()
+	case "data":
+		data, ok := value.(map[string]interface{})
+		if !ok && value != nil {
+			return invalidImport("bucket %s: data must be an object", bucket.ID)
+		}
+		raw, err := utils.MapToJSON(data)
+		if err != nil {
+			return err
+		}
+		bucket.Data = raw
+	}
+	return nil
+}
+
+// MapToEvent creates an event from its JSON object. Its data is either under
+// "data" or, as in exports, next to its timestamp and duration. IDs are
+// ignored.
+func MapToEvent(m map[string]interface{}) (*models.Event, error) {
+	ts, ok := m["timestamp"].(string)
+	if !ok {
+		return nil, invalidEvent("missing timestamp")
+	}
+	t, err := utils.ParseIso8601(ts)
+	if err != nil {
+		return nil, invalidEvent("invalid timestamp %q", ts)
+	}
+	evt := &models.Event{Timestamp: t.UTC()}
+	switch d := m["duration"].(type) {
+	case nil:
+	case float64:
+		evt.Duration = d
+	case json.Number:
+		if evt.Duration, err = d.Float64(); err != nil {
+			return nil, invalidEvent("invalid duration %s", d)
+		}
+	default:
+		return nil, invalidEvent("duration must be a number of seconds")
+	}
+	if evt.Duration < 0 {
+		return nil, invalidEvent("negative duration %v", evt.Duration)
+	}
+
+	data := map[string]interface{}{}
+	switch d := m["data"].(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, v := range d {
+			data[k] = v
+		}
+	default:
+		return nil, invalidEvent("data must be an object")
+	}
+	for k, v := range m {
+		switch k {
+		case "id", "timestamp", "duration", "data":
+		default:
+			data[k] = v
+		}
+	}
+	if evt.Data, err = json.Marshal(data); err != nil {
+		return nil, invalidEvent("invalid data: %v", err)
+	}
+	return evt, nil
+}
+
+// ImportBucket imports a bucket from its exported JSON object. An existing
+// bucket with its ID is handled as onConflict says.
+func (s *API) ImportBucket(bucketData map[string]interface{}, onConflict string) (ImportedBucket, error) {
+	bucketID, ok := bucketData["id"].(string)
+	if !ok {
+		return ImportedBucket{}, invalidImport("invalid bucket data: missing 'id'")
+	}
+	events, ok := bucketData["events"].([]interface{})
+	if !ok {
+		return ImportedBucket{ID: bucketID}, invalidImport("bucket %s: events must be an array", bucketID)
+	}
+	bucket := newImportedBucket(bucketID)
+	return s.importBucket(bucket, onConflict, func(add func(*models.Event) error) error {
+		for key, value := range bucketData {
+			if key == "events" {
+				continue
+			}
+			if err := setBucketField(bucket, key, value); err != nil {
+				return err
+			}
+		}
+		for i, raw := range events {
+			e, err := importedEvent(bucketID, i, raw)
+			if err != nil {
+				return err
+			}
+			if err := add(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// importedEvent converts the i-th event of an imported bucket.
+func importedEvent(bucketID string, i int, raw interface{}) (*models.Event, error) {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, invalidImport("bucket %s: event %d is not an object", bucketID, i)
+	}
+	e, err := MapToEvent(m)
+	if err != nil {
+		msg := err.Error()
+		var invalid *types.BadRequest
+		if errors.As(err, &invalid) {
+			msg = invalid.Message
+		}
+		return nil, invalidImport("bucket %s: event %d: %s", bucketID, i, msg)
+	}
+	return e, nil
+}
+
+// ImportAll imports exported buckets by ID as ImportBucket does, reporting
+// those that failed in the result.
+func (s *API) ImportAll(buckets map[string]interface{}, onConflict string) *ImportResult {
+	result := &ImportResult{Buckets: []ImportedBucket{}}
+	for bucketID, bucketRaw := range buckets {
+		bucketData, ok := bucketRaw.(map[string]interface{})
+		if !ok {
+			result.add(ImportedBucket{ID: bucketID, Error: invalidImport("bucket %s is not an object", bucketID).Error()})
+			continue
+		}
+		imported, err := s.ImportBucket(bucketData, onConflict)
+		if err != nil {
+			log.Printf("Error importing bucket '%s': %v\n", bucketID, err)
+			imported.Error = err.Error()
+		}
+		result.add(imported)
+	}
+	return result
+}
+
+// malformedJSON is returned for an import that is not valid JSON. The
+// buckets before the error are imported.
+func malformedJSON(dec *json.Decoder, err error) error {
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return invalidImport("malformed JSON at byte %d: %v", dec.InputOffset(), err)
+}
+
+// ImportStream imports an export read from r bucket by bucket, without
+// holding more than a batch of events in memory. Existing buckets are handled
+// as onConflict says. A bucket with a malformed event is not imported, and
+// the error is reported in the result. Invalid JSON or a failure to store a
+// bucket stops the import with an error.
+func (s *API) ImportStream(r io.Reader, onConflict string) (*ImportResult, error) {
+	return s.importStream(r, onConflict, nil)
+}
+
+// importStream imports an export as ImportStream does. Bucket IDs and clients
+// are renamed with rename if it is not nil.
+func (s *API) importStream(r io.Reader, onConflict string, rename func(string) string) (*ImportResult, error) {
+	result := &ImportResult{Buckets: []ImportedBucket{}}
+	if err := database.CheckConflict(onConflict); err != nil {
+		return result, err
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := expectDelim(dec, '{'); err != nil {
+		return result, err
+	}
+	for dec.More() {
+		key, err := readKey(dec)
+		if err != nil {
+			return result, err
+		}
+		if key != "buckets" {
+			if err := skipValue(dec); err != nil {
+				return result, err
+			}
+			continue
+		}
+		if err := expectDelim(dec, '{'); err != nil {
+			return result, err
+		}
+		for dec.More() {
+			bucketID, err := readKey(dec)
+			if err != nil {
+				return result, err
+			}
+			if rename != nil {
+				bucketID = rename(bucketID)
+			}
+			imported, err := s.importStreamedBucket(dec, bucketID, onConflict, rename)
+			if err != nil {
+				return result, err
+			}
+			result.add(imported)
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return result, err
+		}
+	}
+	return result, expectDelim(dec, '}')
+}
+
+// importStreamedBucket imports the bucket object read next from dec. Invalid
+// buckets are reported in the result, as the rest of the object is still
+// read; only invalid JSON and failures to store them are returned.
+func (s *API) importStreamedBucket(dec *json.Decoder, bucketID, onConflict string, rename func(string) string) (ImportedBucket, error) {
+	bucket := newImportedBucket(bucketID)
+	var jsonErr error
+	read := false
+	imported, err := s.importBucket(bucket, onConflict, func(add func(*models.Event) error) error {
+		read = true
+		var invalid error
+		if invalid, jsonErr = readBucket(dec, bucket, add, rename); jsonErr != nil {
+			return jsonErr
+		}
+		return invalid
+	})
+	if jsonErr != nil {
+		return imported, jsonErr
+	}
+	if !read {
+		// The bucket could not be created
+		if err := skipValue(dec); err != nil {
+			return imported, err
+		}
+	}
+	if err != nil && !utils.IsBadRequest(err) {
+		return imported, err
+	}
+	if err != nil {
+		log.Printf("Error importing bucket '%s': %v\n", bucketID, err)
+		imported.Error = err.Error()
+	}
+	return imported, nil
+}
+
+// readBucket reads a bucket object from dec, setting the metadata of bucket
+// and adding its events. After an invalid field or event it reads on to the
+// end of the object without adding more events, and returns the first
+// problem as invalid. Invalid JSON is returned as err. Its ID and client are
+// renamed with rename if it is not nil.
+func readBucket(dec *json.Decoder, bucket *models.Bucket, add func(*models.Event) error, rename func(string) string) (invalid, err error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		key, err := readKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		if key != "events" {
+			var value interface{}
+			if err := dec.Decode(&value); err != nil {
+				return nil, malformedJSON(dec, err)
+			}
+			if name, ok := value.(string); ok && rename != nil && (key == "id" || key == "client") {
+				value = rename(name)
+			}
+			if invalid == nil {
+				invalid = setBucketField(bucket, key, value)
+			}
+			continue
+		}
+
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, malformedJSON(dec, err)
+		}
+		if tok == nil {
+			continue
+		}
+		if tok != json.Delim('[') {
+			if invalid == nil {
+				invalid = invalidImport("bucket %s: events must be an array", bucket.ID)
+			}
+			if err := skipRest(dec, tok); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for i := 0; dec.More(); i++ {
+			var raw interface{}
+			if err := dec.Decode(&raw); err != nil {
+				return nil, malformedJSON(dec, err)
+			}
+			if invalid != nil {
+				continue
+			}
+			e, err := importedEvent(bucket.ID, i, raw)
+			if err == nil {
+				err = add(e)
+			}
+			invalid = err
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, err
+		}
+	}
+	return invalid, expectDelim(dec, '}')
+}
+
+// expectDelim reads the delimiter d from dec.
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return malformedJSON(dec, err)
+	}
+	if tok != d {
+		return malformedJSON(dec, fmt.Errorf("expected %v, got %v", d, tok))
+	}
+	return nil
+}
+
+// readKey reads an object key from dec.
+func readKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", malformedJSON(dec, err)
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", malformedJSON(dec, fmt.Errorf("expected a key, got %v", tok))
+	}
+	return key, nil
+}
+
+// skipValue reads past the next value of dec token by token, so large values
+// are not held in memory.
+func skipValue(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return malformedJSON(dec, err)
+	}
+	return skipRest(dec, tok)
+}
+
+// skipRest reads past the rest of the value that began with tok.
+func skipRest(dec *json.Decoder, tok json.Token) error {
+	depth := 0
+	for {
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+		var err error
+		if tok, err = dec.Token(); err != nil {
+			return malformedJSON(dec, err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportStream(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1"
+	post := func(body string, status int) ImportResult {
+		t.Helper()
+		res, err := http.Post(base+"/import", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var result ImportResult
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != status {
+			t.Fatalf("import: expected %d, got %d: %+v", status, res.StatusCode, result)
+		}
+		return result
+	}
+	count := func(bucketID string) int {
+		t.Helper()
+		res := doJSON(t, http.MethodGet, base+"/buckets/"+bucketID+"/events/count", nil)
+		if res.StatusCode != http.StatusOK {
+			return -1
+		}
+		var n int
+		json.NewDecoder(res.Body).Decode(&n)
+		return n
+	}
+	// events returns a JSON array of n events, the bad-th of which is invalid
+	events := func(n, bad int) string {
+		t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		var b strings.Builder
+		b.WriteString("[")
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			ts := t0.Add(time.Duration(i) * time.Minute).Format(time.RFC3339)
+			if i == bad {
+				ts = "not a time"
+			}
+			fmt.Fprintf(&b, `{"timestamp": %q, "duration": 60, "data": {"app": "app%d"}}`, ts, i%3)
+		}
+		b.WriteString("]")
+		return b.String()
+	}
+
+	// Events come before the metadata in exports, and span several batches
+	n := 2*importBatchSize + 10
+	body := fmt.Sprintf(`{"version": 1, "buckets": {
+		"big": {"events": %s, "hostname": "host", "id": "big", "type": "currentwindow"},
+		"broken": {"events": %s, "id": "broken", "type": "currentwindow"},
+		"renamed": {"id": "other", "events": []},
+		"small": {"client": "test", "events": %s, "id": "small", "type": "afkstatus"}
+	}}`, events(n, -1), events(n, importBatchSize+5), events(3, -1))
+	result := post(body, http.StatusBadRequest)
+	if len(result.Buckets) != 4 || result.Error == "" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	for _, b := range result.Buckets {
+		switch b.ID {
+		case "big", "small":
+			if b.Error != "" {
+				t.Errorf("bucket %s: unexpected error %s", b.ID, b.Error)
+			}
+		default:
+			if b.Error == "" || b.Imported != 0 {
+				t.Errorf("bucket %s: expected an error, got %+v", b.ID, b)
+			}
+		}
+	}
+	if !strings.Contains(result.Buckets[1].Error, fmt.Sprintf("event %d: invalid timestamp", importBatchSize+5)) {
+		t.Errorf("unclear error %q", result.Buckets[1].Error)
+	}
+	if got := count("big"); got != n || result.Buckets[0].Imported != int64(n) {
+		t.Errorf("expected %d events in big, got %d", n, got)
+	}
+	if got := count("small"); got != 3 {
+		t.Errorf("expected 3 events in small, got %d", got)
+	}
+	// Failed buckets leave nothing behind
+	for _, id := range []string{"broken", "renamed", "other"} {
+		if got := count(id); got != -1 {
+			t.Errorf("expected no bucket %s, got %d events", id, got)
+		}
+	}
+	var meta map[string]interface{}
+	json.NewDecoder(doJSON(t, http.MethodGet, base+"/buckets/big", nil).Body).Decode(&meta)
+	if meta["type"] != "currentwindow" || meta["hostname"] != "host" {
+		t.Errorf("unexpected metadata %v", meta)
+	}
+
+	// Exports import again with their data
+	res := doJSON(t, http.MethodGet, base+"/buckets/small/export", nil)
+	var export struct {
+		Buckets map[string]map[string]interface{} `json:"buckets"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&export); err != nil {
+		t.Fatal(err)
+	}
+	exported := export.Buckets["small"]
+	exported["id"] = "copy"
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "export.json")
+	json.NewEncoder(fw).Encode(map[string]interface{}{"buckets": map[string]interface{}{"copy": exported}})
+	mw.Close()
+	upload, err := http.Post(base+"/import", mw.FormDataContentType(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.StatusCode != http.StatusOK {
+		t.Fatalf("multipart import: expected 200, got %d", upload.StatusCode)
+	}
+	if apps := eventApps(t, base+"/buckets/copy"); apps != eventApps(t, base+"/buckets/small") || apps == "" {
+		t.Errorf("expected the copy to have the same apps, got %q", apps)
+	}
+
+	// Invalid JSON stops the import, keeping the buckets before it
+	result = post(`{"buckets": {"first": {"id": "first", "events": []}, "second": {"id": "second", "events": [{]}}}`, http.StatusBadRequest)
+	if !strings.Contains(result.Error, "malformed JSON") || len(result.Buckets) != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if count("first") != 0 || count("second") != -1 {
+		t.Errorf("expected only the first bucket to be imported")
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1"
+	restore := func(onConflict string, hostname string, events ...string) ImportResult {
+		t.Helper()
+		body := fmt.Sprintf(`{"buckets": {"restored": {"events": [%s], "hostname": %q, "id": "restored", "type": "currentwindow"}}}`,
+			strings.Join(events, ","), hostname)
+		res, err := http.Post(base+"/import?on_conflict="+onConflict, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var result ImportResult
+		json.NewDecoder(res.Body).Decode(&result)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("import with %s: expected 200, got %d: %+v", onConflict, res.StatusCode, result)
+		}
+		return result
+	}
+	expect := func(result ImportResult, imported, skipped, replaced int64) {
+		t.Helper()
+		if result.Imported != imported || result.Skipped != skipped || result.Replaced != replaced {
+			t.Errorf("expected %d imported, %d skipped and %d replaced, got %+v", imported, skipped, replaced, result)
+		}
+		if b := result.Buckets[0]; b.Imported != imported || b.Skipped != skipped || b.Replaced != replaced {
+			t.Errorf("unexpected bucket result %+v", b)
+		}
+	}
+	hostname := func() string {
+		var meta map[string]interface{}
+		json.NewDecoder(doJSON(t, http.MethodGet, base+"/buckets/restored", nil).Body).Decode(&meta)
+		return meta["hostname"].(string)
+	}
+	a := `{"timestamp": "2024-01-01T10:00:00Z", "duration": 60, "data": {"app": "Editor", "title": "a"}}`
+	b := `{"timestamp": "2024-01-01T10:01:00Z", "duration": 60, "data": {"app": "Editor", "title": "b"}}`
+	// Exports list the data next to the timestamp, in any order
+	bAgain := `{"title": "b", "duration": 60, "app": "Editor", "timestamp": "2024-01-01T10:01:00Z"}`
+	bLonger := `{"timestamp": "2024-01-01T10:01:00Z", "duration": 90, "data": {"app": "Editor", "title": "b"}}`
+	c := `{"timestamp": "2024-01-01T10:02:00Z", "duration": 60, "data": {"app": "Browser"}}`
+
+	expect(restore("merge", "host", a, b), 2, 0, 0)
+	// Repeating an import changes nothing
+	expect(restore("merge", "host", a, b), 0, 2, 0)
+	expect(restore("merge", "other", a, bAgain, bLonger, c, c), 2, 3, 0)
+	if got := eventApps(t, base+"/buckets/restored"); got != "00:Editor,01:Editor,01:Editor,02:Browser" {
+		t.Errorf("unexpected events after merging %s", got)
+	}
+	if hostname() != "host" {
+		t.Errorf("merging must keep the bucket's metadata")
+	}
+
+	expect(restore("skip", "other", a, c), 0, 2, 0)
+	if got := eventApps(t, base+"/buckets/restored"); got != "00:Editor,01:Editor,01:Editor,02:Browser" {
+		t.Errorf("unexpected events after skipping %s", got)
+	}
+
+	expect(restore("replace", "other", c), 1, 0, 4)
+	if got := eventApps(t, base+"/buckets/restored"); got != "02:Browser" {
+		t.Errorf("unexpected events after replacing %s", got)
+	}
+	if hostname() != "other" {
+		t.Errorf("replacing must update the bucket's metadata")
+	}
+
+	res, err := http.Post(base+"/import?on_conflict=overwrite", "application/json", strings.NewReader(`{"buckets": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown on_conflict: expected 400, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"timelygator/server/database/models"
+	"timelygator/server/middleware/auth"
+	"timelygator/server/oauth"
+	"timelygator/server/utils"
+	"timelygator/server/utils/types"
+)
+
+// loginTimeout is how long a user has to complete the sign in at the provider.
+const loginTimeout = 10 * time.Minute
+
+// stateCookie binds a pending sign in to the browser that started it, so that
+// a callback URL forged by someone else is rejected.
+const stateCookie = "tg_oauth_state"
+
+type pendingLogin struct {
+	verifier string
+	returnTo string
+	expires  time.Time
+}
+
+// webLogin signs users in to the web UI through an identity provider.
+type webLogin struct {
+	provider oauth.Provider
+	sessions *auth.Sessions
+	trusted  func(origin string) bool
+
+	mu      sync.Mutex
+	pending map[string]pendingLogin
+}
+
+func newWebLogin(cfg *types.Config, provider oauth.Provider, sessions *auth.Sessions) *webLogin {
+	return &webLogin{
+		provider: provider,
+		sessions: sessions,
+		trusted:  auth.OriginMatcher(cfg.CORSOrigins),
+		pending:  map[string]pendingLogin{},
+	}
+}
+
+func signInDisabled() error {
+	return &types.NotFound{Code: "SignInDisabled", Message: "Set GOOGLE_CLIENT_ID and GOOGLE_CLIENT_SECRET to enable signing in"}
+}
+
+// callbackURL returns the URL the provider redirects back to.
+func (s *API) callbackURL(r *http.Request) string {
+	if s.config.OAuthRedirectURL != "" {
+		return s.config.OAuthRedirectURL
+	}
+	scheme := "http"
+	if auth.IsSecure(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/api/v1/v1/auth/callback"
+}
+
+// checkReturnTo validates where to send the browser after signing in: a path
+// on this server or a page of a trusted origin, never an arbitrary site.
+func (l *webLogin) checkReturnTo(returnTo string) (string, error) {
+	if returnTo == "" {
+		return "/", nil
+	}
+	if strings.HasPrefix(returnTo, "/") && !strings.HasPrefix(returnTo, "//") && !strings.HasPrefix(returnTo, "/\\") {
+		return returnTo, nil
+	}
+	u, err := url.Parse(returnTo)
+	if err == nil && u.Host != "" && l.trusted(u.Scheme+"://"+u.Host) {
+		return returnTo, nil
+	}
+	return "", &types.BadRequest{Code: "InvalidRedirect", Message: "redirect must be a path or a page of an allowed origin"}
+}
+
+// BeginLogin starts signing in. It returns the provider URL to send the
+// browser to and the state to bind to the browser.
+func (s *API) BeginLogin(callbackURL, returnTo string) (authURL, state string, err error) {
+	if s.login == nil {
+		return "", "", signInDisabled()
+	}
+	l := s.login
+	if returnTo, err = l.checkReturnTo(returnTo); err != nil {
+		return "", "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	state = hex.EncodeToString(b)
+	verifier := oauth.GenerateVerifier()
+
+	now := time.Now()
+	l.mu.Lock()
+	for k, p := range l.pending {
+		if now.After(p.expires) {
+			delete(l.pending, k)
+		}
+	}
+	l.pending[state] = pendingLogin{verifier: verifier, returnTo: returnTo, expires: now.Add(loginTimeout)}
+	l.mu.Unlock()
+
+	return l.provider.AuthCodeURL(state, verifier, callbackURL), state, nil
+}
+
+// CompleteLogin finishes signing in with the code the provider passed to the
+// callback. It returns the signed in user and where to send the browser.
+func (s *API) CompleteLogin(ctx context.Context, callbackURL, state, code string) (*models.User, string, error) {
+	if s.login == nil {
+		return nil, "", signInDisabled()
+	}
+	l := s.login
+	l.mu.Lock()
+	pending, ok := l.pending[state]
+	delete(l.pending, state)
+	l.mu.Unlock()
+	if !ok || time.Now().After(pending.expires) {
+		return nil, "", &types.BadRequest{Code: "InvalidState", Message: "Sign in expired or was already completed, please try again"}
+	}
+
+	identity, err := l.provider.Exchange(ctx, code, pending.verifier, callbackURL)
+	if err != nil {
+		return nil, "", &types.BadRequest{Code: "SignInFailed", Message: err.Error()}
+	}
+	user, err := s.findUser(l.provider.Name(), identity)
+	if err != nil {
+		return nil, "", err
+	}
+	user.Email = identity.Email
+	user.Name = identity.Name
+	user.Picture = identity.Picture
+	user.LastLogin = time.Now().UTC()
+	if user.ID == 0 {
+		err = s.ds.CreateUser(user)
+	} else {
+		err = s.ds.SaveUser(user)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	log.Printf("User %s signed in with %s\n", user.Email, user.Provider)
+	return user, pending.returnTo, nil
+}
+
+// findUser returns the user of an identity, which is new if it has no ID yet.
+// Users added from the command line are linked to their identity by email.
+func (s *API) findUser(provider string, identity *oauth.Identity) (*models.User, error) {
+	user, err := s.ds.UserByIdentity(provider, identity.Subject)
+	if err == nil || !utils.IsNotFound(err) {
+		return user, err
+	}
+	if identity.Email != "" {
+		user, err = s.ds.UserByEmail(identity.Email, true)
+		if err == nil {
+			user.Provider = provider
+			user.Subject = identity.Subject
+			return user, nil
+		}
+		if !utils.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	if err := s.checkNewUser(identity); err != nil {
+		return nil, err
+	}
+	return &models.User{Provider: provider, Subject: identity.Subject, Created: time.Now().UTC()}, nil
+}
+
+// checkNewUser decides whether someone without an account may sign up. Their
+// email must match OAUTH_ALLOWED_EMAILS, whose entries are addresses or
+// domains starting with "@". Without it the first user claims the server and
+// others need to be added with `tg-server user add`.
+func (s *API) checkNewUser(identity *oauth.Identity) error {
+	allowed := s.config.OAuthAllowedEmails
+	if len(allowed) == 0 {
+		count, err := s.ds.UserCount()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return &types.Forbidden{Code: "NotAllowed", Message: "Ask an admin of this server to add your account"}
+		}
+		return nil
+	}
+	email := strings.ToLower(identity.Email)
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if email != "" && (email == a || (strings.HasPrefix(a, "@") && strings.HasSuffix(email, a))) {
+			return nil
+		}
+	}
+	return &types.Forbidden{Code: "NotAllowed", Message: "Your account is not allowed to sign in to this server"}
+}
+
+// StartSession signs user in on the browser of the request.
+func (s *API) StartSession(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	if s.login == nil {
+		return signInDisabled()
+	}
+	return s.login.sessions.Start(w, r, user)
+}
+
+// CurrentUser returns the user signed in on the browser of the request.
+func (s *API) CurrentUser(r *http.Request) (*models.User, error) {
+	if s.login == nil {
+		return nil, signInDisabled()
+	}
+	return s.login.sessions.User(r)
+}
+
+// SignOut ends the session of the browser of the request.
+func (s *API) SignOut(w http.ResponseWriter, r *http.Request) error {
+	if s.login == nil {
+		return signInDisabled()
+	}
+	return s.login.sessions.End(w, r)
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"timelygator/server/database/models"
+	"timelygator/server/oauth"
+	"timelygator/server/utils/types"
+)
+
+// fakeProvider is a local identity provider. Its authorization page signs in
+// whoever is set as next without asking.
+type fakeProvider struct {
+	server *httptest.Server
+	next   oauth.Identity
+	codes  map[string]oauth.Identity
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+	p := &fakeProvider{codes: map[string]oauth.Identity{}}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := fmt.Sprintf("code-%d", len(p.codes))
+		p.codes[code] = p.next
+		back, _ := url.Parse(q.Get("redirect_uri"))
+		back.RawQuery = url.Values{"state": {q.Get("state")}, "code": {code}}.Encode()
+		http.Redirect(w, r, back.String(), http.StatusFound)
+	}))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *fakeProvider) Name() string { return "fake" }
+
+func (p *fakeProvider) AuthCodeURL(state, verifier, redirectURL string) string {
+	return p.server.URL + "/authorize?" + url.Values{"state": {state}, "redirect_uri": {redirectURL}}.Encode()
+}
+
+func (p *fakeProvider) Exchange(ctx context.Context, code, verifier, redirectURL string) (*oauth.Identity, error) {
+	id, ok := p.codes[code]
+	if !ok {
+		return nil, fmt.Errorf("invalid code")
+	}
+	delete(p.codes, code)
+	return &id, nil
+}
+
+func newLoginRouter(t *testing.T, cfg types.Config) (*httptest.Server, *fakeProvider) {
+	t.Helper()
+	cfg.Environment = "testing"
+	cfg.GoogleClientID = "test"
+	cfg.SessionTTL = 1
+	cfg.CORSOrigins = []string{"http://localhost:*"}
+	ts := newTestRouterWithConfig(t, cfg)
+	p := newFakeProvider(t)
+	api.login.provider = p
+	return ts, p
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar}
+}
+
+// signIn signs in as id and returns the signed in user.
+func signIn(t *testing.T, browser *http.Client, ts *httptest.Server, p *fakeProvider, id oauth.Identity) (*http.Response, *models.User) {
+	t.Helper()
+	p.next = id
+	res, err := browser.Get(ts.URL + "/api/v1/v1/auth/login?redirect=" + url.QueryEscape("/api/v1/v1/auth/me"))
+	if err != nil {
+		t.Fatalf("sign in failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return res, nil
+	}
+	var user models.User
+	if err := json.NewDecoder(res.Body).Decode(&user); err != nil {
+		t.Fatalf("failed to decode user: %v", err)
+	}
+	return res, &user
+}
+
+func TestLogin(t *testing.T) {
+	ts, p := newLoginRouter(t, types.Config{})
+	base := ts.URL + "/api/v1/v1"
+	browser := newBrowser(t)
+
+	if res, _ := browser.Get(base + "/buckets/"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 before signing in, got %d", res.StatusCode)
+	}
+	if res, _ := browser.Get(base + "/auth/me"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 from /auth/me before signing in, got %d", res.StatusCode)
+	}
+
+	res, user := signIn(t, browser, ts, p, oauth.Identity{Subject: "1", Email: "ada@example.com", Name: "Ada"})
+	if user == nil {
+		t.Fatalf("expected to be signed in, got %d", res.StatusCode)
+	}
+	if user.Email != "ada@example.com" || user.Provider != "fake" {
+		t.Errorf("unexpected user %+v", user)
+	}
+	if res, _ := browser.Get(base + "/buckets/"); res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 after signing in, got %d", res.StatusCode)
+	}
+
+	// Changes need a trusted Origin, as the cookie is sent with forged requests too
+	post := func(origin string) int {
+		req, _ := http.NewRequest(http.MethodPost, base+"/settings/foo", strings.NewReader(`"bar"`))
+		req.Header.Set("Content-Type", "application/json")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		res, err := browser.Do(req)
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if status := post(""); status != http.StatusForbidden {
+		t.Errorf("expected 403 without Origin, got %d", status)
+	}
+	if status := post("http://evil.example"); status != http.StatusForbidden {
+		t.Errorf("expected 403 from untrusted origin, got %d", status)
+	}
+	if status := post("http://localhost:5173"); status != http.StatusOK {
+		t.Errorf("expected 200 from trusted origin, got %d", status)
+	}
+
+	// Signing in again keeps the same user
+	_, again := signIn(t, browser, ts, p, oauth.Identity{Subject: "1", Email: "ada@example.org", Name: "Ada"})
+	if again == nil || again.ID != user.ID || again.Email != "ada@example.org" {
+		t.Errorf("expected the same user with updated email, got %+v", again)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, base+"/auth/logout", nil)
+	if res, err := browser.Do(req); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("logout failed: %v %v", err, res)
+	}
+	if res, _ := browser.Get(base + "/buckets/"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 after signing out, got %d", res.StatusCode)
+	}
+}
+
+func TestLoginFirstUserClaimsServer(t *testing.T) {
+	ts, p := newLoginRouter(t, types.Config{})
+	if _, user := signIn(t, newBrowser(t), ts, p, oauth.Identity{Subject: "1", Email: "ada@example.com"}); user == nil {
+		t.Fatal("expected the first user to sign in")
+	}
+	res, user := signIn(t, newBrowser(t), ts, p, oauth.Identity{Subject: "2", Email: "eve@example.com"})
+	if user != nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a second user, got %d", res.StatusCode)
+	}
+}
+
+func TestLoginAllowedEmails(t *testing.T) {
+	ts, p := newLoginRouter(t, types.Config{OAuthAllowedEmails: []string{"grace@example.com", "@example.org"}})
+	for _, c := range []struct {
+		email string
+		ok    bool
+	}{
+		{"grace@example.com", true},
+		{"ada@EXAMPLE.org", true},
+		{"eve@example.com", false},
+		{"", false},
+	} {
+		res, user := signIn(t, newBrowser(t), ts, p, oauth.Identity{Subject: c.email + "-id", Email: c.email})
+		if (user != nil) != c.ok {
+			t.Errorf("%q: expected allowed=%v, got %d", c.email, c.ok, res.StatusCode)
+		}
+	}
+}
+
+func TestLoginRejectsForgedCallback(t *testing.T) {
+	ts, _ := newLoginRouter(t, types.Config{})
+	base := ts.URL + "/api/v1/v1/auth"
+	browser := newBrowser(t)
+
+	if res, _ := browser.Get(base + "/callback?state=abc&code=code-0"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown state, got %d", res.StatusCode)
+	}
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	if res, _ := noRedirect.Get(base + "/login?redirect=https://evil.example/"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for untrusted redirect, got %d", res.StatusCode)
+	}
+	if res, _ := noRedirect.Get(base + "/login?redirect=//evil.example/"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for protocol relative redirect, got %d", res.StatusCode)
+	}
+	if res, _ := noRedirect.Get(base + "/login?redirect=http://localhost:5173/settings"); res.StatusCode != http.StatusFound {
+		t.Errorf("expected 302 for trusted redirect, got %d", res.StatusCode)
+	}
+}
+
+func TestLoginKeepsLocalHeartbeatsOpen(t *testing.T) {
+	ts, p := newLoginRouter(t, types.Config{})
+	base := ts.URL + "/api/v1/v1"
+	bucket := map[string]interface{}{"client": "test", "type": "afkstatus", "hostname": "host"}
+	heartbeat := map[string]interface{}{"timestamp": "2024-01-01T00:00:00Z", "duration": 0, "data": map[string]interface{}{"status": "afk"}}
+	if _, err := api.ds.CreateBucket("afk", "afkstatus", "test", "host", time.Now(), nil, nil); err != nil {
+		t.Fatalf("CreateBucket error: %v", err)
+	}
+
+	// The test client is on the server's machine
+	if res := doJSON(t, http.MethodPost, base+"/buckets/afk/heartbeat?pulsetime=60", heartbeat); res.StatusCode != http.StatusOK {
+		t.Errorf("expected local observers to send heartbeats without tokens, got %d", res.StatusCode)
+	}
+	if res := doJSON(t, http.MethodGet, base+"/info", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("expected info without tokens, got %d", res.StatusCode)
+	}
+	cases := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodPost, "/buckets/other", bucket},
+		{http.MethodPost, "/buckets/afk/events", []interface{}{heartbeat}},
+		{http.MethodDelete, "/buckets/afk/events/1", nil},
+		{http.MethodGet, "/buckets/afk/events", nil},
+	}
+	for _, c := range cases {
+		if res := doJSON(t, c.method, base+c.path, c.body); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected a session or token to be needed, got %d", c.method, c.path, res.StatusCode)
+		}
+	}
+
+	// Heartbeats without token do not reach the buckets of users
+	browser := newBrowser(t)
+	_, user := signIn(t, browser, ts, p, oauth.Identity{Subject: "1", Email: "ada@example.com"})
+	if _, err := api.ds.ForOwner(user.ID, false).CreateBucket("ada-afk", "afkstatus", "test", "host", time.Now(), nil, nil); err != nil {
+		t.Fatalf("CreateBucket error: %v", err)
+	}
+	if res := doJSON(t, http.MethodPost, base+"/buckets/ada-afk/heartbeat?pulsetime=60", heartbeat); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected heartbeats without token not to reach owned buckets, got %d", res.StatusCode)
+	}
+
+	ts, _ = newLoginRouter(t, types.Config{AuthEnabled: true})
+	if res := doJSON(t, http.MethodPost, ts.URL+"/api/v1/v1/buckets/afk", bucket); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected observers to need tokens with AUTH_ENABLED, got %d", res.StatusCode)
+	}
+}
+
+func TestLoginDisabled(t *testing.T) {
+	ts := newTestRouter(t)
+	if res := doJSON(t, http.MethodGet, ts.URL+"/api/v1/v1/auth/me", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 without sign in configured, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"net/http"
+
+	"timelygator/server/metrics"
+	"timelygator/server/middleware/auth"
+)
+
+// MetricsHandler serves the Prometheus metrics on the main listener. They
+// name every bucket, so if requests are authenticated it takes a token or
+// session with the server scope. RegisterRoutes must have been called.
+func MetricsHandler() http.Handler {
+	if api.authenticator == nil {
+		return metrics.Handler()
+	}
+	serverScope := func(*http.Request) auth.Scope { return auth.Server }
+	return api.authenticator.Middleware(serverScope)(metrics.Handler())
+}
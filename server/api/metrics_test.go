@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"timelygator/server/utils/types"
+)
+
+// scrape returns the samples served by the metrics handler, keyed by name
+// and labels as they appear in the exposition format.
+func scrape(t *testing.T, url, token string) map[string]float64 {
+	t.Helper()
+	res := doAuth(t, http.MethodGet, url, token, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("scraping metrics: expected 200, got %d", res.StatusCode)
+	}
+	samples := map[string]float64{}
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1"
+	metricsServer := httptest.NewServer(MetricsHandler())
+	t.Cleanup(metricsServer.Close)
+	before := scrape(t, metricsServer.URL, "")
+
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	if res := doJSON(t, http.MethodPost, base+"/buckets/metrics-window", bucket); res.StatusCode != http.StatusOK {
+		t.Fatalf("creating bucket: expected 200, got %d", res.StatusCode)
+	}
+	for _, at := range []string{"2024-01-01T00:00:00Z", "2024-01-01T00:00:10Z"} {
+		heartbeat := map[string]interface{}{"timestamp": at, "duration": 0, "data": map[string]interface{}{"app": "a"}}
+		if res := doJSON(t, http.MethodPost, base+"/buckets/metrics-window/heartbeat?pulsetime=60", heartbeat); res.StatusCode != http.StatusOK {
+			t.Fatalf("heartbeat: expected 200, got %d", res.StatusCode)
+		}
+	}
+	q := map[string]interface{}{
+		"timeperiods": []string{"2024-01-01T00:00:00Z/2024-01-02T00:00:00Z"},
+		"query":       []string{`RETURN = query_bucket("metrics-window");`},
+	}
+	if res := doJSON(t, http.MethodPost, base+"/query/", q); res.StatusCode != http.StatusOK {
+		t.Fatalf("query: expected 200, got %d", res.StatusCode)
+	}
+
+	after := scrape(t, metricsServer.URL, "")
+	delta := func(name string) float64 { return after[name] - before[name] }
+	cases := []struct {
+		name string
+		want float64
+	}{
+		{`timelygator_heartbeats_total{result="inserted"}`, 1},
+		{`timelygator_heartbeats_total{result="merged"}`, 1},
+		{`timelygator_bucket_events{bucket="metrics-window"}`, 1},
+		{`timelygator_query_duration_seconds_count{cache="false"}`, 1},
+		{`timelygator_http_request_duration_seconds_count{code="200",method="POST",route="/api/v1/v1/buckets/{bucket_id}/heartbeat"}`, 2},
+	}
+	for _, c := range cases {
+		if got := delta(c.name); got != c.want {
+			t.Errorf("%s: expected an increase by %v, got %v", c.name, c.want, got)
+		}
+	}
+	if after["timelygator_database_size_bytes"] <= 0 {
+		t.Errorf("expected the database size, got %v", after["timelygator_database_size_bytes"])
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	newTestRouterWithConfig(t, types.Config{Environment: "testing", AuthEnabled: true})
+	metricsServer := httptest.NewServer(MetricsHandler())
+	t.Cleanup(metricsServer.Close)
+	_, userToken := addUser(t, "alice@example.com")
+	server := issue(t, "server", "admin")
+
+	cases := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"user token", userToken, http.StatusForbidden},
+		{"server token", server, http.StatusOK},
+	}
+	for _, c := range cases {
+		if res := doAuth(t, http.MethodGet, metricsServer.URL, c.token, nil); res.StatusCode != c.want {
+			t.Errorf("%s: expected %d, got %d", c.name, c.want, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+	"timelygator/server/middleware/auth"
+	"timelygator/server/oauth"
+	"timelygator/server/utils/types"
+)
+
+// addUser adds a user with a write-events token for their observers.
+func addUser(t *testing.T, email string) (*models.User, string) {
+	t.Helper()
+	user := &models.User{Provider: database.LocalProvider, Subject: email, Email: email, Created: time.Now()}
+	if err := api.ds.CreateUser(user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	token, _, err := auth.IssueToken(api.ds.ForOwner(user.ID, false), email, []string{"admin"})
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	return user, token
+}
+
+func bucketIDs(t *testing.T, res *http.Response) map[string]bool {
+	t.Helper()
+	var buckets map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&buckets); err != nil {
+		t.Fatalf("failed to decode buckets: %v", err)
+	}
+	ids := map[string]bool{}
+	for id := range buckets {
+		ids[id] = true
+	}
+	return ids
+}
+
+func TestBucketOwners(t *testing.T) {
+	ts := newTestRouterWithConfig(t, types.Config{Environment: "testing", AuthEnabled: true})
+	base := ts.URL + "/api/v1/v1"
+	alice, aliceToken := addUser(t, "alice@example.com")
+	_, bobToken := addUser(t, "bob@example.com")
+	server := issue(t, "server", "admin")
+	if !alice.Admin {
+		t.Fatalf("expected the first user to be an admin")
+	}
+
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	heartbeat := map[string]interface{}{"timestamp": "2024-01-01T00:00:00Z", "duration": 0, "data": map[string]interface{}{"app": "a"}}
+	for _, c := range []struct{ token, id string }{{aliceToken, "alice-window"}, {bobToken, "bob-window"}, {server, "shared"}} {
+		if res := doAuth(t, http.MethodPost, base+"/buckets/"+c.id, c.token, bucket); res.StatusCode != http.StatusOK {
+			t.Fatalf("creating %s: expected 200, got %d", c.id, res.StatusCode)
+		}
+		if res := doAuth(t, http.MethodPost, base+"/buckets/"+c.id+"/heartbeat?pulsetime=60", c.token, heartbeat); res.StatusCode != http.StatusOK {
+			t.Fatalf("heartbeat to %s: expected 200, got %d", c.id, res.StatusCode)
+		}
+	}
+
+	ids := bucketIDs(t, doAuth(t, http.MethodGet, base+"/buckets/", bobToken, nil))
+	if len(ids) != 1 || !ids["bob-window"] {
+		t.Errorf("expected bob to see only his bucket, got %v", ids)
+	}
+	ids = bucketIDs(t, doAuth(t, http.MethodGet, base+"/buckets/", server, nil))
+	if len(ids) != 3 {
+		t.Errorf("expected a token without owner to see all buckets, got %v", ids)
+	}
+
+	cases := []struct {
+		name, method, path string
+		body               interface{}
+		status             int
+	}{
+		{"get other bucket", http.MethodGet, "/buckets/alice-window", nil, http.StatusNotFound},
+		{"get other events", http.MethodGet, "/buckets/alice-window/events", nil, http.StatusNotFound},
+		{"heartbeat to other bucket", http.MethodPost, "/buckets/alice-window/heartbeat?pulsetime=60", heartbeat, http.StatusNotFound},
+		{"delete other bucket", http.MethodDelete, "/buckets/alice-window?force=1", nil, http.StatusNotFound},
+		{"take other bucket ID", http.MethodPost, "/buckets/alice-window", bucket, http.StatusBadRequest},
+		{"export other bucket", http.MethodGet, "/buckets/alice-window/export", nil, http.StatusNotFound},
+		{"query other bucket", http.MethodPost, "/query/", map[string]interface{}{
+			"timeperiods": []string{"2024-01-01T00:00:00Z/2024-01-02T00:00:00Z"},
+			"query":       []string{`RETURN = query_bucket("alice-window");`},
+		}, http.StatusBadRequest},
+		{"change settings", http.MethodPost, "/settings/startOfDay", "04:00", http.StatusForbidden},
+		{"list webhooks", http.MethodGet, "/webhooks", nil, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if res := doAuth(t, c.method, base+c.path, bobToken, c.body); res.StatusCode != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, res.StatusCode)
+		}
+	}
+
+	// Events of other users cannot be reached through the URL of an own bucket
+	var events []models.Event
+	json.NewDecoder(doAuth(t, http.MethodGet, base+"/buckets/alice-window/events", aliceToken, nil).Body).Decode(&events)
+	if len(events) != 1 {
+		t.Fatalf("expected alice's event, got %v", events)
+	}
+	aliceEvent := fmt.Sprintf("/buckets/bob-window/events/%d", events[0].ID)
+	if res := doAuth(t, http.MethodGet, base+aliceEvent, bobToken, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected bob not to read alice's event through his bucket, got %d", res.StatusCode)
+	}
+	var deleted map[string]bool
+	json.NewDecoder(doAuth(t, http.MethodDelete, base+aliceEvent, bobToken, nil).Body).Decode(&deleted)
+	if deleted["success"] {
+		t.Errorf("expected bob not to delete alice's event through his bucket")
+	}
+	json.NewDecoder(doAuth(t, http.MethodGet, base+"/buckets/alice-window/events", aliceToken, nil).Body).Decode(&events)
+	if len(events) != 1 {
+		t.Errorf("expected alice's event to be kept, got %v", events)
+	}
+
+	res := doAuth(t, http.MethodGet, base+"/export", bobToken, nil)
+	var export struct {
+		Buckets map[string]interface{} `json:"buckets"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&export); err != nil {
+		t.Fatalf("failed to decode export: %v", err)
+	}
+	if len(export.Buckets) != 1 || export.Buckets["bob-window"] == nil {
+		t.Errorf("expected export of bob's bucket only, got %v", export.Buckets)
+	}
+
+	// Imported buckets belong to the importing user
+	export.Buckets["bob-window"].(map[string]interface{})["id"] = "bob-imported"
+	imported := map[string]interface{}{"buckets": map[string]interface{}{"bob-imported": export.Buckets["bob-window"]}}
+	if res := doAuth(t, http.MethodPost, base+"/import", bobToken, imported); res.StatusCode != http.StatusOK {
+		t.Fatalf("import: expected 200, got %d", res.StatusCode)
+	}
+	if ids := bucketIDs(t, doAuth(t, http.MethodGet, base+"/buckets/", bobToken, nil)); !ids["bob-imported"] {
+		t.Errorf("expected imported bucket to belong to bob, got %v", ids)
+	}
+	if ids := bucketIDs(t, doAuth(t, http.MethodGet, base+"/buckets/", aliceToken, nil)); ids["bob-imported"] || ids["shared"] {
+		t.Errorf("expected alice's token to see only her buckets, got %v", ids)
+	}
+
+	// Tokens of users are scoped too
+	res = doAuth(t, http.MethodGet, base+"/tokens", bobToken, nil)
+	var tokens []models.APIToken
+	json.NewDecoder(res.Body).Decode(&tokens)
+	if len(tokens) != 1 || tokens[0].Name != "bob@example.com" {
+		t.Errorf("expected bob to see only his token, got %v", tokens)
+	}
+	if res := doAuth(t, http.MethodDelete, base+"/tokens/server", bobToken, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected bob not to revoke other tokens, got %d", res.StatusCode)
+	}
+
+	// Token names are unique per user, so they do not reveal other users' tokens
+	laptop := map[string]interface{}{"name": "laptop", "scopes": []string{"read"}}
+	for _, c := range []struct {
+		name, token string
+		status      int
+	}{{"bob", bobToken, http.StatusOK}, {"alice", aliceToken, http.StatusOK}, {"bob again", bobToken, http.StatusBadRequest}} {
+		if res := doAuth(t, http.MethodPost, base+"/tokens", c.token, laptop); res.StatusCode != c.status {
+			t.Errorf("%s creating laptop: expected %d, got %d", c.name, c.status, res.StatusCode)
+		}
+	}
+	if res := doAuth(t, http.MethodDelete, base+"/tokens/laptop", server, nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected tokens of the same name to be revoked by ID, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodDelete, base+"/tokens/laptop", bobToken, nil); res.StatusCode != http.StatusOK {
+		t.Errorf("expected bob to revoke his laptop token, got %d", res.StatusCode)
+	}
+}
+
+func TestBucketOwnersSignIn(t *testing.T) {
+	ts, p := newLoginRouter(t, types.Config{})
+	base := ts.URL + "/api/v1/v1"
+
+	// Buckets of tokens without owner are shared with admins
+	if _, err := api.ds.CreateBucket("afk", "afkstatus", "test", "host", time.Now(), nil, nil); err != nil {
+		t.Fatalf("CreateBucket error: %v", err)
+	}
+	admin := newBrowser(t)
+	if _, user := signIn(t, admin, ts, p, oauth.Identity{Subject: "1", Email: "alice@example.com"}); user == nil || !user.Admin {
+		t.Fatalf("expected the first user to be an admin, got %+v", user)
+	}
+	res, _ := admin.Get(base + "/buckets/")
+	if ids := bucketIDs(t, res); !ids["afk"] {
+		t.Errorf("expected admin to see buckets without owner, got %v", ids)
+	}
+
+	// Users added from the command line are linked by email on first sign in
+	bob := &models.User{Provider: database.LocalProvider, Subject: "bob@example.com", Email: "bob@example.com", Created: time.Now()}
+	if err := api.ds.CreateUser(bob); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	browser := newBrowser(t)
+	_, user := signIn(t, browser, ts, p, oauth.Identity{Subject: "2", Email: "bob@example.com"})
+	if user == nil || user.ID != bob.ID || user.Provider != "fake" || user.Admin {
+		t.Fatalf("expected bob to be linked to his account, got %+v", user)
+	}
+	res, _ = browser.Get(base + "/buckets/")
+	if ids := bucketIDs(t, res); len(ids) != 0 {
+		t.Errorf("expected bob to see no buckets, got %v", ids)
+	}
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventPages(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1/buckets/pages"
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	if res := doJSON(t, http.MethodPost, base, bucket); res.StatusCode != http.StatusOK {
+		t.Fatalf("creating bucket: expected 200, got %d", res.StatusCode)
+	}
+	// 25 events, the last two at the same time to test ordering by ID
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var events []map[string]interface{}
+	for i := 0; i < 25; i++ {
+		at := start.Add(time.Duration(min(i, 23)) * time.Minute)
+		events = append(events, map[string]interface{}{
+			"timestamp": at.Format(time.RFC3339),
+			"duration":  60,
+			"data":      map[string]interface{}{"app": fmt.Sprintf("app%d", i), "title": "secret"},
+		})
+	}
+	if res := doJSON(t, http.MethodPost, base+"/events", events); res.StatusCode != http.StatusOK {
+		t.Fatalf("inserting events: expected 200, got %d", res.StatusCode)
+	}
+
+	seen := map[float64]bool{}
+	var apps []string
+	cursor := ""
+	pages := 0
+	for {
+		u := base + "/events?page_size=10&fields=app"
+		if cursor != "" {
+			u += "&cursor=" + url.QueryEscape(cursor)
+		}
+		res := doJSON(t, http.MethodGet, u, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("page %d: expected 200, got %d", pages, res.StatusCode)
+		}
+		var page []map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, e := range page {
+			if _, ok := e["title"]; ok {
+				t.Fatalf("expected title to be left out, got %v", e)
+			}
+			if seen[e["id"].(float64)] {
+				t.Fatalf("event %v returned twice", e["id"])
+			}
+			seen[e["id"].(float64)] = true
+			apps = append(apps, e["app"].(string))
+		}
+		cursor = res.Header.Get(nextCursorHeader)
+		if cursor == "" {
+			if link := res.Header.Get("Link"); link != "" {
+				t.Errorf("expected no Link on the last page, got %q", link)
+			}
+			break
+		}
+		if link := res.Header.Get("Link"); !strings.Contains(link, `rel="next"`) || !strings.Contains(link, "cursor=") {
+			t.Errorf("expected a next Link, got %q", link)
+		}
+		if pages == 1 {
+			// Events inserted while paging do not shift later pages
+			late := map[string]interface{}{"timestamp": "2024-02-01T00:00:00Z", "duration": 1, "data": map[string]interface{}{"app": "late"}}
+			doJSON(t, http.MethodPost, base+"/events", late)
+		}
+	}
+	if pages != 3 || len(apps) != 25 {
+		t.Fatalf("expected 25 events in 3 pages, got %d in %d", len(apps), pages)
+	}
+	if apps[0] != "app24" || apps[1] != "app23" || apps[24] != "app0" {
+		t.Errorf("expected events newest first, got %v", apps)
+	}
+
+	cases := []struct {
+		query string
+		want  int
+	}{
+		{"page_size=0", http.StatusBadRequest},
+		{"page_size=abc", http.StatusBadRequest},
+		{"page_size=10&limit=5", http.StatusBadRequest},
+		{"cursor=not-a-cursor", http.StatusBadRequest},
+		{"cursor=", http.StatusOK},
+	}
+	for _, c := range cases {
+		if res := doJSON(t, http.MethodGet, base+"/events?"+c.query, nil); res.StatusCode != c.want {
+			t.Errorf("%s: expected %d, got %d", c.query, c.want, res.StatusCode)
+		}
+	}
+	if res := doJSON(t, http.MethodGet, ts.URL+"/api/v1/v1/buckets/missing/events?page_size=10", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("missing bucket: expected 404, got %d", res.StatusCode)
+	}
+}
+
+func TestEventsClip(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1/buckets/clip"
+	bucket := map[string]interface{}{"client": "test", "type": "afkstatus", "hostname": "host"}
+	if res := doJSON(t, http.MethodPost, base, bucket); res.StatusCode != http.StatusOK {
+		t.Fatalf("creating bucket: expected 200, got %d", res.StatusCode)
+	}
+	span := map[string]interface{}{"timestamp": "2024-01-01T23:00:00Z", "duration": 7200, "data": map[string]interface{}{"status": "not-afk"}}
+	if res := doJSON(t, http.MethodPost, base+"/events", span); res.StatusCode != http.StatusOK {
+		t.Fatalf("inserting event: expected 200, got %d", res.StatusCode)
+	}
+
+	window := "start=2024-01-02T00:00:00Z&end=2024-01-03T00:00:00Z"
+	cases := []struct {
+		query     string
+		timestamp string
+		duration  float64
+	}{
+		{window, "2024-01-01T23:00:00Z", 7200},
+		{window + "&clip=true", "2024-01-02T00:00:00Z", 3600},
+		{window + "&clip=true&page_size=5", "2024-01-02T00:00:00Z", 3600},
+		{"end=2024-01-01T23:30:00Z&clip=1", "2024-01-01T23:00:00Z", 1800},
+	}
+	for _, c := range cases {
+		res := doJSON(t, http.MethodGet, base+"/events?"+c.query, nil)
+		var events []map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&events)
+		if len(events) != 1 {
+			t.Fatalf("%s: expected the event running into the window, got %v", c.query, events)
+		}
+		if events[0]["timestamp"] != c.timestamp || events[0]["duration"] != c.duration {
+			t.Errorf("%s: expected %s for %vs, got %v for %vs", c.query, c.timestamp, c.duration, events[0]["timestamp"], events[0]["duration"])
+		}
+	}
+	if res := doJSON(t, http.MethodGet, base+"/events?clip=maybe", nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid clip, got %d", res.StatusCode)
+	}
+}
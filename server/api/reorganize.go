@@ -0,0 +1,65 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/utils"
+	"timelygator/server/utils/types"
+)
+
+// bucketsMoved is called after events moved between buckets, to drop state
+// kept for either.
+func (s *API) bucketsMoved(bucketIDs ...string) {
+	s.lastEvent.forget(bucketIDs...)
+	for _, id := range bucketIDs {
+		s.bucketChanged(id)
+	}
+}
+
+// RenameBucket changes the ID of a bucket, keeping its events and their IDs.
+func (s *API) RenameBucket(bucketID string, p types.BucketRenamePayload) error {
+	if err := s.ds.RenameBucket(bucketID, p.ID); err != nil {
+		return err
+	}
+	log.Printf("Renamed bucket '%s' to '%s'\n", bucketID, p.ID)
+	s.bucketsMoved(bucketID, p.ID)
+	return nil
+}
+
+// MergeBuckets moves the events of a bucket into another and deletes it.
+func (s *API) MergeBuckets(bucketID string, p types.BucketMergePayload) (*database.MergeResult, error) {
+	overlap := p.Overlap
+	if overlap == "" {
+		overlap = database.OverlapKeep
+	}
+	result, err := s.ds.MergeBuckets(bucketID, p.Into, overlap)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Merged bucket '%s' into '%s': %+v\n", bucketID, p.Into, *result)
+	s.bucketsMoved(bucketID, p.Into)
+	return result, nil
+}
+
+// SplitBucket moves the events of a bucket that begin at or after a time and
+// pass the filter into a new bucket.
+func (s *API) SplitBucket(bucketID string, p types.BucketSplitPayload, filter *database.EventFilter) (*BulkResponse, error) {
+	var cutoff *time.Time
+	if p.After != "" {
+		t, err := utils.ParseIso8601(p.After)
+		if err != nil {
+			return nil, &types.BadRequest{Code: "InvalidTime", Message: fmt.Sprintf("invalid after time %q", p.After)}
+		}
+		cutoff = &t
+	}
+	moved, err := s.ds.SplitBucket(bucketID, p.ID, p.Hostname, cutoff, filter)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Split %d events of bucket '%s' into '%s'\n", moved, bucketID, p.ID)
+	s.bucketsMoved(bucketID, p.ID)
+	return &BulkResponse{Count: int(moved)}, nil
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"timelygator/server/database"
+	"timelygator/server/utils/types"
+)
+
+// eventIDs returns the IDs of a bucket's events by the minutes of their
+// timestamps.
+func eventIDs(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+	res := doJSON(t, http.MethodGet, url+"/events", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("events of %s: expected 200, got %d", url, res.StatusCode)
+	}
+	var events []map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&events)
+	ids := map[string]float64{}
+	for _, e := range events {
+		ids[e["timestamp"].(string)[14:16]] = e["id"].(float64)
+	}
+	return ids
+}
+
+// eventApps returns the minutes and apps of a bucket's events in order.
+func eventApps(t *testing.T, url string) string {
+	t.Helper()
+	var events []map[string]interface{}
+	json.NewDecoder(doJSON(t, http.MethodGet, url+"/events", nil).Body).Decode(&events)
+	apps := make([]string, len(events))
+	for i, e := range events {
+		apps[i] = e["timestamp"].(string)[14:16] + ":" + e["app"].(string)
+	}
+	sort.Strings(apps)
+	return strings.Join(apps, ",")
+}
+
+func minutes(ids map[string]float64) string {
+	keys := make([]string, 0, len(ids))
+	for k := range ids {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func TestReorganizeBuckets(t *testing.T) {
+	ts := newTestRouter(t)
+	buckets := ts.URL + "/api/v1/v1/buckets"
+	window := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "old"}
+	at := func(minute, duration int, app string) map[string]interface{} {
+		return map[string]interface{}{
+			"timestamp": fmt.Sprintf("2024-01-01T00:%02d:00Z", minute),
+			"duration":  duration,
+			"data":      map[string]interface{}{"app": app},
+		}
+	}
+	create := func(id string, bucket map[string]interface{}, events ...map[string]interface{}) {
+		t.Helper()
+		if res := doJSON(t, http.MethodPost, buckets+"/"+id, bucket); res.StatusCode != http.StatusOK {
+			t.Fatalf("creating %s: expected 200, got %d", id, res.StatusCode)
+		}
+		if res := doJSON(t, http.MethodPost, buckets+"/"+id+"/events", events); res.StatusCode != http.StatusOK {
+			t.Fatalf("inserting into %s: expected 200, got %d", id, res.StatusCode)
+		}
+	}
+
+	// Rename keeps events, their IDs and revisions
+	create("window_old", window, at(0, 60, "a"), at(10, 60, "b"))
+	before := eventIDs(t, buckets+"/window_old")
+	doJSON(t, http.MethodPut, fmt.Sprintf("%s/window_old/events/%d", buckets, int(before["00"])), map[string]interface{}{"duration": 30})
+	if res := doJSON(t, http.MethodPost, buckets+"/window_old/rename", map[string]string{"id": "window_new"}); res.StatusCode != http.StatusOK {
+		t.Fatalf("rename: expected 200, got %d", res.StatusCode)
+	}
+	if ids := bucketIDs(t, doJSON(t, http.MethodGet, buckets+"/", nil)); ids["window_old"] || !ids["window_new"] {
+		t.Fatalf("expected the bucket to be renamed, got %v", ids)
+	}
+	if after := eventIDs(t, buckets+"/window_new"); after["00"] != before["00"] || after["10"] != before["10"] {
+		t.Fatalf("expected event IDs %v to be kept, got %v", before, after)
+	}
+	var revisions []map[string]interface{}
+	json.NewDecoder(doJSON(t, http.MethodGet, fmt.Sprintf("%s/window_new/events/%d/revisions", buckets, int(before["00"])), nil).Body).Decode(&revisions)
+	if len(revisions) != 1 {
+		t.Fatalf("expected the revision to follow the event, got %v", revisions)
+	}
+
+	// Merges by overlap handling, the target's events are a at 00 and b at 10
+	cases := []struct {
+		overlap, want string
+		result        database.MergeResult
+	}{
+		{"keep", "00:a,00:c,10:b,10:d,20:e", database.MergeResult{Moved: 3}},
+		{"skip", "00:a,10:b,20:e", database.MergeResult{Moved: 1, Skipped: 2}},
+		{"replace", "00:c,10:d,20:e", database.MergeResult{Moved: 3, Replaced: 2}},
+	}
+	for _, c := range cases {
+		target, source := "target_"+c.overlap, "source_"+c.overlap
+		create(target, window, at(0, 60, "a"), at(10, 60, "b"))
+		// Overlaps the first event, begins with the second and is apart
+		create(source, window, at(0, 30, "c"), at(10, 0, "d"), at(20, 60, "e"))
+		sourceIDs := eventIDs(t, buckets+"/"+source)
+		res := doJSON(t, http.MethodPost, buckets+"/"+source+"/merge", map[string]string{"into": target, "overlap": c.overlap})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("merge %s: expected 200, got %d", c.overlap, res.StatusCode)
+		}
+		var result database.MergeResult
+		json.NewDecoder(res.Body).Decode(&result)
+		if result != c.result {
+			t.Errorf("merge %s: expected %+v, got %+v", c.overlap, c.result, result)
+		}
+		if got := eventApps(t, buckets+"/"+target); got != c.want {
+			t.Errorf("merge %s: expected events %s, got %s", c.overlap, c.want, got)
+		}
+		if eventIDs(t, buckets+"/"+target)["20"] != sourceIDs["20"] {
+			t.Errorf("merge %s: expected the moved event to keep its ID", c.overlap)
+		}
+		if res := doJSON(t, http.MethodGet, buckets+"/"+source, nil); res.StatusCode != http.StatusNotFound {
+			t.Errorf("merge %s: expected the source bucket to be deleted, got %d", c.overlap, res.StatusCode)
+		}
+	}
+
+	// Split by cutoff into a bucket with the new hostname
+	create("laptop", window, at(0, 60, "a"), at(10, 60, "b"), at(20, 60, "c"))
+	laptopIDs := eventIDs(t, buckets+"/laptop")
+	split := map[string]string{"id": "laptop_renamed", "hostname": "renamed", "after": "2024-01-01T00:10:00Z"}
+	res := doJSON(t, http.MethodPost, buckets+"/laptop/split", split)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("split: expected 200, got %d", res.StatusCode)
+	}
+	var moved BulkResponse
+	json.NewDecoder(res.Body).Decode(&moved)
+	if moved.Count != 2 {
+		t.Fatalf("split: expected 2 events moved, got %+v", moved)
+	}
+	if got := minutes(eventIDs(t, buckets+"/laptop")); got != "00" {
+		t.Errorf("split: expected the first event to stay, got %s", got)
+	}
+	if got := eventIDs(t, buckets+"/laptop_renamed"); minutes(got) != "10,20" || got["20"] != laptopIDs["20"] {
+		t.Errorf("split: expected the later events with their IDs, got %v", got)
+	}
+	var meta map[string]interface{}
+	json.NewDecoder(doJSON(t, http.MethodGet, buckets+"/laptop_renamed", nil).Body).Decode(&meta)
+	if meta["hostname"] != "renamed" || meta["type"] != "currentwindow" {
+		t.Errorf("split: unexpected bucket %v", meta)
+	}
+	// Split by data filter
+	res = doJSON(t, http.MethodPost, buckets+"/laptop_renamed/split?data.app=c", map[string]string{"id": "laptop_c"})
+	if json.NewDecoder(res.Body).Decode(&moved); moved.Count != 1 {
+		t.Errorf("split by filter: expected 1 event moved, got %+v", moved)
+	}
+
+	afk := map[string]interface{}{"client": "test", "type": "afkstatus", "hostname": "old"}
+	create("afk", afk, at(0, 60, "a"))
+	errs := []struct {
+		name, path string
+		body       interface{}
+		status     int
+	}{
+		{"rename to existing", "/laptop/rename", map[string]string{"id": "laptop_c"}, http.StatusBadRequest},
+		{"rename to empty", "/laptop/rename", map[string]string{"id": ""}, http.StatusBadRequest},
+		{"rename missing", "/missing/rename", map[string]string{"id": "other"}, http.StatusNotFound},
+		{"merge into itself", "/laptop/merge", map[string]string{"into": "laptop"}, http.StatusBadRequest},
+		{"merge into missing", "/laptop/merge", map[string]string{"into": "missing"}, http.StatusNotFound},
+		{"merge other type", "/afk/merge", map[string]string{"into": "laptop"}, http.StatusBadRequest},
+		{"merge bad overlap", "/laptop/merge", map[string]string{"into": "laptop_c", "overlap": "maybe"}, http.StatusBadRequest},
+		{"split without cutoff", "/laptop/split", map[string]string{"id": "laptop_2"}, http.StatusBadRequest},
+		{"split bad cutoff", "/laptop/split", map[string]string{"id": "laptop_2", "after": "soon"}, http.StatusBadRequest},
+		{"split into existing", "/laptop/split", map[string]string{"id": "laptop_c", "after": "2024-01-01T00:00:00Z"}, http.StatusBadRequest},
+	}
+	for _, c := range errs {
+		if res := doJSON(t, http.MethodPost, buckets+c.path, c.body); res.StatusCode != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, res.StatusCode)
+		}
+	}
+}
+
+func TestReorganizeScopedToken(t *testing.T) {
+	ts := newTestRouterWithConfig(t, types.Config{Environment: "testing", AuthEnabled: true})
+	buckets := ts.URL + "/api/v1/v1/buckets"
+	admin := issue(t, "admin", "admin")
+	scoped := issue(t, "laptop", "admin", "bucket:tg-observer-window_laptop")
+	window := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "laptop"}
+	for _, id := range []string{"tg-observer-window_laptop", "tg-observer-window_desktop"} {
+		if res := doAuth(t, http.MethodPost, buckets+"/"+id, admin, window); res.StatusCode != http.StatusOK {
+			t.Fatalf("creating %s: expected 200, got %d", id, res.StatusCode)
+		}
+	}
+
+	cases := []struct {
+		name, path string
+		body       interface{}
+		status     int
+	}{
+		{"rename out of scope", "/rename", map[string]string{"id": "tg-observer-window_desktop2"}, http.StatusForbidden},
+		{"merge out of scope", "/merge", map[string]string{"into": "tg-observer-window_desktop"}, http.StatusForbidden},
+		{"split out of scope", "/split", map[string]string{"id": "other", "after": "2024-01-01T00:00:00Z"}, http.StatusForbidden},
+		{"split in scope", "/split", map[string]string{"id": "tg-observer-window_laptop2", "after": "2024-01-01T00:00:00Z"}, http.StatusOK},
+		{"rename in scope", "/rename", map[string]string{"id": "tg-observer-window_laptop_old"}, http.StatusOK},
+	}
+	for _, c := range cases {
+		if res := doAuth(t, http.MethodPost, buckets+"/tg-observer-window_laptop"+c.path, scoped, c.body); res.StatusCode != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, res.StatusCode)
+		}
+	}
+	if res := doAuth(t, http.MethodGet, buckets+"/tg-observer-window_desktop2", admin, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the bucket not to be renamed, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"timelygator/server/utils/types"
+)
+
+func TestUpdateEvent(t *testing.T) {
+	ts := newTestRouterWithConfig(t, types.Config{Environment: "testing", AuthEnabled: true})
+	base := ts.URL + "/api/v1/v1/buckets"
+	admin := issue(t, "editor", "admin")
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	for _, id := range []string{"edits", "other"} {
+		if res := doAuth(t, http.MethodPost, base+"/"+id, admin, bucket); res.StatusCode != http.StatusOK {
+			t.Fatalf("creating bucket %s: expected 200, got %d", id, res.StatusCode)
+		}
+	}
+	heartbeat := map[string]interface{}{"timestamp": "2024-01-01T10:00:00Z", "duration": 0, "data": map[string]interface{}{"app": "editor"}}
+	res := doAuth(t, http.MethodPost, base+"/edits/heartbeat?pulsetime=60", admin, heartbeat)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("heartbeat: expected 200, got %d", res.StatusCode)
+	}
+	var created map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	id := int(created["id"].(float64))
+	eventURL := fmt.Sprintf("%s/edits/events/%d", base, id)
+
+	update := map[string]interface{}{"timestamp": "2024-01-01T09:00:00Z", "duration": 120, "data": map[string]interface{}{"app": "browser"}}
+	res = doAuth(t, http.MethodPut, eventURL, admin, update)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("update: expected 200, got %d", res.StatusCode)
+	}
+	var updated map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&updated); err != nil {
+		t.Fatal(err)
+	}
+	if int(updated["id"].(float64)) != id || updated["duration"].(float64) != 120 || updated["app"] != "browser" {
+		t.Fatalf("unexpected updated event %v", updated)
+	}
+
+	// Only the given fields change
+	res = doAuth(t, http.MethodPut, eventURL, admin, map[string]interface{}{"duration": 30})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("partial update: expected 200, got %d", res.StatusCode)
+	}
+	res = doAuth(t, http.MethodGet, eventURL, admin, nil)
+	var stored map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored["duration"].(float64) != 30 || stored["app"] != "browser" || stored["timestamp"] != "2024-01-01T09:00:00Z" {
+		t.Fatalf("unexpected stored event %v", stored)
+	}
+
+	// A heartbeat for the old event must not extend the edited one
+	heartbeat["timestamp"] = "2024-01-01T10:00:30Z"
+	doAuth(t, http.MethodPost, base+"/edits/heartbeat?pulsetime=60", admin, heartbeat)
+	res = doAuth(t, http.MethodGet, base+"/edits/events/count", admin, nil)
+	var count int
+	if err := json.NewDecoder(res.Body).Decode(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected the heartbeat to start a new event, got %d events", count)
+	}
+
+	errs := []struct {
+		name, url string
+		body      interface{}
+		status    int
+	}{
+		{"wrong bucket", fmt.Sprintf("%s/other/events/%d", base, id), map[string]interface{}{"duration": 1}, http.StatusNotFound},
+		{"missing bucket", fmt.Sprintf("%s/missing/events/%d", base, id), map[string]interface{}{"duration": 1}, http.StatusNotFound},
+		{"missing event", base + "/edits/events/9999", map[string]interface{}{"duration": 1}, http.StatusNotFound},
+		{"bad timestamp", eventURL, map[string]interface{}{"timestamp": "yesterday"}, http.StatusBadRequest},
+		{"negative duration", eventURL, map[string]interface{}{"duration": -1}, http.StatusBadRequest},
+		{"bad body", eventURL, "not an object", http.StatusBadRequest},
+	}
+	for _, c := range errs {
+		if res := doAuth(t, http.MethodPut, c.url, admin, c.body); res.StatusCode != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, res.StatusCode)
+		}
+	}
+	if res := doAuth(t, http.MethodGet, fmt.Sprintf("%s/other/events/%d", base, id), admin, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("get from wrong bucket: expected 404, got %d", res.StatusCode)
+	}
+
+	// Observers record activity but cannot rewrite it
+	observer := issue(t, "observer", "write-events")
+	if res := doAuth(t, http.MethodPut, eventURL, observer, map[string]interface{}{"duration": 1}); res.StatusCode != http.StatusForbidden {
+		t.Errorf("observer update: expected 403, got %d", res.StatusCode)
+	}
+
+	res = doAuth(t, http.MethodGet, eventURL+"/revisions", admin, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("revisions: expected 200, got %d", res.StatusCode)
+	}
+	var revisions []struct {
+		EventID   int                    `json:"event_id"`
+		ChangedBy string                 `json:"changed_by"`
+		Before    map[string]interface{} `json:"before"`
+		After     map[string]interface{} `json:"after"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&revisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("expected 2 revisions, got %d", len(revisions))
+	}
+	first := revisions[0]
+	if first.EventID != id || first.ChangedBy != "editor" {
+		t.Errorf("unexpected revision %+v", first)
+	}
+	if first.Before["app"] != "editor" || first.After["app"] != "browser" || first.After["duration"].(float64) != 120 {
+		t.Errorf("unexpected revision contents %+v", first)
+	}
+	if revisions[1].Before["duration"].(float64) != 120 || revisions[1].After["duration"].(float64) != 30 {
+		t.Errorf("unexpected second revision %+v", revisions[1])
+	}
+	if res := doAuth(t, http.MethodGet, base+"/edits/events/9999/revisions", admin, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("revisions of missing event: expected 404, got %d", res.StatusCode)
+	}
+}
+
+// TestHeartbeatsAlongsideDeletes sends heartbeats while their events are
+// edited and deleted, which must not race on the last events of buckets. Run
+// it with -race.
+func TestHeartbeatsAlongsideDeletes(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1/buckets"
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	if res := doJSON(t, http.MethodPost, base+"/busy", bucket); res.StatusCode != http.StatusOK {
+		t.Fatalf("creating bucket: expected 200, got %d", res.StatusCode)
+	}
+
+	const rounds = 20
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			heartbeat := map[string]interface{}{"timestamp": fmt.Sprintf("2024-01-01T10:00:%02dZ", i), "duration": 0,
+				"data": map[string]interface{}{"app": fmt.Sprint(i % 2)}}
+			doJSON(t, http.MethodPost, base+"/busy/heartbeat?pulsetime=60", heartbeat).Body.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= rounds; i++ {
+			doJSON(t, http.MethodDelete, fmt.Sprintf("%s/busy/events/%d", base, i), nil).Body.Close()
+			doJSON(t, http.MethodPut, fmt.Sprintf("%s/busy/events/%d", base, i+1),
+				map[string]interface{}{"duration": 1}).Body.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds/4; i++ {
+			doJSON(t, http.MethodDelete, base+"/busy/events?end=2024-01-01T10:00:05Z", nil).Body.Close()
+		}
+	}()
+	wg.Wait()
+
+	heartbeat := map[string]interface{}{"timestamp": "2024-01-01T11:00:00Z", "duration": 0, "data": map[string]interface{}{"app": "a"}}
+	if res := doJSON(t, http.MethodPost, base+"/busy/heartbeat?pulsetime=60", heartbeat); res.StatusCode != http.StatusOK {
+		t.Errorf("expected heartbeats to keep working, got %d", res.StatusCode)
+	}
+}
@@ -3,19 +3,36 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"timelygator/server/database"
 	"timelygator/server/database/models"
+	"timelygator/server/metrics"
+	"timelygator/server/middleware/auth"
 	"timelygator/server/middleware/errors"
+	"timelygator/server/oauth"
+	"timelygator/server/query"
+	"timelygator/server/stream"
 	"timelygator/server/utils"
 	"timelygator/server/utils/types"
+	"timelygator/server/webhooks"
 
 	"github.com/gorilla/mux"
 )
 
+// defaultPageSize is the page size when paging events without page_size.
+const defaultPageSize = 100
+
+// nextCursorHeader holds the cursor of the next page of events.
+const nextCursorHeader = "X-Next-Cursor"
+
 var heartbeatLock sync.Mutex
 var api API
 
@@ -26,21 +43,76 @@ var api API
 
 func RegisterRoutes(cfg types.Config, datastore *database.Datastore, r *mux.Router) {
 	api = API{
-		config:    &cfg,
-		ds:        datastore,
-		lastEvent: make(map[string]*models.Event),
+		config:        &cfg,
+		ds:            datastore,
+		lastEvent:     newLastEvents(),
+		cache:         query.NewCache(query.DefaultCacheSize),
+		broker:        stream.NewBroker(stream.DefaultHistory),
+		bucketChanges: new(atomic.Uint64),
+	}
+	dispatcher, err := webhooks.NewDispatcher(datastore, cfg.WebhookMaxAttempts, time.Duration(cfg.WebhookTimeout)*time.Second)
+	if err != nil {
+		log.Fatalf("Error loading webhooks: %v", err)
+	}
+	api.webhooks = dispatcher
+
+	authenticator := auth.NewAuthenticator(datastore)
+	if cfg.GoogleClientID != "" {
+		sessions := auth.NewSessions(datastore, time.Duration(cfg.SessionTTL)*time.Hour)
+		api.login = newWebLogin(&cfg, oauth.NewGoogle(cfg.GoogleClientID, cfg.GoogleClientSecret), sessions)
+		authenticator.Sessions = sessions
+		authenticator.TrustedOrigin = api.login.trusted
+	}
+	if cfg.TrashDays > 0 {
+		go api.emptyTrash(trashInterval)
+	}
+	metrics.RegisterStorage(datastore)
+	r.Use(metrics.Middleware)
+	if cfg.AuthEnabled || api.login != nil {
+		api.authenticator = authenticator
+		r.Use(authenticator.Middleware(api.requiredScope))
 	}
 	r.HandleFunc("/v1/info", getInfo).Methods("GET")
 	r.HandleFunc("/v1/export", export).Methods("GET")
 	r.HandleFunc("/v1/import", importer).Methods("POST")
+	r.HandleFunc("/v1/import/activitywatch", importActivityWatch).Methods("POST")
 
 	r.HandleFunc("/v1/buckets/", getBuckets).Methods("GET")
+	r.HandleFunc("/v1/trash", getTrash).Methods("GET")
 	r.HandleFunc("/v1/buckets/{bucket_id}", bucket).Methods("GET", "POST", "PUT", "DELETE")
-	r.HandleFunc("/v1/buckets/{bucket_id}/events", event).Methods("GET", "POST")
+	r.HandleFunc("/v1/buckets/{bucket_id}/restore", restoreBucket).Methods("POST")
+	r.HandleFunc("/v1/buckets/{bucket_id}/rename", renameBucket).Methods("POST")
+	r.HandleFunc("/v1/buckets/{bucket_id}/merge", mergeBucket).Methods("POST")
+	r.HandleFunc("/v1/buckets/{bucket_id}/split", splitBucket).Methods("POST")
+	r.HandleFunc("/v1/buckets/{bucket_id}/events", event).Methods("GET", "POST", "DELETE")
 	r.HandleFunc("/v1/buckets/{bucket_id}/events/count", getCount).Methods("GET")
-	r.HandleFunc("/v1/buckets/{bucket_id}/events/{event_id}", getEvent).Methods("GET", "DELETE")
+	r.HandleFunc("/v1/buckets/{bucket_id}/events/rewrite", rewriteEvents).Methods("POST")
+	r.HandleFunc("/v1/buckets/{bucket_id}/events/{event_id}", getEvent).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/v1/buckets/{bucket_id}/events/{event_id}/revisions", eventRevisions).Methods("GET")
 	r.HandleFunc("/v1/buckets/{bucket_id}/heartbeat", heartbeat).Methods("POST")
 	r.HandleFunc("/v1/buckets/{bucket_id}/export", exportB).Methods("GET")
+	r.HandleFunc("/v1/buckets/{bucket_id}/stream", streamBucket).Methods("GET")
+	r.HandleFunc("/v1/stream", streamAll).Methods("GET")
+
+	r.HandleFunc("/v1/query", queryHandler).Methods("POST")
+	r.HandleFunc("/v1/query/", queryHandler).Methods("POST")
+
+	r.HandleFunc("/v1/settings", getSettings).Methods("GET")
+	r.HandleFunc("/v1/settings/{key}", setting).Methods("GET", "POST", "DELETE")
+
+	r.HandleFunc("/v1/categories/test", testCategories).Methods("POST")
+
+	r.HandleFunc("/v1/webhooks", webhooksHandler).Methods("GET", "POST")
+	r.HandleFunc("/v1/webhooks/{webhook_id}", webhook).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/v1/webhooks/{webhook_id}/deadletters", deadLetters).Methods("GET", "DELETE")
+
+	r.HandleFunc("/v1/tokens", tokens).Methods("GET", "POST")
+	r.HandleFunc("/v1/tokens/{token_id}", deleteToken).Methods("DELETE")
+
+	r.HandleFunc("/v1/auth/login", login).Methods("GET")
+	r.HandleFunc("/v1/auth/callback", loginCallback).Methods("GET")
+	r.HandleFunc("/v1/auth/logout", logout).Methods("POST")
+	r.HandleFunc("/v1/auth/me", me).Methods("GET")
 }
 
 // GetInfo godoc
@@ -73,6 +145,7 @@ func getInfo(w http.ResponseWriter, r *http.Request) {
 // @Failure 500 {object} types.HTTPError "Internal server error occurred"
 // @Router /v1/buckets [get]
 func getBuckets(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
 	buckets, err := api.GetBuckets()
 	if err != nil {
 		errors.HttpError(w, err, http.StatusInternalServerError)
@@ -88,10 +161,13 @@ func getBuckets(w http.ResponseWriter, r *http.Request) {
 // @Accept json
 // @Produce json
 // @Param bucket_id path string true "Unique identifier for the bucket"
-// @Param force query string false "Force deletion flag (required for DELETE unless in testing mode)"
+// @Description Deleting a bucket also deletes its events. With TRASH_DAYS set, deleted buckets are
+// @Description moved to the trash instead, from which they can be restored until they are purged.
+// @Param force query string false "Set to 1 to confirm deleting, required for DELETE unless in testing mode"
+// @Param purge query string false "Set to 1 to delete at once, bypassing or emptying the trash (for DELETE)"
 // @Success 200 {object} models.Bucket "Operation completed successfully"
 // @Success 204 {string} string "No content (for successful updates)"
-// @Failure 400 {object} types.HTTPError "Invalid request parameters"
+// @Failure 400 {object} types.HTTPError "Invalid request parameters, or the bucket ID is taken by another user"
 // @Failure 404 {object} types.HTTPError "Bucket not found"
 // @Failure 500 {object} types.HTTPError "Internal server error occurred"
 // @Router /v1/buckets/{bucket_id} [get]
@@ -99,6 +175,7 @@ func getBuckets(w http.ResponseWriter, r *http.Request) {
 // @Router /v1/buckets/{bucket_id} [put]
 // @Router /v1/buckets/{bucket_id} [delete]
 func bucket(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
 	bucketID := mux.Vars(r)["bucket_id"]
 	switch r.Method {
 	case "GET":
@@ -128,7 +205,11 @@ func bucket(w http.ResponseWriter, r *http.Request) {
 		}
 		created, err := api.CreateBucket(bucketID, payload.Type, payload.Client, payload.Hostname, nil, nil)
 		if err != nil {
-			errors.HttpError(w, err, http.StatusInternalServerError)
+			if utils.IsBadRequest(err) {
+				errors.HttpError(w, err, http.StatusBadRequest)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
 			return
 		}
 		if created {
@@ -172,9 +253,13 @@ func bucket(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
-		err := api.DeleteBucket(bucketID)
+		err := api.DeleteBucket(bucketID, q.Get("purge") == "1")
 		if err != nil {
-			errors.HttpError(w, err, http.StatusInternalServerError)
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -184,6 +269,176 @@ func bucket(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// RestoreBucket godoc
+// @Summary Restore a deleted bucket
+// @Description Take a bucket out of the trash with its events.
+// @Tags buckets
+// @Param bucket_id path string true "Bucket ID"
+// @Success 200
+// @Failure 404 {object} types.HTTPError "Bucket not in the trash"
+// @Failure 500 {object} types.HTTPError
+// @Router /v1/buckets/{bucket_id}/restore [post]
+func restoreBucket(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	bucketID := mux.Vars(r)["bucket_id"]
+	if err := api.RestoreBucket(bucketID); err != nil {
+		if utils.IsNotFound(err) {
+			errors.HttpError(w, err, http.StatusNotFound)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// bucketOpError writes the error of a bucket operation.
+func bucketOpError(w http.ResponseWriter, err error) {
+	if utils.IsNotFound(err) {
+		errors.HttpError(w, err, http.StatusNotFound)
+	} else if utils.IsBadRequest(err) {
+		errors.HttpError(w, err, http.StatusBadRequest)
+	} else {
+		errors.HttpError(w, err, http.StatusInternalServerError)
+	}
+}
+
+// allowsTarget checks that the token of a request that moves events into
+// another bucket may change that bucket too, as the auth middleware only
+// checks the bucket of the path, and answers 403 if not.
+func allowsTarget(w http.ResponseWriter, r *http.Request, bucketID string) bool {
+	grant := auth.FromContext(r.Context())
+	if grant == nil || grant.Allows(auth.Admin, bucketID) {
+		return true
+	}
+	errors.HttpErrorString(w, fmt.Sprintf("%s does not grant %s access to bucket %s", grant.Name(), auth.Admin, bucketID), http.StatusForbidden)
+	return false
+}
+
+// RenameBucket godoc
+// @Summary Rename a bucket
+// @Description Change the ID of a bucket, for example after the hostname of a device changed.
+// @Description Its events keep their IDs.
+// @Tags buckets
+// @Accept json
+// @Param bucket_id path string true "Bucket ID"
+// @Param rename body types.BucketRenamePayload true "New bucket ID"
+// @Success 200
+// @Failure 400 {object} types.HTTPError "Invalid ID, or a bucket with the new ID exists"
+// @Failure 404 {object} types.HTTPError "Bucket not found"
+// @Failure 500 {object} types.HTTPError
+// @Router /v1/buckets/{bucket_id}/rename [post]
+func renameBucket(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	bucketID := mux.Vars(r)["bucket_id"]
+	var payload types.BucketRenamePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errors.HttpError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !allowsTarget(w, r, payload.ID) {
+		return
+	}
+	if err := api.RenameBucket(bucketID, payload); err != nil {
+		bucketOpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// MergeBucket godoc
+// @Summary Merge a bucket into another
+// @Description Move the events of a bucket into another bucket of the same type, keeping their IDs,
+// @Description and delete the emptied bucket. Events that overlap events of the other bucket are
+// @Description moved anyway with overlap=keep, dropped with skip, or replace the events they overlap with replace.
+// @Tags buckets
+// @Accept json
+// @Produce json
+// @Param bucket_id path string true "Bucket ID"
+// @Param merge body types.BucketMergePayload true "Bucket to merge into and overlap handling"
+// @Success 200 {object} database.MergeResult
+// @Failure 400 {object} types.HTTPError "Invalid overlap handling or buckets of different types"
+// @Failure 404 {object} types.HTTPError "Bucket not found"
+// @Failure 500 {object} types.HTTPError
+// @Router /v1/buckets/{bucket_id}/merge [post]
+func mergeBucket(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	bucketID := mux.Vars(r)["bucket_id"]
+	var payload types.BucketMergePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errors.HttpError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !allowsTarget(w, r, payload.Into) {
+		return
+	}
+	result, err := api.MergeBuckets(bucketID, payload)
+	if err != nil {
+		bucketOpError(w, err)
+		return
+	}
+	errors.JsonOK(w, result)
+}
+
+// SplitBucket godoc
+// @Summary Split a bucket
+// @Description Move the events of a bucket that begin at or after a time, and match the data filters,
+// @Description into a new bucket, keeping their IDs. The new bucket copies the old one, with another
+// @Description hostname if one is given. At least a time or filter is required.
+// @Tags buckets
+// @Accept json
+// @Produce json
+// @Param bucket_id path string true "Bucket ID"
+// @Param data.key query string false "Only events whose data key equals the value, data.key~ for a regular expression"
+// @Param min_duration query number false "Only events lasting at least this many seconds"
+// @Param split body types.BucketSplitPayload true "New bucket ID, hostname and cutoff time"
+// @Success 200 {object} BulkResponse
+// @Failure 400 {object} types.HTTPError "Invalid or missing cutoff or filter, or a bucket with the new ID exists"
+// @Failure 404 {object} types.HTTPError "Bucket not found"
+// @Failure 500 {object} types.HTTPError
+// @Router /v1/buckets/{bucket_id}/split [post]
+func splitBucket(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	bucketID := mux.Vars(r)["bucket_id"]
+	filter, err := eventFilter(r.URL.Query())
+	if err != nil {
+		errors.HttpError(w, err, http.StatusBadRequest)
+		return
+	}
+	var payload types.BucketSplitPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errors.HttpError(w, err, http.StatusBadRequest)
+		return
+	}
+	if !allowsTarget(w, r, payload.ID) {
+		return
+	}
+	result, err := api.SplitBucket(bucketID, payload, filter)
+	if err != nil {
+		bucketOpError(w, err)
+		return
+	}
+	errors.JsonOK(w, result)
+}
+
+// GetTrash godoc
+// @Summary List deleted buckets
+// @Description Returns the buckets in the trash, most recently deleted first, with the time they will be purged.
+// @Tags buckets
+// @Produce json
+// @Success 200 {array} TrashedBucket
+// @Failure 500 {object} types.HTTPError
+// @Router /v1/trash [get]
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	trash, err := api.GetTrash()
+	if err != nil {
+		errors.HttpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	errors.JsonOK(w, trash)
+}
+
 // Event operations godoc
 // @Summary Manage events within a bucket
 // @Description Endpoint for creating and retrieving events associated with a specific bucket.
@@ -192,9 +447,17 @@ func bucket(w http.ResponseWriter, r *http.Request) {
 // @Accept json
 // @Produce json
 // @Param bucket_id path string true "ID of the bucket containing the events"
+// @Description Pass page_size or cursor to page through the events newest first. The cursor
+// @Description of the next page is returned in the X-Next-Cursor header, which is missing on the last page.
 // @Param limit query integer false "Maximum number of events to return (for GET)"
-// @Param start query string false "Start time in ISO8601 format (for GET)"
+// @Param start query string false "Start time in ISO8601 format, events running into it are included (for GET)"
 // @Param end query string false "End time in ISO8601 format (for GET)"
+// @Param clip query boolean false "Trim events to the time between start and end (for GET)"
+// @Param page_size query integer false "Number of events per page, up to 10000 (for GET)"
+// @Param cursor query string false "Cursor of the page to return, from X-Next-Cursor (for GET)"
+// @Param fields query string false "Comma separated data keys to return, others are left out (for GET)"
+// @Param data.key query string false "Only events whose data key equals the value, data.key~ for a regular expression (for GET)"
+// @Param min_duration query number false "Only events lasting at least this many seconds (for GET)"
 // @Param event body object false "Event object or array of event objects (for POST)"
 // @Success 200 {array} models.Event "Events retrieved/created successfully"
 // @Success 201 {object} models.Event "Event created successfully"
@@ -203,7 +466,25 @@ func bucket(w http.ResponseWriter, r *http.Request) {
 // @Failure 500 {object} types.HTTPError "Internal server error occurred"
 // @Router /v1/buckets/{bucket_id}/events [get]
 // @Router /v1/buckets/{bucket_id}/events [post]
+// DeleteEvents godoc
+// @Summary Delete matching events
+// @Description Delete the events that overlap the time between start and end and match the data filters.
+// @Description At least a start, end or filter is required. Pass dry_run=true to only count the events.
+// @Tags events
+// @Produce json
+// @Param bucket_id path string true "Bucket ID"
+// @Param start query string false "Start time in ISO8601 format"
+// @Param end query string false "End time in ISO8601 format"
+// @Param data.key query string false "Only events whose data key equals the value, data.key~ for a regular expression"
+// @Param min_duration query number false "Only events lasting at least this many seconds"
+// @Param dry_run query boolean false "Count the events without deleting them"
+// @Success 200 {object} BulkResponse
+// @Failure 400 {object} types.HTTPError "Invalid or missing filter"
+// @Failure 404 {object} types.HTTPError "Bucket not found"
+// @Failure 500 {object} types.HTTPError
+// @Router /v1/buckets/{bucket_id}/events [delete]
 func event(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
 	bucketID := mux.Vars(r)["bucket_id"]
 	switch r.Method {
 	case "GET":
@@ -231,11 +512,72 @@ func event(w http.ResponseWriter, r *http.Request) {
 				endTime = &t
 			}
 		}
-		events, err := api.GetEvents(bucketID, limit, startTime, endTime)
+		filter, err := eventFilter(q)
 		if err != nil {
-			errors.HttpError(w, err, http.StatusInternalServerError)
+			errors.HttpError(w, err, http.StatusBadRequest)
+			return
+		}
+		clip := false
+		if clipStr := q.Get("clip"); clipStr != "" {
+			if clip, err = strconv.ParseBool(clipStr); err != nil {
+				errors.HttpErrorString(w, "Invalid clip param", http.StatusBadRequest)
+				return
+			}
+		}
+		var fields []string
+		if fieldsStr := q.Get("fields"); fieldsStr != "" {
+			fields = strings.Split(fieldsStr, ",")
+		}
+
+		if q.Has("page_size") || q.Has("cursor") {
+			if limitStr != "" {
+				errors.HttpErrorString(w, "limit cannot be combined with page_size or cursor", http.StatusBadRequest)
+				return
+			}
+			pageSize := defaultPageSize
+			if sizeStr := q.Get("page_size"); sizeStr != "" {
+				val, err := strconv.Atoi(sizeStr)
+				if err != nil {
+					errors.HttpErrorString(w, "Invalid page_size param", http.StatusBadRequest)
+					return
+				}
+				pageSize = val
+			}
+			events, next, err := api.GetEventsPage(bucketID, q.Get("cursor"), pageSize, startTime, endTime, filter, clip, fields)
+			if err != nil {
+				if utils.IsNotFound(err) {
+					errors.HttpError(w, err, http.StatusNotFound)
+				} else if utils.IsBadRequest(err) {
+					errors.HttpError(w, err, http.StatusBadRequest)
+				} else {
+					errors.HttpError(w, err, http.StatusInternalServerError)
+				}
+				return
+			}
+			if next != "" {
+				w.Header().Set(nextCursorHeader, next)
+				nextURL := *r.URL
+				params := nextURL.Query()
+				params.Set("cursor", next)
+				nextURL.RawQuery = params.Encode()
+				w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextURL.RequestURI()))
+			}
+			errors.JsonOK(w, events)
+			return
+		}
+
+		events, err := api.GetEvents(bucketID, limit, startTime, endTime, filter, clip)
+		if err != nil {
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
 			return
 		}
+		for i, e := range events {
+			events[i] = projectFields(e, fields)
+		}
 		errors.JsonOK(w, events)
 
 	case "POST":
@@ -277,7 +619,11 @@ func event(w http.ResponseWriter, r *http.Request) {
 
 		inserted, err := api.CreateEvents(bucketID, evts)
 		if err != nil {
-			errors.HttpError(w, err, http.StatusInternalServerError)
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
 			return
 		}
 		if inserted != nil {
@@ -286,11 +632,95 @@ func event(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK) // no single event returned
 		}
 
+	case "DELETE":
+		q := r.URL.Query()
+		start, end, filter, dryRun, err := bulkParams(q)
+		if err != nil {
+			errors.HttpError(w, err, http.StatusBadRequest)
+			return
+		}
+		res, err := api.DeleteEvents(bucketID, start, end, filter, dryRun)
+		if err != nil {
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else if utils.IsBadRequest(err) {
+				errors.HttpError(w, err, http.StatusBadRequest)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		errors.JsonOK(w, res)
+
 	default:
 		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// bulkParams reads the time range, filter and dry_run flag of a bulk
+// operation.
+func bulkParams(q url.Values) (start, end *time.Time, filter *database.EventFilter, dryRun bool, err error) {
+	if start, end, err = bulkRange(q); err != nil {
+		return nil, nil, nil, false, err
+	}
+	if filter, err = eventFilter(q); err != nil {
+		return nil, nil, nil, false, err
+	}
+	if s := q.Get("dry_run"); s != "" {
+		if dryRun, err = strconv.ParseBool(s); err != nil {
+			return nil, nil, nil, false, &types.BadRequest{Code: "InvalidDryRun", Message: "Invalid dry_run param"}
+		}
+	}
+	return start, end, filter, dryRun, nil
+}
+
+// RewriteEvents godoc
+// @Summary Rewrite a data key of matching events
+// @Description Set a data key to the same value on the events that overlap the time between start
+// @Description and end and match the data filters, for example to redact titles of a sensitive site.
+// @Description At least a start, end or filter is required. Pass dry_run=true to only count the events.
+// @Tags events
+// @Accept json
+// @Produce json
+// @Param bucket_id path string true "Bucket ID"
+// @Param start query string false "Start time in ISO8601 format"
+// @Param end query string false "End time in ISO8601 format"
+// @Param data.key query string false "Only events whose data key equals the value, data.key~ for a regular expression"
+// @Param min_duration query number false "Only events lasting at least this many seconds"
+// @Param dry_run query boolean false "Count the events without changing them"
+// @Param rewrite body types.EventRewritePayload true "Key to set and its new value"
+// @Success 200 {object} BulkResponse
+// @Failure 400 {object} types.HTTPError "Invalid or missing filter or key"
+// @Failure 404 {object} types.HTTPError "Bucket not found"
+// @Failure 500 {object} types.HTTPError
+// @Router /v1/buckets/{bucket_id}/events/rewrite [post]
+func rewriteEvents(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	bucketID := mux.Vars(r)["bucket_id"]
+	start, end, filter, dryRun, err := bulkParams(r.URL.Query())
+	if err != nil {
+		errors.HttpError(w, err, http.StatusBadRequest)
+		return
+	}
+	var payload types.EventRewritePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errors.HttpError(w, err, http.StatusBadRequest)
+		return
+	}
+	res, err := api.RewriteEvents(bucketID, start, end, filter, payload, dryRun)
+	if err != nil {
+		if utils.IsNotFound(err) {
+			errors.HttpError(w, err, http.StatusNotFound)
+		} else if utils.IsBadRequest(err) {
+			errors.HttpError(w, err, http.StatusBadRequest)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	errors.JsonOK(w, res)
+}
+
 // GetEventCount godoc
 // @Summary Get event count for a bucket
 // @Description Retrieve the count of events for a specific bucket within an optional time range.
@@ -299,10 +729,14 @@ func event(w http.ResponseWriter, r *http.Request) {
 // @Param bucket_id path string true "Bucket ID"
 // @Param start query string false "Start time in ISO8601 format"
 // @Param end query string false "End time in ISO8601 format"
+// @Param data.key query string false "Only events whose data key equals the value, data.key~ for a regular expression"
+// @Param min_duration query number false "Only events lasting at least this many seconds"
 // @Success 200 {integer} integer
+// @Failure 400 {object} types.HTTPError "Invalid filter"
 // @Failure 500 {object} types.HTTPError
 // @Router /v1/buckets/{bucket_id}/events/count [get]
 func getCount(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
 	bucketID := mux.Vars(r)["bucket_id"]
 	q := r.URL.Query()
 	startStr := q.Get("start")
@@ -321,9 +755,18 @@ func getCount(w http.ResponseWriter, r *http.Request) {
 			endTime = &t
 		}
 	}
-	count, err := api.GetEventCount(bucketID, startTime, endTime)
+	filter, err := eventFilter(q)
 	if err != nil {
-		errors.HttpError(w, err, http.StatusInternalServerError)
+		errors.HttpError(w, err, http.StatusBadRequest)
+		return
+	}
+	count, err := api.GetEventCount(bucketID, startTime, endTime, filter)
+	if err != nil {
+		if utils.IsNotFound(err) {
+			errors.HttpError(w, err, http.StatusNotFound)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
 		return
 	}
 	errors.JsonOK(w, count)
@@ -350,7 +793,24 @@ func getCount(w http.ResponseWriter, r *http.Request) {
 // @Success 200 {object} map[string]bool
 // @Failure 500 {object} types.HTTPError
 // @Router /v1/buckets/{bucket_id}/events/{event_id} [delete]
+// UpdateEvent godoc
+// @Summary Edit a single event
+// @Description Change the timestamp, duration or data of an event in place, keeping its ID.
+// @Description Fields left out keep their value, data replaces the whole event data.
+// @Description The change is recorded as a revision of the event.
+// @Tags events
+// @Accept json
+// @Produce json
+// @Param bucket_id path string true "Bucket ID"
+// @Param event_id path integer true "Event ID"
+// @Param event body types.EventUpdatePayload true "Fields to change"
+// @Success 200 {object} models.Event
+// @Failure 400 {object} types.HTTPError "Invalid event"
+// @Failure 404 {object} types.HTTPError "Bucket or event not found"
+// @Failure 500 {object} types.HTTPError
+// @Router /v1/buckets/{bucket_id}/events/{event_id} [put]
 func getEvent(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
 	bucketID := mux.Vars(r)["bucket_id"]
 	eventIDStr := mux.Vars(r)["event_id"]
 	eventID, err := strconv.Atoi(eventIDStr)
@@ -363,7 +823,11 @@ func getEvent(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		evt, err := api.GetEvent(bucketID, eventID)
 		if err != nil {
-			errors.HttpError(w, err, http.StatusInternalServerError)
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
 			return
 		}
 		if evt == nil {
@@ -372,10 +836,37 @@ func getEvent(w http.ResponseWriter, r *http.Request) {
 		}
 		errors.JsonOK(w, evt)
 
+	case "PUT":
+		var payload types.EventUpdatePayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			errors.HttpError(w, err, http.StatusBadRequest)
+			return
+		}
+		changedBy := ""
+		if grant := auth.FromContext(r.Context()); grant != nil {
+			changedBy = grant.Name()
+		}
+		evt, err := api.UpdateEvent(bucketID, eventID, payload, changedBy)
+		if err != nil {
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else if utils.IsBadRequest(err) {
+				errors.HttpError(w, err, http.StatusBadRequest)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		errors.JsonOK(w, evt)
+
 	case "DELETE":
 		success, err := api.DeleteEvent(bucketID, eventID)
 		if err != nil {
-			errors.HttpError(w, err, http.StatusInternalServerError)
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
 			return
 		}
 		errors.JsonOK(w, map[string]bool{"success": success})
@@ -385,23 +876,55 @@ func getEvent(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Heartbeat godoc
-// @Summary Send bucket heartbeat
-// @Description Updates or creates an event in the specified bucket to indicate active status.
-// @Description If an existing event is found within the pulsetime window, it will be updated
-// @Description instead of creating a new event.
+// GetEventRevisions godoc
+// @Summary List the edits of an event
+// @Description Returns the recorded edits of an event, oldest first, with the event before and after each.
 // @Tags events
-// @Accept json
 // @Produce json
-// @Param bucket_id path string true "ID of the bucket to send heartbeat to"
-// @Param pulsetime query number true "Time window in seconds to merge events"
-// @Param event body object true "Event data to record"
-// @Success 200 {object} models.Event "Heartbeat recorded successfully"
+// @Param bucket_id path string true "Bucket ID"
+// @Param event_id path integer true "Event ID"
+// @Success 200 {array} models.EventRevision
+// @Failure 404 {object} types.HTTPError "Bucket or event not found"
+// @Failure 500 {object} types.HTTPError
+// @Router /v1/buckets/{bucket_id}/events/{event_id}/revisions [get]
+func eventRevisions(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	bucketID := mux.Vars(r)["bucket_id"]
+	eventID, err := strconv.Atoi(mux.Vars(r)["event_id"])
+	if err != nil {
+		errors.HttpErrorString(w, "invalid event ID", http.StatusBadRequest)
+		return
+	}
+	revisions, err := api.GetEventRevisions(bucketID, eventID)
+	if err != nil {
+		if utils.IsNotFound(err) {
+			errors.HttpError(w, err, http.StatusNotFound)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	errors.JsonOK(w, revisions)
+}
+
+// Heartbeat godoc
+// @Summary Send bucket heartbeat
+// @Description Updates or creates an event in the specified bucket to indicate active status.
+// @Description If an existing event is found within the pulsetime window, it will be updated
+// @Description instead of creating a new event.
+// @Tags events
+// @Accept json
+// @Produce json
+// @Param bucket_id path string true "ID of the bucket to send heartbeat to"
+// @Param pulsetime query number true "Time window in seconds to merge events"
+// @Param event body object true "Event data to record"
+// @Success 200 {object} models.Event "Heartbeat recorded successfully"
 // @Failure 400 {object} types.HTTPError "Missing or invalid parameters"
 // @Failure 409 {object} types.HTTPError "Concurrent heartbeat operation in progress"
 // @Failure 500 {object} types.HTTPError "Internal server error occurred"
 // @Router /v1/buckets/{bucket_id}/heartbeat [post]
 func heartbeat(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
 	if r.Method != "POST" {
 		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
@@ -441,36 +964,58 @@ func heartbeat(w http.ResponseWriter, r *http.Request) {
 		defer heartbeatLock.Unlock()
 		e, err := api.Heartbeat(bucketID, evt, pulsetime)
 		if err != nil {
-			errors.HttpError(w, err, http.StatusInternalServerError)
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
 			return
 		}
 		errors.JsonOK(w, e.ToJSONDict())
 	case <-time.After(1 * time.Second):
 		// Could not acquire lock in 1s
+		metrics.HeartbeatLockTimeouts.Inc()
 		errors.HttpErrorString(w, "Could not acquire heartbeat lock in reasonable time", http.StatusConflict)
 	}
 }
 
 // Export/Import operations godoc
 // @Summary Export all bucket data
-// @Description Exports all buckets and their associated events as a JSON file attachment.
-// @Description The exported data can be used for backup or migration purposes.
+// @Description Exports all buckets and their associated events as a file attachment.
+// @Description The default JSON format can be used for backup or migration purposes. The ndjson, csv
+// @Description and ics formats are streamed for use in other tools: ndjson writes an event per line,
+// @Description csv a row per event with a data.<key> column per data key and ics a calendar entry per event.
 // @Tags export-import
 // @Produce json
+// @Produce application/x-ndjson
+// @Produce text/csv
+// @Produce text/calendar
 // @Produce application/octet-stream
-// @Success 200 {file} binary "JSON file containing all bucket data"
+// @Param format query string false "json (default), ndjson, csv or ics"
+// @Param start query string false "Only events overlapping the time after start, in ISO8601 format"
+// @Param end query string false "Only events overlapping the time before end, in ISO8601 format"
+// @Param clip query boolean false "Trim events to the time between start and end"
+// @Param bucket_pattern query string false "Only buckets whose ID matches the pattern, such as tg-observer-window_*"
+// @Param data.key query string false "Only events whose data key equals the value, data.key~ for a regular expression"
+// @Success 200 {file} binary "File containing all bucket data"
+// @Failure 400 {object} types.HTTPError "Invalid format, time, pattern or filter"
 // @Failure 500 {object} types.HTTPError "Internal server error occurred"
 // @Router /v1/export [get]
 func export(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
 	switch r.Method {
 	case "GET":
-		bucketsExport, err := api.ExportAll()
+		format, opts, err := exportParams(r.URL.Query())
+		if err != nil {
+			errors.HttpError(w, err, http.StatusBadRequest)
+			return
+		}
+		bucketIDs, err := api.ExportBucketIDs(opts)
 		if err != nil {
 			errors.HttpError(w, err, http.StatusInternalServerError)
 			return
 		}
-		payload := map[string]interface{}{"buckets": bucketsExport}
-		utils.WriteAttachmentJSON(w, payload, "tg-buckets-export.json")
+		writeExport(w, api, format, bucketIDs, opts, "tg-buckets-export."+format)
 	default:
 		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
@@ -478,94 +1023,743 @@ func export(w http.ResponseWriter, r *http.Request) {
 
 // ExportBucket godoc
 // @Summary Export a bucket
-// @Description Export a specific bucket and its data as a JSON attachment.
+// @Description Export a specific bucket and its data as an attachment, in the formats of /v1/export.
 // @Tags export-import
 // @Produce json
+// @Produce application/x-ndjson
+// @Produce text/csv
+// @Produce text/calendar
 // @Param bucket_id path string true "Bucket ID"
+// @Param format query string false "json (default), ndjson, csv or ics"
+// @Param start query string false "Only events overlapping the time after start, in ISO8601 format"
+// @Param end query string false "Only events overlapping the time before end, in ISO8601 format"
+// @Param clip query boolean false "Trim events to the time between start and end"
+// @Param data.key query string false "Only events whose data key equals the value, data.key~ for a regular expression"
 // @Success 200 {file} json "attachment"
+// @Failure 400 {object} types.HTTPError "Invalid format, time or filter"
+// @Failure 404 {object} types.HTTPError "Bucket not found"
 // @Failure 500 {object} types.HTTPError
 // @Router /v1/buckets/{bucket_id}/export [get]
 func exportB(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
 	if r.Method != "GET" {
 		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	bucketID := mux.Vars(r)["bucket_id"]
-	bucketExport, err := api.ExportBucket(bucketID)
+	format, opts, err := exportParams(r.URL.Query())
 	if err != nil {
-		errors.HttpError(w, err, http.StatusInternalServerError)
+		errors.HttpError(w, err, http.StatusBadRequest)
 		return
 	}
-	idVal, ok := bucketExport["id"].(string)
-	if !ok {
-		// Handle the case where bucketExport["id"] isn't a string:
-		// e.g., log an error, return an HTTP error, etc.
-		errors.HttpErrorString(w, "Invalid bucket ID", http.StatusInternalServerError)
+	if err := api.checkBucketExists(bucketID); err != nil {
+		bucketOpError(w, err)
 		return
 	}
+	writeExport(w, api, format, []string{bucketID}, opts, fmt.Sprintf("tg-bucket-export_%v.%s", bucketID, format))
+}
+
+// exportParams reads the format and options of an export. As for bulk
+// operations, invalid times are an error rather than ignored.
+func exportParams(q url.Values) (string, ExportOptions, error) {
+	var opts ExportOptions
+	format := q.Get("format")
+	if format == "" {
+		format = ExportJSON
+	}
+	var err error
+	if opts.Start, opts.End, err = bulkRange(q); err != nil {
+		return "", opts, err
+	}
+	if opts.Filter, err = eventFilter(q); err != nil {
+		return "", opts, err
+	}
+	if s := q.Get("clip"); s != "" {
+		if opts.Clip, err = strconv.ParseBool(s); err != nil {
+			return "", opts, &types.BadRequest{Code: "InvalidClip", Message: "Invalid clip param"}
+		}
+	}
+	opts.BucketPattern = q.Get("bucket_pattern")
+	return format, opts, CheckExportOptions(format, opts)
+}
 
-	payload := map[string]interface{}{
-		"buckets": map[string]interface{}{
-			idVal: bucketExport,
-		},
+// writeExport streams an export as an attachment. Once it started the status
+// can no longer change, so errors are only logged.
+func writeExport(w http.ResponseWriter, api *API, format string, bucketIDs []string, opts ExportOptions, filename string) {
+	w.Header().Set("Content-Type", ExportContentTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	if err := api.WriteExport(w, format, bucketIDs, opts); err != nil {
+		log.Printf("Error exporting %s: %v\n", format, err)
 	}
-	filename := fmt.Sprintf("tg-bucket-export_%v.json", idVal)
-	utils.WriteAttachmentJSON(w, payload, filename)
 }
 
 // ImportAll godoc
 // @Summary Import all buckets
-// @Description Import buckets and their data from a JSON payload, either as request body or multipart form.
+// @Description Import buckets and their data from a JSON export, either as request body or multipart form.
+// @Description The export is read as a stream, so files of any size can be imported. Each bucket is
+// @Description imported completely or not at all: a bucket with a malformed event is left out and the
+// @Description error reported with it, while the other buckets are imported.
+// @Description Buckets that exist are skipped, merged or replaced as on_conflict says. Merging only
+// @Description adds the events the bucket does not have with the same timestamp, duration and data,
+// @Description so an import can safely be repeated.
 // @Tags export-import
 // @Accept json
 // @Accept multipart/form-data
+// @Produce json
+// @Param on_conflict query string false "skip, merge (default) or replace existing buckets"
 // @Param body body types.ImportPayload true "Import payload"
-// @Success 200 {string} Success
-// @Failure 400 {object} types.HTTPError
-// @Failure 500 {object} types.HTTPError
+// @Success 200 {object} ImportResult "Events imported, skipped and replaced in total and per bucket"
+// @Failure 400 {object} ImportResult "Malformed JSON, or buckets that could not be imported"
+// @Failure 500 {object} ImportResult "Buckets could not be stored"
 // @Router /v1/import [post]
 func importer(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	importFiles(w, r, api.ImportStream)
+}
+
+// ImportActivityWatch godoc
+// @Summary Import ActivityWatch data
+// @Description Import buckets from an aw-server JSON export or an aw-server SQLite database file,
+// @Description either as request body or multipart form. Buckets and clients of aw-watcher-* are
+// @Description renamed to the matching tg-observer-*, so aw-watcher-window_laptop is imported as
+// @Description tg-observer-window_laptop. Buckets are imported as by /v1/import.
+// @Tags export-import
+// @Accept json
+// @Accept application/octet-stream
+// @Accept multipart/form-data
+// @Produce json
+// @Param on_conflict query string false "skip, merge (default) or replace existing buckets"
+// @Success 200 {object} ImportResult "Events imported, skipped and replaced in total and per bucket"
+// @Failure 400 {object} ImportResult "Not an ActivityWatch export or database, or buckets that could not be imported"
+// @Failure 500 {object} ImportResult "Buckets could not be stored"
+// @Router /v1/import/activitywatch [post]
+func importActivityWatch(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	importFiles(w, r, api.ImportActivityWatch)
+}
+
+// importFiles imports the files uploaded with a request with importFile and
+// writes the result.
+func importFiles(w http.ResponseWriter, r *http.Request, importFile func(io.Reader, string) (*ImportResult, error)) {
 	if r.Method != "POST" {
 		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	// If import comes from a form in the web-ui:
-	if err := r.ParseMultipartForm(32 << 20); err == nil && len(r.MultipartForm.File) > 0 {
-		for _, files := range r.MultipartForm.File {
-			for _, f := range files {
-				file, err := f.Open()
-				if err != nil {
-					errors.HttpError(w, err, http.StatusBadRequest)
-					return
-				}
-				defer file.Close()
-
-				var data struct {
-					Buckets map[string]interface{} `json:"buckets"`
-				}
-				if decodeErr := json.NewDecoder(file).Decode(&data); decodeErr != nil {
-					errors.HttpError(w, decodeErr, http.StatusBadRequest)
-					return
-				}
-				if err := api.ImportAll(data.Buckets); err != nil {
-					errors.HttpError(w, err, http.StatusInternalServerError)
-					return
-				}
+	onConflict := r.URL.Query().Get("on_conflict")
+	if onConflict == "" {
+		onConflict = database.ConflictMerge
+	}
+	if err := database.CheckConflict(onConflict); err != nil {
+		errors.HttpError(w, err, http.StatusBadRequest)
+		return
+	}
+	result := &ImportResult{Buckets: []ImportedBucket{}}
+	var err error
+	// If import comes from a form in the web-ui, read the files as they arrive
+	if mr, mErr := r.MultipartReader(); mErr == nil {
+		for {
+			part, pErr := mr.NextPart()
+			if pErr == io.EOF {
+				break
+			}
+			if pErr != nil {
+				errors.HttpError(w, pErr, http.StatusBadRequest)
+				return
+			}
+			if part.FileName() == "" {
+				continue
+			}
+			var res *ImportResult
+			res, err = importFile(part, onConflict)
+			for _, b := range res.Buckets {
+				result.add(b)
+			}
+			if err != nil {
+				break
 			}
 		}
 	} else {
 		// Normal import from body
-		var data struct {
-			Buckets map[string]interface{} `json:"buckets"`
+		result, err = importFile(r.Body, onConflict)
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		result.Error = err.Error()
+		status = http.StatusBadRequest
+		if !utils.IsBadRequest(err) {
+			status = http.StatusInternalServerError
+		}
+	}
+	for _, b := range result.Buckets {
+		if b.Error != "" && result.Error == "" {
+			result.Error = fmt.Sprintf("bucket %s could not be imported: %s", b.ID, b.Error)
+			status = http.StatusBadRequest
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// Query godoc
+// @Summary Run a query
+// @Description Evaluates a query script once for each of the given time periods and returns
+// @Description one result per period. Periods are given as "<start>/<end>" in RFC3339 format
+// @Description and the script must assign its result to RETURN.
+// @Tags query
+// @Accept json
+// @Produce json
+// @Param name query string false "Name of the query (required when caching)"
+// @Param cache query string false "Set to 1 to reuse results for time periods that have already ended"
+// @Param body body types.QueryPayload true "Query script and time periods"
+// @Success 200 {array} object "One result per time period"
+// @Failure 400 {object} types.HTTPError "Invalid query or time period"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/query [post]
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	if r.Method != "POST" {
+		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var payload types.QueryPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errors.HttpError(w, err, http.StatusBadRequest)
+		return
+	}
+	if len(payload.Timeperiods) == 0 {
+		errors.HttpErrorString(w, "Missing timeperiods", http.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	cache := r.URL.Query().Get("cache") == "1"
+	results, err := api.Query(name, payload.Query, payload.Timeperiods, cache)
+	if err != nil {
+		if IsQueryError(err) || utils.IsBadRequest(err) {
+			errors.HttpError(w, err, http.StatusBadRequest)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	errors.JsonOK(w, results)
+}
+
+// GetSettings godoc
+// @Summary List all settings
+// @Description Returns all stored settings as an object mapping each key to its JSON value.
+// @Tags settings
+// @Produce json
+// @Success 200 {object} map[string]interface{} "Settings retrieved successfully"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/settings [get]
+func getSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := api.GetSettings()
+	if err != nil {
+		errors.HttpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	errors.JsonOK(w, settings)
+}
+
+// Setting operations godoc
+// @Summary Manage a single setting
+// @Description Get, set or delete the setting stored under key. The request body of a POST
+// @Description is the new JSON value. Known keys such as "classes" are validated before saving.
+// @Tags settings
+// @Accept json
+// @Produce json
+// @Param key path string true "Setting key"
+// @Param value body object false "New value of the setting (for POST)"
+// @Success 200 {object} object "Setting value, or empty response for POST/DELETE"
+// @Failure 400 {object} types.HTTPError "Invalid setting value"
+// @Failure 404 {object} types.HTTPError "Setting not found"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/settings/{key} [get]
+// @Router /v1/settings/{key} [post]
+// @Router /v1/settings/{key} [delete]
+func setting(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	switch r.Method {
+	case "GET":
+		value, err := api.GetSetting(key)
+		if err != nil {
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		errors.JsonOK(w, value)
+
+	case "POST":
+		var value json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+			errors.HttpError(w, err, http.StatusBadRequest)
+			return
+		}
+		if err := api.SetSetting(key, value); err != nil {
+			if utils.IsBadRequest(err) {
+				errors.HttpError(w, err, http.StatusBadRequest)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case "DELETE":
+		if err := api.DeleteSetting(key); err != nil {
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TestCategories godoc
+// @Summary Test category rules against a sample
+// @Description Categorizes a sample {app, title, url} event and explains the result: the category,
+// @Description the rule that selected it, the field and text it matched, and all other rules that matched.
+// @Description Uses the stored "classes" setting unless classes are included in the request.
+// @Tags categories
+// @Accept json
+// @Produce json
+// @Param sample body types.CategoryTestPayload true "Sample event and optional classes"
+// @Success 200 {object} categories.Result "Categorization result"
+// @Failure 400 {object} types.HTTPError "Invalid sample or classes"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/categories/test [post]
+func testCategories(w http.ResponseWriter, r *http.Request) {
+	var payload types.CategoryTestPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		errors.HttpError(w, err, http.StatusBadRequest)
+		return
+	}
+	sample := map[string]interface{}{}
+	for key, value := range map[string]string{"app": payload.App, "title": payload.Title, "url": payload.URL} {
+		if value != "" {
+			sample[key] = value
+		}
+	}
+	result, err := api.TestCategories(sample, payload.Classes)
+	if err != nil {
+		if utils.IsBadRequest(err) {
+			errors.HttpError(w, err, http.StatusBadRequest)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	errors.JsonOK(w, result)
+}
+
+// StreamAll godoc
+// @Summary Stream event changes of all buckets
+// @Description Pushes inserted, merged and deleted events of every bucket as Server-Sent Events.
+// @Description Each message has an id to resume from: reconnect with the Last-Event-ID header
+// @Description (or the last_event_id query parameter) to receive the messages missed in between.
+// @Description A "reset" event is sent first if some of them can no longer be delivered.
+// @Tags stream
+// @Produce text/event-stream
+// @Param last_event_id query string false "Resume after this message id"
+// @Success 200 {object} stream.Message "Stream of event changes"
+// @Router /v1/stream [get]
+func streamAll(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	api.broker.ServeSSE(w, r, "", api.bucketFilter())
+}
+
+// StreamBucket godoc
+// @Summary Stream event changes of a bucket
+// @Description Pushes inserted, merged and deleted events of the bucket as Server-Sent Events.
+// @Description Resuming works as for /v1/stream.
+// @Tags stream
+// @Produce text/event-stream
+// @Param bucket_id path string true "Bucket ID"
+// @Param last_event_id query string false "Resume after this message id"
+// @Success 200 {object} stream.Message "Stream of event changes"
+// @Failure 404 {object} types.HTTPError "Bucket not found"
+// @Router /v1/buckets/{bucket_id}/stream [get]
+func streamBucket(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	bucketID := mux.Vars(r)["bucket_id"]
+	if err := api.checkBucketExists(bucketID); err != nil {
+		errors.HttpError(w, err, http.StatusNotFound)
+		return
+	}
+	api.broker.ServeSSE(w, r, bucketID, nil)
+}
+
+// Webhooks godoc
+// @Summary List or create webhooks
+// @Description GET lists all webhooks. POST registers a webhook that receives signed JSON POSTs for
+// @Description event changes, filtered by bucket ID glob pattern, bucket types and kinds (created,
+// @Description heartbeat-merged, deleted, bucket-deleted). Empty filters match everything. The secret
+// @Description used for the X-TimelyGator-Signature header is generated unless given, and only
+// @Description returned when the webhook is created.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param webhook body types.WebhookPayload false "Webhook to create (for POST)"
+// @Success 200 {array} models.Webhook "Webhooks, or the created webhook with its secret for POST"
+// @Failure 400 {object} types.HTTPError "Invalid webhook"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/webhooks [get]
+// @Router /v1/webhooks [post]
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		hooks, err := api.GetWebhooks()
+		if err != nil {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		errors.JsonOK(w, hooks)
+
+	case "POST":
+		var payload types.WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			errors.HttpError(w, err, http.StatusBadRequest)
+			return
+		}
+		hook, err := api.CreateWebhook(payload)
+		if err != nil {
+			if utils.IsBadRequest(err) {
+				errors.HttpError(w, err, http.StatusBadRequest)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		errors.JsonOK(w, hook)
+
+	default:
+		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Webhook operations godoc
+// @Summary Manage a single webhook
+// @Description Get, update or delete a webhook. An update only changes the fields present in the body.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param webhook_id path int true "Webhook ID"
+// @Param webhook body types.WebhookPayload false "Fields to change (for PUT)"
+// @Success 200 {object} models.Webhook "Webhook, or empty response for DELETE"
+// @Failure 400 {object} types.HTTPError "Invalid webhook"
+// @Failure 404 {object} types.HTTPError "Webhook not found"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/webhooks/{webhook_id} [get]
+// @Router /v1/webhooks/{webhook_id} [put]
+// @Router /v1/webhooks/{webhook_id} [delete]
+func webhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["webhook_id"], 10, 0)
+	if err != nil {
+		errors.HttpErrorString(w, "invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		hook, err := api.GetWebhook(uint(id))
+		if err != nil {
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
 		}
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		errors.JsonOK(w, hook)
+
+	case "PUT":
+		var payload types.WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 			errors.HttpError(w, err, http.StatusBadRequest)
 			return
 		}
-		if err := api.ImportAll(data.Buckets); err != nil {
+		hook, err := api.UpdateWebhook(uint(id), payload)
+		if err != nil {
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else if utils.IsBadRequest(err) {
+				errors.HttpError(w, err, http.StatusBadRequest)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		errors.JsonOK(w, hook)
+
+	case "DELETE":
+		if err := api.DeleteWebhook(uint(id)); err != nil {
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DeadLetters godoc
+// @Summary List or clear failed webhook deliveries
+// @Description GET returns the deliveries that failed after all retries, newest first, with the
+// @Description payload that was sent and the last error. DELETE clears them.
+// @Tags webhooks
+// @Produce json
+// @Param webhook_id path int true "Webhook ID"
+// @Success 200 {array} models.WebhookDelivery "Failed deliveries, or empty response for DELETE"
+// @Failure 404 {object} types.HTTPError "Webhook not found"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/webhooks/{webhook_id}/deadletters [get]
+// @Router /v1/webhooks/{webhook_id}/deadletters [delete]
+func deadLetters(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["webhook_id"], 10, 0)
+	if err != nil {
+		errors.HttpErrorString(w, "invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		deliveries, err := api.GetDeadLetters(uint(id))
+		if err != nil {
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		errors.JsonOK(w, deliveries)
+
+	case "DELETE":
+		if err := api.ClearDeadLetters(uint(id)); err != nil {
+			if utils.IsNotFound(err) {
+				errors.HttpError(w, err, http.StatusNotFound)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Tokens godoc
+// @Summary List or create API tokens
+// @Description GET lists the API tokens without the secret tokens themselves. POST creates a token
+// @Description with the given scopes: read, write-events, admin and bucket:<prefix> to restrict it to
+// @Description buckets whose ID starts with prefix. The token is only returned in the response to POST.
+// @Tags tokens
+// @Accept json
+// @Produce json
+// @Param token body types.TokenPayload false "Token to create (for POST)"
+// @Success 200 {array} models.APIToken "Tokens, or the created token for POST"
+// @Failure 400 {object} types.HTTPError "Invalid name or scopes"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/tokens [get]
+// @Router /v1/tokens [post]
+func tokens(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	switch r.Method {
+	case "GET":
+		list, err := api.GetTokens()
+		if err != nil {
 			errors.HttpError(w, err, http.StatusInternalServerError)
 			return
 		}
+		errors.JsonOK(w, list)
+
+	case "POST":
+		var payload types.TokenPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			errors.HttpError(w, err, http.StatusBadRequest)
+			return
+		}
+		token, err := api.CreateToken(payload.Name, payload.Scopes)
+		if err != nil {
+			if utils.IsBadRequest(err) {
+				errors.HttpError(w, err, http.StatusBadRequest)
+			} else {
+				errors.HttpError(w, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		errors.JsonOK(w, token)
+
+	default:
+		errors.HttpErrorString(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DeleteToken godoc
+// @Summary Revoke an API token
+// @Tags tokens
+// @Param token_id path string true "Token ID or name"
+// @Success 200 "Token revoked"
+// @Failure 400 {object} types.HTTPError "Several tokens have the name"
+// @Failure 404 {object} types.HTTPError "Token not found"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/tokens/{token_id} [delete]
+func deleteToken(w http.ResponseWriter, r *http.Request) {
+	api := api.forRequest(r)
+	if err := api.DeleteToken(mux.Vars(r)["token_id"]); err != nil {
+		if utils.IsNotFound(err) {
+			errors.HttpError(w, err, http.StatusNotFound)
+		} else if utils.IsBadRequest(err) {
+			errors.HttpError(w, err, http.StatusBadRequest)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Login godoc
+// @Summary Sign in to the web UI
+// @Description Redirects the browser to Google to sign in. After signing in, the browser is sent to
+// @Description redirect, which must be a path on this server or a page of an origin in CORS_ORIGINS.
+// @Tags auth
+// @Param redirect query string false "Where to go after signing in (default /)"
+// @Success 302 "Redirect to the identity provider"
+// @Failure 400 {object} types.HTTPError "Invalid redirect"
+// @Failure 404 {object} types.HTTPError "Sign in is not configured"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/auth/login [get]
+func login(w http.ResponseWriter, r *http.Request) {
+	authURL, state, err := api.BeginLogin(api.callbackURL(r), r.URL.Query().Get("redirect"))
+	if err != nil {
+		if utils.IsNotFound(err) {
+			errors.HttpError(w, err, http.StatusNotFound)
+		} else if utils.IsBadRequest(err) {
+			errors.HttpError(w, err, http.StatusBadRequest)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/api/v1/v1/auth/",
+		MaxAge:   int(loginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   auth.IsSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// LoginCallback godoc
+// @Summary Complete signing in
+// @Description The identity provider redirects here after the user signed in. Starts a session
+// @Description stored in the tg_session cookie and redirects to the page given to /v1/auth/login.
+// @Tags auth
+// @Param state query string true "State passed to the provider"
+// @Param code query string true "Authorization code"
+// @Success 302 "Signed in, redirect to the web UI"
+// @Failure 400 {object} types.HTTPError "Invalid, expired or cancelled sign in"
+// @Failure 403 {object} types.HTTPError "The account may not sign in"
+// @Failure 404 {object} types.HTTPError "Sign in is not configured"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/auth/callback [get]
+func loginCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if msg := q.Get("error"); msg != "" {
+		errors.HttpErrorString(w, fmt.Sprintf("Sign in failed: %s", msg), http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil || cookie.Value != q.Get("state") {
+		errors.HttpErrorString(w, "Sign in was started in another browser, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/api/v1/v1/auth/", MaxAge: -1})
+
+	user, returnTo, err := api.CompleteLogin(r.Context(), api.callbackURL(r), q.Get("state"), q.Get("code"))
+	if err == nil {
+		err = api.StartSession(w, r, user)
+	}
+	if err != nil {
+		if utils.IsNotFound(err) {
+			errors.HttpError(w, err, http.StatusNotFound)
+		} else if utils.IsBadRequest(err) {
+			errors.HttpError(w, err, http.StatusBadRequest)
+		} else if utils.IsForbidden(err) {
+			errors.HttpError(w, err, http.StatusForbidden)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// Logout godoc
+// @Summary Sign out of the web UI
+// @Description Ends the session of the browser and clears its session cookie.
+// @Tags auth
+// @Success 200 "Signed out"
+// @Failure 404 {object} types.HTTPError "Sign in is not configured"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/auth/logout [post]
+func logout(w http.ResponseWriter, r *http.Request) {
+	if err := api.SignOut(w, r); err != nil {
+		if utils.IsNotFound(err) {
+			errors.HttpError(w, err, http.StatusNotFound)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// Me godoc
+// @Summary Get the signed in user
+// @Description Returns the user signed in on this browser, or 401 if nobody is.
+// @Tags auth
+// @Produce json
+// @Success 200 {object} models.User "Signed in user"
+// @Failure 401 {object} types.HTTPError "Not signed in"
+// @Failure 404 {object} types.HTTPError "Sign in is not configured"
+// @Failure 500 {object} types.HTTPError "Internal server error occurred"
+// @Router /v1/auth/me [get]
+func me(w http.ResponseWriter, r *http.Request) {
+	if api.login == nil {
+		errors.HttpError(w, signInDisabled(), http.StatusNotFound)
+		return
+	}
+	user, err := api.CurrentUser(r)
+	if err != nil {
+		if utils.IsNotFound(err) {
+			errors.HttpError(w, err, http.StatusUnauthorized)
+		} else {
+			errors.HttpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	errors.JsonOK(w, user)
+}
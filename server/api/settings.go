@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+
+	"timelygator/server/categories"
+	"timelygator/server/utils/types"
+)
+
+// settingValidators check the values of settings the server knows about.
+// Settings with other keys are stored as-is.
+var settingValidators = map[string]func(value interface{}) error{
+	"classes":         validateClasses,
+	"startOfDay":      validateStartOfDay,
+	"startOfWeek":     validateStartOfWeek,
+	"durationDefault": validateDurationDefault,
+}
+
+var startOfDayPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+func invalidSetting(key string, format string, args ...interface{}) error {
+	return &types.BadRequest{
+		Code:    "InvalidSetting",
+		Message: fmt.Sprintf("%s: %s", key, fmt.Sprintf(format, args...)),
+	}
+}
+
+// validateClasses checks that value is a list of {"name": [...], "rule": {...}}
+// category definitions with compilable regexes.
+func validateClasses(value interface{}) error {
+	classes, err := categories.Parse(value)
+	if err != nil {
+		return invalidSetting("classes", "%v", err)
+	}
+	if _, err := categories.Compile(classes); err != nil {
+		return invalidSetting("classes", "%v", err)
+	}
+	return nil
+}
+
+func validateStartOfDay(value interface{}) error {
+	s, ok := value.(string)
+	if !ok || !startOfDayPattern.MatchString(s) {
+		return invalidSetting("startOfDay", "must be a time of day formatted as HH:MM")
+	}
+	return nil
+}
+
+func validateStartOfWeek(value interface{}) error {
+	if value != "Monday" && value != "Sunday" {
+		return invalidSetting("startOfWeek", "must be either Monday or Sunday")
+	}
+	return nil
+}
+
+func validateDurationDefault(value interface{}) error {
+	if d, ok := value.(float64); !ok || d <= 0 {
+		return invalidSetting("durationDefault", "must be a positive number of seconds")
+	}
+	return nil
+}
+
+// GetSettings returns all settings as key -> value.
+func (s *API) GetSettings() (map[string]interface{}, error) {
+	raw, err := s.ds.Settings()
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		var v interface{}
+		if err := json.Unmarshal(value, &v); err != nil {
+			log.Printf("Skipping setting '%s' with invalid JSON: %v\n", key, err)
+			continue
+		}
+		settings[key] = v
+	}
+	return settings, nil
+}
+
+// GetSetting returns the value of a single setting.
+func (s *API) GetSetting(key string) (interface{}, error) {
+	raw, err := s.ds.GetSetting(key)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// SetSetting validates value (if key is a known setting) and stores it.
+func (s *API) SetSetting(key string, value json.RawMessage) error {
+	var v interface{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return &types.BadRequest{Code: "InvalidSetting", Message: fmt.Sprintf("%s: value is not valid JSON", key)}
+	}
+	if validate, ok := settingValidators[key]; ok {
+		if err := validate(v); err != nil {
+			return err
+		}
+	}
+	log.Printf("Setting '%s' updated\n", key)
+	if err := s.ds.SetSetting(key, []byte(value)); err != nil {
+		return err
+	}
+	s.settingChanged(key)
+	return nil
+}
+
+// DeleteSetting removes a setting.
+func (s *API) DeleteSetting(key string) error {
+	if _, err := s.ds.GetSetting(key); err != nil {
+		return err
+	}
+	if err := s.ds.DeleteSetting(key); err != nil {
+		return err
+	}
+	s.settingChanged(key)
+	return nil
+}
+
+// settingChanged drops query results that depended on the setting.
+func (s *API) settingChanged(key string) {
+	if key == categories.SettingKey {
+		s.cache.InvalidateClasses()
+	}
+}
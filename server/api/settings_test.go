@@ -0,0 +1,124 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"timelygator/server/database"
+	"timelygator/server/utils/types"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestRouter registers the real routes against a fresh datastore.
+func newTestRouter(t *testing.T) *httptest.Server {
+	t.Helper()
+	return newTestRouterWithConfig(t, types.Config{Environment: "testing"})
+}
+
+func newTestRouterWithConfig(t *testing.T, cfg types.Config) *httptest.Server {
+	t.Helper()
+	ds, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open datastore: %v", err)
+	}
+	r := mux.NewRouter().PathPrefix("/api/v1").Subrouter()
+	RegisterRoutes(cfg, ds, r)
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func doJSON(t *testing.T, method, url string, body interface{}) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("failed to encode body: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func TestSettings(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1/settings"
+
+	if res := doJSON(t, http.MethodGet, base+"/classes", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for missing setting, got %d", res.StatusCode)
+	}
+
+	classes := []interface{}{
+		map[string]interface{}{
+			"name": []string{"Work", "Programming"},
+			"rule": map[string]interface{}{"type": "regex", "regex": "GitHub|vim", "ignore_case": true},
+		},
+	}
+	if res := doJSON(t, http.MethodPost, base+"/classes", classes); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 when setting classes, got %d", res.StatusCode)
+	}
+	if res := doJSON(t, http.MethodPost, base+"/startOfDay", "04:00"); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 when setting startOfDay, got %d", res.StatusCode)
+	}
+
+	res := doJSON(t, http.MethodGet, base+"/classes", nil)
+	var got []map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode classes: %v", err)
+	}
+	if len(got) != 1 || got[0]["rule"].(map[string]interface{})["regex"] != "GitHub|vim" {
+		t.Errorf("unexpected classes %v", got)
+	}
+
+	res = doJSON(t, http.MethodGet, base, nil)
+	var all map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&all); err != nil {
+		t.Fatalf("failed to decode settings: %v", err)
+	}
+	if len(all) != 2 || all["startOfDay"] != "04:00" {
+		t.Errorf("unexpected settings %v", all)
+	}
+
+	if res := doJSON(t, http.MethodDelete, base+"/startOfDay", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 when deleting setting, got %d", res.StatusCode)
+	}
+	if res := doJSON(t, http.MethodDelete, base+"/startOfDay", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 when deleting missing setting, got %d", res.StatusCode)
+	}
+}
+
+func TestSettingsValidation(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1/settings"
+
+	invalid := map[string]interface{}{
+		"classes":     []interface{}{map[string]interface{}{"name": []string{"Work"}, "rule": map[string]interface{}{"type": "regex", "regex": "("}}},
+		"startOfDay":  "25:00",
+		"startOfWeek": "Tuesday",
+	}
+	for key, value := range invalid {
+		if res := doJSON(t, http.MethodPost, base+"/"+key, value); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", key, res.StatusCode)
+		}
+	}
+	if res := doJSON(t, http.MethodPost, base+"/classes", map[string]string{"not": "a list"}); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for classes object, got %d", res.StatusCode)
+	}
+	if res := doJSON(t, http.MethodPost, base+"/customKey", map[string]string{"any": "value"}); res.StatusCode != http.StatusOK {
+		t.Errorf("expected unknown keys to be accepted, got %d", res.StatusCode)
+	}
+}
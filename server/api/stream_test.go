@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"timelygator/server/stream"
+	"timelygator/server/utils/types"
+)
+
+type sseEvent struct {
+	id, event string
+	msg       stream.Message
+}
+
+// openStream connects to an SSE endpoint and returns a channel of its events.
+func openStream(t *testing.T, url, lastEventID string) <-chan sseEvent {
+	t.Helper()
+	return openStreamAuth(t, url, lastEventID, "")
+}
+
+// openStreamAuth connects to an SSE endpoint with a token.
+func openStreamAuth(t *testing.T, url, lastEventID, token string) <-chan sseEvent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from %s, got %d", url, res.StatusCode)
+	}
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer res.Body.Close()
+		defer close(events)
+		var ev sseEvent
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if ev.event != "" {
+					events <- ev
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				ev.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				ev.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.msg)
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for stream event")
+	}
+	return sseEvent{}
+}
+
+func TestStream(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1"
+	for _, id := range []string{"window", "afk"} {
+		bucket := map[string]string{"client": "test", "type": "test", "hostname": "host"}
+		if r := doJSON(t, http.MethodPost, base+"/buckets/"+id, bucket); r.StatusCode != http.StatusOK {
+			t.Fatalf("failed to create bucket %s: %d", id, r.StatusCode)
+		}
+	}
+	if r := doJSON(t, http.MethodGet, base+"/buckets/missing/stream", nil); r.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for missing bucket, got %d", r.StatusCode)
+	}
+
+	all := openStream(t, base+"/stream", "")
+	window := openStream(t, base+"/buckets/window/stream", "")
+
+	ts0 := time.Date(2024, 3, 20, 9, 0, 0, 0, time.UTC)
+	heartbeat := func(offset int) {
+		hb := map[string]interface{}{
+			"timestamp": ts0.Add(time.Duration(offset) * time.Second).Format(time.RFC3339),
+			"duration":  0,
+			"data":      map[string]interface{}{"app": "Code"},
+		}
+		if r := doJSON(t, http.MethodPost, base+"/buckets/window/heartbeat?pulsetime=5", hb); r.StatusCode != http.StatusOK {
+			t.Fatalf("heartbeat failed: %d", r.StatusCode)
+		}
+	}
+	heartbeat(0)
+	heartbeat(2)
+	afk := map[string]interface{}{"timestamp": ts0.Format(time.RFC3339), "duration": 1, "data": map[string]interface{}{"status": "afk"}}
+	if r := doJSON(t, http.MethodPost, base+"/buckets/afk/events", afk); r.StatusCode != http.StatusOK {
+		t.Fatalf("failed to insert event: %d", r.StatusCode)
+	}
+
+	inserted := nextEvent(t, window)
+	if inserted.event != "inserted" || inserted.msg.Event["app"] != "Code" {
+		t.Fatalf("expected inserted heartbeat, got %+v", inserted)
+	}
+	merged := nextEvent(t, window)
+	if merged.event != "merged" || merged.msg.Event["duration"] != 2.0 || merged.msg.Event["id"] != inserted.msg.Event["id"] {
+		t.Errorf("expected merged heartbeat with duration 2, got %+v", merged)
+	}
+
+	var kinds []string
+	for i := 0; i < 3; i++ {
+		ev := nextEvent(t, all)
+		kinds = append(kinds, ev.msg.BucketID+":"+ev.event)
+	}
+	if strings.Join(kinds, ",") != "window:inserted,window:merged,afk:inserted" {
+		t.Errorf("unexpected global stream %v", kinds)
+	}
+
+	id := int(inserted.msg.Event["id"].(float64))
+	if r := doJSON(t, http.MethodDelete, base+"/buckets/window/events/"+strconv.Itoa(id), nil); r.StatusCode != http.StatusOK {
+		t.Fatalf("failed to delete event: %d", r.StatusCode)
+	}
+	if ev := nextEvent(t, window); ev.event != "deleted" {
+		t.Errorf("expected deleted event, got %+v", ev)
+	}
+
+	// Reconnecting after the first message replays the rest of the bucket
+	resumed := openStream(t, base+"/buckets/window/stream", inserted.id)
+	if ev := nextEvent(t, resumed); ev.event != "merged" || ev.id != merged.id {
+		t.Errorf("expected to resume with merged event, got %+v", ev)
+	}
+	if ev := nextEvent(t, resumed); ev.event != "deleted" {
+		t.Errorf("expected to resume with deleted event, got %+v", ev)
+	}
+
+	stale := openStream(t, base+"/stream", "0-1")
+	if ev := nextEvent(t, stale); ev.event != "reset" {
+		t.Errorf("expected reset for stale cursor, got %+v", ev)
+	}
+}
+
+func TestStreamOwners(t *testing.T) {
+	ts := newTestRouterWithConfig(t, types.Config{Environment: "testing", AuthEnabled: true})
+	base := ts.URL + "/api/v1/v1"
+	_, aliceToken := addUser(t, "alice@example.com")
+	_, bobToken := addUser(t, "bob@example.com")
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	heartbeat := func(token, bucketID, app string) {
+		t.Helper()
+		hb := map[string]interface{}{"timestamp": "2024-01-01T00:00:00Z", "duration": 0, "data": map[string]interface{}{"app": app}}
+		if res := doAuth(t, http.MethodPost, base+"/buckets/"+bucketID+"/heartbeat?pulsetime=0", token, hb); res.StatusCode != http.StatusOK {
+			t.Fatalf("heartbeat to %s: expected 200, got %d", bucketID, res.StatusCode)
+		}
+	}
+	if res := doAuth(t, http.MethodPost, base+"/buckets/bob-window", bobToken, bucket); res.StatusCode != http.StatusOK {
+		t.Fatalf("creating bob-window: expected 200, got %d", res.StatusCode)
+	}
+	events := openStreamAuth(t, base+"/stream", "", bobToken)
+	heartbeat(bobToken, "bob-window", "bob")
+	if ev := nextEvent(t, events); ev.msg.BucketID != "bob-window" {
+		t.Fatalf("expected bob's heartbeat, got %+v", ev)
+	}
+
+	// A bucket ID freed by a rename can be taken by another user, whose
+	// events are not streamed to the first
+	if res := doAuth(t, http.MethodPost, base+"/buckets/bob-window/rename", bobToken, map[string]string{"id": "bob-laptop"}); res.StatusCode != http.StatusOK {
+		t.Fatalf("rename: expected 200, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodPost, base+"/buckets/bob-window", aliceToken, bucket); res.StatusCode != http.StatusOK {
+		t.Fatalf("creating alice's bob-window: expected 200, got %d", res.StatusCode)
+	}
+	heartbeat(aliceToken, "bob-window", "alice")
+	heartbeat(bobToken, "bob-laptop", "bob")
+	if ev := nextEvent(t, events); ev.msg.BucketID != "bob-laptop" {
+		t.Errorf("expected only bob's heartbeat, got %+v", ev)
+	}
+}
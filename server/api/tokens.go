@@ -0,0 +1,129 @@
+package api
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"timelygator/server/database/models"
+	"timelygator/server/middleware/auth"
+
+	"github.com/gorilla/mux"
+)
+
+// TokenResponse is a newly created token. The token itself is only ever
+// returned here.
+type TokenResponse struct {
+	*models.APIToken
+	Token string `json:"token"`
+}
+
+// writeEventRoutes are the routes observers need to record activity, by
+// route template and method.
+var writeEventRoutes = map[string]string{
+	"/v1/buckets/{bucket_id}":           http.MethodPost,
+	"/v1/buckets/{bucket_id}/events":    http.MethodPost,
+	"/v1/buckets/{bucket_id}/heartbeat": http.MethodPost,
+}
+
+// heartbeatRoute is the route observers on the server's machine may use
+// without token when only web sign in is enabled.
+const heartbeatRoute = "/v1/buckets/{bucket_id}/heartbeat"
+
+// isLoopback reports whether the request comes from the server's machine.
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// readRoutes are routes that only read despite using POST.
+var readRoutes = map[string]bool{
+	"/v1/query":           true,
+	"/v1/query/":          true,
+	"/v1/categories/test": true,
+}
+
+// adminRoutes are routes that need the admin scope even to read.
+var adminRoutes = map[string]bool{
+	"/v1/tokens":            true,
+	"/v1/tokens/{token_id}": true,
+}
+
+// serverRoutes are routes that affect every user of the server. Webhooks
+// receive the events of all users, so even reading them is restricted.
+var serverRoutes = map[string]bool{
+	"/v1/webhooks":                          true,
+	"/v1/webhooks/{webhook_id}":             true,
+	"/v1/webhooks/{webhook_id}/deadletters": true,
+}
+
+// settingsRoutes are server-wide but readable by everyone.
+var settingsRoutes = map[string]bool{
+	"/v1/settings":       true,
+	"/v1/settings/{key}": true,
+}
+
+// requiredScope returns the scope a token needs for the matched route.
+func (s *API) requiredScope(r *http.Request) auth.Scope {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return auth.Admin
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return auth.Admin
+	}
+	// Routes are registered on the /api/v1 subrouter
+	tmpl = strings.TrimPrefix(tmpl, "/api/v1")
+	switch {
+	case strings.HasPrefix(tmpl, "/v1/auth/"):
+		return auth.Public
+	case !s.config.AuthEnabled && tmpl == "/v1/info":
+		return auth.Public
+	case !s.config.AuthEnabled && tmpl == heartbeatRoute && r.Method == http.MethodPost && isLoopback(r):
+		// Only web sign in is enabled, local observers keep sending heartbeats
+		// to buckets without owner
+		return auth.Public
+	case serverRoutes[tmpl]:
+		return auth.Server
+	case settingsRoutes[tmpl] && r.Method != http.MethodGet && r.Method != http.MethodHead:
+		return auth.Server
+	case adminRoutes[tmpl]:
+		return auth.Admin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || readRoutes[tmpl]:
+		return auth.Read
+	case writeEventRoutes[tmpl] == r.Method:
+		return auth.WriteEvents
+	}
+	return auth.Admin
+}
+
+// GetTokens returns the API tokens visible to the caller, without the tokens
+// themselves.
+func (s *API) GetTokens() ([]*models.APIToken, error) {
+	return s.ds.Tokens()
+}
+
+// CreateToken issues a new API token.
+func (s *API) CreateToken(name string, scopes []string) (*TokenResponse, error) {
+	token, stored, err := auth.IssueToken(s.ds, name, scopes)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Created API token '%s' with scopes %s\n", stored.Name, stored.Scopes)
+	return &TokenResponse{APIToken: stored, Token: token}, nil
+}
+
+// DeleteToken revokes an API token by ID or name.
+func (s *API) DeleteToken(idOrName string) error {
+	if err := s.ds.DeleteToken(idOrName); err != nil {
+		return err
+	}
+	log.Printf("Revoked API token '%s'\n", idOrName)
+	return nil
+}
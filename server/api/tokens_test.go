@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"timelygator/server/middleware/auth"
+	"timelygator/server/utils/types"
+)
+
+func doAuth(t *testing.T, method, url, token string, body interface{}) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("failed to encode body: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func issue(t *testing.T, name string, scopes ...string) string {
+	t.Helper()
+	token, _, err := auth.IssueToken(api.ds, name, scopes)
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	return token
+}
+
+func TestTokenScopes(t *testing.T) {
+	ts := newTestRouterWithConfig(t, types.Config{Environment: "testing", AuthEnabled: true})
+	base := ts.URL + "/api/v1/v1"
+	admin := issue(t, "admin", "admin")
+	read := issue(t, "read", "read")
+	write := issue(t, "observer", "write-events")
+	scoped := issue(t, "scoped", "write-events", "bucket:tg-observer-window")
+
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	heartbeat := map[string]interface{}{"timestamp": "2024-01-01T00:00:00Z", "duration": 0, "data": map[string]interface{}{"app": "a"}}
+
+	cases := []struct {
+		name, method, path, token string
+		body                      interface{}
+		status                    int
+	}{
+		{"no token", http.MethodGet, "/buckets/", "", nil, http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "/buckets/", "tg_nope", nil, http.StatusUnauthorized},
+		{"write creates bucket", http.MethodPost, "/buckets/tg-observer-window_host", write, bucket, http.StatusOK},
+		{"read lists buckets", http.MethodGet, "/buckets/", read, nil, http.StatusOK},
+		{"read cannot insert", http.MethodPost, "/buckets/tg-observer-window_host/events", read, []interface{}{heartbeat}, http.StatusForbidden},
+		{"write sends heartbeat", http.MethodPost, "/buckets/tg-observer-window_host/heartbeat?pulsetime=60", write, heartbeat, http.StatusOK},
+		{"write reads events", http.MethodGet, "/buckets/tg-observer-window_host/events", write, nil, http.StatusOK},
+		{"write cannot delete bucket", http.MethodDelete, "/buckets/tg-observer-window_host?force=1", write, nil, http.StatusForbidden},
+		{"write cannot change settings", http.MethodPost, "/settings/foo", write, "bar", http.StatusForbidden},
+		{"read cannot list tokens", http.MethodGet, "/tokens", read, nil, http.StatusForbidden},
+		{"scoped uses matching bucket", http.MethodPost, "/buckets/tg-observer-window_host/heartbeat?pulsetime=60", scoped, heartbeat, http.StatusOK},
+		{"scoped blocked from other bucket", http.MethodGet, "/buckets/tg-observer-afk_host/events", scoped, nil, http.StatusForbidden},
+		{"scoped blocked from global routes", http.MethodGet, "/buckets/", scoped, nil, http.StatusForbidden},
+		{"admin deletes bucket", http.MethodDelete, "/buckets/tg-observer-window_host?force=1", admin, nil, http.StatusOK},
+	}
+	for _, c := range cases {
+		res := doAuth(t, c.method, base+c.path, c.token, c.body)
+		if res.StatusCode != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, res.StatusCode)
+		}
+	}
+
+	res := doJSON(t, http.MethodGet, base+"/buckets/?access_token="+read, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("access_token query parameter: expected 200, got %d", res.StatusCode)
+	}
+	res = doJSON(t, http.MethodGet, base+"/buckets/", nil)
+	if res.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("expected WWW-Authenticate header on 401")
+	}
+}
+
+func TestTokensEndpoints(t *testing.T) {
+	ts := newTestRouterWithConfig(t, types.Config{Environment: "testing", AuthEnabled: true})
+	base := ts.URL + "/api/v1/v1/tokens"
+	admin := issue(t, "admin", "admin")
+
+	res := doAuth(t, http.MethodPost, base, admin, types.TokenPayload{Name: "laptop", Scopes: []string{"write-events"}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 creating token, got %d", res.StatusCode)
+	}
+	var created TokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode token: %v", err)
+	}
+	if created.Token == "" || created.Prefix == "" || created.Token[:len(created.Prefix)] != created.Prefix {
+		t.Fatalf("unexpected token response: %+v", created)
+	}
+
+	res = doAuth(t, http.MethodPost, base, admin, types.TokenPayload{Name: "laptop", Scopes: []string{"read"}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for duplicate name, got %d", res.StatusCode)
+	}
+	res = doAuth(t, http.MethodPost, base, admin, types.TokenPayload{Name: "bad", Scopes: []string{"everything"}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown scope, got %d", res.StatusCode)
+	}
+
+	res = doAuth(t, http.MethodGet, base, admin, nil)
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
+		t.Fatalf("failed to decode tokens: %v", err)
+	}
+	if len(raw) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(raw))
+	}
+	for _, tok := range raw {
+		if _, ok := tok["hash"]; ok {
+			t.Errorf("token hash must not be listed: %v", tok)
+		}
+		if _, ok := tok["token"]; ok {
+			t.Errorf("token must not be listed: %v", tok)
+		}
+	}
+
+	if res := doAuth(t, http.MethodGet, ts.URL+"/api/v1/v1/buckets/", created.Token, nil); res.StatusCode != http.StatusOK {
+		t.Errorf("expected new token to work, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodDelete, base+"/laptop", admin, nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 revoking token, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodGet, ts.URL+"/api/v1/v1/buckets/", created.Token, nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected revoked token to be rejected, got %d", res.StatusCode)
+	}
+	if res := doAuth(t, http.MethodDelete, base+"/laptop", admin, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 revoking unknown token, got %d", res.StatusCode)
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	ts := newTestRouter(t)
+	if res := doJSON(t, http.MethodGet, ts.URL+"/api/v1/v1/buckets/", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("expected open access without auth, got %d", res.StatusCode)
+	}
+}
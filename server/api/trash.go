@@ -0,0 +1,76 @@
+package api
+
+import (
+	"log"
+	"time"
+)
+
+// trashInterval is how often buckets past their time in the trash are purged.
+const trashInterval = time.Hour
+
+// TrashedBucket is a bucket in the trash with the time it will be purged.
+type TrashedBucket struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Client   string    `json:"client"`
+	Hostname string    `json:"hostname"`
+	Created  time.Time `json:"created"`
+	Deleted  time.Time `json:"deleted"`
+	Purge    time.Time `json:"purge"`
+}
+
+// trashPeriod returns how long buckets stay in the trash.
+func (s *API) trashPeriod() time.Duration {
+	return time.Duration(s.config.TrashDays) * 24 * time.Hour
+}
+
+// GetTrash returns the buckets in the trash, most recently deleted first.
+func (s *API) GetTrash() ([]*TrashedBucket, error) {
+	buckets, err := s.ds.Trash()
+	if err != nil {
+		return nil, err
+	}
+	trash := make([]*TrashedBucket, len(buckets))
+	for i, b := range buckets {
+		trash[i] = &TrashedBucket{
+			ID:       b.ID,
+			Type:     b.Type,
+			Client:   b.Client,
+			Hostname: b.Hostname,
+			Created:  b.Created,
+			Deleted:  b.Deleted.Time.UTC(),
+			Purge:    b.Deleted.Time.Add(s.trashPeriod()).UTC(),
+		}
+	}
+	return trash, nil
+}
+
+// RestoreBucket takes a bucket out of the trash with its events.
+func (s *API) RestoreBucket(bucketID string) error {
+	if err := s.ds.RestoreBucket(bucketID); err != nil {
+		return err
+	}
+	log.Printf("Restored bucket '%s'\n", bucketID)
+	s.bucketChanged(bucketID)
+	return nil
+}
+
+// purgeTrash permanently deletes the buckets that have been in the trash for
+// longer than the configured days.
+func (s *API) purgeTrash(now time.Time) error {
+	purged, err := s.ds.PurgeTrash(now.Add(-s.trashPeriod()))
+	for _, id := range purged {
+		log.Printf("Purged bucket '%s' from the trash\n", id)
+	}
+	return err
+}
+
+// emptyTrash purges the trash now and then every interval.
+func (s *API) emptyTrash(interval time.Duration) {
+	for {
+		if err := s.purgeTrash(time.Now()); err != nil {
+			log.Printf("Error purging the trash: %v\n", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"timelygator/server/database/models"
+	"timelygator/server/utils/types"
+)
+
+func TestDeleteBucketCascades(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1/buckets/gone"
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	doJSON(t, http.MethodPost, base, bucket)
+	event := map[string]interface{}{"timestamp": "2024-01-01T00:00:00Z", "duration": 60, "data": map[string]interface{}{"app": "old"}}
+	doJSON(t, http.MethodPost, base+"/events", event)
+
+	if res := doJSON(t, http.MethodDelete, base, nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: expected 200, got %d", res.StatusCode)
+	}
+	if res := doJSON(t, http.MethodPost, base+"/restore", nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("restore without trash: expected 404, got %d", res.StatusCode)
+	}
+	// A new bucket of the same name starts empty
+	doJSON(t, http.MethodPost, base, bucket)
+	var count int
+	json.NewDecoder(doJSON(t, http.MethodGet, base+"/events/count", nil).Body).Decode(&count)
+	if count != 0 {
+		t.Fatalf("expected the events to be deleted with the bucket, got %d", count)
+	}
+	var stored int64
+	api.ds.DB().Model(&models.Event{}).Where("bucket_id = ?", "gone").Count(&stored)
+	if stored != 0 {
+		t.Fatalf("expected no events left in the database, got %d", stored)
+	}
+}
+
+func TestBucketTrash(t *testing.T) {
+	ts := newTestRouterWithConfig(t, types.Config{Environment: "production", TrashDays: 7})
+	buckets := ts.URL + "/api/v1/v1/buckets"
+	bucket := map[string]interface{}{"client": "test", "type": "currentwindow", "hostname": "host"}
+	event := map[string]interface{}{"timestamp": "2024-01-01T00:00:00Z", "duration": 60, "data": map[string]interface{}{"app": "kept"}}
+	for _, id := range []string{"trashed", "purged"} {
+		doJSON(t, http.MethodPost, buckets+"/"+id, bucket)
+		doJSON(t, http.MethodPost, buckets+"/"+id+"/events", event)
+	}
+
+	if res := doJSON(t, http.MethodDelete, buckets+"/trashed", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("delete without force: expected 401, got %d", res.StatusCode)
+	}
+	if res := doJSON(t, http.MethodDelete, buckets+"/trashed?force=1", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("trash: expected 200, got %d", res.StatusCode)
+	}
+	if ids := bucketIDs(t, doJSON(t, http.MethodGet, buckets+"/", nil)); ids["trashed"] || !ids["purged"] {
+		t.Fatalf("expected the trashed bucket to be hidden, got %v", ids)
+	}
+	if res := doJSON(t, http.MethodGet, buckets+"/trashed/events", nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("events of trashed bucket: expected 404, got %d", res.StatusCode)
+	}
+	if res := doJSON(t, http.MethodPost, buckets+"/trashed", bucket); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("recreating a trashed bucket: expected 400, got %d", res.StatusCode)
+	}
+
+	var trash []TrashedBucket
+	json.NewDecoder(doJSON(t, http.MethodGet, ts.URL+"/api/v1/v1/trash", nil).Body).Decode(&trash)
+	if len(trash) != 1 || trash[0].ID != "trashed" || trash[0].Purge.Sub(trash[0].Deleted) != 7*24*time.Hour {
+		t.Fatalf("unexpected trash %+v", trash)
+	}
+
+	if res := doJSON(t, http.MethodPost, buckets+"/trashed/restore", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("restore: expected 200, got %d", res.StatusCode)
+	}
+	var count int
+	json.NewDecoder(doJSON(t, http.MethodGet, buckets+"/trashed/events/count", nil).Body).Decode(&count)
+	if count != 1 {
+		t.Fatalf("expected the restored bucket to keep its event, got %d", count)
+	}
+	if res := doJSON(t, http.MethodPost, buckets+"/trashed/restore", nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("restoring twice: expected 404, got %d", res.StatusCode)
+	}
+
+	// Purging skips the trash
+	if res := doJSON(t, http.MethodDelete, buckets+"/purged?force=1&purge=1", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("purge: expected 200, got %d", res.StatusCode)
+	}
+	json.NewDecoder(doJSON(t, http.MethodGet, ts.URL+"/api/v1/v1/trash", nil).Body).Decode(&trash)
+	if len(trash) != 0 {
+		t.Fatalf("expected a purged bucket not to be in the trash, got %+v", trash)
+	}
+
+	// The janitor purges buckets once their days in the trash are over
+	doJSON(t, http.MethodDelete, buckets+"/trashed?force=1", nil)
+	if err := api.purgeTrash(time.Now().Add(6 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(doJSON(t, http.MethodGet, ts.URL+"/api/v1/v1/trash", nil).Body).Decode(&trash)
+	if len(trash) != 1 {
+		t.Fatalf("expected the bucket to stay in the trash for 7 days, got %+v", trash)
+	}
+	if err := api.purgeTrash(time.Now().Add(8 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(doJSON(t, http.MethodGet, ts.URL+"/api/v1/v1/trash", nil).Body).Decode(&trash)
+	if len(trash) != 0 {
+		t.Fatalf("expected the trash to be purged, got %+v", trash)
+	}
+	if res := doJSON(t, http.MethodPost, buckets+"/trashed", bucket); res.StatusCode != http.StatusOK {
+		t.Fatalf("recreating a purged bucket: expected 200, got %d", res.StatusCode)
+	}
+	json.NewDecoder(doJSON(t, http.MethodGet, buckets+"/trashed/events/count", nil).Body).Decode(&count)
+	if count != 0 {
+		t.Fatalf("expected purged events to be gone, got %d", count)
+	}
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+	"timelygator/server/stream"
+	"timelygator/server/utils/types"
+	"timelygator/server/webhooks"
+)
+
+// WebhookResponse is a webhook as returned by the API. The secret is only
+// included in the response to creating the webhook.
+type WebhookResponse struct {
+	*models.Webhook
+	Secret string `json:"secret,omitempty"`
+}
+
+// webhookKinds maps the kinds of the event stream to webhook kinds.
+var webhookKinds = map[stream.Kind]webhooks.Kind{
+	stream.Inserted: webhooks.Created,
+	stream.Merged:   webhooks.HeartbeatMerged,
+	stream.Deleted:  webhooks.Deleted,
+	stream.Updated:  webhooks.Updated,
+}
+
+// notifyWebhooks sends changed events to the webhooks subscribed to them.
+func (s *API) notifyWebhooks(bucketID string, kind stream.Kind, events []*models.Event) {
+	if !s.webhooks.Enabled() {
+		return
+	}
+	bucketType := database.NewBucket(s.ds, bucketID).Type()
+	for _, e := range events {
+		s.webhooks.Notify(webhookKinds[kind], bucketID, bucketType, e.ToJSONDict())
+	}
+}
+
+func invalidWebhook(format string, args ...interface{}) error {
+	return &types.BadRequest{Code: "InvalidWebhook", Message: fmt.Sprintf(format, args...)}
+}
+
+// applyWebhookPayload validates the payload and copies the fields it sets.
+func applyWebhookPayload(hook *models.Webhook, p types.WebhookPayload) error {
+	if p.URL != nil {
+		u, err := url.Parse(*p.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalidWebhook("url must be an absolute http or https URL")
+		}
+		hook.URL = *p.URL
+	}
+	if p.Secret != nil {
+		if *p.Secret == "" {
+			return invalidWebhook("secret must not be empty")
+		}
+		hook.Secret = *p.Secret
+	}
+	if p.BucketPattern != nil {
+		if _, err := path.Match(*p.BucketPattern, ""); err != nil {
+			return invalidWebhook("invalid bucket_pattern %q: %v", *p.BucketPattern, err)
+		}
+		hook.BucketPattern = *p.BucketPattern
+	}
+	if p.BucketTypes != nil {
+		for _, t := range p.BucketTypes {
+			if t == "" {
+				return invalidWebhook("bucket_types must not contain empty types")
+			}
+		}
+		hook.BucketTypes, _ = json.Marshal(p.BucketTypes)
+	}
+	if p.Kinds != nil {
+		for _, k := range p.Kinds {
+			known := false
+			for _, kind := range webhooks.Kinds {
+				known = known || webhooks.Kind(k) == kind
+			}
+			if !known {
+				return invalidWebhook("unknown kind %q, expected one of %v", k, webhooks.Kinds)
+			}
+		}
+		hook.Kinds, _ = json.Marshal(p.Kinds)
+	}
+	if p.Active != nil {
+		hook.Active = *p.Active
+	}
+	return nil
+}
+
+// GetWebhooks returns all webhooks.
+func (s *API) GetWebhooks() ([]*models.Webhook, error) {
+	return s.ds.Webhooks()
+}
+
+// GetWebhook returns a single webhook.
+func (s *API) GetWebhook(id uint) (*models.Webhook, error) {
+	return s.ds.GetWebhook(id)
+}
+
+// CreateWebhook registers a webhook. A secret is generated if none is given.
+func (s *API) CreateWebhook(p types.WebhookPayload) (*WebhookResponse, error) {
+	if p.URL == nil {
+		return nil, invalidWebhook("url is required")
+	}
+	hook := &models.Webhook{
+		Secret:      webhooks.NewSecret(),
+		BucketTypes: []byte("[]"),
+		Kinds:       []byte("[]"),
+		Active:      true,
+		Created:     time.Now().UTC(),
+	}
+	if err := applyWebhookPayload(hook, p); err != nil {
+		return nil, err
+	}
+	if err := s.ds.SaveWebhook(hook); err != nil {
+		return nil, err
+	}
+	log.Printf("Created webhook %d for %s\n", hook.ID, hook.URL)
+	if err := s.webhooks.Reload(); err != nil {
+		return nil, err
+	}
+	return &WebhookResponse{Webhook: hook, Secret: hook.Secret}, nil
+}
+
+// UpdateWebhook changes the fields of a webhook set in the payload.
+func (s *API) UpdateWebhook(id uint, p types.WebhookPayload) (*models.Webhook, error) {
+	hook, err := s.ds.GetWebhook(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyWebhookPayload(hook, p); err != nil {
+		return nil, err
+	}
+	if err := s.ds.SaveWebhook(hook); err != nil {
+		return nil, err
+	}
+	if err := s.webhooks.Reload(); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// DeleteWebhook removes a webhook and its dead letters.
+func (s *API) DeleteWebhook(id uint) error {
+	if _, err := s.ds.GetWebhook(id); err != nil {
+		return err
+	}
+	if err := s.ds.DeleteWebhook(id); err != nil {
+		return err
+	}
+	log.Printf("Deleted webhook %d\n", id)
+	return s.webhooks.Reload()
+}
+
+// GetDeadLetters returns the deliveries to a webhook that failed.
+func (s *API) GetDeadLetters(id uint) ([]*models.WebhookDelivery, error) {
+	if _, err := s.ds.GetWebhook(id); err != nil {
+		return nil, err
+	}
+	return s.ds.DeadLetters(id)
+}
+
+// ClearDeadLetters removes the failed deliveries of a webhook.
+func (s *API) ClearDeadLetters(id uint) error {
+	if _, err := s.ds.GetWebhook(id); err != nil {
+		return err
+	}
+	return s.ds.ClearDeadLetters(id)
+}
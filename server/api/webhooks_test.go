@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"timelygator/server/webhooks"
+)
+
+func TestWebhooks(t *testing.T) {
+	ts := newTestRouter(t)
+	base := ts.URL + "/api/v1/v1"
+
+	deliveries := make(chan webhooks.Payload, 8)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(webhooks.SignatureHeader) != webhooks.Sign("s3cret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var p webhooks.Payload
+		json.Unmarshal(body, &p)
+		deliveries <- p
+	}))
+	defer receiver.Close()
+
+	invalid := []map[string]interface{}{
+		{},
+		{"url": "ftp://example.com"},
+		{"url": receiver.URL, "kinds": []string{"renamed"}},
+		{"url": receiver.URL, "bucket_pattern": "["},
+	}
+	for _, body := range invalid {
+		if r := doJSON(t, http.MethodPost, base+"/webhooks", body); r.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400 for %v, got %d", body, r.StatusCode)
+		}
+	}
+
+	var created struct {
+		ID     uint   `json:"id"`
+		Secret string `json:"secret"`
+	}
+	r := doJSON(t, http.MethodPost, base+"/webhooks", map[string]interface{}{
+		"url":            receiver.URL,
+		"secret":         "s3cret",
+		"bucket_pattern": "window*",
+		"bucket_types":   []string{"currentwindow"},
+		"kinds":          []string{"created", "bucket-deleted"},
+	})
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("failed to create webhook: %d", r.StatusCode)
+	}
+	json.NewDecoder(r.Body).Decode(&created)
+	if created.ID == 0 || created.Secret != "s3cret" {
+		t.Fatalf("unexpected created webhook %+v", created)
+	}
+	hookURL := base + "/webhooks/" + strconv.Itoa(int(created.ID))
+
+	var listed []map[string]interface{}
+	json.NewDecoder(doJSON(t, http.MethodGet, base+"/webhooks", nil).Body).Decode(&listed)
+	if len(listed) != 1 || listed[0]["secret"] != nil {
+		t.Errorf("expected 1 webhook without secret, got %v", listed)
+	}
+
+	for id, typ := range map[string]string{"window": "currentwindow", "afk": "afkstatus"} {
+		bucket := map[string]string{"client": "test", "type": typ, "hostname": "host"}
+		if r := doJSON(t, http.MethodPost, base+"/buckets/"+id, bucket); r.StatusCode != http.StatusOK {
+			t.Fatalf("failed to create bucket %s: %d", id, r.StatusCode)
+		}
+	}
+	ts0 := time.Date(2024, 3, 20, 9, 0, 0, 0, time.UTC)
+	for _, id := range []string{"afk", "window"} {
+		ev := map[string]interface{}{"timestamp": ts0.Format(time.RFC3339), "duration": 1, "data": map[string]interface{}{"bucket": id}}
+		if r := doJSON(t, http.MethodPost, base+"/buckets/"+id+"/events", ev); r.StatusCode != http.StatusOK {
+			t.Fatalf("failed to insert event: %d", r.StatusCode)
+		}
+	}
+	if r := doJSON(t, http.MethodDelete, base+"/buckets/window?force=1", nil); r.StatusCode != http.StatusOK {
+		t.Fatalf("failed to delete bucket: %d", r.StatusCode)
+	}
+
+	next := func() webhooks.Payload {
+		t.Helper()
+		select {
+		case p := <-deliveries:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for delivery")
+		}
+		return webhooks.Payload{}
+	}
+	got := map[webhooks.Kind]webhooks.Payload{}
+	for i := 0; i < 2; i++ {
+		p := next()
+		got[p.Kind] = p
+	}
+	if p := got[webhooks.Created]; p.BucketID != "window" || p.BucketType != "currentwindow" || p.Event["bucket"] != "window" {
+		t.Errorf("unexpected created delivery %+v", p)
+	}
+	if p := got[webhooks.BucketDeleted]; p.BucketID != "window" {
+		t.Errorf("unexpected bucket-deleted delivery %+v", p)
+	}
+	api.webhooks.Wait()
+	select {
+	case p := <-deliveries:
+		t.Errorf("unexpected delivery %+v", p)
+	default:
+	}
+
+	// Updates keep fields that are left out
+	r = doJSON(t, http.MethodPut, hookURL, map[string]interface{}{"active": false})
+	var updated map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&updated)
+	if updated["active"] != false || updated["bucket_pattern"] != "window*" {
+		t.Errorf("unexpected updated webhook %v", updated)
+	}
+
+	if r := doJSON(t, http.MethodGet, hookURL+"/deadletters", nil); r.StatusCode != http.StatusOK {
+		t.Errorf("expected dead letters, got %d", r.StatusCode)
+	}
+	if r := doJSON(t, http.MethodDelete, hookURL, nil); r.StatusCode != http.StatusOK {
+		t.Errorf("failed to delete webhook: %d", r.StatusCode)
+	}
+	if r := doJSON(t, http.MethodGet, hookURL, nil); r.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for deleted webhook, got %d", r.StatusCode)
+	}
+}
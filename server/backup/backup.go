@@ -0,0 +1,252 @@
+// Package backup takes snapshots of the SQLite database of the server, prunes
+// them by age and restores them.
+//
+// Snapshots are written with VACUUM INTO, which copies the database in one
+// read transaction, so they are consistent while the server keeps writing.
+// Each is a complete database named after the time it was taken, such as
+// timelygator-20240102T030405Z.db, that the server can open as it is.
+package backup
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+)
+
+const (
+	snapshotPrefix = "timelygator-"
+	snapshotSuffix = ".db"
+	timeFormat     = "20060102T150405Z"
+)
+
+// Snapshot is a database snapshot in a backup directory.
+type Snapshot struct {
+	Path string
+	Time time.Time
+}
+
+// Policy is how many snapshots Prune keeps: the newest of each of the last
+// Daily days, Weekly weeks and Monthly months that have snapshots. Periods
+// are in UTC and weeks are ISO weeks.
+type Policy struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// Take writes a snapshot of db to dir, named after now.
+func Take(db *sql.DB, dir string, now time.Time) (*Snapshot, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	now = now.UTC().Truncate(time.Second)
+	path := filepath.Join(dir, snapshotPrefix+now.Format(timeFormat)+snapshotSuffix)
+	// VACUUM INTO refuses to overwrite, and an interrupted snapshot must not
+	// look like a complete one
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if _, err := db.Exec("VACUUM INTO ?", tmp); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return &Snapshot{Path: path, Time: now}, nil
+}
+
+// List returns the snapshots in dir, newest first. Other files are ignored.
+func List(dir string) ([]Snapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, snapshotPrefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		stamp, ok = strings.CutSuffix(stamp, snapshotSuffix)
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(timeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Path: filepath.Join(dir, name), Time: t})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.After(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// Prune deletes the snapshots in dir that policy does not keep and returns
+// them. The newest snapshot is always kept.
+func Prune(dir string, policy Policy) ([]Snapshot, error) {
+	snapshots, err := List(dir)
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+	keep := map[string]bool{snapshots[0].Path: true}
+	rules := []struct {
+		count  int
+		period func(time.Time) string
+	}{
+		{policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{policy.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, rule := range rules {
+		seen := map[string]bool{}
+		for _, s := range snapshots {
+			if len(seen) == rule.count {
+				break
+			}
+			period := rule.period(s.Time)
+			if !seen[period] {
+				seen[period] = true
+				keep[s.Path] = true
+			}
+		}
+	}
+
+	var pruned []Snapshot
+	for _, s := range snapshots {
+		if keep[s.Path] {
+			continue
+		}
+		if err := os.Remove(s.Path); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, s)
+	}
+	return pruned, nil
+}
+
+// Schedule takes a snapshot of db every interval and prunes the snapshots
+// after each. The first is taken once interval has passed since the newest
+// snapshot in dir, so restarting the server does not take one every time.
+func Schedule(db *sql.DB, dir string, interval time.Duration, policy Policy) {
+	for {
+		if snapshots, err := List(dir); err == nil && len(snapshots) > 0 {
+			if wait := time.Until(snapshots[0].Time.Add(interval)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		snapshot, err := Take(db, dir, time.Now())
+		if err != nil {
+			log.Printf("Error backing up the database: %v\n", err)
+			time.Sleep(interval)
+			continue
+		}
+		log.Printf("Backed up the database to %s\n", snapshot.Path)
+		pruned, err := Prune(dir, policy)
+		if err != nil {
+			log.Printf("Error pruning backups: %v\n", err)
+		}
+		for _, s := range pruned {
+			log.Printf("Pruned backup %s\n", s.Path)
+		}
+	}
+}
+
+// Check returns an error unless path is an intact SQLite database.
+func Check(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("%s is not a database: %w", path, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%s is damaged: %s", path, result)
+	}
+	return nil
+}
+
+// Restore replaces the database at target with a copy of the snapshot at
+// path, after checking the snapshot. The server must not be running. If the
+// target exists, a snapshot of it is taken into dir first, which is returned,
+// so that a restore can be undone.
+func Restore(path, target, dir string) (*Snapshot, error) {
+	if err := Check(path); err != nil {
+		return nil, err
+	}
+	// Copy next to the target and rename, so the database is never partly
+	// written
+	tmp := target + ".restore"
+	if err := copyFile(path, tmp); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	var before *Snapshot
+	if _, err := os.Stat(target); err == nil {
+		db, err := sql.Open("sqlite3", target)
+		if err != nil {
+			os.Remove(tmp)
+			return nil, err
+		}
+		before, err = Take(db, dir, time.Now())
+		db.Close()
+		if err != nil {
+			os.Remove(tmp)
+			return nil, fmt.Errorf("backing up %s before restoring: %w", target, err)
+		}
+	}
+	// The journal of the old database must not be applied to the new one
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(target + suffix); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmp)
+			return before, err
+		}
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return before, err
+	}
+	return before, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
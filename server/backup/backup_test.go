@@ -0,0 +1,119 @@
+package backup_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"timelygator/server/backup"
+	"timelygator/server/database"
+)
+
+func TestTakeAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	target := filepath.Join(dir, "timelygator.db")
+	ds, err := database.Open(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.CreateBucket("kept", "test", "test", "host", time.Now(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	db, _ := ds.DB().DB()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	snapshot, err := backup.Take(db, backups, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(snapshot.Path) != "timelygator-20240301T120000Z.db" {
+		t.Errorf("unexpected snapshot name %s", snapshot.Path)
+	}
+	if _, err := ds.CreateBucket("lost", "test", "test", "host", time.Now(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	before, err := backup.Restore(snapshot.Path, target, backups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == nil {
+		t.Fatalf("expected the replaced database to be backed up")
+	}
+	restored, err := database.Open(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets := restored.Buckets()
+	if _, ok := buckets["kept"]; !ok || len(buckets) != 1 {
+		t.Errorf("expected only the bucket of the snapshot, got %v", buckets)
+	}
+	undo, err := database.Open(before.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buckets := undo.Buckets(); len(buckets) != 2 {
+		t.Errorf("expected the backup before restoring to have both buckets, got %v", buckets)
+	}
+
+	// Files that are not intact databases are refused
+	broken := filepath.Join(dir, "broken.db")
+	os.WriteFile(broken, []byte("not a database"), 0o600)
+	if _, err := backup.Restore(broken, target, backups); err == nil {
+		t.Errorf("expected restoring a broken snapshot to fail")
+	}
+	if _, err := backup.Restore(filepath.Join(dir, "missing.db"), target, backups); err == nil {
+		t.Errorf("expected restoring a missing snapshot to fail")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// A snapshot at 03:00 and 15:00 every day from 2024-01-01 to 2024-03-31
+	start := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	for ts := start; ts.Before(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)); ts = ts.Add(12 * time.Hour) {
+		if _, err := backup.Take(db, dir, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o600)
+
+	if _, err := backup.Prune(dir, backup.Policy{Daily: 3, Weekly: 2, Monthly: 3}); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := backup.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, s := range snapshots {
+		kept = append(kept, s.Time.Format("01-02 15"))
+	}
+	// The newest of each of the last 3 days, 2 weeks and 3 months
+	want := []string{"03-31 15", "03-30 15", "03-29 15", "03-24 15", "02-29 15", "01-31 15"}
+	if len(kept) != len(want) {
+		t.Fatalf("expected %v, got %v", want, kept)
+	}
+	for i := range want {
+		if kept[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, kept)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("other files must be kept: %v", err)
+	}
+
+	// Without rules only the newest is kept
+	backup.Prune(dir, backup.Policy{})
+	if snapshots, _ := backup.List(dir); len(snapshots) != 1 || snapshots[0].Time.Format("01-02 15") != "03-31 15" {
+		t.Errorf("expected only the newest snapshot, got %v", snapshots)
+	}
+}
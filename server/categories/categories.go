@@ -0,0 +1,245 @@
+// Package categories compiles the category rules stored in the "classes"
+// setting and assigns events to the deepest matching category.
+//
+// A rule set is a list of classes as sent by client.ClassItem:
+//
+//	[{"name": ["Work", "Programming"], "rule": {"type": "regex", "regex": "GitHub", "ignore_case": true}}]
+//
+// The [[name, rule], ...] pair form used by older query scripts is accepted too.
+package categories
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Key is the data key events are tagged with.
+const Key = "$category"
+
+// SettingKey is the setting the rule set is stored under.
+const SettingKey = "classes"
+
+// Uncategorized is the category of events no rule matches.
+var Uncategorized = []string{"Uncategorized"}
+
+// Rule describes how events are matched to a class.
+type Rule struct {
+	Type       string `json:"type"`
+	Regex      string `json:"regex,omitempty"`
+	IgnoreCase bool   `json:"ignore_case,omitempty"`
+}
+
+// Class is a category path with the rule that selects it.
+type Class struct {
+	Name []string `json:"name"`
+	Rule Rule     `json:"rule"`
+}
+
+type compiledClass struct {
+	Class
+	index int
+	re    *regexp.Regexp // nil for rules that never match
+}
+
+// Classifier matches event data against a compiled rule set.
+type Classifier struct {
+	classes []compiledClass
+}
+
+// Parse converts a decoded JSON rule set into classes, validating its shape.
+func Parse(value interface{}) ([]Class, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("classes must be a list")
+	}
+	classes := make([]Class, 0, len(items))
+	for i, item := range items {
+		var name, rule interface{}
+		switch c := item.(type) {
+		case map[string]interface{}:
+			name, rule = c["name"], c["rule"]
+		case []interface{}:
+			if len(c) != 2 {
+				return nil, fmt.Errorf("class %d must be a [name, rule] pair", i)
+			}
+			name, rule = c[0], c[1]
+		default:
+			return nil, fmt.Errorf("class %d must be an object", i)
+		}
+
+		path, ok := name.([]interface{})
+		if !ok || len(path) == 0 {
+			return nil, fmt.Errorf("class %d must have a non-empty name list", i)
+		}
+		class := Class{Name: make([]string, 0, len(path))}
+		for _, part := range path {
+			s, ok := part.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("class %d has a name that is not a list of strings", i)
+			}
+			class.Name = append(class.Name, s)
+		}
+
+		spec, ok := rule.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("class %d must have a rule object", i)
+		}
+		switch t := spec["type"].(type) {
+		case nil:
+			class.Rule.Type = "none"
+		case string:
+			class.Rule.Type = t
+		default:
+			return nil, fmt.Errorf("class %d has a non-string rule type", i)
+		}
+		switch class.Rule.Type {
+		case "none":
+		case "regex":
+			pattern, ok := spec["regex"].(string)
+			if !ok {
+				return nil, fmt.Errorf("class %d has a regex rule without a regex", i)
+			}
+			class.Rule.Regex = pattern
+			if ic, ok := spec["ignore_case"]; ok && ic != nil {
+				b, ok := ic.(bool)
+				if !ok {
+					return nil, fmt.Errorf("class %d has a non-boolean ignore_case", i)
+				}
+				class.Rule.IgnoreCase = b
+			}
+		default:
+			return nil, fmt.Errorf("class %d has unknown rule type %q", i, class.Rule.Type)
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+// ParseJSON parses a rule set from its JSON encoding.
+func ParseJSON(raw []byte) ([]Class, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("classes are not valid JSON: %w", err)
+	}
+	return Parse(value)
+}
+
+// Compile compiles the regexes of a rule set. Regex rules with an empty
+// pattern never match, as an empty regex would match every event.
+func Compile(classes []Class) (*Classifier, error) {
+	c := &Classifier{classes: make([]compiledClass, 0, len(classes))}
+	for i, class := range classes {
+		cc := compiledClass{Class: class, index: i}
+		if class.Rule.Type == "regex" && class.Rule.Regex != "" {
+			pattern := class.Rule.Regex
+			if class.Rule.IgnoreCase {
+				pattern = "(?i)" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex for class %v: %w", class.Name, err)
+			}
+			cc.re = re
+		}
+		c.classes = append(c.classes, cc)
+	}
+	return c, nil
+}
+
+// Len returns the number of classes in the rule set.
+func (c *Classifier) Len() int {
+	return len(c.classes)
+}
+
+// Match explains why an event was assigned its category.
+type Match struct {
+	Class *Class `json:"class"`      // nil if no rule matched
+	Index int    `json:"index"`      // position of the class in the rule set
+	Field string `json:"field"`      // data key whose value matched
+	Value string `json:"value"`      // the full value of that key
+	Text  string `json:"match_text"` // the part of the value the regex matched
+}
+
+// Result is the category of an event and the rules that led to it.
+type Result struct {
+	Category []string `json:"category"`
+	Matched  bool     `json:"matched"`
+	// Match is the rule that selected Category
+	Match *Match `json:"match,omitempty"`
+	// Candidates are all rules that matched, in rule set order
+	Candidates []Match `json:"candidates"`
+}
+
+// match finds the first data value (in key order) the class matches.
+func (cc *compiledClass) match(data map[string]interface{}) *Match {
+	if cc.re == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s, ok := data[k].(string)
+		if !ok {
+			continue
+		}
+		if loc := cc.re.FindStringIndex(s); loc != nil {
+			class := cc.Class
+			return &Match{Class: &class, Index: cc.index, Field: k, Value: s, Text: s[loc[0]:loc[1]]}
+		}
+	}
+	return nil
+}
+
+// Explain categorizes event data and reports every rule that matched. Of all
+// matching classes the one with the deepest name wins, ties going to the
+// class listed first.
+func (c *Classifier) Explain(data map[string]interface{}) Result {
+	res := Result{Category: Uncategorized, Candidates: []Match{}}
+	for i := range c.classes {
+		m := c.classes[i].match(data)
+		if m == nil {
+			continue
+		}
+		res.Candidates = append(res.Candidates, *m)
+		if res.Match == nil || len(m.Class.Name) > len(res.Match.Class.Name) {
+			res.Match = m
+			res.Category = m.Class.Name
+			res.Matched = true
+		}
+	}
+	return res
+}
+
+// Categorize returns the category path for event data.
+func (c *Classifier) Categorize(data map[string]interface{}) []string {
+	best := -1
+	for i := range c.classes {
+		cc := &c.classes[i]
+		if cc.re == nil || (best >= 0 && len(cc.Name) <= len(c.classes[best].Name)) {
+			continue
+		}
+		if cc.match(data) != nil {
+			best = i
+		}
+	}
+	if best < 0 {
+		return Uncategorized
+	}
+	return c.classes[best].Name
+}
+
+// Tags returns the last name element of every class that matches.
+func (c *Classifier) Tags(data map[string]interface{}) []string {
+	tags := []string{}
+	for i := range c.classes {
+		if c.classes[i].match(data) != nil {
+			tags = append(tags, c.classes[i].Name[len(c.classes[i].Name)-1])
+		}
+	}
+	return tags
+}
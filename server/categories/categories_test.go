@@ -0,0 +1,108 @@
+package categories
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"timelygator/server/database"
+)
+
+func mustCompile(t *testing.T, raw string) *Classifier {
+	t.Helper()
+	classes, err := ParseJSON([]byte(raw))
+	if err != nil {
+		t.Fatalf("ParseJSON error: %v", err)
+	}
+	c, err := Compile(classes)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	return c
+}
+
+func TestExplain(t *testing.T) {
+	c := mustCompile(t, `[
+		{"name": ["Work"], "rule": {"type": "regex", "regex": "Code|vim"}},
+		{"name": ["Work", "Programming"], "rule": {"type": "regex", "regex": "github", "ignore_case": true}},
+		{"name": ["Media"], "rule": {"type": "none"}},
+		[["Comms"], {"type": "regex", "regex": ""}]
+	]`)
+
+	res := c.Explain(map[string]interface{}{"app": "Code", "title": "GitHub - repo", "count": 3.0})
+	if !res.Matched || !reflect.DeepEqual(res.Category, []string{"Work", "Programming"}) {
+		t.Fatalf("expected Work > Programming, got %v", res.Category)
+	}
+	if res.Match.Index != 1 || res.Match.Field != "title" || res.Match.Value != "GitHub - repo" || res.Match.Text != "GitHub" {
+		t.Errorf("unexpected match %+v", res.Match)
+	}
+	if len(res.Candidates) != 2 || res.Candidates[0].Field != "app" {
+		t.Errorf("unexpected candidates %+v", res.Candidates)
+	}
+	if got := c.Categorize(map[string]interface{}{"app": "Code", "title": "GitHub"}); !reflect.DeepEqual(got, res.Category) {
+		t.Errorf("Categorize and Explain disagree: %v", got)
+	}
+	if got := c.Tags(map[string]interface{}{"app": "vim"}); !reflect.DeepEqual(got, []string{"Work"}) {
+		t.Errorf("unexpected tags %v", got)
+	}
+
+	// Rules of type none and empty regexes never match
+	res = c.Explain(map[string]interface{}{"app": "Spotify"})
+	if res.Matched || !reflect.DeepEqual(res.Category, Uncategorized) || res.Match != nil {
+		t.Errorf("expected Uncategorized, got %+v", res)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"not a list":     `{"name": ["A"]}`,
+		"empty name":     `[{"name": [], "rule": {"type": "none"}}]`,
+		"name not str":   `[{"name": [1], "rule": {"type": "none"}}]`,
+		"missing rule":   `[{"name": ["A"]}]`,
+		"unknown type":   `[{"name": ["A"], "rule": {"type": "glob"}}]`,
+		"missing regex":  `[{"name": ["A"], "rule": {"type": "regex"}}]`,
+		"bad ignorecase": `[{"name": ["A"], "rule": {"type": "regex", "regex": "a", "ignore_case": "yes"}}]`,
+	}
+	for name, raw := range cases {
+		if _, err := ParseJSON([]byte(raw)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	classes, err := ParseJSON([]byte(`[{"name": ["A"], "rule": {"type": "regex", "regex": "("}}]`))
+	if err != nil {
+		t.Fatalf("ParseJSON error: %v", err)
+	}
+	if _, err := Compile(classes); err == nil {
+		t.Errorf("expected error for invalid regex")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ds, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open datastore: %v", err)
+	}
+	c, err := Load(ds)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if c.Len() != 0 {
+		t.Errorf("expected no classes without setting, got %d", c.Len())
+	}
+
+	raw, _ := json.Marshal([]interface{}{map[string]interface{}{"name": []string{"Work"}, "rule": map[string]interface{}{"type": "regex", "regex": "Code"}}})
+	if err := ds.SetSetting(SettingKey, raw); err != nil {
+		t.Fatalf("SetSetting error: %v", err)
+	}
+	c, err = Load(ds)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if got := c.Categorize(map[string]interface{}{"app": "Code"}); !reflect.DeepEqual(got, []string{"Work"}) {
+		t.Errorf("expected stored classes to be used, got %v", got)
+	}
+	if again, _ := Load(ds); again != c {
+		t.Errorf("expected unchanged classes not to be recompiled")
+	}
+}
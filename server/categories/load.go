@@ -0,0 +1,73 @@
+package categories
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+	"timelygator/server/utils"
+)
+
+// loaded remembers the last compiled rule set so that queries and ingest do
+// not recompile the regexes as long as the setting is unchanged.
+var loaded struct {
+	mu         sync.Mutex
+	raw        []byte
+	classifier *Classifier
+}
+
+// Load compiles the rule set stored in the "classes" setting. Without stored
+// classes every event is Uncategorized.
+func Load(ds *database.Datastore) (*Classifier, error) {
+	raw, err := ds.GetSetting(SettingKey)
+	if err != nil {
+		if utils.IsNotFound(err) {
+			return &Classifier{}, nil
+		}
+		return nil, err
+	}
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+	if loaded.classifier != nil && bytes.Equal(loaded.raw, raw) {
+		return loaded.classifier, nil
+	}
+	classes, err := ParseJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Compile(classes)
+	if err != nil {
+		return nil, err
+	}
+	loaded.raw = append([]byte(nil), raw...)
+	loaded.classifier = c
+	return c, nil
+}
+
+// IngestBucketTypes are the bucket types whose events are categorized on
+// ingest. Other buckets, like afkstatus, hold no data worth categorizing.
+var IngestBucketTypes = map[string]bool{
+	"currentwindow":       true,
+	"web.tab.current":     true,
+	"app.editor.activity": true,
+}
+
+// TagEvent stores the category of a stored event under Key in its data.
+func (c *Classifier) TagEvent(e *models.Event) error {
+	data := map[string]interface{}{}
+	if len(e.Data) > 0 {
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return err
+		}
+	}
+	data[Key] = c.Categorize(data)
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	e.Data = raw
+	return nil
+}
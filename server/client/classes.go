@@ -73,12 +73,11 @@ var DefaultClasses = []ClassItem{
 }
 
 // GetClasses attempts to fetch "classes" from the server
-// via c.GetSetting("classes"). If that fails (error or parse issue),
+// via c.GetSettingValue("classes"). If that fails (error or parse issue),
 // it returns defaultClasses as a fallback.
 func GetClasses(c *TimelyGatorClient) []ClassItem {
 	// Attempt to fetch from the server
-	settingKey := "classes"
-	data, err := c.GetSetting(&settingKey)
+	data, err := c.GetSettingValue("classes")
 	if err != nil {
 		log.Printf("Failed to get classes from server; using default: %v", err)
 		return DefaultClasses
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -17,6 +19,7 @@ import (
 
 	"timelygator/server/database/models"
 	"timelygator/server/utils"
+	"timelygator/server/utils/certs"
 	"timelygator/server/utils/types"
 )
 
@@ -27,6 +30,10 @@ type TimelyGatorClient struct {
 	ServerAddress  string
 	Instance       *SingleInstance
 	CommitInterval float64
+	// APIToken is sent as a bearer token if the server requires authentication
+	APIToken string
+	// HTTPClient sends the requests, set up with the TLS_* config for https
+	HTTPClient *http.Client
 
 	LastHeartbeat map[string]*models.Event
 
@@ -41,14 +48,24 @@ func NewTimelyGatorClient(
 	portOverride *string,
 	protocol string,
 ) *TimelyGatorClient {
-	if protocol == "" {
-		protocol = "http"
-	}
-
 	var cfg types.Config
 	if err := env.Parse(&cfg); err != nil {
 		log.Fatalf("Failed to parse environment config: %v", err)
 	}
+	if protocol == "" {
+		protocol = cfg.Protocol
+	}
+
+	httpClient := &http.Client{}
+	if protocol == "https" {
+		tlsConfig, err := certs.ClientConfig(cfg.TLSCA, cfg.TLSClientCert, cfg.TLSClientKey)
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		httpClient.Transport = transport
+	}
 
 	serverHost := cfg.Interface
 	if hostOverride != nil && *hostOverride != "" {
@@ -79,6 +96,8 @@ func NewTimelyGatorClient(
 		ServerAddress:  serverAddress,
 		Instance:       inst,
 		CommitInterval: 60.0,
+		APIToken:       utils.LocalToken(cfg),
+		HTTPClient:     httpClient,
 		LastHeartbeat:  make(map[string]*models.Event),
 	}
 	c.requestQueue = NewRequestQueue(c)
@@ -89,13 +108,25 @@ func (c *TimelyGatorClient) _url(endpoint string) string {
 	return fmt.Sprintf("%s/api/v1/v1/%s", c.ServerAddress, endpoint)
 }
 
+// authorize adds the API token to a request, if one is configured.
+func (c *TimelyGatorClient) authorize(req *http.Request) {
+	if c.APIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIToken)
+	}
+}
+
 // GET request to fetch data from the server.
 func (c *TimelyGatorClient) get(endpoint string, params map[string]string) (*http.Response, error) {
 	url := c._url(endpoint)
 	if len(params) > 0 {
 		url = appendQuery(url, params)
 	}
-	resp, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -125,9 +156,9 @@ func (c *TimelyGatorClient) post(
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	c.authorize(req)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -154,9 +185,9 @@ func (c *TimelyGatorClient) deleteReq(endpoint string, data interface{}) (*http.
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	c.authorize(req)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -234,6 +265,71 @@ func (c *TimelyGatorClient) GetEvents(
 	return raw, nil
 }
 
+// GetEventsPage returns a page of up to pageSize events of a bucket, newest
+// first, and the cursor of the next page, which is empty after the last one.
+// Pass an empty cursor for the first page. If fields is not empty, only those
+// keys of the event data are returned.
+func (c *TimelyGatorClient) GetEventsPage(
+	bucketID string,
+	pageSize int,
+	cursor string,
+	start, end *time.Time,
+	fields []string,
+) ([]map[string]interface{}, string, error) {
+	endpoint := fmt.Sprintf("buckets/%s/events", bucketID)
+	params := map[string]string{"page_size": strconv.Itoa(pageSize)}
+	if cursor != "" {
+		params["cursor"] = cursor
+	}
+	if start != nil {
+		params["start"] = url.QueryEscape(start.Format(time.RFC3339))
+	}
+	if end != nil {
+		params["end"] = url.QueryEscape(end.Format(time.RFC3339))
+	}
+	if len(fields) > 0 {
+		params["fields"] = url.QueryEscape(strings.Join(fields, ","))
+	}
+	resp, err := c.get(endpoint, params)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, "", err
+	}
+	return raw, resp.Header.Get("X-Next-Cursor"), nil
+}
+
+// EachEvent calls fn for every event of a bucket between start and end,
+// newest first, fetching pageSize events at a time. It stops at the first
+// error, which is returned.
+func (c *TimelyGatorClient) EachEvent(
+	bucketID string,
+	pageSize int,
+	start, end *time.Time,
+	fields []string,
+	fn func(event map[string]interface{}) error,
+) error {
+	cursor := ""
+	for {
+		events, next, err := c.GetEventsPage(bucketID, pageSize, cursor, start, end, fields)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
 func (c *TimelyGatorClient) InsertEvent(bucketID string, evt interface{}) error {
 	endpoint := fmt.Sprintf("buckets/%s/events", bucketID)
 	data := []interface{}{evt} // single event
@@ -253,6 +349,77 @@ func (c *TimelyGatorClient) DeleteEvent(bucketID string, eventID int) error {
 	return err
 }
 
+// bulkParams returns the query parameters selecting the events of a bulk
+// operation. Keys of filter are data keys matched exactly, or by regular
+// expression when they end in "~".
+func bulkParams(start, end *time.Time, filter map[string]string, dryRun bool) map[string]string {
+	params := make(map[string]string)
+	if start != nil {
+		params["start"] = url.QueryEscape(start.Format(time.RFC3339))
+	}
+	if end != nil {
+		params["end"] = url.QueryEscape(end.Format(time.RFC3339))
+	}
+	for k, v := range filter {
+		params[url.QueryEscape("data."+k)] = url.QueryEscape(v)
+	}
+	if dryRun {
+		params["dry_run"] = "true"
+	}
+	return params
+}
+
+// bulkCount decodes the number of events a bulk operation changed.
+func bulkCount(resp *http.Response) (int, error) {
+	defer resp.Body.Close()
+	var res struct {
+		Count int `json:"count"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, err
+	}
+	return res.Count, nil
+}
+
+// DeleteEvents deletes the events of a bucket between start and end whose
+// data matches filter, and returns how many were deleted. With dryRun nothing
+// is deleted and the number of matching events is returned.
+func (c *TimelyGatorClient) DeleteEvents(
+	bucketID string,
+	start, end *time.Time,
+	filter map[string]string,
+	dryRun bool,
+) (int, error) {
+	endpoint := fmt.Sprintf("buckets/%s/events", bucketID)
+	endpoint = appendQuery(endpoint, bulkParams(start, end, filter, dryRun))
+	resp, err := c.deleteReq(endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	return bulkCount(resp)
+}
+
+// RewriteEvents sets the data key to value on the events of a bucket between
+// start and end whose data matches filter, and returns how many were
+// changed. With dryRun nothing is changed and the number of matching events
+// is returned.
+func (c *TimelyGatorClient) RewriteEvents(
+	bucketID string,
+	start, end *time.Time,
+	filter map[string]string,
+	key string,
+	value interface{},
+	dryRun bool,
+) (int, error) {
+	endpoint := fmt.Sprintf("buckets/%s/events/rewrite", bucketID)
+	data := map[string]interface{}{"key": key, "value": value}
+	resp, err := c.post(endpoint, data, bulkParams(start, end, filter, dryRun))
+	if err != nil {
+		return 0, err
+	}
+	return bulkCount(resp)
+}
+
 func (c *TimelyGatorClient) GetEventCount(
 	bucketID string,
 	start, end *time.Time,
@@ -368,6 +535,8 @@ func (c *TimelyGatorClient) CreateBucket(bucketID, eventType string, queued bool
 	return err
 }
 
+// DeleteBucket deletes a bucket with its events, or moves it to the trash if
+// the server keeps one. Servers outside testing mode require force.
 func (c *TimelyGatorClient) DeleteBucket(bucketID string, force bool) error {
 	endpoint := fmt.Sprintf("buckets/%s", bucketID)
 	if force {
@@ -377,6 +546,88 @@ func (c *TimelyGatorClient) DeleteBucket(bucketID string, force bool) error {
 	return err
 }
 
+// PurgeBucket deletes a bucket with its events at once, bypassing the trash,
+// or deletes it from the trash.
+func (c *TimelyGatorClient) PurgeBucket(bucketID string) error {
+	endpoint := fmt.Sprintf("buckets/%s?force=1&purge=1", bucketID)
+	_, err := c.deleteReq(endpoint, nil)
+	return err
+}
+
+// RestoreBucket takes a bucket out of the trash.
+func (c *TimelyGatorClient) RestoreBucket(bucketID string) error {
+	endpoint := fmt.Sprintf("buckets/%s/restore", bucketID)
+	resp, err := c.post(endpoint, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// RenameBucket changes the ID of a bucket.
+func (c *TimelyGatorClient) RenameBucket(bucketID, newID string) error {
+	endpoint := fmt.Sprintf("buckets/%s/rename", bucketID)
+	resp, err := c.post(endpoint, map[string]string{"id": newID}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// MergeBuckets moves the events of a bucket into another and deletes it.
+// overlap is "keep", "skip" or "replace", see the server API. It returns
+// the numbers of moved, skipped and replaced events.
+func (c *TimelyGatorClient) MergeBuckets(bucketID, into, overlap string) (map[string]int, error) {
+	endpoint := fmt.Sprintf("buckets/%s/merge", bucketID)
+	resp, err := c.post(endpoint, map[string]string{"into": into, "overlap": overlap}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result map[string]int
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SplitBucket moves the events of a bucket that begin at or after after, if
+// given, and whose data matches filter into a new bucket with hostname, if
+// given. It returns how many events were moved.
+func (c *TimelyGatorClient) SplitBucket(
+	bucketID, newID, hostname string,
+	after *time.Time,
+	filter map[string]string,
+) (int, error) {
+	endpoint := fmt.Sprintf("buckets/%s/split", bucketID)
+	data := map[string]string{"id": newID, "hostname": hostname}
+	if after != nil {
+		data["after"] = after.Format(time.RFC3339)
+	}
+	resp, err := c.post(endpoint, data, bulkParams(nil, nil, filter, false))
+	if err != nil {
+		return 0, err
+	}
+	return bulkCount(resp)
+}
+
+// GetTrash returns the buckets in the trash with the time they are deleted
+// and purged.
+func (c *TimelyGatorClient) GetTrash() ([]map[string]interface{}, error) {
+	resp, err := c.get("trash", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
 func (c *TimelyGatorClient) ExportAll() (map[string]interface{}, error) {
 	resp, err := c.get("export", nil)
 	if err != nil {
@@ -404,6 +655,30 @@ func (c *TimelyGatorClient) ExportBucket(bucketID string) (map[string]interface{
 	return raw, nil
 }
 
+// ExportTo writes the events of the buckets matching bucketPattern, or of
+// all buckets if it is empty, between start and end whose data matches
+// filter to w in an export format: json, ndjson, csv or ics.
+func (c *TimelyGatorClient) ExportTo(
+	w io.Writer,
+	format string,
+	start, end *time.Time,
+	bucketPattern string,
+	filter map[string]string,
+) error {
+	params := bulkParams(start, end, filter, false)
+	params["format"] = url.QueryEscape(format)
+	if bucketPattern != "" {
+		params["bucket_pattern"] = url.QueryEscape(bucketPattern)
+	}
+	resp, err := c.get("export", params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
 func (c *TimelyGatorClient) ImportBucket(bucket map[string]interface{}) error {
 	endpoint := "import"
 
@@ -422,6 +697,41 @@ func (c *TimelyGatorClient) ImportBucket(bucket map[string]interface{}) error {
 	return err
 }
 
+// ImportActivityWatch uploads an aw-server JSON export or database read from
+// r, handling existing buckets as onConflict says: skip, merge or replace. It
+// returns the counts of events imported, skipped and replaced.
+func (c *TimelyGatorClient) ImportActivityWatch(r io.Reader, onConflict string) (map[string]int64, error) {
+	endpoint := c._url("import/activitywatch")
+	if onConflict != "" {
+		endpoint = appendQuery(endpoint, map[string]string{"on_conflict": url.QueryEscape(onConflict)})
+	}
+	req, err := http.NewRequest("POST", endpoint, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	c.authorize(req)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Imported int64  `json:"imported"`
+		Skipped  int64  `json:"skipped"`
+		Replaced int64  `json:"replaced"`
+		Error    string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode >= 400 {
+		if result.Error != "" {
+			return nil, fmt.Errorf("POST %s => status %d: %s", endpoint, resp.StatusCode, result.Error)
+		}
+		return nil, fmt.Errorf("POST %s => status %d", endpoint, resp.StatusCode)
+	}
+	return map[string]int64{"imported": result.Imported, "skipped": result.Skipped, "replaced": result.Replaced}, nil
+}
+
 func (c *TimelyGatorClient) Query(
 	queryStr string,
 	timeperiods [][2]time.Time,
@@ -478,7 +788,27 @@ func (c *TimelyGatorClient) GetSetting(key *string) (map[string]interface{}, err
 	return raw, nil
 }
 
+// GetSettingValue fetches the value of a single setting, which may be any
+// JSON value (e.g. the list stored under "classes").
+func (c *TimelyGatorClient) GetSettingValue(key string) (interface{}, error) {
+	resp, err := c.get(fmt.Sprintf("settings/%s", key), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var raw interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
 func (c *TimelyGatorClient) SetSetting(key string, value string) error {
+	return c.SetSettingValue(key, value)
+}
+
+// SetSettingValue stores any JSON-serializable value under key.
+func (c *TimelyGatorClient) SetSettingValue(key string, value interface{}) error {
 	endpoint := fmt.Sprintf("settings/%s", key)
 	_, err := c.post(endpoint, value, nil)
 	return err
@@ -5,10 +5,13 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"timelygator/server/utils/certs"
 )
 
 // testServerHandler simulates the server responses expected by the client.
@@ -345,3 +348,121 @@ func TestWaitForStart(t *testing.T) {
 		t.Fatalf("WaitForStart error: %v", err)
 	}
 }
+
+func TestAPIToken(t *testing.T) {
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Method+" "+r.Header.Get("Authorization"))
+		testServerHandler(w, r)
+	}))
+	defer ts.Close()
+
+	client := newTestClient(ts.URL)
+	client.APIToken = "tg_secret"
+	if _, err := client.GetInfo(); err != nil {
+		t.Fatalf("GetInfo error: %v", err)
+	}
+	if err := client.SetSetting("testKey", "testValue"); err != nil {
+		t.Fatalf("SetSetting error: %v", err)
+	}
+	for _, h := range got {
+		if !strings.HasSuffix(h, " Bearer tg_secret") {
+			t.Errorf("Expected bearer token on every request, got %q", h)
+		}
+	}
+}
+
+func TestCustomCA(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	for _, pair := range [][3]string{{serverCert, serverKey, "127.0.0.1"}, {clientCert, clientKey, "laptop"}} {
+		if _, err := certs.EnsureSelfSigned(pair[0], pair[1], []string{pair[2]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serverConfig, err := certs.ServerConfig(serverCert, serverKey, clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(testServerHandler))
+	ts.TLS = serverConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	t.Setenv("PROTOCOL", "https")
+	t.Setenv("TLS_CA", serverCert)
+	t.Setenv("TLS_CLIENT_CERT", clientCert)
+	t.Setenv("TLS_CLIENT_KEY", clientKey)
+	client := NewTimelyGatorClient("test-client", true, nil, nil, "")
+	if !strings.HasPrefix(client.ServerAddress, "https://") {
+		t.Fatalf("Expected https server address, got %s", client.ServerAddress)
+	}
+	client.ServerAddress = ts.URL
+	if _, err := client.GetInfo(); err != nil {
+		t.Fatalf("GetInfo error: %v", err)
+	}
+
+	// Without the CA the self-signed certificate is not trusted
+	plain := newTestClient(ts.URL)
+	if _, err := plain.GetInfo(); err == nil {
+		t.Fatal("Expected an untrusted certificate to be rejected")
+	}
+}
+
+func TestEachEvent(t *testing.T) {
+	var queries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		queries = append(queries, q.Get("page_size")+"/"+q.Get("cursor")+"/"+q.Get("fields"))
+		switch q.Get("cursor") {
+		case "":
+			w.Header().Set("X-Next-Cursor", "page2")
+			json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 3}, {"id": 2}})
+		case "page2":
+			json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 1}})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	client := newTestClient(ts.URL)
+	var ids []float64
+	err := client.EachEvent("bucket1", 2, nil, nil, []string{"app", "title"}, func(e map[string]interface{}) error {
+		ids = append(ids, e["id"].(float64))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("EachEvent error: %v", err)
+	}
+	if len(ids) != 3 || ids[0] != 3 || ids[2] != 1 {
+		t.Errorf("Expected events 3, 2, 1, got %v", ids)
+	}
+	if strings.Join(queries, " ") != "2//app,title 2/page2/app,title" {
+		t.Errorf("Unexpected page requests %v", queries)
+	}
+}
+
+func TestDeleteEvents(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		got = r.Method + " " + r.URL.Path + " " + q.Get("data.title~") + " " + q.Get("start") + " " + q.Get("dry_run")
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": 4, "dry_run": q.Has("dry_run")})
+	}))
+	defer ts.Close()
+
+	client := newTestClient(ts.URL)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.FixedZone("", 3600))
+	count, err := client.DeleteEvents("bucket1", &start, nil, map[string]string{"title~": "^My Bank"}, true)
+	if err != nil {
+		t.Fatalf("DeleteEvents error: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("Expected 4 events, got %d", count)
+	}
+	if want := "DELETE /api/v1/v1/buckets/bucket1/events ^My Bank 2024-01-01T00:00:00+01:00 true"; got != want {
+		t.Errorf("Unexpected request %q, want %q", got, want)
+	}
+}
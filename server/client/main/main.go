@@ -17,10 +17,12 @@ import (
 
 // Global options that we parse from root flags
 type rootOpts struct {
-	host    string
-	port    int
-	verbose bool
-	testing bool
+	host     string
+	port     int
+	verbose  bool
+	testing  bool
+	token    string
+	protocol string
 }
 
 // We'll store a single global TimelyGatorClient in our CLI. Another approach is to store this in the cobra command context.
@@ -50,8 +52,11 @@ var rootCmd = &cobra.Command{
 			gOpts.testing, // testing
 			&gOpts.host,
 			intToStringPtr(finalPort),
-			"http", // or "http"
+			gOpts.protocol,
 		)
+		if gOpts.token != "" {
+			gClient.APIToken = gOpts.token
+		}
 
 		// If verbose => set logging to debug
 		if gOpts.verbose {
@@ -112,6 +117,120 @@ var bucketsCmd = &cobra.Command{
 	},
 }
 
+// deleteBucketCmd => `tg-cli delete-bucket <bucket_id> [--force] [--purge]`
+var deleteBucketCmd = &cobra.Command{
+	Use:   "delete-bucket <bucket_id>",
+	Short: "Delete a bucket and its events, or move it to the trash if the server keeps one",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		force, _ := cmd.Flags().GetBool("force")
+		purge, _ := cmd.Flags().GetBool("purge")
+		if purge {
+			if !force {
+				return fmt.Errorf("purging cannot be undone, pass --force to confirm")
+			}
+			if err := gClient.PurgeBucket(args[0]); err != nil {
+				return fmt.Errorf("failed to purge bucket: %v", err)
+			}
+			log.Printf("Purged bucket %s\n", args[0])
+			return nil
+		}
+		if err := gClient.DeleteBucket(args[0], force); err != nil {
+			return fmt.Errorf("failed to delete bucket: %v", err)
+		}
+		log.Printf("Deleted bucket %s\n", args[0])
+		return nil
+	},
+}
+
+// restoreBucketCmd => `tg-cli restore-bucket <bucket_id>`
+var restoreBucketCmd = &cobra.Command{
+	Use:   "restore-bucket <bucket_id>",
+	Short: "Restore a bucket from the trash",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := gClient.RestoreBucket(args[0]); err != nil {
+			return fmt.Errorf("failed to restore bucket: %v", err)
+		}
+		log.Printf("Restored bucket %s\n", args[0])
+		return nil
+	},
+}
+
+// trashCmd => `tg-cli trash`
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "List deleted buckets that can be restored",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		trash, err := gClient.GetTrash()
+		if err != nil {
+			return fmt.Errorf("failed to get trash: %v", err)
+		}
+		log.Println("Trash:")
+		for _, b := range trash {
+			log.Printf(" - %v (deleted %v, purged %v)\n", b["id"], b["deleted"], b["purge"])
+		}
+		return nil
+	},
+}
+
+// renameBucketCmd => `tg-cli rename-bucket <bucket_id> <new_id>`
+var renameBucketCmd = &cobra.Command{
+	Use:   "rename-bucket <bucket_id> <new_id>",
+	Short: "Change the ID of a bucket, keeping its events",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := gClient.RenameBucket(args[0], args[1]); err != nil {
+			return fmt.Errorf("failed to rename bucket: %v", err)
+		}
+		log.Printf("Renamed bucket %s to %s\n", args[0], args[1])
+		return nil
+	},
+}
+
+// mergeBucketsCmd => `tg-cli merge-buckets <bucket_id> <into> [--overlap=keep]`
+var mergeBucketsCmd = &cobra.Command{
+	Use:   "merge-buckets <bucket_id> <into>",
+	Short: "Move the events of a bucket into another and delete it",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		overlap, _ := cmd.Flags().GetString("overlap")
+		result, err := gClient.MergeBuckets(args[0], args[1], overlap)
+		if err != nil {
+			return fmt.Errorf("failed to merge buckets: %v", err)
+		}
+		log.Printf("Merged bucket %s into %s: %d events moved, %d skipped, %d replaced\n",
+			args[0], args[1], result["moved"], result["skipped"], result["replaced"])
+		return nil
+	},
+}
+
+// splitBucketCmd => `tg-cli split-bucket <bucket_id> <new_id> [--hostname] [--after]`
+var splitBucketCmd = &cobra.Command{
+	Use:   "split-bucket <bucket_id> <new_id>",
+	Short: "Move the events of a bucket from a time on into a new bucket",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		hostname, _ := cmd.Flags().GetString("hostname")
+		afterStr, _ := cmd.Flags().GetString("after")
+		filter, _ := cmd.Flags().GetStringToString("data")
+		var after *time.Time
+		if afterStr != "" {
+			t, err := parseDateTime(afterStr)
+			if err != nil {
+				return err
+			}
+			after = &t
+		}
+		moved, err := gClient.SplitBucket(args[0], args[1], hostname, after, filter)
+		if err != nil {
+			return fmt.Errorf("failed to split bucket: %v", err)
+		}
+		log.Printf("Moved %d events of bucket %s to %s\n", moved, args[0], args[1])
+		return nil
+	},
+}
+
 // eventsCmd => `tg-cli events <bucket_id>`
 var eventsCmd = &cobra.Command{
 	Use:   "events <bucket_id>",
@@ -266,11 +385,17 @@ var reportCmd = &cobra.Command{
 	},
 }
 
-// exportCmd => `tg-cli export`
+// exportCmd => `tg-cli export [--format] [--output] [--start] [--end] [--buckets] [--data]`
 var exportCmd = &cobra.Command{
 	Use:   "export",
 	Short: "Export all buckets and their events",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, name := range []string{"format", "output", "start", "end", "buckets", "data"} {
+			if cmd.Flags().Changed(name) {
+				return exportTo(cmd)
+			}
+		}
+
 		data, err := gClient.ExportAll()
 		if err != nil {
 			return fmt.Errorf("failed to export all data: %v", err)
@@ -293,6 +418,58 @@ var exportCmd = &cobra.Command{
 	},
 }
 
+// exportTo writes the export selected by the flags of the export command to
+// the output file, or to stdout.
+func exportTo(cmd *cobra.Command) error {
+	format, _ := cmd.Flags().GetString("format")
+	output, _ := cmd.Flags().GetString("output")
+	bucketPattern, _ := cmd.Flags().GetString("buckets")
+	filter, _ := cmd.Flags().GetStringToString("data")
+	start, err := optionalDateTime(cmd, "start")
+	if err != nil {
+		return err
+	}
+	end, err := optionalDateTime(cmd, "end")
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := gClient.ExportTo(w, format, start, end, bucketPattern, filter); err != nil {
+		return fmt.Errorf("failed to export: %v", err)
+	}
+	return nil
+}
+
+// importActivityWatchCmd => `tg-cli import-activitywatch <file> [--on-conflict]`
+var importActivityWatchCmd = &cobra.Command{
+	Use:   "import-activitywatch <file>",
+	Short: "Import an ActivityWatch export or aw-server database file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		onConflict, _ := cmd.Flags().GetString("on-conflict")
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		result, err := gClient.ImportActivityWatch(f, onConflict)
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %v", args[0], err)
+		}
+		log.Printf("Imported %s: %d events imported, %d skipped, %d replaced\n",
+			args[0], result["imported"], result["skipped"], result["replaced"])
+		return nil
+	},
+}
 
 // canonicalCmd => `tg-cli canonical <hostname> [--cache] [--start] [--stop]`
 var canonicalCmd = &cobra.Command{
@@ -394,6 +571,19 @@ func parseDateTime(s string) (time.Time, error) {
 	return time.Time{}, fmt.Errorf("invalid time format (must be RFC3339), got: %q", s)
 }
 
+// optionalDateTime parses the time flag name, or returns nil if it is empty.
+func optionalDateTime(cmd *cobra.Command, name string) (*time.Time, error) {
+	s, _ := cmd.Flags().GetString(name)
+	if s == "" {
+		return nil, nil
+	}
+	t, err := parseDateTime(s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
 // intToStringPtr => quick helper to turn an int into a *string
 func intToStringPtr(i int) *string {
 	s := strconv.Itoa(i)
@@ -406,6 +596,8 @@ func init() {
 	rootCmd.PersistentFlags().IntVar(&gOpts.port, "port", 8080, "Port to use")
 	rootCmd.PersistentFlags().BoolVar(&gOpts.testing, "testing", false, "Use testing mode (port=8080 if not specified)") // change
 	rootCmd.PersistentFlags().BoolVar(&gOpts.verbose, "verbose", false, "Enable verbose logging")
+	rootCmd.PersistentFlags().StringVar(&gOpts.token, "token", "", "API token (defaults to API_TOKEN from the environment)")
+	rootCmd.PersistentFlags().StringVar(&gOpts.protocol, "protocol", "", "http or https (defaults to PROTOCOL from the environment)")
 
 	// Subcommand: heartbeat
 	heartbeatCmd.Flags().Int("pulsetime", 60, "Pulsetime for merging heartbeats")
@@ -428,13 +620,43 @@ func init() {
 	canonicalCmd.Flags().String("start", time.Now().Add(-24*time.Hour).Format(time.RFC3339), "Start time (RFC3339)")
 	canonicalCmd.Flags().String("stop", time.Now().Add(365*24*time.Hour).Format(time.RFC3339), "Stop time (RFC3339)")
 
+	// Subcommand: delete-bucket
+	deleteBucketCmd.Flags().Bool("force", false, "Confirm deleting, required unless the server is in testing mode")
+	deleteBucketCmd.Flags().Bool("purge", false, "Delete at once instead of moving to the trash, or delete from the trash")
+
+	// Subcommand: merge-buckets
+	mergeBucketsCmd.Flags().String("overlap", "keep", "Events overlapping the other bucket's: keep, skip or replace them")
+
+	// Subcommand: split-bucket
+	splitBucketCmd.Flags().String("hostname", "", "Hostname of the new bucket, defaults to the old one's")
+	splitBucketCmd.Flags().String("after", "", "Move events beginning at or after this time (RFC3339)")
+	splitBucketCmd.Flags().StringToString("data", nil, "Move events whose data key equals the value, key~ for a regular expression")
+
+	// Subcommand: export
+	exportCmd.Flags().String("format", "json", "Export format: json, ndjson, csv or ics")
+	exportCmd.Flags().String("output", "", "File to write the export to instead of stdout")
+	exportCmd.Flags().String("start", "", "Only events after this time (RFC3339)")
+	exportCmd.Flags().String("end", "", "Only events before this time (RFC3339)")
+	exportCmd.Flags().String("buckets", "", "Only buckets whose ID matches this pattern, such as tg-observer-window_*")
+	exportCmd.Flags().StringToString("data", nil, "Only events whose data key equals the value, key~ for a regular expression")
+
+	// Subcommand: import-activitywatch
+	importActivityWatchCmd.Flags().String("on-conflict", "merge", "Existing buckets: skip, merge or replace them")
+
 	// Register subcommands
 	rootCmd.AddCommand(heartbeatCmd)
 	rootCmd.AddCommand(bucketsCmd)
+	rootCmd.AddCommand(deleteBucketCmd)
+	rootCmd.AddCommand(restoreBucketCmd)
+	rootCmd.AddCommand(trashCmd)
+	rootCmd.AddCommand(renameBucketCmd)
+	rootCmd.AddCommand(mergeBucketsCmd)
+	rootCmd.AddCommand(splitBucketCmd)
 	rootCmd.AddCommand(eventsCmd)
 	rootCmd.AddCommand(queryCmd)
 	rootCmd.AddCommand(reportCmd)
 	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importActivityWatchCmd)
 	rootCmd.AddCommand(canonicalCmd)
 }
 
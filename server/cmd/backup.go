@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"timelygator/server/backup"
+	"timelygator/server/database"
+	"timelygator/server/utils/types"
+
+	"github.com/spf13/cobra"
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <snapshot>",
+	Short: "Replace the database with a backup",
+	Long: `Replace the database with a backup taken by the server, given by its path or
+its file name in the backup directory. Stop the server first.
+
+The backup is checked before it is restored, and a backup of the current
+database is taken, so a restore can be undone by restoring that one.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig()
+		dir, err := database.BackupDir(cfg)
+		if err != nil {
+			log.Fatalf("Error finding the backup directory: %v", err)
+		}
+		target, err := database.Path(cfg)
+		if err != nil {
+			log.Fatalf("Error finding the database: %v", err)
+		}
+		snapshot := args[0]
+		if _, err := os.Stat(snapshot); os.IsNotExist(err) && filepath.Base(snapshot) == snapshot {
+			snapshot = filepath.Join(dir, snapshot)
+		}
+		before, err := backup.Restore(snapshot, target, dir)
+		if err != nil {
+			log.Fatalf("Error restoring %s: %v", snapshot, err)
+		}
+		if before != nil {
+			fmt.Fprintf(os.Stderr, "Backed up the replaced database to %s\n", before.Path)
+		}
+		fmt.Fprintf(os.Stderr, "Restored %s to %s\n", snapshot, target)
+	},
+}
+
+// scheduleBackups backs up the database in the background as the config says.
+func scheduleBackups(cfg types.Config, ds *database.Datastore) {
+	if cfg.BackupInterval <= 0 {
+		return
+	}
+	if name := ds.DB().Dialector.Name(); name != database.SQLite {
+		slog.Warn(fmt.Sprintf("Not backing up the %s database, only SQLite databases are backed up", name))
+		return
+	}
+	dir, err := database.BackupDir(cfg)
+	if err != nil {
+		log.Fatalf("Error finding the backup directory: %v", err)
+	}
+	db, err := ds.DB().DB()
+	if err != nil {
+		log.Fatalf("Error scheduling backups: %v", err)
+	}
+	policy := backup.Policy{
+		Daily:   cfg.BackupKeepDaily,
+		Weekly:  cfg.BackupKeepWeekly,
+		Monthly: cfg.BackupKeepMonthly,
+	}
+	slog.Info(fmt.Sprintf("Backing up the database to %s every %d hours", dir, cfg.BackupInterval))
+	go backup.Schedule(db, dir, time.Duration(cfg.BackupInterval)*time.Hour, policy)
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+}
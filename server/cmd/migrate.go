@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/database/migrations"
+
+	"github.com/spf13/cobra"
+	"gorm.io/gorm"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Show and change the version of the database schema",
+	Long: `Show and change the version of the database schema. The server migrates the
+database to the latest version when it starts, so these commands are only
+needed to migrate ahead of time or to go back to an earlier version.
+
+Before changing the schema a backup of the database is taken, which
+'tg-server restore' restores. Stop the server first.`,
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List the migrations and whether they are applied",
+	Run: func(cmd *cobra.Command, args []string) {
+		db, _ := connectDatabase(false)
+		states, err := migrations.Status(db)
+		if err != nil {
+			log.Fatalf("Error reading the schema version: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range states {
+			applied := "pending"
+			if s.Applied != nil {
+				applied = s.Applied.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		w.Flush()
+	},
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply the pending migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		to, _ := cmd.Flags().GetInt("to")
+		db, backupDir := connectDatabase(true)
+		if pending, err := migrations.Pending(db); err == nil && len(pending) > 0 {
+			backupBeforeMigrating(db, backupDir)
+		}
+		applied, err := migrations.Up(db, to)
+		for _, m := range applied {
+			fmt.Fprintf(os.Stderr, "Applied migration %d: %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("Error migrating: %v", err)
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(os.Stderr, "The database is up to date")
+		}
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Revert the newest migration, or those above a version",
+	Long: `Revert the newest migration, or those above the version of --to.
+
+Reverting migration 1 drops all tables and the data in them, so it is only
+done with an explicit --to 0 and --yes.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		db, backupDir := connectDatabase(true)
+		version, err := migrations.Version(db)
+		if err != nil {
+			log.Fatalf("Error reading the schema version: %v", err)
+		}
+		to, _ := cmd.Flags().GetInt("to")
+		if !cmd.Flags().Changed("to") {
+			to = max(version-1, 0)
+		}
+		if yes, _ := cmd.Flags().GetBool("yes"); to == 0 && version > 0 && (!cmd.Flags().Changed("to") || !yes) {
+			log.Fatalf("Reverting migration 1 drops all tables and their data, run with --to 0 --yes to do so")
+		}
+		if version > to {
+			backupBeforeMigrating(db, backupDir)
+		}
+		reverted, err := migrations.Down(db, to)
+		for _, m := range reverted {
+			fmt.Fprintf(os.Stderr, "Reverted migration %d: %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("Error reverting migrations: %v", err)
+		}
+		if len(reverted) == 0 {
+			fmt.Fprintln(os.Stderr, "No migrations to revert")
+		}
+	},
+}
+
+// connectDatabase opens the database of the server without migrating it, and
+// returns it with the backup directory.
+func connectDatabase(needBackups bool) (*gorm.DB, string) {
+	cfg := loadConfig()
+	dialector, err := database.Dialector(cfg)
+	if err != nil {
+		log.Fatalf("Error finding the database: %v", err)
+	}
+	db, err := database.Connect(dialector)
+	if err != nil {
+		log.Fatalf("Error opening the database: %v", err)
+	}
+	if !needBackups {
+		return db, ""
+	}
+	dir, err := database.BackupDir(cfg)
+	if err != nil {
+		log.Fatalf("Error finding the backup directory: %v", err)
+	}
+	return db, dir
+}
+
+// backupBeforeMigrating takes a backup of db unless it is empty or not an
+// SQLite database, which are backed up with their own tools.
+func backupBeforeMigrating(db *gorm.DB, dir string) {
+	if db.Dialector.Name() != database.SQLite {
+		fmt.Fprintf(os.Stderr, "Not backing up the %s database, back it up with its own tools first\n", db.Dialector.Name())
+		return
+	}
+	snapshot, err := migrations.Backup(db, dir)
+	if err != nil {
+		log.Fatalf("Error backing up the database: %v", err)
+	}
+	if snapshot != nil {
+		fmt.Fprintf(os.Stderr, "Backed up the database to %s\n", snapshot.Path)
+	}
+}
+
+func init() {
+	migrateUpCmd.Flags().Int("to", 0, "Version to migrate to, defaults to the latest")
+	migrateDownCmd.Flags().Int("to", 0, "Version to go back to, defaults to the one before the current")
+	migrateDownCmd.Flags().Bool("yes", false, "Confirm dropping all tables when going back to version 0")
+	migrateCmd.AddCommand(migrateStatusCmd, migrateUpCmd, migrateDownCmd)
+	rootCmd.AddCommand(migrateCmd)
+}
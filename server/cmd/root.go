@@ -1,13 +1,18 @@
 package cmd
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"timelygator/server/api"
 	"timelygator/server/database"
+	"timelygator/server/metrics"
+	"timelygator/server/utils"
+	"timelygator/server/utils/certs"
 	"timelygator/server/utils/types"
 
 	"github.com/rs/cors"
@@ -25,37 +30,129 @@ var rootCmd = &cobra.Command{
 	Short:   "TimelyGator is a time tracking application. This is the server cli for the project",
 	Version: types.ModuleVersion,
 	Run: func(cmd *cobra.Command, args []string) {
-		cfg := types.Config{}
-		if err := env.Parse(&cfg); err != nil {
-			log.Fatalf("Error parsing config: %v", err)
-		}
-		if strings.Contains(cfg.DataSourceName, "@") {
-			log.Fatalf("Only SQLite DSN is supported")
-		}
+		cfg := loadConfig()
 
 		c := cors.New(cors.Options{
-			AllowedOrigins:   []string{"*"},
+			AllowedOrigins:   cfg.CORSOrigins,
+			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "HEAD"},
+			AllowedHeaders:   []string{"Authorization", "Content-Type", "Last-Event-ID"},
+			ExposedHeaders:   []string{"X-Next-Cursor", "Link"},
 			AllowCredentials: true,
 		})
+		if !cfg.AuthEnabled && cfg.GoogleClientID == "" {
+			slog.Warn("API token authentication is disabled, any process that reaches the server can change data")
+		} else if !cfg.AuthEnabled {
+			slog.Info("Web UI requires signing in with Google, local observers can send heartbeats to buckets without owner without tokens")
+		}
 
 		datastore, err := database.InitDB(cfg)
 		if err != nil {
 			log.Fatalf("Error initializing database: %v", err)
 		}
+		if cfg.AuthEnabled {
+			bootstrapToken(cfg, datastore)
+		}
+		scheduleBackups(cfg, datastore)
 		routes := mux.NewRouter().PathPrefix("/api/v1").Subrouter()
 		api.RegisterRoutes(cfg, datastore, routes)
 
 		router := mux.NewRouter()
 		router.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
 		router.PathPrefix("/api/v1/").Handler(routes)
+		serveMetrics(cfg, router)
 
 		handler := c.Handler(router)
 
-		slog.Info(fmt.Sprintf("Server running on %s:%s", cfg.Interface, cfg.Port))
-		log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%s", cfg.Interface, cfg.Port), handler))
+		tlsConfig, err := serverTLS(&cfg)
+		if err != nil {
+			log.Fatalf("Error configuring TLS: %v", err)
+		}
+		server := &http.Server{
+			Addr:      fmt.Sprintf("%s:%s", cfg.Interface, cfg.Port),
+			Handler:   handler,
+			TLSConfig: tlsConfig,
+		}
+		if tlsConfig == nil {
+			slog.Info(fmt.Sprintf("Server running on http://%s:%s", cfg.Interface, cfg.Port))
+			log.Fatal(server.ListenAndServe())
+		}
+		slog.Info(fmt.Sprintf("Server running on https://%s:%s", cfg.Interface, cfg.Port))
+		log.Fatal(server.ListenAndServeTLS("", ""))
 	},
 }
 
+// loadConfig parses the server config from the environment.
+func loadConfig() types.Config {
+	cfg := types.Config{}
+	if err := env.Parse(&cfg); err != nil {
+		log.Fatalf("Error parsing config: %v", err)
+	}
+	return cfg
+}
+
+// serveMetrics serves the Prometheus metrics on their own listener if
+// METRICS_ADDR is set, or at /metrics of router if they are enabled.
+func serveMetrics(cfg types.Config, router *mux.Router) {
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		go func() {
+			slog.Info(fmt.Sprintf("Metrics served on http://%s/metrics", cfg.MetricsAddr))
+			log.Fatal(http.ListenAndServe(cfg.MetricsAddr, mux))
+		}()
+	} else if cfg.MetricsEnabled {
+		router.Handle("/metrics", api.MetricsHandler()).Methods("GET")
+	}
+}
+
+// serverTLS returns the TLS config to serve with, or nil to serve plain HTTP.
+// With TLS_SELF_SIGNED a certificate is created on the first run.
+func serverTLS(cfg *types.Config) (*tls.Config, error) {
+	if cfg.TLSSelfSigned {
+		if cfg.TLSCert == "" || cfg.TLSKey == "" {
+			dir, err := utils.GetDir("config")
+			if err != nil {
+				return nil, err
+			}
+			cfg.TLSCert = filepath.Join(dir, "tls", "cert.pem")
+			cfg.TLSKey = filepath.Join(dir, "tls", "key.pem")
+		}
+		hosts := cfg.TLSHosts
+		if len(hosts) == 0 {
+			hosts = certs.DefaultHosts()
+		}
+		created, err := certs.EnsureSelfSigned(cfg.TLSCert, cfg.TLSKey, hosts)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			slog.Info(fmt.Sprintf("Created self-signed certificate %s for %s", cfg.TLSCert, strings.Join(hosts, ", ")))
+		}
+		fingerprint, err := certs.Fingerprint(cfg.TLSCert)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info(fmt.Sprintf("Set TLS_CA=%s on observers to trust the certificate, SHA-256 fingerprint %s", cfg.TLSCert, fingerprint))
+	}
+	if cfg.TLSCert == "" && cfg.TLSKey == "" {
+		if cfg.TLSClientCA != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA needs TLS_CERT and TLS_KEY")
+		}
+		return nil, nil
+	}
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return nil, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	tlsConfig, err := certs.ServerConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TLSClientCA != "" {
+		slog.Info(fmt.Sprintf("Requiring client certificates signed by %s", cfg.TLSClientCA))
+	}
+	return tlsConfig, nil
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalf("Error executing command: %v", err)
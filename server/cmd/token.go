@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/middleware/auth"
+	"timelygator/server/utils"
+	"timelygator/server/utils/types"
+
+	"github.com/spf13/cobra"
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage API tokens used to authenticate clients and observers",
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create an API token and print it",
+	Long: `Create an API token with the given scopes and print it. The token is only shown once.
+
+Scopes are read, write-events, admin and bucket:<prefix>, which restricts the
+token to buckets whose ID starts with prefix. Observers need write-events.
+
+With --user the token belongs to a user and only reaches their buckets.
+Tokens without user reach every bucket.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		scopes, _ := cmd.Flags().GetStringSlice("scope")
+		email, _ := cmd.Flags().GetString("user")
+		ds := openDatastore()
+		if email != "" {
+			user, err := ds.UserByEmail(email, false)
+			if err != nil {
+				log.Fatalf("Error finding user: %v", err)
+			}
+			ds = ds.ForOwner(user.ID, false)
+		}
+		token, stored, err := auth.IssueToken(ds, args[0], scopes)
+		if err != nil {
+			log.Fatalf("Error creating token: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Created token '%s' (id %d) with scopes %s\n", stored.Name, stored.ID, stored.Scopes)
+		fmt.Println(token)
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List API tokens",
+	Run: func(cmd *cobra.Command, args []string) {
+		tokens, err := openDatastore().Tokens()
+		if err != nil {
+			log.Fatalf("Error listing tokens: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tPREFIX\tSCOPES\tUSER\tLAST USED")
+		for _, t := range tokens {
+			user := "-"
+			if t.UserID != nil {
+				user = fmt.Sprint(*t.UserID)
+			}
+			var scopes []string
+			json.Unmarshal(t.Scopes, &scopes)
+			lastUsed := "never"
+			if t.LastUsed != nil {
+				lastUsed = t.LastUsed.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s…\t%v\t%s\t%s\n", t.ID, t.Name, t.Prefix, scopes, user, lastUsed)
+		}
+		w.Flush()
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <id|name>",
+	Short: "Revoke an API token",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := openDatastore().DeleteToken(args[0]); err != nil {
+			log.Fatalf("Error revoking token: %v", err)
+		}
+		fmt.Printf("Revoked token %s\n", args[0])
+	},
+}
+
+// bootstrapToken creates an admin token on the first run with authentication,
+// when there are no tokens yet, and writes it to the token file, readable only
+// by the user running the server. Clients and observers on this machine send
+// it unless API_TOKEN is set.
+func bootstrapToken(cfg types.Config, ds *database.Datastore) {
+	tokens, err := ds.Tokens()
+	if err != nil {
+		log.Fatalf("Error listing tokens: %v", err)
+	}
+	if len(tokens) > 0 {
+		return
+	}
+	path, err := utils.TokenFile(cfg)
+	if err != nil {
+		log.Fatalf("Error finding the token file: %v", err)
+	}
+	token, stored, err := auth.IssueToken(ds, "local", []string{string(auth.Admin)})
+	if err != nil {
+		log.Fatalf("Error creating the first token: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		log.Fatalf("Error writing the token file: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		log.Fatalf("Error writing the token file: %v", err)
+	}
+	slog.Info(fmt.Sprintf("Created admin token '%s' in %s for clients and observers on this machine, "+
+		"create tokens for others with `tg-server token create`", stored.Name, path))
+}
+
+// openDatastore opens the database configured in the environment.
+func openDatastore() *database.Datastore {
+	ds, err := database.InitDB(loadConfig())
+	if err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+	return ds
+}
+
+func init() {
+	tokenCreateCmd.Flags().StringSlice("scope", []string{"write-events"}, "Scopes to grant (repeat or comma-separate)")
+	tokenCreateCmd.Flags().String("user", "", "Email of the user the token belongs to")
+	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenRevokeCmd)
+	rootCmd.AddCommand(tokenCmd)
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+
+	"github.com/spf13/cobra"
+)
+
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage the users of a shared server",
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add <email>",
+	Short: "Add a user",
+	Long: `Add a user, who is linked to their Google account when they first sign in with
+the same email. Create tokens for their observers with 'token create --user'.
+
+The first user is always an admin. Admins change settings and webhooks and
+also see buckets without owner.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, _ := cmd.Flags().GetString("name")
+		admin, _ := cmd.Flags().GetBool("admin")
+		user := &models.User{
+			Provider: database.LocalProvider,
+			Subject:  args[0],
+			Email:    args[0],
+			Name:     name,
+			Admin:    admin,
+			Created:  time.Now().UTC(),
+		}
+		if err := openDatastore().CreateUser(user); err != nil {
+			log.Fatalf("Error adding user: %v", err)
+		}
+		fmt.Printf("Added user %s (id %d, admin %v)\n", user.Email, user.ID, user.Admin)
+	},
+}
+
+var userListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List users",
+	Run: func(cmd *cobra.Command, args []string) {
+		users, err := openDatastore().Users()
+		if err != nil {
+			log.Fatalf("Error listing users: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tEMAIL\tNAME\tPROVIDER\tADMIN\tLAST LOGIN")
+		for _, u := range users {
+			lastLogin := "never"
+			if !u.LastLogin.IsZero() {
+				lastLogin = u.LastLogin.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%v\t%s\n", u.ID, u.Email, u.Name, u.Provider, u.Admin, lastLogin)
+		}
+		w.Flush()
+	},
+}
+
+var userRemoveCmd = &cobra.Command{
+	Use:   "remove <id|email>",
+	Short: "Remove a user with their sessions and tokens",
+	Long:  "Remove a user with their sessions and tokens. Their buckets are kept and shared with admins.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ds := openDatastore()
+		id, err := strconv.ParseUint(args[0], 10, 0)
+		if err != nil {
+			user, err := ds.UserByEmail(args[0], false)
+			if err != nil {
+				log.Fatalf("Error finding user: %v", err)
+			}
+			id = uint64(user.ID)
+		}
+		if err := ds.DeleteUser(uint(id)); err != nil {
+			log.Fatalf("Error removing user: %v", err)
+		}
+		fmt.Printf("Removed user %s\n", args[0])
+	},
+}
+
+func init() {
+	userAddCmd.Flags().String("name", "", "Display name")
+	userAddCmd.Flags().Bool("admin", false, "Let the user change settings and webhooks")
+	userCmd.AddCommand(userAddCmd, userListCmd, userRemoveCmd)
+	rootCmd.AddCommand(userCmd)
+}
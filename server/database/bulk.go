@@ -0,0 +1,156 @@
+package database
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"timelygator/server/database/models"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// bulkBatchSize is the number of event IDs changed per statement, well below
+// the SQLite limit on query parameters.
+const bulkBatchSize = 500
+
+// matching returns the query of the bucket's events that overlap the time
+// between start and end and pass the bucket's filter.
+func (b *Bucket) matching(tx *gorm.DB, start, end *time.Time) *gorm.DB {
+	q := tx.Model(&models.Event{}).Where("bucket_id = ?", b.bucketID)
+	q = overlapping(q, start, end)
+	return b.filter.apply(q)
+}
+
+// inBatches calls fn with the IDs of events in slices of bulkBatchSize.
+func inBatches(events []*models.Event, fn func(ids []uint) error) error {
+	for i := 0; i < len(events); i += bulkBatchSize {
+		batch := events[i:min(i+bulkBatchSize, len(events))]
+		ids := make([]uint, len(batch))
+		for j, e := range batch {
+			ids[j] = e.ID
+		}
+		if err := fn(ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMatching deletes the events that overlap the time between start and
+// end and pass the bucket's filter, and returns them. Their revisions are
+// deleted too, so that purged data does not live on in the edit history.
+func (b *Bucket) DeleteMatching(start, end *time.Time) ([]*models.Event, error) {
+	var events []*models.Event
+	err := b.ds.db.Transaction(func(tx *gorm.DB) error {
+		if err := b.matching(tx, start, end).Find(&events).Error; err != nil {
+			return err
+		}
+		return inBatches(events, func(ids []uint) error {
+			if err := tx.Where("bucket_id = ? AND event_id IN ?", b.bucketID, ids).
+				Delete(&models.EventRevision{}).Error; err != nil {
+				return err
+			}
+			return tx.Where("bucket_id = ? AND id IN ?", b.bucketID, ids).Delete(&models.Event{}).Error
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// RewriteMatching sets the data key to value on the events that overlap the
+// time between start and end and pass the bucket's filter, and returns them
+// as they are afterwards. Keys of nested objects are separated by dots. No
+// revisions are recorded, as rewrites are mostly used to remove data, and the
+// key is rewritten in the events' earlier revisions too, so that the removed
+// data does not live on in their history.
+func (b *Bucket) RewriteMatching(start, end *time.Time, key string, value interface{}) ([]*models.Event, error) {
+	if err := CheckKey(key); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, invalidFilter("invalid value for %s: %v", key, err)
+	}
+	var events []*models.Event
+	err = b.ds.db.Transaction(func(tx *gorm.DB) error {
+		if err := b.matching(tx, start, end).Find(&events).Error; err != nil {
+			return err
+		}
+		err := inBatches(events, func(ids []uint) error {
+			if err := tx.Model(&models.Event{}).Where("bucket_id = ? AND id IN ?", b.bucketID, ids).
+				UpdateColumn("data", setData(tx.Dialector.Name(), key, raw)).Error; err != nil {
+				return err
+			}
+			return b.rewriteRevisions(tx, ids, key, value)
+		})
+		if err != nil {
+			return err
+		}
+		rewritten := make([]*models.Event, 0, len(events))
+		err = inBatches(events, func(ids []uint) error {
+			var batch []*models.Event
+			if err := tx.Where("id IN ?", ids).Order("timestamp DESC").Find(&batch).Error; err != nil {
+				return err
+			}
+			rewritten = append(rewritten, batch...)
+			return nil
+		})
+		events = rewritten
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// rewriteRevisions sets the data key to value in the events before and after
+// every revision of the events with the given IDs.
+func (b *Bucket) rewriteRevisions(tx *gorm.DB, ids []uint, key string, value interface{}) error {
+	var revisions []*models.EventRevision
+	if err := tx.Where("bucket_id = ? AND event_id IN ?", b.bucketID, ids).Find(&revisions).Error; err != nil {
+		return err
+	}
+	for _, r := range revisions {
+		before, err := rewriteSnapshot(r.Before, key, value)
+		if err != nil {
+			return err
+		}
+		after, err := rewriteSnapshot(r.After, key, value)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(r).Updates(map[string]interface{}{"before": before, "after": after}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteSnapshot sets the data key to value in an event as recorded in a
+// revision, whose data keys sit beside id, timestamp and duration.
+func rewriteSnapshot(snapshot datatypes.JSON, key string, value interface{}) (datatypes.JSON, error) {
+	if len(snapshot) == 0 {
+		return snapshot, nil
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(snapshot, &data); err != nil {
+		return nil, err
+	}
+	event := data
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, _ := data[part].(map[string]interface{})
+		if next == nil {
+			next = map[string]interface{}{}
+			data[part] = next
+		}
+		data = next
+	}
+	data[parts[len(parts)-1]] = value
+	return json.Marshal(event)
+}
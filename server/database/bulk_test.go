@@ -0,0 +1,54 @@
+package database
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"timelygator/server/database/models"
+)
+
+func TestRewriteRevisions(t *testing.T) {
+	ds, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.CreateBucket("window", "currentwindow", "test", "host", t0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	bucket, _ := ds.GetBucket("window")
+	events := []*models.Event{
+		{BucketID: "window", Timestamp: t0, Duration: 60, Data: []byte(`{"app":"Firefox","title":"My Bank"}`)},
+		{BucketID: "window", Timestamp: t0.Add(time.Minute), Duration: 60, Data: []byte(`{"app":"Firefox","title":"News"}`)},
+	}
+	if _, err := bucket.Insert(events); err != nil {
+		t.Fatal(err)
+	}
+	for i, title := range []string{"My Bank - Accounts", "News - Sports"} {
+		edited := &models.Event{Timestamp: events[i].Timestamp, Duration: 60,
+			Data: []byte(`{"app":"Firefox","title":"` + title + `"}`)}
+		if _, _, err := bucket.Revise(int(events[i].ID), edited, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var filter EventFilter
+	filter.Add("title", OpMatch, "Bank")
+	if _, err := bucket.Filtered(&filter).RewriteMatching(nil, nil, "title", "[redacted]"); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := bucket.Revisions(int(events[0].ID))
+	if err != nil || len(revisions) != 1 {
+		t.Fatalf("expected the revision to be kept, got %d, %v", len(revisions), err)
+	}
+	for _, snapshot := range []string{string(revisions[0].Before), string(revisions[0].After)} {
+		if strings.Contains(snapshot, "Bank") || !strings.Contains(snapshot, "[redacted]") {
+			t.Errorf("expected the title to be redacted in the revision, got %s", snapshot)
+		}
+	}
+	revisions, _ = bucket.Revisions(int(events[1].ID))
+	if len(revisions) != 1 || !strings.Contains(string(revisions[0].Before), `"News"`) {
+		t.Errorf("expected revisions of other events to be kept as they were, got %+v", revisions)
+	}
+}
@@ -1,57 +1,180 @@
 package database
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"path/filepath"
 	"time"
 
+	"timelygator/server/database/migrations"
 	"timelygator/server/database/models"
 	"timelygator/server/utils"
 	"timelygator/server/utils/types"
 
-	"gorm.io/driver/sqlite"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Datastore struct {
 	db *gorm.DB
+
+	// owner restricts buckets to those of a user if set, see ForOwner.
+	owner          *uint
+	includeUnowned bool
 }
 
 func InitDB(cfg types.Config) (*Datastore, error) {
+	dialector, err := Dialector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	backupDir, err := BackupDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ds, err := open(dialector, backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug(fmt.Sprintf("Using GORM-based %s database", dialector.Name()))
+
+	return ds, nil
+}
+
+// BackupDir returns the directory backups of the database are kept in.
+func BackupDir(cfg types.Config) (string, error) {
+	if cfg.BackupDir != "" {
+		return cfg.BackupDir, nil
+	}
 	datadir, err := utils.GetDir("data")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get data dir: %w", err)
+		return "", fmt.Errorf("failed to get data dir: %w", err)
 	}
-	file := filepath.Join(datadir, cfg.DataSourceName)
+	return filepath.Join(datadir, "backups"), nil
+}
 
-	db, err := gorm.Open(sqlite.Open(file), &gorm.Config{})
+// Connect opens (or creates) a database without migrating it, for the
+// migrate command.
+func Connect(dialector gorm.Dialector) (*gorm.DB, error) {
+	db, err := gorm.Open(dialector, &gorm.Config{
+		// Times are stored in UTC so that they compare correctly as text
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to open sqlite db with gorm: %w", err)
+		return nil, fmt.Errorf("failed to open %s db with gorm: %w", dialector.Name(), err)
 	}
+	return db, nil
+}
 
-	// Auto-migrate models
-	if err := db.AutoMigrate(&models.Bucket{}, &models.Event{}); err != nil {
-		return nil, fmt.Errorf("auto-migrate error: %w", err)
+// Open opens (or creates) the SQLite database at path and migrates it.
+func Open(path string) (*Datastore, error) {
+	return open(sqliteDialector(path), "")
+}
+
+// open opens a database and migrates it, backing it up to backupDir first if
+// it has an older schema and backupDir is set.
+func open(dialector gorm.Dialector, backupDir string) (*Datastore, error) {
+	db, err := Connect(dialector)
+	if err != nil {
+		return nil, err
 	}
 
-	slog.Debug(fmt.Sprintf("Using GORM-based SQLite at: %s", file))
+	if err := migrate(db, backupDir); err != nil {
+		return nil, err
+	}
 
 	return &Datastore{
 		db: db,
 	}, nil
 }
 
+// migrate brings the schema of db to the latest version.
+func migrate(db *gorm.DB, backupDir string) error {
+	pending, err := migrations.Pending(db)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if backupDir != "" && db.Dialector.Name() != SQLite {
+		slog.Warn("Only SQLite databases are backed up before migrating, back the database up with its own tools")
+	} else if backupDir != "" {
+		snapshot, err := migrations.Backup(db, backupDir)
+		if err != nil {
+			return fmt.Errorf("failed to back up the database before migrating: %w", err)
+		}
+		if snapshot != nil {
+			slog.Info(fmt.Sprintf("Backed up the database to %s before migrating", snapshot.Path))
+		}
+	}
+	applied, err := migrations.Up(db, 0)
+	for _, m := range applied {
+		slog.Info(fmt.Sprintf("Migrated the database to version %d: %s", m.Version, m.Name))
+	}
+	if err != nil {
+		return fmt.Errorf("migration error: %w", err)
+	}
+	return nil
+}
+
 func (ds *Datastore) DB() *gorm.DB {
 	return ds.db
 }
 
+// ForOwner returns a view of the datastore in which only the buckets of a
+// user exist, and buckets are created for them. With includeUnowned, buckets
+// without owner are visible too, as they are to admins.
+func (ds *Datastore) ForOwner(userID uint, includeUnowned bool) *Datastore {
+	return &Datastore{db: ds.db, owner: &userID, includeUnowned: includeUnowned}
+}
+
+// Unowned returns a view of the datastore in which only buckets without owner
+// exist, for requests nobody signed in to.
+func (ds *Datastore) Unowned() *Datastore {
+	// No user has ID 0, so only the buckets without owner are included
+	return ds.ForOwner(0, true)
+}
+
+// Owner returns the user the datastore is restricted to, or nil if it sees
+// every bucket.
+func (ds *Datastore) Owner() *uint {
+	return ds.owner
+}
+
+// Scope describes which buckets the datastore sees, for use in cache keys.
+func (ds *Datastore) Scope() string {
+	switch {
+	case ds.owner == nil:
+		return "all"
+	case ds.includeUnowned:
+		return fmt.Sprintf("user:%d+unowned", *ds.owner)
+	}
+	return fmt.Sprintf("user:%d", *ds.owner)
+}
+
+// owned restricts q to the rows of the owner in column, if there is one.
+func (ds *Datastore) owned(q *gorm.DB, column string) *gorm.DB {
+	if ds.owner == nil {
+		return q
+	}
+	if ds.includeUnowned {
+		return q.Where("("+column+" = ? OR "+column+" IS NULL)", *ds.owner)
+	}
+	return q.Where(column+" = ?", *ds.owner)
+}
+
 // Batches returns a map of bucket_id -> metadata.
 func (ds *Datastore) Buckets() map[string]map[string]interface{} {
 	result := make(map[string]map[string]interface{})
 
 	var buckets []models.Bucket
-	if err := ds.db.Find(&buckets).Error; err != nil {
+	if err := ds.owned(ds.db, "owner_id").Find(&buckets).Error; err != nil {
 		slog.Warn(fmt.Sprintf("Error listing buckets: %v\n", err))
 		return result
 	}
@@ -87,6 +210,10 @@ func (ds *Datastore) CreateBucket(
 		return nil, fmt.Errorf("failed to convert data to JSON: %w", err)
 	}
 
+	if err := checkBucketIDFree(ds.db, bucketID); err != nil {
+		return nil, err
+	}
+
 	// Insert into DB via GORM
 	newBucket := models.Bucket{
 		ID:       bucketID,
@@ -96,6 +223,7 @@ func (ds *Datastore) CreateBucket(
 		Created:  created,
 		Name:     name,
 		Data:     jsonData,
+		OwnerID:  ds.owner,
 	}
 
 	if err := ds.db.Create(&newBucket).Error; err != nil {
@@ -105,10 +233,32 @@ func (ds *Datastore) CreateBucket(
 	return NewBucket(ds, bucketID), nil
 }
 
+// checkBucketIDFree returns an error if a bucket named bucketID exists. Bucket
+// IDs are unique across users and with the trash.
+func checkBucketIDFree(tx *gorm.DB, bucketID string) error {
+	var existing models.Bucket
+	if err := tx.Unscoped().Limit(1).Find(&existing, "id = ?", bucketID).Error; err != nil {
+		return err
+	}
+	if existing.ID != "" && existing.Deleted.Valid {
+		return &types.BadRequest{
+			Code:    "BucketInTrash",
+			Message: fmt.Sprintf("A bucket named %s is in the trash, restore or purge it first", bucketID),
+		}
+	}
+	if existing.ID != "" {
+		return &types.BadRequest{
+			Code:    "BucketExists",
+			Message: fmt.Sprintf("A bucket named %s already exists", bucketID),
+		}
+	}
+	return nil
+}
+
 func (ds *Datastore) UpdateBucket(bucketID string, updates map[string]interface{}) error {
 	// We find the existing row, then apply updates
 	var existing models.Bucket
-	if err := ds.db.First(&existing, "id = ?", bucketID).Error; err != nil {
+	if err := ds.owned(ds.db, "owner_id").First(&existing, "id = ?", bucketID).Error; err != nil {
 		return err
 	}
 
@@ -140,17 +290,37 @@ func (ds *Datastore) UpdateBucket(bucketID string, updates map[string]interface{
 	return ds.db.Save(&existing).Error
 }
 
-// DeleteBucket
+// DeleteBucket permanently deletes a bucket, also from the trash, with its
+// events and their revisions.
 func (ds *Datastore) DeleteBucket(bucketID string) error {
-	// If we want to also delete associated events, we can define a foreign-key relationship
-	// with "OnDelete:CASCADE" or do a separate .Where("bucket_id=?").Delete(&Event{})
-	return ds.db.Where("id = ?", bucketID).Delete(&models.Bucket{}).Error
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		res := ds.owned(tx.Unscoped(), "owner_id").Where("id = ?", bucketID).Delete(&models.Bucket{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return noSuchBucket(bucketID)
+		}
+		return deleteBucketEvents(tx, bucketID)
+	})
+}
+
+// deleteBucketEvents deletes the events of a bucket and their revisions.
+func deleteBucketEvents(tx *gorm.DB, bucketID string) error {
+	if err := tx.Where("bucket_id = ?", bucketID).Delete(&models.EventRevision{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("bucket_id = ?", bucketID).Delete(&models.Event{}).Error
+}
+
+func noSuchBucket(bucketID string) error {
+	return &types.NotFound{Code: "NoSuchBucket", Message: fmt.Sprintf("No bucket named %s", bucketID)}
 }
 
 // GetBucket returns the "bucket" if it exists
 func (ds *Datastore) GetBucket(bucketID string) (*Bucket, error) {
 	var count int64
-	if err := ds.db.Model(&models.Bucket{}).
+	if err := ds.owned(ds.db.Model(&models.Bucket{}), "owner_id").
 		Where("id = ?", bucketID).
 		Count(&count).Error; err != nil {
 		return nil, err
@@ -161,10 +331,55 @@ func (ds *Datastore) GetBucket(bucketID string) (*Bucket, error) {
 	return NewBucket(ds, bucketID), nil
 }
 
+// Settings returns all stored settings as key -> raw JSON value.
+func (ds *Datastore) Settings() (map[string]datatypes.JSON, error) {
+	var settings []models.Setting
+	if err := ds.db.Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	result := make(map[string]datatypes.JSON, len(settings))
+	for _, s := range settings {
+		result[s.Key] = s.Value
+	}
+	return result, nil
+}
+
+// GetSetting returns the raw JSON value stored under key.
+func (ds *Datastore) GetSetting(key string) (datatypes.JSON, error) {
+	var setting models.Setting
+	if err := ds.db.First(&setting, settingKey(key)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &types.NotFound{
+				Code:    "NoSuchSetting",
+				Message: fmt.Sprintf("No setting named %s", key),
+			}
+		}
+		return nil, err
+	}
+	return setting.Value, nil
+}
+
+// SetSetting creates or replaces the setting stored under key.
+func (ds *Datastore) SetSetting(key string, value datatypes.JSON) error {
+	return ds.db.Save(&models.Setting{Key: key, Value: value}).Error
+}
+
+// DeleteSetting removes the setting stored under key.
+func (ds *Datastore) DeleteSetting(key string) error {
+	return ds.db.Where(settingKey(key)).Delete(&models.Setting{}).Error
+}
+
+// settingKey matches the setting stored under key. The column is quoted, as
+// KEY is reserved in MySQL.
+func settingKey(key string) clause.Eq {
+	return clause.Eq{Column: clause.Column{Name: "key"}, Value: key}
+}
+
 // Bucket is the GORM-backed "bucket handle"
 type Bucket struct {
 	ds       *Datastore
 	bucketID string
+	filter   *EventFilter
 }
 
 func NewBucket(ds *Datastore, bucketID string) *Bucket {
@@ -174,6 +389,26 @@ func NewBucket(ds *Datastore, bucketID string) *Bucket {
 	}
 }
 
+// Filtered returns a view of the bucket in which Get, Page and GetEventCount
+// only return events that pass the filter.
+func (b *Bucket) Filtered(filter *EventFilter) *Bucket {
+	filtered := *b
+	filtered.filter = filter
+	return &filtered
+}
+
+// Type returns the type of the bucket, or "" if it does not exist.
+func (b *Bucket) Type() string {
+	var found []string
+	if err := b.ds.db.Model(&models.Bucket{}).Where("id = ?", b.bucketID).Limit(1).Pluck("type", &found).Error; err != nil {
+		slog.Warn(fmt.Sprintf("Error in Type() for bucket %s: %v", b.bucketID, err))
+	}
+	if len(found) == 0 {
+		return ""
+	}
+	return found[0]
+}
+
 // Metadata can read the bucket row from DB
 func (b *Bucket) Metadata() map[string]interface{} {
 	var bucket models.Bucket
@@ -192,6 +427,24 @@ func (b *Bucket) Metadata() map[string]interface{} {
 	}
 }
 
+// overlapping restricts q to events that overlap the time between start and
+// end, either of which may be nil. Events that begin before start but run
+// into it are included.
+func overlapping(q *gorm.DB, start, end *time.Time) *gorm.DB {
+	if start != nil && !start.IsZero() {
+		// Events end at or after they begin, so end_time is the range of the
+		// index, and events without duration that begin at start count as
+		// overlapping, but those that end there do not
+		q = q.Where("end_time >= ? AND (end_time > ? OR duration = 0)", start.UTC(), start.UTC())
+	}
+	if end != nil && !end.IsZero() {
+		q = q.Where("timestamp <= ?", end.UTC())
+	}
+	return q
+}
+
+// Get returns up to limit events, or all for -1, that overlap the time
+// between starttime and endtime, newest first.
 func (b *Bucket) Get(limit int, starttime, endtime *time.Time) ([]*models.Event, error) {
 	// Round start/end times to nearest millisecond
 	if starttime != nil {
@@ -206,11 +459,10 @@ func (b *Bucket) Get(limit int, starttime, endtime *time.Time) ([]*models.Event,
 	// Build the base query filtering on bucket_id
 	dbq := b.ds.db.Debug().Model(&models.Event{}).
 		Where("bucket_id = ?", b.bucketID)
+	dbq = b.filter.apply(dbq)
 
 	// If start/end time are provided, filter by them
-	if starttime != nil && !starttime.IsZero() && endtime != nil && !endtime.IsZero() {
-		dbq = dbq.Where("timestamp >= ? AND timestamp <= ?", *starttime, *endtime)
-	}
+	dbq = overlapping(dbq, starttime, endtime)
 
 	// If limit > 0, apply it. If limit == -1, do no limit
 	if limit > 0 {
@@ -227,10 +479,16 @@ func (b *Bucket) Get(limit int, starttime, endtime *time.Time) ([]*models.Event,
 	return events, nil
 }
 
-// GetByID
+// GetByID returns an event of the bucket.
 func (b *Bucket) GetByID(eventID int) (*models.Event, error) {
 	var evt models.Event
-	if err := b.ds.db.First(&evt, "id = ?", eventID).Error; err != nil {
+	if err := b.ds.db.First(&evt, "id = ? AND bucket_id = ?", eventID, b.bucketID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &types.NotFound{
+				Code:    "NoSuchEvent",
+				Message: fmt.Sprintf("There's no event with id %d in bucket %s", eventID, b.bucketID),
+			}
+		}
 		return nil, err
 	}
 	return &evt, nil
@@ -238,8 +496,9 @@ func (b *Bucket) GetByID(eventID int) (*models.Event, error) {
 
 // GetEventCount
 func (b *Bucket) GetEventCount(starttime, endtime *time.Time) (int, error) {
-	dbq := b.ds.db.Model(&models.Event{})
-	// Add filters if desired
+	dbq := b.ds.db.Model(&models.Event{}).Where("bucket_id = ?", b.bucketID)
+	dbq = overlapping(dbq, starttime, endtime)
+	dbq = b.filter.apply(dbq)
 	var count int64
 	if err := dbq.Count(&count).Error; err != nil {
 		return 0, err
@@ -255,7 +514,7 @@ func (b *Bucket) GetLastEvent(before time.Time) (*models.Event, error) {
 	// Query for events in this bucket that occurred before (or at) 'before'
 	if err := b.ds.db.
 		Model(&models.Event{}).
-		Where("bucket_id = ? AND timestamp <= ?", b.bucketID, before).
+		Where("bucket_id = ? AND timestamp <= ?", b.bucketID, before.UTC()).
 		Order("timestamp DESC").
 		First(&evt).Error; err != nil {
 		return nil, err
@@ -292,21 +551,23 @@ func (b *Bucket) Insert(events interface{}) (*models.Event, error) {
 	}
 }
 
-// Delete
+// Delete removes an event of the bucket and reports whether it existed.
 func (b *Bucket) Delete(eventID int) (bool, error) {
-	if err := b.ds.db.Delete(&models.Event{}, eventID).Error; err != nil {
-		return false, err
+	res := b.ds.db.Where("bucket_id = ?", b.bucketID).Delete(&models.Event{}, eventID)
+	if res.Error != nil {
+		return false, res.Error
 	}
-	return true, nil
+	return res.RowsAffected > 0, nil
 }
 
 // ReplaceLast - do a GORM query for the last event, then update it
 func (b *Bucket) ReplaceLast(event *models.Event) error {
 	var last models.Event
 	// find the last event for this bucket
-	if err := b.ds.db.Order("timestamp desc").First(&last).Error; err != nil {
+	if err := b.ds.db.Where("bucket_id = ?", b.bucketID).Order("timestamp desc").First(&last).Error; err != nil {
 		return err
 	}
+	event.ID = last.ID
 	// Update last with data from the new event
 	last.Timestamp = event.Timestamp
 	last.Duration = event.Duration
@@ -316,12 +577,58 @@ func (b *Bucket) ReplaceLast(event *models.Event) error {
 
 // Replace replaces the event with eventID
 func (b *Bucket) Replace(eventID int, event *models.Event) error {
-	var existing models.Event
-	if err := b.ds.db.First(&existing, "id = ?", eventID).Error; err != nil {
+	existing, err := b.GetByID(eventID)
+	if err != nil {
 		return err
 	}
 	existing.Timestamp = event.Timestamp
 	existing.Duration = event.Duration
 	existing.Data = event.Data
-	return b.ds.db.Save(&existing).Error
+	return b.ds.db.Save(existing).Error
+}
+
+// Revise replaces the timestamp, duration and data of an event and records
+// the change as a revision, in one transaction. It returns the event as it
+// was before.
+func (b *Bucket) Revise(eventID int, event *models.Event, changedBy string) (*models.Event, *models.EventRevision, error) {
+	before, err := b.GetByID(eventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	beforeJSON, err := json.Marshal(before.ToJSONDict())
+	if err != nil {
+		return nil, nil, err
+	}
+	event.ID = before.ID
+	event.BucketID = b.bucketID
+	revision := &models.EventRevision{
+		EventID:   before.ID,
+		BucketID:  b.bucketID,
+		Changed:   time.Now().UTC(),
+		ChangedBy: changedBy,
+		Before:    beforeJSON,
+	}
+	err = b.ds.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(event).Error; err != nil {
+			return err
+		}
+		afterJSON, err := json.Marshal(event.ToJSONDict())
+		if err != nil {
+			return err
+		}
+		revision.After = afterJSON
+		return tx.Create(revision).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, revision, nil
+}
+
+// Revisions returns the recorded edits of an event, oldest first.
+func (b *Bucket) Revisions(eventID int) ([]*models.EventRevision, error) {
+	var revisions []*models.EventRevision
+	err := b.ds.db.Where("event_id = ? AND bucket_id = ?", eventID, b.bucketID).
+		Order("changed ASC").Order("id ASC").Find(&revisions).Error
+	return revisions, err
 }
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"timelygator/server/utils"
+	"timelygator/server/utils/types"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Databases the datastore runs on, named as by their GORM dialector.
+const (
+	SQLite   = "sqlite"
+	Postgres = "postgres"
+	MySQL    = "mysql"
+)
+
+// Dialector returns the GORM dialector of the database named by the DSN of
+// the config. DSNs starting with postgres:// or postgresql:// are PostgreSQL
+// servers, and those starting with mysql:// or written for the MySQL driver,
+// like user:password@tcp(localhost:3306)/dbname, are MySQL servers. Other
+// DSNs are SQLite files in the data directory.
+func Dialector(cfg types.Config) (gorm.Dialector, error) {
+	dsn := cfg.DataSourceName
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return postgres.Open(dsn), nil
+	case strings.HasPrefix(dsn, "mysql://"), strings.Contains(dsn, "@"):
+		mysqlDSN, err := mysqlDSN(strings.TrimPrefix(dsn, "mysql://"))
+		if err != nil {
+			return nil, err
+		}
+		return mysql.Open(mysqlDSN), nil
+	}
+	path, err := Path(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sqliteDialector(path), nil
+}
+
+// mysqlDSN returns the DSN with the options the datastore needs: times are
+// read as time.Time, and in UTC as they are written.
+func mysqlDSN(dsn string) (string, error) {
+	cfg, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		return "", fmt.Errorf("invalid MySQL DSN: %w", err)
+	}
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	return cfg.FormatDSN(), nil
+}
+
+func sqliteDialector(path string) gorm.Dialector {
+	return sqlite.New(sqlite.Config{DriverName: driverName, DSN: path})
+}
+
+// Path returns the path of the SQLite database file of the server.
+func Path(cfg types.Config) (string, error) {
+	if dsn := cfg.DataSourceName; strings.Contains(dsn, "://") || strings.Contains(dsn, "@") {
+		return "", fmt.Errorf("DSN %q is not an SQLite database file", dsn)
+	}
+	datadir, err := utils.GetDir("data")
+	if err != nil {
+		return "", fmt.Errorf("failed to get data dir: %w", err)
+	}
+	return filepath.Join(datadir, cfg.DataSourceName), nil
+}
+
+// pgPath returns the PostgreSQL path of a data key, a text array literal.
+func pgPath(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `\`, `\\`) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// dataCondition returns the SQL of a filter condition in the dialect of the
+// database, comparing values as SQLite's json_extract does: strings without
+// quotes, numbers as written and booleans only to true or false.
+func dataCondition(dialect string, c DataCondition) (string, []interface{}) {
+	isBool := c.Value == "true" || c.Value == "false"
+	switch dialect {
+	case Postgres:
+		path := pgPath(c.Key)
+		switch {
+		case c.Op == OpMatch:
+			return "data #>> ?::text[] ~ ?", []interface{}{path, c.Value}
+		case isBool:
+			// The JSON text of strings is quoted, so only booleans match
+			return "(data #> ?::text[])::text = ?", []interface{}{path, c.Value}
+		}
+		return "data #>> ?::text[] = ?", []interface{}{path, c.Value}
+	case MySQL:
+		path := jsonPath(c.Key)
+		switch {
+		case c.Op == OpMatch:
+			return "JSON_UNQUOTE(JSON_EXTRACT(data, ?)) REGEXP ?", []interface{}{path, c.Value}
+		case isBool:
+			return "JSON_EXTRACT(data, ?) = CAST(? AS JSON)", []interface{}{path, c.Value}
+		}
+		return "JSON_UNQUOTE(JSON_EXTRACT(data, ?)) = ?", []interface{}{path, c.Value}
+	}
+	path := jsonPath(c.Key)
+	switch {
+	case c.Op == OpMatch:
+		return "json_extract(data, ?) REGEXP ?", []interface{}{path, c.Value}
+	case isBool:
+		// json_extract returns booleans as 1 and 0
+		return "json_type(data, ?) = ?", []interface{}{path, c.Value}
+	}
+	return "CAST(json_extract(data, ?) AS TEXT) = ?", []interface{}{path, c.Value}
+}
+
+// setData returns an expression of the event data with key set to the JSON
+// value raw, in the dialect of the database.
+func setData(dialect, key string, raw []byte) interface{} {
+	switch dialect {
+	case Postgres:
+		return gorm.Expr("jsonb_set(data::jsonb, ?::text[], ?::jsonb)::json", pgPath(key), string(raw))
+	case MySQL:
+		return gorm.Expr("JSON_SET(data, ?, CAST(? AS JSON))", jsonPath(key), string(raw))
+	}
+	return gorm.Expr("json_set(data, ?, json(?))", jsonPath(key), string(raw))
+}
+
+// sizeQuery returns the query of the size of the database in bytes.
+func sizeQuery(dialect string) string {
+	switch dialect {
+	case Postgres:
+		return "SELECT pg_database_size(current_database())"
+	case MySQL:
+		return `SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables
+			WHERE table_schema = DATABASE()`
+	}
+	return "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()"
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"container/list"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"timelygator/server/utils/types"
+
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/gorm"
+)
+
+// driverName is the SQLite driver with the functions filters need, which
+// SQLite does not have built in.
+const driverName = "sqlite3_timelygator"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("regexp", matchRegexp, true)
+		},
+	})
+}
+
+// regexpCacheSize is the number of compiled patterns kept. Patterns come
+// from clients, so the cache is bounded.
+const regexpCacheSize = 100
+
+// regexpCache keeps the most recently used compiled patterns, since REGEXP is
+// called for every row.
+type regexpCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // least recently used at the back
+}
+
+var regexps = newRegexpCache(regexpCacheSize)
+
+func newRegexpCache(size int) *regexpCache {
+	return &regexpCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// compile returns the compiled pattern, compiling it if it is not cached.
+func (c *regexpCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*regexp.Regexp), nil
+	}
+	c.mu.Unlock()
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[pattern]; !ok {
+		c.entries[pattern] = c.order.PushFront(re)
+		for c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*regexp.Regexp).String())
+		}
+	}
+	return re, nil
+}
+
+// matchRegexp implements "value REGEXP pattern" with Go regular expressions.
+// NULL, such as a missing data key, never matches.
+func matchRegexp(pattern string, value interface{}) (bool, error) {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		if v == nil {
+			return false, nil
+		}
+		s = string(v)
+	default:
+		s = fmt.Sprint(v)
+	}
+	re, err := regexps.compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(s), nil
+}
+
+// Data filter operators.
+const (
+	OpEquals = "="
+	OpMatch  = "~="
+)
+
+// DataCondition compares a key of the event data with a value. Keys of
+// nested objects are separated by dots.
+type DataCondition struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// EventFilter restricts events by their data and duration. Conditions must
+// all hold.
+type EventFilter struct {
+	Conditions  []DataCondition
+	MinDuration float64 // seconds, 0 for no minimum
+}
+
+func invalidFilter(format string, args ...interface{}) error {
+	return &types.BadRequest{Code: "InvalidFilter", Message: fmt.Sprintf(format, args...)}
+}
+
+// CheckKey returns an error unless key can be turned into a JSON path.
+func CheckKey(key string) error {
+	if key == "" || strings.Contains(key, `"`) {
+		return invalidFilter("invalid data key %q", key)
+	}
+	for _, part := range strings.Split(key, ".") {
+		if part == "" {
+			return invalidFilter("invalid data key %q", key)
+		}
+	}
+	return nil
+}
+
+// Add appends a condition after checking that it can be evaluated.
+func (f *EventFilter) Add(key, op, value string) error {
+	if err := CheckKey(key); err != nil {
+		return err
+	}
+	switch op {
+	case OpEquals:
+	case OpMatch:
+		if _, err := regexp.Compile(value); err != nil {
+			return invalidFilter("invalid regular expression for %s: %v", key, err)
+		}
+	default:
+		return invalidFilter("unknown operator %q", op)
+	}
+	f.Conditions = append(f.Conditions, DataCondition{Key: key, Op: op, Value: value})
+	return nil
+}
+
+// IsEmpty reports whether the filter lets every event through.
+func (f *EventFilter) IsEmpty() bool {
+	return f == nil || (len(f.Conditions) == 0 && f.MinDuration <= 0)
+}
+
+// jsonPath returns the SQLite and MySQL JSON path of a data key, quoting
+// every part so that keys like $category work.
+func jsonPath(key string) string {
+	return `$."` + strings.Join(strings.Split(key, "."), `"."`) + `"`
+}
+
+// apply adds the filter to a query of the events table.
+func (f *EventFilter) apply(q *gorm.DB) *gorm.DB {
+	if f == nil {
+		return q
+	}
+	for _, c := range f.Conditions {
+		condition, args := dataCondition(q.Dialector.Name(), c)
+		q = q.Where(condition, args...)
+	}
+	if f.MinDuration > 0 {
+		q = q.Where("duration >= ?", f.MinDuration)
+	}
+	return q
+}
@@ -0,0 +1,25 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRegexpCache(t *testing.T) {
+	cache := newRegexpCache(2)
+	for i := 0; i < 10; i++ {
+		re, err := cache.compile(fmt.Sprintf("^app%d$", i))
+		if err != nil || !re.MatchString(fmt.Sprintf("app%d", i)) {
+			t.Fatalf("unexpected pattern %v, %v", re, err)
+		}
+	}
+	if cache.order.Len() != 2 || len(cache.entries) != 2 {
+		t.Errorf("expected the cache to keep 2 patterns, got %d", len(cache.entries))
+	}
+	if _, ok := cache.entries["^app9$"]; !ok {
+		t.Errorf("expected the most recent pattern to be kept")
+	}
+	if _, err := cache.compile("("); err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+}
@@ -0,0 +1,199 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"timelygator/server/database/models"
+	"timelygator/server/utils/types"
+
+	"gorm.io/gorm"
+)
+
+// How ImportBucket handles a bucket that already exists.
+const (
+	ConflictSkip    = "skip"    // leave it as it is
+	ConflictMerge   = "merge"   // add the events it does not have yet
+	ConflictReplace = "replace" // replace its metadata and events
+)
+
+// CheckConflict returns a BadRequest for an unknown conflict strategy.
+func CheckConflict(onConflict string) error {
+	switch onConflict {
+	case ConflictSkip, ConflictMerge, ConflictReplace:
+		return nil
+	}
+	return &types.BadRequest{
+		Code:    "InvalidConflict",
+		Message: fmt.Sprintf("unknown on_conflict %q, expected skip, merge or replace", onConflict),
+	}
+}
+
+// BucketImport stores the events of a bucket being imported. It is only valid
+// in the function given to ImportBucket.
+type BucketImport struct {
+	tx         *gorm.DB
+	bucket     *models.Bucket
+	created    bool
+	onConflict string
+	lastID     uint // highest event ID before the import
+
+	Imported int64 // events stored
+	Skipped  int64 // events left out as the bucket had them or was skipped
+	Replaced int64 // events of the bucket deleted to replace them
+}
+
+// ImportBucket imports a bucket in one transaction, so a failed import
+// leaves no trace. The bucket is created unless the datastore already sees
+// one with its ID, which is then handled as onConflict says. read stores the
+// events and may fill in the metadata of the bucket, which is saved after it
+// returns if the bucket was created or replaced.
+func (ds *Datastore) ImportBucket(bucket *models.Bucket, onConflict string, read func(*BucketImport) error) error {
+	if err := CheckConflict(onConflict); err != nil {
+		return err
+	}
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		imp := &BucketImport{tx: tx, bucket: bucket, onConflict: onConflict}
+		var existing models.Bucket
+		if err := ds.owned(tx, "owner_id").Limit(1).Find(&existing, "id = ?", bucket.ID).Error; err != nil {
+			return err
+		}
+		if existing.ID != "" && onConflict == ConflictReplace {
+			if err := tx.Model(&models.Event{}).Where("bucket_id = ?", bucket.ID).Count(&imp.Replaced).Error; err != nil {
+				return err
+			}
+			if err := deleteBucketEvents(tx, bucket.ID); err != nil {
+				return err
+			}
+			bucket.OwnerID = existing.OwnerID
+			imp.created = true
+		} else if existing.ID != "" {
+			imp.bucket = &existing
+		} else {
+			if err := checkBucketIDFree(tx, bucket.ID); err != nil {
+				return err
+			}
+			bucket.OwnerID = ds.owner
+			if err := tx.Create(bucket).Error; err != nil {
+				return err
+			}
+			imp.created = true
+		}
+		if err := tx.Model(&models.Event{}).Select("COALESCE(MAX(id), 0)").Scan(&imp.lastID).Error; err != nil {
+			return err
+		}
+		if err := read(imp); err != nil {
+			return err
+		}
+		if !imp.created {
+			return nil
+		}
+		return tx.Save(bucket).Error
+	})
+}
+
+// Bucket returns the bucket the events are imported into.
+func (imp *BucketImport) Bucket() *models.Bucket {
+	return imp.bucket
+}
+
+// Insert stores a batch of events in the bucket. Into a skipped bucket none
+// are stored, and when merging those it already has are left out.
+func (imp *BucketImport) Insert(events []*models.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	if !imp.created && imp.onConflict == ConflictSkip {
+		imp.Skipped += int64(len(events))
+		return nil
+	}
+	if !imp.created && imp.onConflict == ConflictMerge {
+		var err error
+		if events, err = imp.newEvents(events); err != nil {
+			return err
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	for _, e := range events {
+		e.BucketID = imp.bucket.ID
+	}
+	if err := imp.tx.Create(&events).Error; err != nil {
+		return err
+	}
+	imp.Imported += int64(len(events))
+	return nil
+}
+
+// eventKey identifies events with the same timestamp, duration and data.
+type eventKey struct {
+	timestamp int64
+	duration  float64
+	data      [sha256.Size]byte
+}
+
+func keyOf(e *models.Event) eventKey {
+	// Encode the data again so that the order of its keys does not matter
+	var data interface{}
+	canonical := []byte(e.Data)
+	if json.Unmarshal(e.Data, &data) == nil {
+		canonical, _ = json.Marshal(data)
+	}
+	return eventKey{e.Timestamp.UnixNano(), e.Duration, sha256.Sum256(canonical)}
+}
+
+// newEvents returns the events the bucket has no copy of yet, counting the
+// others as skipped. Events earlier in the import are found too.
+func (imp *BucketImport) newEvents(events []*models.Event) ([]*models.Event, error) {
+	timestamps := make([]time.Time, len(events))
+	for i, e := range events {
+		timestamps[i] = e.Timestamp.UTC()
+	}
+	var stored []*models.Event
+	err := imp.tx.Where("bucket_id = ? AND timestamp IN ?", imp.bucket.ID, timestamps).Find(&stored).Error
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[eventKey]bool, len(stored))
+	for _, e := range stored {
+		seen[keyOf(e)] = true
+	}
+	fresh := events[:0:0]
+	for _, e := range events {
+		key := keyOf(e)
+		if seen[key] {
+			imp.Skipped++
+			continue
+		}
+		seen[key] = true
+		fresh = append(fresh, e)
+	}
+	return fresh, nil
+}
+
+// Update calls fn with the imported events in batches and saves the data it
+// gives them.
+func (imp *BucketImport) Update(fn func([]*models.Event)) error {
+	after := imp.lastID
+	for {
+		var events []*models.Event
+		err := imp.tx.Where("bucket_id = ? AND id > ?", imp.bucket.ID, after).
+			Order("id").Limit(bulkBatchSize).Find(&events).Error
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		fn(events)
+		for _, e := range events {
+			if err := imp.tx.Model(e).UpdateColumn("data", e.Data).Error; err != nil {
+				return err
+			}
+		}
+		after = events[len(events)-1].ID
+	}
+}
@@ -0,0 +1,43 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// endTimeEvent is an event as backfilled by migration 2.
+type endTimeEvent struct {
+	ID        uint
+	Timestamp time.Time
+	Duration  float64
+	EndTime   *time.Time
+}
+
+func (endTimeEvent) TableName() string { return "events" }
+
+// endTimesBatch is the number of events backfilled at once.
+const endTimesBatch = 1000
+
+// endTimesUp sets the end time of events stored before it existed, and moves
+// their timestamps to UTC, as the server stores them since.
+func endTimesUp(tx *gorm.DB) error {
+	for {
+		var events []endTimeEvent
+		if err := tx.Where("end_time IS NULL").Limit(endTimesBatch).Find(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		for _, e := range events {
+			timestamp := e.Timestamp.UTC()
+			if err := tx.Model(&e).UpdateColumns(map[string]interface{}{
+				"timestamp": timestamp,
+				"end_time":  timestamp.Add(time.Duration(e.Duration * float64(time.Second))),
+			}).Error; err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// The tables as they were before migrations, when they were created by
+// AutoMigrate. Databases of those servers are brought to this schema by
+// migration 1, which creates what is missing and keeps what exists.
+
+type initialEvent struct {
+	ID        uint           `gorm:"primaryKey;autoIncrement"`
+	BucketID  string         `gorm:"index;index:idx_events_bucket_end,priority:1"`
+	Timestamp time.Time      `gorm:"not null;type:timestamp"`
+	Duration  float64        `gorm:"not null;type:real"`
+	Data      datatypes.JSON `gorm:"type:json"`
+	EndTime   time.Time      `gorm:"type:timestamp;index:idx_events_bucket_end,priority:2"`
+}
+
+func (initialEvent) TableName() string { return "events" }
+
+type initialBucket struct {
+	ID       string `gorm:"primaryKey"`
+	Name     *string
+	Type     string
+	Client   string
+	Hostname string
+	Created  time.Time
+	Data     datatypes.JSON `gorm:"type:json"`
+	OwnerID  *uint          `gorm:"index"`
+	Deleted  gorm.DeletedAt `gorm:"index"`
+}
+
+func (initialBucket) TableName() string { return "buckets" }
+
+type initialSetting struct {
+	Key   string         `gorm:"primaryKey"`
+	Value datatypes.JSON `gorm:"type:json"`
+}
+
+func (initialSetting) TableName() string { return "settings" }
+
+type initialWebhook struct {
+	ID            uint   `gorm:"primaryKey;autoIncrement"`
+	URL           string `gorm:"not null"`
+	Secret        string `gorm:"not null"`
+	BucketPattern string
+	BucketTypes   datatypes.JSON `gorm:"type:json"`
+	Kinds         datatypes.JSON `gorm:"type:json"`
+	Active        bool           `gorm:"not null"`
+	Created       time.Time
+}
+
+func (initialWebhook) TableName() string { return "webhooks" }
+
+type initialWebhookDelivery struct {
+	ID         uint           `gorm:"primaryKey;autoIncrement"`
+	WebhookID  uint           `gorm:"index;not null"`
+	DeliveryID string         `gorm:"not null"`
+	Kind       string         `gorm:"not null"`
+	Payload    datatypes.JSON `gorm:"type:json"`
+	Attempts   int
+	LastStatus int
+	LastError  string
+	Failed     time.Time
+}
+
+func (initialWebhookDelivery) TableName() string { return "webhook_deliveries" }
+
+type initialAPIToken struct {
+	ID       uint           `gorm:"primaryKey;autoIncrement"`
+	UserID   *uint          `gorm:"index"`
+	Name     string         `gorm:"uniqueIndex;not null;size:191"`
+	Prefix   string         `gorm:"not null"`
+	Hash     string         `gorm:"uniqueIndex;not null;size:191"`
+	Scopes   datatypes.JSON `gorm:"type:json"`
+	Created  time.Time
+	LastUsed *time.Time
+}
+
+func (initialAPIToken) TableName() string { return "api_tokens" }
+
+type initialUser struct {
+	ID        uint   `gorm:"primaryKey;autoIncrement"`
+	Provider  string `gorm:"uniqueIndex:idx_user_identity;not null;size:191"`
+	Subject   string `gorm:"uniqueIndex:idx_user_identity;not null;size:191"`
+	Email     string
+	Name      string
+	Picture   string
+	Admin     bool `gorm:"not null"`
+	Created   time.Time
+	LastLogin time.Time
+}
+
+func (initialUser) TableName() string { return "users" }
+
+type initialSession struct {
+	ID      uint   `gorm:"primaryKey;autoIncrement"`
+	UserID  uint   `gorm:"index;not null"`
+	Hash    string `gorm:"uniqueIndex;not null;size:191"`
+	Created time.Time
+	Expires time.Time `gorm:"index"`
+}
+
+func (initialSession) TableName() string { return "sessions" }
+
+type initialEventRevision struct {
+	ID        uint   `gorm:"primaryKey;autoIncrement"`
+	EventID   uint   `gorm:"index;not null"`
+	BucketID  string `gorm:"index;not null"`
+	Changed   time.Time
+	ChangedBy string
+	Before    datatypes.JSON `gorm:"type:json"`
+	After     datatypes.JSON `gorm:"type:json"`
+}
+
+func (initialEventRevision) TableName() string { return "event_revisions" }
+
+var initialTables = []interface{}{
+	&initialBucket{}, &initialEvent{}, &initialSetting{}, &initialWebhook{}, &initialWebhookDelivery{},
+	&initialAPIToken{}, &initialUser{}, &initialSession{}, &initialEventRevision{},
+}
+
+func initialUp(tx *gorm.DB) error {
+	return tx.AutoMigrate(initialTables...)
+}
+
+func initialDown(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(initialTables...)
+}
@@ -0,0 +1,250 @@
+// Package migrations versions the schema of the database.
+//
+// Each migration is a numbered step with an Up function that changes the
+// schema or data, and a Down function that reverts it. The versions applied
+// are recorded in the schema_version table, and each step runs in a
+// transaction with its record, so a failed step leaves the database as it was.
+//
+// Migrations must not use the structs of the models package, which change
+// with later migrations, but declare the tables as they are at their version.
+// A new migration is appended to all with the next version; released
+// migrations are never changed.
+package migrations
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"timelygator/server/backup"
+
+	"gorm.io/gorm"
+)
+
+// Migration is a step from the schema of Version-1 to that of Version.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	// Down reverts Up; nil if there is nothing to revert
+	Down func(tx *gorm.DB) error
+}
+
+// all are the migrations in order of version, starting at 1.
+var all = []Migration{
+	{1, "initial schema", initialUp, initialDown},
+	// End times are kept by version 1 too, so there is nothing to revert
+	{2, "backfill event end times", endTimesUp, nil},
+	{3, "delete events of deleted buckets", orphansUp, nil},
+	{4, "event time precision", timesUp, timesDown},
+	{5, "token names per user", tokenNamesUp, tokenNamesDown},
+}
+
+// Latest returns the version of the schema the server uses.
+func Latest() int {
+	return len(all)
+}
+
+// State is a migration and when it was applied, nil if it is pending.
+type State struct {
+	Migration
+	Applied *time.Time
+}
+
+// schemaVersion records an applied migration.
+type schemaVersion struct {
+	Version int    `gorm:"primaryKey;autoIncrement:false"`
+	Name    string `gorm:"not null"`
+	Applied time.Time
+}
+
+func (schemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// applied returns the records of the applied migrations by version.
+func applied(db *gorm.DB) (map[int]schemaVersion, error) {
+	if !db.Migrator().HasTable(&schemaVersion{}) {
+		if err := db.Migrator().CreateTable(&schemaVersion{}); err != nil {
+			return nil, fmt.Errorf("creating schema_version: %w", err)
+		}
+	}
+	var records []schemaVersion
+	if err := db.Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	versions := make(map[int]schemaVersion, len(records))
+	for _, r := range records {
+		versions[r.Version] = r
+	}
+	return versions, nil
+}
+
+// Version returns the version of the schema of db, the highest applied.
+func Version(db *gorm.DB) (int, error) {
+	versions, err := applied(db)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range versions {
+		version = max(version, v)
+	}
+	return version, nil
+}
+
+// Status returns the state of every migration in order of version. A
+// database migrated by a newer server has versions this one does not know,
+// which are returned without Up and Down.
+func Status(db *gorm.DB) ([]State, error) {
+	return status(db, all)
+}
+
+func status(db *gorm.DB, migrations []Migration) ([]State, error) {
+	versions, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]State, 0, len(migrations))
+	for _, m := range migrations {
+		state := State{Migration: m}
+		if r, ok := versions[m.Version]; ok {
+			state.Applied = &r.Applied
+			delete(versions, m.Version)
+		}
+		states = append(states, state)
+	}
+	unknown := make([]int, 0, len(versions))
+	for v := range versions {
+		unknown = append(unknown, v)
+	}
+	sort.Ints(unknown)
+	for _, v := range unknown {
+		r := versions[v]
+		states = append(states, State{Migration: Migration{Version: v, Name: r.Name}, Applied: &r.Applied})
+	}
+	return states, nil
+}
+
+// Pending returns the migrations Up would apply to reach the latest version.
+func Pending(db *gorm.DB) ([]Migration, error) {
+	return pending(db, all, len(all))
+}
+
+func pending(db *gorm.DB, migrations []Migration, target int) ([]Migration, error) {
+	states, err := status(db, migrations)
+	if err != nil {
+		return nil, err
+	}
+	if target < 0 || target > len(migrations) {
+		return nil, fmt.Errorf("unknown schema version %d, the latest is %d", target, len(migrations))
+	}
+	if len(states) > len(migrations) {
+		return nil, fmt.Errorf("the database has schema version %d, newer than the latest this server knows, %d",
+			states[len(states)-1].Version, len(migrations))
+	}
+	var steps []Migration
+	for _, s := range states[:target] {
+		if s.Applied == nil {
+			steps = append(steps, s.Migration)
+		}
+	}
+	return steps, nil
+}
+
+// Up applies the pending migrations up to version target, or all of them if
+// target is 0, and returns those applied.
+func Up(db *gorm.DB, target int) ([]Migration, error) {
+	if target == 0 {
+		target = len(all)
+	}
+	return up(db, all, target)
+}
+
+func up(db *gorm.DB, migrations []Migration, target int) ([]Migration, error) {
+	steps, err := pending(db, migrations, target)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range steps {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&schemaVersion{Version: m.Version, Name: m.Name, Applied: time.Now().UTC()}).Error
+		})
+		if err != nil {
+			return steps[:i], fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	return steps, nil
+}
+
+// Down reverts the applied migrations above version target, newest first,
+// and returns those reverted.
+func Down(db *gorm.DB, target int) ([]Migration, error) {
+	return down(db, all, target)
+}
+
+func down(db *gorm.DB, migrations []Migration, target int) ([]Migration, error) {
+	states, err := status(db, migrations)
+	if err != nil {
+		return nil, err
+	}
+	if target < 0 {
+		return nil, fmt.Errorf("unknown schema version %d", target)
+	}
+	var steps []Migration
+	for i := len(states) - 1; i >= target; i-- {
+		s := states[i]
+		if s.Applied == nil {
+			continue
+		}
+		if s.Version > len(migrations) {
+			return nil, fmt.Errorf("cannot revert schema version %d, which is newer than this server", s.Version)
+		}
+		steps = append(steps, s.Migration)
+	}
+	for i, m := range steps {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if m.Down != nil {
+				if err := m.Down(tx); err != nil {
+					return err
+				}
+			}
+			return tx.Delete(&schemaVersion{Version: m.Version}).Error
+		})
+		if err != nil {
+			return steps[:i], fmt.Errorf("reverting migration %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	return steps, nil
+}
+
+// Backup takes a snapshot of db into dir before it is migrated, and returns
+// it. A database without tables has nothing to lose, and only SQLite
+// databases are backed up, so for others it returns nil.
+func Backup(db *gorm.DB, dir string) (*backup.Snapshot, error) {
+	if db.Dialector.Name() != "sqlite" {
+		return nil, nil
+	}
+	tables, err := db.Migrator().GetTables()
+	if err != nil {
+		return nil, err
+	}
+	empty := true
+	for _, table := range tables {
+		if table != (schemaVersion{}).TableName() && !strings.HasPrefix(table, "sqlite_") {
+			empty = false
+		}
+	}
+	if empty {
+		return nil, nil
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	return backup.Take(sqlDB, dir, time.Now())
+}
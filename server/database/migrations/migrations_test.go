@@ -0,0 +1,176 @@
+package migrations
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"timelygator/server/database/models"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func openDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// schema returns the statements creating the tables and indexes of db.
+func schema(t *testing.T, db *gorm.DB) string {
+	t.Helper()
+	var statements []string
+	err := db.Raw(`SELECT sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT IN ('schema_version', 'sqlite_sequence')
+		ORDER BY type, name`).Scan(&statements).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(statements, ";\n")
+}
+
+func TestSchemaMatchesModels(t *testing.T) {
+	// Databases created before migrations keep their schema
+	db := openDB(t)
+	if err := db.AutoMigrate(&models.Bucket{}, &models.Event{}, &models.Setting{},
+		&models.Webhook{}, &models.WebhookDelivery{}, &models.APIToken{}, &models.User{}, &models.Session{},
+		&models.EventRevision{}); err != nil {
+		t.Fatal(err)
+	}
+	want := schema(t, db)
+	if _, err := Up(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := schema(t, db); got != want {
+		t.Errorf("migrating changed the schema of an existing database:\n%s\nexpected:\n%s", got, want)
+	}
+
+	// New databases get the schema of the models, or a migration is missing
+	fresh := openDB(t)
+	applied, err := Up(fresh, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != Latest() {
+		t.Errorf("expected %d migrations to be applied, got %d", Latest(), len(applied))
+	}
+	if got := schema(t, fresh); got != want {
+		t.Errorf("the migrated schema differs from the models:\n%s\nexpected:\n%s", got, want)
+	}
+	if version, _ := Version(fresh); version != Latest() {
+		t.Errorf("expected version %d, got %d", Latest(), version)
+	}
+
+	if _, err := Down(fresh, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := schema(t, fresh); got != "" {
+		t.Errorf("expected reverting all migrations to drop the tables, got\n%s", got)
+	}
+}
+
+func TestUpAndDown(t *testing.T) {
+	type note struct {
+		ID    uint
+		Text  string
+		Title string
+	}
+	steps := []Migration{
+		{1, "create notes", func(tx *gorm.DB) error {
+			return tx.Exec("CREATE TABLE notes (id INTEGER PRIMARY KEY, text TEXT)").Error
+		}, func(tx *gorm.DB) error {
+			return tx.Exec("DROP TABLE notes").Error
+		}},
+		{2, "add titles", func(tx *gorm.DB) error {
+			if err := tx.Exec("ALTER TABLE notes ADD COLUMN title TEXT").Error; err != nil {
+				return err
+			}
+			return tx.Exec("UPDATE notes SET title = substr(text, 1, 3)").Error
+		}, func(tx *gorm.DB) error {
+			return tx.Exec("ALTER TABLE notes DROP COLUMN title").Error
+		}},
+		{3, "broken", func(tx *gorm.DB) error {
+			if err := tx.Exec("DELETE FROM notes").Error; err != nil {
+				return err
+			}
+			return errors.New("failed")
+		}, nil},
+	}
+	db := openDB(t)
+	if applied, err := up(db, steps, 1); err != nil || len(applied) != 1 {
+		t.Fatalf("expected to apply 1 migration, got %d, %v", len(applied), err)
+	}
+	db.Exec("INSERT INTO notes (text) VALUES ('hello')")
+	if applied, err := up(db, steps, 2); err != nil || len(applied) != 1 || applied[0].Version != 2 {
+		t.Fatalf("expected to apply migration 2, got %v, %v", applied, err)
+	}
+	var n note
+	db.Table("notes").First(&n)
+	if n.Title != "hel" {
+		t.Errorf("expected the data to be backfilled, got %+v", n)
+	}
+
+	// A failed migration leaves the database as it was
+	if applied, err := up(db, steps, 3); err == nil || len(applied) != 0 {
+		t.Fatalf("expected migration 3 to fail, got %v, %v", applied, err)
+	}
+	var count int64
+	db.Table("notes").Count(&count)
+	if count != 1 {
+		t.Errorf("expected the failed migration to be rolled back, got %d notes", count)
+	}
+	states, err := status(db, steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if states[1].Applied == nil || states[2].Applied != nil {
+		t.Errorf("expected versions 1 and 2 to be applied, got %+v", states)
+	}
+
+	if reverted, err := down(db, steps, 1); err != nil || len(reverted) != 1 || reverted[0].Version != 2 {
+		t.Fatalf("expected to revert migration 2, got %v, %v", reverted, err)
+	}
+	if db.Migrator().HasColumn("notes", "title") {
+		t.Errorf("expected the column to be dropped")
+	}
+
+	// Servers refuse databases migrated by newer servers
+	if _, err := up(db, steps[:0], 0); err == nil {
+		t.Errorf("expected an error for a database newer than the migrations")
+	}
+	if _, err := up(db, steps, 4); err == nil {
+		t.Errorf("expected an error for an unknown version")
+	}
+}
+
+func TestTokenNamesPerUser(t *testing.T) {
+	db := openDB(t)
+	if _, err := Up(db, 4); err != nil {
+		t.Fatal(err)
+	}
+	insert := func(userID int, hash string) error {
+		return db.Exec("INSERT INTO api_tokens (user_id, name, prefix, hash) VALUES (?, 'laptop', 'tg_', ?)", userID, hash).Error
+	}
+	if err := insert(1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(2, "b"); err == nil {
+		t.Fatalf("expected token names to be unique before migration 5")
+	}
+	if _, err := Up(db, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(2, "b"); err != nil {
+		t.Errorf("expected users to have tokens of the same name, got %v", err)
+	}
+	if err := insert(2, "c"); err == nil {
+		t.Errorf("expected token names to be unique per user")
+	}
+	if _, err := Down(db, 4); err == nil {
+		t.Errorf("expected reverting to fail while users share a token name")
+	}
+}
@@ -0,0 +1,14 @@
+package migrations
+
+import "gorm.io/gorm"
+
+// orphansUp deletes the events and revisions left behind by buckets deleted
+// before deletion cascaded, so that they do not reappear in a new bucket of
+// the same name. They cannot be restored, so there is no Down.
+func orphansUp(tx *gorm.DB) error {
+	orphaned := "bucket_id NOT IN (SELECT id FROM buckets)"
+	if err := tx.Exec("DELETE FROM event_revisions WHERE " + orphaned).Error; err != nil {
+		return err
+	}
+	return tx.Exec("DELETE FROM events WHERE " + orphaned).Error
+}
@@ -0,0 +1,33 @@
+package migrations
+
+import "gorm.io/gorm"
+
+// times gives the event times of servers other than SQLite the precision
+// SQLite keeps, and PostgreSQL the time zone they are written in. SQLite
+// keeps its columns.
+var times = map[string]string{
+	"postgres": `ALTER TABLE events ALTER COLUMN "timestamp" TYPE timestamptz,
+		ALTER COLUMN end_time TYPE timestamptz, ALTER COLUMN duration TYPE double precision`,
+	"mysql": "ALTER TABLE events MODIFY `timestamp` DATETIME(6) NOT NULL, MODIFY end_time DATETIME(6) NULL",
+}
+
+// timesReverted are the columns of version 3, as created by migration 1.
+var timesReverted = map[string]string{
+	"postgres": `ALTER TABLE events ALTER COLUMN "timestamp" TYPE timestamp,
+		ALTER COLUMN end_time TYPE timestamp, ALTER COLUMN duration TYPE real`,
+	"mysql": "ALTER TABLE events MODIFY `timestamp` TIMESTAMP NOT NULL, MODIFY end_time TIMESTAMP NULL",
+}
+
+func timesUp(tx *gorm.DB) error {
+	if alter, ok := times[tx.Dialector.Name()]; ok {
+		return tx.Exec(alter).Error
+	}
+	return nil
+}
+
+func timesDown(tx *gorm.DB) error {
+	if alter, ok := timesReverted[tx.Dialector.Name()]; ok {
+		return tx.Exec(alter).Error
+	}
+	return nil
+}
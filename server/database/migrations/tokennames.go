@@ -0,0 +1,43 @@
+package migrations
+
+import "gorm.io/gorm"
+
+// ownedTokenName is the name of an API token as of migration 5, unique among
+// the tokens of its owner rather than among all tokens.
+type ownedTokenName struct {
+	UserID *uint  `gorm:"uniqueIndex:idx_api_tokens_user_name,priority:1"`
+	Name   string `gorm:"uniqueIndex:idx_api_tokens_user_name,priority:2;not null;size:191"`
+}
+
+func (ownedTokenName) TableName() string { return "api_tokens" }
+
+// tokenName is the name of an API token before migration 5.
+type tokenName struct {
+	Name string `gorm:"uniqueIndex;not null;size:191"`
+}
+
+func (tokenName) TableName() string { return "api_tokens" }
+
+// swapIndex replaces the index drop of a model with the index create of
+// another, keeping an index that exists already.
+func swapIndex(tx *gorm.DB, from interface{}, drop string, to interface{}, create string) error {
+	m := tx.Migrator()
+	if m.HasIndex(from, drop) {
+		if err := m.DropIndex(from, drop); err != nil {
+			return err
+		}
+	}
+	if m.HasIndex(to, create) {
+		return nil
+	}
+	return m.CreateIndex(to, create)
+}
+
+func tokenNamesUp(tx *gorm.DB) error {
+	return swapIndex(tx, &tokenName{}, "idx_api_tokens_name", &ownedTokenName{}, "idx_api_tokens_user_name")
+}
+
+// tokenNamesDown fails if users have tokens of the same name.
+func tokenNamesDown(tx *gorm.DB) error {
+	return swapIndex(tx, &ownedTokenName{}, "idx_api_tokens_user_name", &tokenName{}, "idx_api_tokens_name")
+}
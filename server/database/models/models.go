@@ -3,9 +3,11 @@ package models
 import (
 	"encoding/json"
 	"log"
+	"reflect"
 	"time"
 
 	"gorm.io/datatypes"
+	"gorm.io/gorm"
 )
 
 // For convenience, define aliases or helper types as needed.
@@ -18,13 +20,57 @@ type Duration interface{}
 // Event is stored in the DB with a JSON blob for Data.
 type Event struct {
 	ID        uint           `gorm:"primaryKey;autoIncrement" json:"id"`
-	BucketID  string         `gorm:"index" json:"bucket_id"`
+	BucketID  string         `gorm:"index;index:idx_events_bucket_end,priority:1" json:"bucket_id"`
 	Timestamp time.Time      `gorm:"not null;type:timestamp" json:"timestamp"`
 	Duration  float64  		 `gorm:"not null;type:real"      json:"duration"`
 	Data      datatypes.JSON `gorm:"type:json" json:"data"`
+	// EndTime is Timestamp plus Duration, kept for overlap queries
+	EndTime time.Time `gorm:"type:timestamp;index:idx_events_bucket_end,priority:2" json:"-"`
 }
 
-// Bucket is also stored in the DB with a JSON blob for Data.
+// BeforeSave stores the timestamp in UTC, so that timestamps compare
+// correctly as text in SQLite, and derives the end time.
+func (e *Event) BeforeSave(tx *gorm.DB) error {
+	e.Timestamp = e.Timestamp.UTC()
+	e.EndTime = e.End()
+	return nil
+}
+
+// AfterFind returns the times in UTC, as they were saved, from databases
+// whose drivers read them in local time.
+func (e *Event) AfterFind(tx *gorm.DB) error {
+	e.Timestamp = e.Timestamp.UTC()
+	e.EndTime = e.EndTime.UTC()
+	return nil
+}
+
+// End returns the time the event ends.
+func (e *Event) End() time.Time {
+	return e.Timestamp.Add(time.Duration(e.Duration * float64(time.Second))).UTC()
+}
+
+// Clip returns a copy of the event trimmed to the part between start and end,
+// either of which may be nil. Events outside the window get no duration.
+func (e *Event) Clip(start, end *time.Time) *Event {
+	clipped := *e
+	eventEnd := e.End()
+	if start != nil && clipped.Timestamp.Before(*start) {
+		clipped.Timestamp = start.UTC()
+	}
+	if end != nil && eventEnd.After(*end) {
+		eventEnd = end.UTC()
+	}
+	clipped.Duration = 0
+	if eventEnd.After(clipped.Timestamp) {
+		clipped.Duration = eventEnd.Sub(clipped.Timestamp).Seconds()
+	}
+	clipped.EndTime = clipped.End()
+	return &clipped
+}
+
+// Bucket is also stored in the DB with a JSON blob for Data. OwnerID is the
+// user the bucket belongs to, nil for buckets shared with admins. Buckets in
+// the trash are left out of queries unless they are Unscoped.
 type Bucket struct {
 	ID       string `gorm:"primaryKey" json:"id"`
 	Name     *string
@@ -33,6 +79,98 @@ type Bucket struct {
 	Hostname string
 	Created  time.Time
 	Data     datatypes.JSON `gorm:"type:json" json:"data"`
+	OwnerID  *uint          `gorm:"index" json:"owner_id"`
+	// Deleted is set while the bucket is in the trash, which hides it
+	Deleted gorm.DeletedAt `gorm:"index" json:"deleted"`
+}
+
+// Setting is a user setting stored as a JSON value under a unique key.
+type Setting struct {
+	Key   string         `gorm:"primaryKey" json:"key"`
+	Value datatypes.JSON `gorm:"type:json" json:"value"`
+}
+
+// Webhook is a subscription that receives bucket and event changes as signed
+// HTTP POST requests. BucketTypes and Kinds are JSON lists, empty matching all.
+type Webhook struct {
+	ID            uint           `gorm:"primaryKey;autoIncrement" json:"id"`
+	URL           string         `gorm:"not null" json:"url"`
+	Secret        string         `gorm:"not null" json:"-"`
+	BucketPattern string         `json:"bucket_pattern"`
+	BucketTypes   datatypes.JSON `gorm:"type:json" json:"bucket_types"`
+	Kinds         datatypes.JSON `gorm:"type:json" json:"kinds"`
+	Active        bool           `gorm:"not null" json:"active"`
+	Created       time.Time      `json:"created"`
+}
+
+// WebhookDelivery is a delivery that failed after all retries, kept as a
+// dead letter for inspection.
+type WebhookDelivery struct {
+	ID         uint           `gorm:"primaryKey;autoIncrement" json:"id"`
+	WebhookID  uint           `gorm:"index;not null" json:"webhook_id"`
+	DeliveryID string         `gorm:"not null" json:"delivery_id"`
+	Kind       string         `gorm:"not null" json:"kind"`
+	Payload    datatypes.JSON `gorm:"type:json" json:"payload"`
+	Attempts   int            `json:"attempts"`
+	LastStatus int            `json:"last_status"`
+	LastError  string         `json:"last_error"`
+	Failed     time.Time      `json:"failed"`
+}
+
+// APIToken is a token clients authenticate with. Only the SHA-256 hash of the
+// token is stored; Prefix keeps its first characters so users can tell tokens
+// apart. Scopes is a JSON list such as ["read", "bucket:tg-observer-"].
+// Tokens of a user only reach that user's buckets, and their names are unique
+// among the user's tokens.
+type APIToken struct {
+	ID       uint           `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID   *uint          `gorm:"index;uniqueIndex:idx_api_tokens_user_name,priority:1" json:"user_id"`
+	Name     string         `gorm:"uniqueIndex:idx_api_tokens_user_name,priority:2;not null;size:191" json:"name"`
+	Prefix   string         `gorm:"not null" json:"prefix"`
+	Hash     string         `gorm:"uniqueIndex;not null;size:191" json:"-"`
+	Scopes   datatypes.JSON `gorm:"type:json" json:"scopes"`
+	Created  time.Time      `json:"created"`
+	LastUsed *time.Time     `json:"last_used"`
+}
+
+// User is a person who signed in to the web UI through an identity provider,
+// or was added with `tg-server user add` (provider "local") to be linked by
+// email when they first sign in. Users are identified by the provider's
+// stable subject, not their email. Admins manage server-wide settings and
+// webhooks and also see buckets without owner.
+type User struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Provider  string    `gorm:"uniqueIndex:idx_user_identity;not null;size:191" json:"provider"`
+	Subject   string    `gorm:"uniqueIndex:idx_user_identity;not null;size:191" json:"-"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Picture   string    `json:"picture"`
+	Admin     bool      `gorm:"not null" json:"admin"`
+	Created   time.Time `json:"created"`
+	LastLogin time.Time `json:"last_login"`
+}
+
+// Session is a signed in browser. Like API tokens, only the SHA-256 hash of
+// the session cookie is stored.
+type Session struct {
+	ID      uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID  uint      `gorm:"index;not null" json:"user_id"`
+	Hash    string    `gorm:"uniqueIndex;not null;size:191" json:"-"`
+	Created time.Time `json:"created"`
+	Expires time.Time `gorm:"index" json:"expires"`
+}
+
+// EventRevision records an edit of an event with the event before and after
+// it, so that corrections can be reviewed and undone. ChangedBy names the
+// token or user that made the edit, empty without authentication.
+type EventRevision struct {
+	ID        uint           `gorm:"primaryKey;autoIncrement" json:"id"`
+	EventID   uint           `gorm:"index;not null" json:"event_id"`
+	BucketID  string         `gorm:"index;not null" json:"bucket_id"`
+	Changed   time.Time      `json:"changed"`
+	ChangedBy string         `json:"changed_by"`
+	Before    datatypes.JSON `gorm:"type:json" json:"before"`
+	After     datatypes.JSON `gorm:"type:json" json:"after"`
 }
 
 // NewEvent creates an Event with typed timestamp/duration
@@ -140,16 +278,8 @@ func (e *Event) DataEqualEvent(other *Event) bool {
 		return false
 	}
 
-	// Compare shallowly (keys and values)
-	if len(thisMap) != len(otherMap) {
-		return false
-	}
-	for k, v := range thisMap {
-		if ov, ok := otherMap[k]; !ok || v != ov {
-			return false
-		}
-	}
-	return true
+	// Compare deeply, values may be lists like the $category path
+	return reflect.DeepEqual(thisMap, otherMap)
 }
 
 // DataEqualJSON compares the event's JSON data to another JSON blob
@@ -164,14 +294,5 @@ func (e *Event) DataEqualJSON(other datatypes.JSON) bool {
 	if err := json.Unmarshal(other, &otherMap); err != nil {
 		return false
 	}
-	// Compare eMap and otherMap. Basic approach:
-	if len(eMap) != len(otherMap) {
-		return false
-	}
-	for k, v := range eMap {
-		if ov, ok := otherMap[k]; !ok || v != ov {
-			return false
-		}
-	}
-	return true
+	return reflect.DeepEqual(eMap, otherMap)
 }
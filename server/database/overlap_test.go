@@ -0,0 +1,133 @@
+package database
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"timelygator/server/database/migrations"
+	"timelygator/server/database/models"
+
+	"gorm.io/gorm"
+)
+
+var t0 = time.Date(2024, 3, 20, 23, 0, 0, 0, time.UTC)
+
+func TestOverlap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	ds, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.CreateBucket("afk", "afkstatus", "test", "host", t0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	bucket, _ := ds.GetBucket("afk")
+	// Stored with another time zone, as events from observers are
+	cet := time.FixedZone("CET", 3600)
+	events := []*models.Event{
+		{BucketID: "afk", Timestamp: t0.In(cet), Duration: 7200, Data: []byte(`{"status":"not-afk"}`)},
+		{BucketID: "afk", Timestamp: t0.Add(-time.Hour), Duration: 60, Data: []byte(`{"status":"afk"}`)},
+		{BucketID: "afk", Timestamp: t0.Add(2 * time.Hour), Duration: 0, Data: []byte(`{"status":"afk"}`)},
+	}
+	if _, err := bucket.Insert(events); err != nil {
+		t.Fatal(err)
+	}
+
+	midnight := time.Date(2024, 3, 21, 0, 0, 0, 0, time.UTC)
+	dayEnd := midnight.Add(24 * time.Hour)
+	got, err := bucket.Get(-1, &midnight, &dayEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].ID != events[0].ID {
+		t.Fatalf("expected the event running past midnight and the one after, got %d events", len(got))
+	}
+	if count, _ := bucket.GetEventCount(&midnight, &dayEnd); count != 2 {
+		t.Errorf("expected count 2, got %d", count)
+	}
+	page, _, err := bucket.Page(nil, 10, &midnight, &dayEnd)
+	if err != nil || len(page) != 2 {
+		t.Errorf("expected a page of 2 events, got %d, %v", len(page), err)
+	}
+
+	clipped := got[1].Clip(&midnight, &dayEnd)
+	if !clipped.Timestamp.Equal(midnight) || clipped.Duration != 3600 {
+		t.Errorf("expected the event clipped to an hour from midnight, got %v for %vs", clipped.Timestamp, clipped.Duration)
+	}
+	if got[1].Duration != 7200 {
+		t.Errorf("Clip changed the original event")
+	}
+
+	// Events stored before end times existed are backfilled by migration 2
+	if _, err := migrations.Down(ds.DB(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.DB().Exec("UPDATE events SET end_time = NULL").Error; err != nil {
+		t.Fatal(err)
+	}
+	if ds, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	var missing int64
+	ds.DB().Model(&models.Event{}).Where("end_time IS NULL").Count(&missing)
+	if missing != 0 {
+		t.Errorf("expected all end times to be backfilled, %d are missing", missing)
+	}
+	bucket, _ = ds.GetBucket("afk")
+	if got, _ := bucket.Get(-1, &midnight, &dayEnd); len(got) != 2 {
+		t.Errorf("expected 2 events after the backfill, got %d", len(got))
+	}
+}
+
+func TestOverlapBoundaries(t *testing.T) {
+	ds, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.CreateBucket("afk", "afkstatus", "test", "host", t0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	bucket, _ := ds.GetBucket("afk")
+	start, end := t0, t0.Add(time.Hour)
+	events := []*models.Event{
+		{BucketID: "afk", Timestamp: start.Add(-time.Minute), Duration: 60, Data: []byte(`{"case":"ends at start"}`)},
+		{BucketID: "afk", Timestamp: start.Add(-time.Minute), Duration: 61, Data: []byte(`{"case":"runs into start"}`)},
+		{BucketID: "afk", Timestamp: start, Duration: 0, Data: []byte(`{"case":"no duration at start"}`)},
+		{BucketID: "afk", Timestamp: start.Add(-time.Second), Duration: 0, Data: []byte(`{"case":"no duration before start"}`)},
+		{BucketID: "afk", Timestamp: end, Duration: 60, Data: []byte(`{"case":"begins at end"}`)},
+		{BucketID: "afk", Timestamp: end.Add(time.Second), Duration: 60, Data: []byte(`{"case":"begins after end"}`)},
+	}
+	if _, err := bucket.Insert(events); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bucket.Get(-1, &start, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{}
+	for _, e := range got {
+		var data map[string]string
+		json.Unmarshal(e.Data, &data)
+		cases[data["case"]] = true
+	}
+	want := map[string]bool{"runs into start": true, "no duration at start": true, "begins at end": true}
+	if !reflect.DeepEqual(cases, want) {
+		t.Errorf("expected %v to overlap, got %v", want, cases)
+	}
+
+	// The start is a range of the index rather than a filter of the bucket's rows
+	query := ds.db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+		return overlapping(tx.Model(&models.Event{}).Where("bucket_id = ?", "afk"), &start, &end).Find(&[]*models.Event{})
+	})
+	var plan []struct{ Detail string }
+	if err := ds.db.Raw("EXPLAIN QUERY PLAN " + query).Scan(&plan).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) == 0 || !strings.Contains(plan[0].Detail, "idx_events_bucket_end (bucket_id=? AND end_time>?)") {
+		t.Errorf("expected a range of idx_events_bucket_end, got %+v", plan)
+	}
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"timelygator/server/database/models"
+	"timelygator/server/utils/types"
+)
+
+// MaxPageSize is the largest number of events returned in a single page.
+const MaxPageSize = 10000
+
+// EventCursor is the position after the last event of a page. Events are
+// paged newest first, ordered by timestamp and then ID, so a cursor stays
+// valid while events are inserted or deleted.
+type EventCursor struct {
+	Timestamp time.Time
+	ID        uint
+}
+
+// Encode returns the cursor as an opaque URL-safe string.
+func (c *EventCursor) Encode() string {
+	raw := strconv.FormatInt(c.Timestamp.UnixNano(), 10) + ":" + strconv.FormatUint(uint64(c.ID), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func invalidCursor() error {
+	return &types.BadRequest{Code: "InvalidCursor", Message: "The cursor is invalid, start again from the first page"}
+}
+
+// DecodeEventCursor parses a cursor returned by Encode.
+func DecodeEventCursor(s string) (*EventCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, invalidCursor()
+	}
+	nanos, id, found := strings.Cut(string(raw), ":")
+	if !found {
+		return nil, invalidCursor()
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, invalidCursor()
+	}
+	i, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, invalidCursor()
+	}
+	return &EventCursor{Timestamp: time.Unix(0, n).UTC(), ID: uint(i)}, nil
+}
+
+// Page returns up to size events overlapping the time between starttime and
+// endtime, either of which may be nil, that come after the cursor, newest
+// first. The returned
+// cursor is nil on the last page.
+func (b *Bucket) Page(after *EventCursor, size int, starttime, endtime *time.Time) ([]*models.Event, *EventCursor, error) {
+	if size <= 0 || size > MaxPageSize {
+		return nil, nil, &types.BadRequest{
+			Code:    "InvalidPageSize",
+			Message: fmt.Sprintf("page_size must be between 1 and %d", MaxPageSize),
+		}
+	}
+	dbq := b.ds.db.Model(&models.Event{}).Where("bucket_id = ?", b.bucketID)
+	dbq = overlapping(dbq, starttime, endtime)
+	dbq = b.filter.apply(dbq)
+	if after != nil {
+		dbq = dbq.Where("(timestamp < ? OR (timestamp = ? AND id < ?))", after.Timestamp, after.Timestamp, after.ID)
+	}
+
+	// Fetch one more than asked for to learn if there is another page
+	var events []*models.Event
+	if err := dbq.Order("timestamp DESC").Order("id DESC").Limit(size + 1).Find(&events).Error; err != nil {
+		return nil, nil, err
+	}
+	if len(events) <= size {
+		return events, nil, nil
+	}
+	events = events[:size]
+	last := events[size-1]
+	return events, &EventCursor{Timestamp: last.Timestamp, ID: last.ID}, nil
+}
@@ -0,0 +1,212 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"timelygator/server/database/models"
+	"timelygator/server/utils/types"
+
+	"gorm.io/gorm"
+)
+
+// How MergeBuckets handles events of the source bucket that overlap events of
+// the target bucket.
+const (
+	OverlapKeep    = "keep"    // move them anyway
+	OverlapSkip    = "skip"    // drop them, keeping the target's events
+	OverlapReplace = "replace" // delete the target's events they overlap
+)
+
+// overlapsIn matches the events that overlap an event of another bucket, or
+// begin at the same time as one.
+const overlapsIn = `EXISTS (SELECT 1 FROM events o WHERE o.bucket_id = ?
+	AND ((o.timestamp < events.end_time AND o.end_time > events.timestamp) OR o.timestamp = events.timestamp))`
+
+// MergeResult reports what happened to the events of a merged bucket.
+type MergeResult struct {
+	Moved    int64 `json:"moved"`    // events moved into the target bucket
+	Skipped  int64 `json:"skipped"`  // overlapping events dropped with OverlapSkip
+	Replaced int64 `json:"replaced"` // target events deleted with OverlapReplace
+}
+
+// findBucket returns the row of a bucket the datastore sees.
+func (ds *Datastore) findBucket(tx *gorm.DB, bucketID string) (*models.Bucket, error) {
+	var bucket models.Bucket
+	if err := ds.owned(tx, "owner_id").Limit(1).Find(&bucket, "id = ?", bucketID).Error; err != nil {
+		return nil, err
+	}
+	if bucket.ID == "" {
+		return nil, noSuchBucket(bucketID)
+	}
+	return &bucket, nil
+}
+
+func invalidBucketID(bucketID string) error {
+	return &types.BadRequest{Code: "InvalidBucketID", Message: fmt.Sprintf("Invalid bucket ID %q", bucketID)}
+}
+
+// moveRevisions moves the revisions of the events now in bucket to, from the
+// bucket they were moved from.
+func moveRevisions(tx *gorm.DB, from, to string) error {
+	return tx.Model(&models.EventRevision{}).
+		Where("bucket_id = ? AND event_id IN (SELECT id FROM events WHERE bucket_id = ?)", from, to).
+		Update("bucket_id", to).Error
+}
+
+// RenameBucket changes the ID of a bucket. Its events keep their IDs.
+func (ds *Datastore) RenameBucket(bucketID, newID string) error {
+	if newID == "" {
+		return invalidBucketID(newID)
+	}
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := ds.findBucket(tx, bucketID); err != nil {
+			return err
+		}
+		if err := checkBucketIDFree(tx, newID); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Bucket{}).Where("id = ?", bucketID).Update("id", newID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Event{}).Where("bucket_id = ?", bucketID).
+			UpdateColumn("bucket_id", newID).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.EventRevision{}).Where("bucket_id = ?", bucketID).Update("bucket_id", newID).Error
+	})
+}
+
+// MergeBuckets moves the events of a bucket into another of the same type,
+// keeping their IDs, and deletes the emptied bucket. overlap is one of
+// OverlapKeep, OverlapSkip or OverlapReplace.
+func (ds *Datastore) MergeBuckets(sourceID, targetID, overlap string) (*MergeResult, error) {
+	switch overlap {
+	case OverlapKeep, OverlapSkip, OverlapReplace:
+	default:
+		return nil, &types.BadRequest{Code: "InvalidOverlap", Message: fmt.Sprintf("Unknown overlap handling %q", overlap)}
+	}
+	if sourceID == targetID {
+		return nil, &types.BadRequest{Code: "InvalidMerge", Message: "Cannot merge a bucket into itself"}
+	}
+	result := &MergeResult{}
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		source, err := ds.findBucket(tx, sourceID)
+		if err != nil {
+			return err
+		}
+		target, err := ds.findBucket(tx, targetID)
+		if err != nil {
+			return err
+		}
+		if source.Type != target.Type {
+			return &types.BadRequest{
+				Code:    "BucketTypeMismatch",
+				Message: fmt.Sprintf("Cannot merge a %s bucket into a %s bucket", source.Type, target.Type),
+			}
+		}
+		if overlap == OverlapReplace {
+			replaced := tx.Model(&models.Event{}).Where("bucket_id = ?", targetID).Where(overlapsIn, sourceID)
+			var ids []uint
+			if err := replaced.Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+			for i := 0; i < len(ids); i += bulkBatchSize {
+				batch := ids[i:min(i+bulkBatchSize, len(ids))]
+				if err := tx.Where("bucket_id = ? AND event_id IN ?", targetID, batch).Delete(&models.EventRevision{}).Error; err != nil {
+					return err
+				}
+				res := tx.Where("id IN ?", batch).Delete(&models.Event{})
+				if res.Error != nil {
+					return res.Error
+				}
+				result.Replaced += res.RowsAffected
+			}
+		}
+		moved := tx.Model(&models.Event{}).Where("bucket_id = ?", sourceID)
+		if overlap == OverlapSkip {
+			// MySQL cannot update events while reading them in a subquery,
+			// so the events to move are looked up first
+			var ids []uint
+			if err := moved.Where("NOT "+overlapsIn, targetID).Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+			for i := 0; i < len(ids); i += bulkBatchSize {
+				res := tx.Model(&models.Event{}).Where("id IN ?", ids[i:min(i+bulkBatchSize, len(ids))]).
+					UpdateColumn("bucket_id", targetID)
+				if res.Error != nil {
+					return res.Error
+				}
+				result.Moved += res.RowsAffected
+			}
+		} else {
+			res := moved.UpdateColumn("bucket_id", targetID)
+			if res.Error != nil {
+				return res.Error
+			}
+			result.Moved = res.RowsAffected
+		}
+		if err := moveRevisions(tx, sourceID, targetID); err != nil {
+			return err
+		}
+		res := tx.Where("bucket_id = ?", sourceID).Delete(&models.Event{})
+		if res.Error != nil {
+			return res.Error
+		}
+		result.Skipped = res.RowsAffected
+		if err := deleteBucketEvents(tx, sourceID); err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("id = ?", sourceID).Delete(&models.Bucket{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SplitBucket moves the events of a bucket that begin at or after cutoff and
+// pass filter into a new bucket, keeping their IDs, and returns how many were
+// moved. The new bucket is a copy of the old one, with hostname if it is not
+// empty.
+func (ds *Datastore) SplitBucket(bucketID, newID, hostname string, cutoff *time.Time, filter *EventFilter) (int64, error) {
+	if newID == "" {
+		return 0, invalidBucketID(newID)
+	}
+	if cutoff == nil && filter.IsEmpty() {
+		return 0, &types.BadRequest{Code: "MissingFilter", Message: "Splitting needs a cutoff time or data filter"}
+	}
+	var moved int64
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		source, err := ds.findBucket(tx, bucketID)
+		if err != nil {
+			return err
+		}
+		if err := checkBucketIDFree(tx, newID); err != nil {
+			return err
+		}
+		split := *source
+		split.ID = newID
+		split.Created = time.Now().UTC()
+		if hostname != "" {
+			split.Hostname = hostname
+		}
+		if err := tx.Create(&split).Error; err != nil {
+			return err
+		}
+		q := tx.Model(&models.Event{}).Where("bucket_id = ?", bucketID)
+		if cutoff != nil {
+			q = q.Where("timestamp >= ?", cutoff.UTC())
+		}
+		res := filter.apply(q).UpdateColumn("bucket_id", newID)
+		if res.Error != nil {
+			return res.Error
+		}
+		moved = res.RowsAffected
+		return moveRevisions(tx, bucketID, newID)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
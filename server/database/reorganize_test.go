@@ -0,0 +1,42 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"timelygator/server/database/models"
+)
+
+func TestMergeReplaceInBatches(t *testing.T) {
+	ds, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More overlapping events than are deleted per statement
+	n := 2*bulkBatchSize + 1
+	for _, id := range []string{"window", "window-copy"} {
+		if _, err := ds.CreateBucket(id, "currentwindow", "test", "host", t0, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		events := make([]*models.Event, n)
+		for i := range events {
+			events[i] = &models.Event{BucketID: id, Timestamp: t0.Add(time.Duration(i) * time.Minute), Duration: 60, Data: []byte(`{}`)}
+		}
+		bucket, _ := ds.GetBucket(id)
+		if _, err := bucket.Insert(events); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := ds.MergeBuckets("window-copy", "window", OverlapReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Replaced != int64(n) || result.Moved != int64(n) {
+		t.Errorf("expected %d events replaced and moved, got %+v", n, result)
+	}
+	bucket, _ := ds.GetBucket("window")
+	if count, _ := bucket.GetEventCount(nil, nil); count != n {
+		t.Errorf("expected %d events after the merge, got %d", n, count)
+	}
+}
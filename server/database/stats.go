@@ -0,0 +1,31 @@
+package database
+
+// EventCounts returns the number of events in each bucket the datastore sees.
+func (ds *Datastore) EventCounts() (map[string]int64, error) {
+	var rows []struct {
+		BucketID string
+		Count    int64
+	}
+	q := ds.db.Table("events").Select("events.bucket_id, COUNT(*) AS count").Group("events.bucket_id")
+	if ds.owner != nil {
+		q = q.Joins("JOIN buckets ON buckets.id = events.bucket_id")
+		q = ds.owned(q, "buckets.owner_id")
+	}
+	if err := q.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		counts[r.BucketID] = r.Count
+	}
+	return counts, nil
+}
+
+// Size returns the size of the database in bytes.
+func (ds *Datastore) Size() (int64, error) {
+	var size int64
+	if err := ds.db.Raw(sizeQuery(ds.db.Dialector.Name())).Scan(&size).Error; err != nil {
+		return 0, err
+	}
+	return size, nil
+}
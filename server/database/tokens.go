@@ -0,0 +1,93 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"timelygator/server/database/models"
+	"timelygator/server/utils/types"
+
+	"gorm.io/gorm"
+)
+
+// Tokens returns the API tokens of the owner, or all tokens, ordered by ID.
+func (ds *Datastore) Tokens() ([]*models.APIToken, error) {
+	tokens := []*models.APIToken{}
+	if err := ds.owned(ds.db, "user_id").Order("id").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// CreateToken stores a new API token, owned by the owner of the datastore
+// if it has one.
+func (ds *Datastore) CreateToken(token *models.APIToken) error {
+	if ds.owner != nil {
+		token.UserID = ds.owner
+	}
+	// Names are unique per user, and the names of other users' tokens are
+	// not revealed
+	var count int64
+	if err := ds.owned(ds.db.Model(&models.APIToken{}), "user_id").Where("name = ?", token.Name).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return &types.BadRequest{
+			Code:    "TokenExists",
+			Message: fmt.Sprintf("A token named %s already exists", token.Name),
+		}
+	}
+	return ds.db.Create(token).Error
+}
+
+// TokenByHash returns the token with the given hash.
+func (ds *Datastore) TokenByHash(hash string) (*models.APIToken, error) {
+	var token models.APIToken
+	if err := ds.db.First(&token, "hash = ?", hash).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &types.NotFound{Code: "NoSuchToken", Message: "Unknown API token"}
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// TouchToken records that a token was used.
+func (ds *Datastore) TouchToken(id uint, at time.Time) error {
+	return ds.db.Model(&models.APIToken{}).Where("id = ?", id).Update("last_used", at).Error
+}
+
+// DeleteToken revokes the token with the given ID or name. Tokens of
+// different users may share a name, and are then only revoked by ID.
+func (ds *Datastore) DeleteToken(idOrName string) error {
+	matching := func() *gorm.DB {
+		q := ds.db.Model(&models.APIToken{}).Where("name = ?", idOrName)
+		if id, err := strconv.ParseUint(idOrName, 10, 0); err == nil {
+			q = ds.db.Model(&models.APIToken{}).Where("(name = ? OR id = ?)", idOrName, id)
+		}
+		return ds.owned(q, "user_id")
+	}
+	var count int64
+	if err := matching().Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 1 {
+		return &types.BadRequest{
+			Code:    "AmbiguousToken",
+			Message: fmt.Sprintf("Several tokens are named %s, revoke one by its ID", idOrName),
+		}
+	}
+	res := matching().Delete(&models.APIToken{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &types.NotFound{
+			Code:    "NoSuchToken",
+			Message: fmt.Sprintf("No token with id or name %s", idOrName),
+		}
+	}
+	return nil
+}
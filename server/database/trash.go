@@ -0,0 +1,70 @@
+package database
+
+import (
+	"time"
+
+	"timelygator/server/database/models"
+
+	"gorm.io/gorm"
+)
+
+// TrashBucket moves a bucket to the trash. It is hidden with its events until
+// it is restored or purged.
+func (ds *Datastore) TrashBucket(bucketID string) error {
+	res := ds.owned(ds.db, "owner_id").Where("id = ?", bucketID).Delete(&models.Bucket{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return noSuchBucket(bucketID)
+	}
+	return nil
+}
+
+// trashed returns the query of the buckets in the trash the datastore sees.
+func (ds *Datastore) trashed(tx *gorm.DB) *gorm.DB {
+	return ds.owned(tx.Unscoped().Model(&models.Bucket{}), "owner_id").Where("deleted IS NOT NULL")
+}
+
+// RestoreBucket takes a bucket out of the trash.
+func (ds *Datastore) RestoreBucket(bucketID string) error {
+	res := ds.trashed(ds.db).Where("id = ?", bucketID).Update("deleted", nil)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return noSuchBucket(bucketID)
+	}
+	return nil
+}
+
+// Trash returns the buckets in the trash, most recently deleted first.
+func (ds *Datastore) Trash() ([]*models.Bucket, error) {
+	var buckets []*models.Bucket
+	err := ds.trashed(ds.db).Order("deleted DESC").Find(&buckets).Error
+	return buckets, err
+}
+
+// PurgeTrash permanently deletes the buckets moved to the trash before a
+// time, with their events, and returns their IDs.
+func (ds *Datastore) PurgeTrash(before time.Time) ([]string, error) {
+	var ids []string
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		if err := ds.trashed(tx).Where("deleted < ?", before.UTC()).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := tx.Unscoped().Where("id = ?", id).Delete(&models.Bucket{}).Error; err != nil {
+				return err
+			}
+			if err := deleteBucketEvents(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"timelygator/server/database/migrations"
+	"timelygator/server/database/models"
+)
+
+func TestOrphanedEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	ds, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.CreateBucket("kept", "afkstatus", "test", "host", t0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Left behind by a bucket deleted before deletion cascaded, and deleted by
+	// migration 3
+	if _, err := migrations.Down(ds.db, 2); err != nil {
+		t.Fatal(err)
+	}
+	events := []*models.Event{
+		{BucketID: "kept", Timestamp: t0, Duration: 60, Data: []byte(`{}`)},
+		{BucketID: "deleted", Timestamp: t0, Duration: 60, Data: []byte(`{}`)},
+	}
+	if err := ds.db.Create(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.db.Create(&models.EventRevision{EventID: events[1].ID, BucketID: "deleted"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if ds, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	ds.db.Model(&models.Event{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("expected only the event of the existing bucket to be kept, got %d", count)
+	}
+	ds.db.Model(&models.EventRevision{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected orphaned revisions to be deleted, got %d", count)
+	}
+}
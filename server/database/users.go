@@ -0,0 +1,139 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"timelygator/server/database/models"
+	"timelygator/server/utils/types"
+
+	"gorm.io/gorm"
+)
+
+// LocalProvider is the provider of users added from the command line, who
+// are linked to their identity by email when they first sign in.
+const LocalProvider = "local"
+
+// Users returns all users ordered by ID.
+func (ds *Datastore) Users() ([]*models.User, error) {
+	users := []*models.User{}
+	if err := ds.db.Order("id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// UserCount returns the number of users.
+func (ds *Datastore) UserCount() (int64, error) {
+	var count int64
+	err := ds.db.Model(&models.User{}).Count(&count).Error
+	return count, err
+}
+
+// UserByIdentity returns the user with the given provider subject.
+func (ds *Datastore) UserByIdentity(provider, subject string) (*models.User, error) {
+	var user models.User
+	if err := ds.db.First(&user, "provider = ? AND subject = ?", provider, subject).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &types.NotFound{Code: "NoSuchUser", Message: "Unknown user"}
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// UserByEmail returns the user with the given email added from the command
+// line, or of any provider if local is false.
+func (ds *Datastore) UserByEmail(email string, local bool) (*models.User, error) {
+	q := ds.db.Where("LOWER(email) = LOWER(?)", email)
+	if local {
+		q = q.Where("provider = ?", LocalProvider)
+	}
+	var user models.User
+	if err := q.First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &types.NotFound{Code: "NoSuchUser", Message: fmt.Sprintf("No user with email %s", email)}
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateUser stores a new user. The first user becomes an admin.
+func (ds *Datastore) CreateUser(user *models.User) error {
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.User{}).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			user.Admin = true
+		}
+		if user.Email != "" {
+			if err := tx.Model(&models.User{}).Where("LOWER(email) = LOWER(?)", user.Email).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return &types.BadRequest{Code: "UserExists", Message: fmt.Sprintf("A user with email %s already exists", user.Email)}
+			}
+		}
+		return tx.Create(user).Error
+	})
+}
+
+// SaveUser updates a user.
+func (ds *Datastore) SaveUser(user *models.User) error {
+	return ds.db.Save(user).Error
+}
+
+// DeleteUser removes a user with their sessions and tokens. Their buckets are
+// kept and shared with admins.
+func (ds *Datastore) DeleteUser(id uint) error {
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Delete(&models.User{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return &types.NotFound{Code: "NoSuchUser", Message: fmt.Sprintf("No user with id %d", id)}
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&models.Session{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&models.APIToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Model(&models.Bucket{}).Where("owner_id = ?", id).Update("owner_id", nil).Error
+	})
+}
+
+// CreateSession stores a new session.
+func (ds *Datastore) CreateSession(session *models.Session) error {
+	return ds.db.Create(session).Error
+}
+
+// SessionUser returns the user of the unexpired session with the given hash.
+func (ds *Datastore) SessionUser(hash string, now time.Time) (*models.User, error) {
+	var user models.User
+	err := ds.db.Joins("JOIN sessions ON sessions.user_id = users.id").
+		Where("sessions.hash = ? AND sessions.expires > ?", hash, now).
+		First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &types.NotFound{Code: "NoSuchSession", Message: "Unknown or expired session"}
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// DeleteSession removes the session with the given hash.
+func (ds *Datastore) DeleteSession(hash string) error {
+	return ds.db.Where("hash = ?", hash).Delete(&models.Session{}).Error
+}
+
+// DeleteExpiredSessions removes sessions that expired before now.
+func (ds *Datastore) DeleteExpiredSessions(now time.Time) error {
+	return ds.db.Where("expires <= ?", now).Delete(&models.Session{}).Error
+}
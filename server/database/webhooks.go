@@ -0,0 +1,69 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"timelygator/server/database/models"
+	"timelygator/server/utils/types"
+
+	"gorm.io/gorm"
+)
+
+// Webhooks returns all webhook subscriptions ordered by ID.
+func (ds *Datastore) Webhooks() ([]*models.Webhook, error) {
+	var hooks []*models.Webhook
+	if err := ds.db.Order("id").Find(&hooks).Error; err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// GetWebhook returns the webhook with the given ID.
+func (ds *Datastore) GetWebhook(id uint) (*models.Webhook, error) {
+	var hook models.Webhook
+	if err := ds.db.First(&hook, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &types.NotFound{
+				Code:    "NoSuchWebhook",
+				Message: fmt.Sprintf("No webhook with id %d", id),
+			}
+		}
+		return nil, err
+	}
+	return &hook, nil
+}
+
+// SaveWebhook creates the webhook, or updates it if it has an ID.
+func (ds *Datastore) SaveWebhook(hook *models.Webhook) error {
+	return ds.db.Save(hook).Error
+}
+
+// DeleteWebhook removes a webhook along with its dead letters.
+func (ds *Datastore) DeleteWebhook(id uint) error {
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", id).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.Webhook{}, id).Error
+	})
+}
+
+// AddDeadLetter records a delivery that could not be made.
+func (ds *Datastore) AddDeadLetter(delivery *models.WebhookDelivery) error {
+	return ds.db.Create(delivery).Error
+}
+
+// DeadLetters returns the failed deliveries of a webhook, newest first.
+func (ds *Datastore) DeadLetters(webhookID uint) ([]*models.WebhookDelivery, error) {
+	deliveries := []*models.WebhookDelivery{}
+	if err := ds.db.Where("webhook_id = ?", webhookID).Order("id DESC").Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// ClearDeadLetters removes the failed deliveries of a webhook.
+func (ds *Datastore) ClearDeadLetters(webhookID uint) error {
+	return ds.db.Where("webhook_id = ?", webhookID).Delete(&models.WebhookDelivery{}).Error
+}
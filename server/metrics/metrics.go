@@ -0,0 +1,171 @@
+// Package metrics collects the Prometheus metrics of the server. They are
+// served in the text exposition format by Handler, on the main listener at
+// /metrics or on a separate one, see METRICS_ADDR.
+//
+// Metrics are registered on Registry rather than the global Prometheus
+// registry, so that tests can create servers without conflicting
+// registrations.
+package metrics
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"timelygator/server/database"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "timelygator"
+
+// Registry holds all metrics of the server.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	// Heartbeats counts heartbeats by whether they were merged into the
+	// last event or inserted as a new one.
+	Heartbeats = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "heartbeats_total",
+		Help:      "Heartbeats received, by whether they were merged into the last event or inserted.",
+	}, []string{"result"})
+
+	// HeartbeatLockTimeouts counts heartbeats rejected with 409 because the
+	// heartbeat lock could not be acquired in time.
+	HeartbeatLockTimeouts = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "heartbeat_lock_timeouts_total",
+		Help:      "Heartbeats rejected because the heartbeat lock could not be acquired in time.",
+	})
+
+	// QueryDuration observes the evaluation of a query for one time period.
+	QueryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_duration_seconds",
+		Help:      "Time to evaluate a query for one time period, by whether the cache was asked for.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"cache"})
+
+	requestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of API requests, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// Heartbeat results.
+const (
+	Merged   = "merged"
+	Inserted = "inserted"
+)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Handler serves the metrics of Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// statusWriter remembers the status code written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working through the wrapper.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware observes the latency of requests by their route template, so
+// that requests for different buckets share a series. It must run after
+// routing.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		requestDuration.WithLabelValues(route, r.Method, strconv.Itoa(sw.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// storageCollector reports the number of events per bucket and the size of
+// the database, read when the metrics are scraped.
+type storageCollector struct {
+	ds     *database.Datastore
+	events *prometheus.Desc
+	size   *prometheus.Desc
+}
+
+// RegisterStorage adds the storage metrics of ds to Registry. It replaces
+// the datastore of an earlier call.
+func RegisterStorage(ds *database.Datastore) {
+	c := &storageCollector{
+		ds:     ds,
+		events: prometheus.NewDesc(namespace+"_bucket_events", "Number of events stored in a bucket.", []string{"bucket"}, nil),
+		size:   prometheus.NewDesc(namespace+"_database_size_bytes", "Size of the SQLite database.", nil, nil),
+	}
+	Registry.Unregister(c)
+	Registry.MustRegister(c)
+}
+
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.events
+	ch <- c.size
+}
+
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.ds.EventCounts()
+	if err != nil {
+		log.Printf("Could not count events for metrics: %v\n", err)
+	}
+	for bucketID, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.events, prometheus.GaugeValue, float64(n), bucketID)
+	}
+	size, err := c.ds.Size()
+	if err != nil {
+		log.Printf("Could not read database size for metrics: %v\n", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(size))
+}
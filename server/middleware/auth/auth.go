@@ -0,0 +1,334 @@
+// Package auth authenticates API requests with server-managed tokens.
+//
+// Clients send their token as "Authorization: Bearer <token>". Browsers'
+// EventSource cannot set headers, so GET requests may pass it as the
+// access_token query parameter instead. Tokens carry scopes:
+//
+//	read          read buckets, events, settings and run queries
+//	write-events  create buckets and insert or heartbeat events
+//	admin         everything, including settings, webhooks and tokens
+//	bucket:<p>    restrict the token to buckets whose ID starts with p
+//
+// A token with bucket scopes can only use routes of a single bucket. Users
+// signed in to the web UI through an identity provider carry a session cookie
+// instead, which grants admin access.
+//
+// Tokens created by a user, and users themselves, only reach that user's
+// buckets, and admin access covers only their own data. Changing what affects
+// every user, like settings and webhooks, needs the server scope, which only
+// admin tokens without owner and admin users have.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+	"timelygator/server/middleware/errors"
+	"timelygator/server/utils"
+	"timelygator/server/utils/types"
+
+	"github.com/gorilla/mux"
+)
+
+// Scope is a permission granted to a token.
+type Scope string
+
+const (
+	Read        Scope = "read"
+	WriteEvents Scope = "write-events"
+	Admin       Scope = "admin"
+
+	// Server is needed for changes that affect every user. It cannot be
+	// given to tokens directly, see Grant.Allows.
+	Server Scope = "server"
+
+	// Public marks routes that need no authentication at all.
+	Public Scope = ""
+
+	// BucketPrefix starts scopes that restrict a token to some buckets.
+	BucketPrefix = "bucket:"
+)
+
+// tokenPrefix marks TimelyGator tokens so they are easy to spot in configs.
+const tokenPrefix = "tg_"
+
+// touchInterval limits how often the last use of a token is written.
+const touchInterval = time.Minute
+
+// ValidateScopes checks that all scopes are known.
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("a token needs at least one scope")
+	}
+	for _, s := range scopes {
+		switch {
+		case s == string(Read), s == string(WriteEvents), s == string(Admin):
+		case strings.HasPrefix(s, BucketPrefix) && len(s) > len(BucketPrefix):
+		default:
+			return fmt.Errorf("unknown scope %q, expected read, write-events, admin or bucket:<prefix>", s)
+		}
+	}
+	return nil
+}
+
+// GenerateToken returns a new random token and the hash to store for it.
+func GenerateToken() (token, hash string) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token = tokenPrefix + hex.EncodeToString(b)
+	return token, HashToken(token)
+}
+
+// HashToken returns the hash a token is stored under. Tokens are long and
+// random, so a plain SHA-256 is enough.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// DisplayPrefix returns the part of a token kept in clear for identification.
+func DisplayPrefix(token string) string {
+	if len(token) > len(tokenPrefix)+8 {
+		return token[:len(tokenPrefix)+8]
+	}
+	return token
+}
+
+// IssueToken creates and stores a token with the given scopes. The returned
+// token is the only time it is available in clear.
+func IssueToken(ds *database.Datastore, name string, scopes []string) (string, *models.APIToken, error) {
+	if name == "" {
+		return "", nil, &types.BadRequest{Code: "InvalidToken", Message: "A token needs a name"}
+	}
+	if err := ValidateScopes(scopes); err != nil {
+		return "", nil, &types.BadRequest{Code: "InvalidToken", Message: err.Error()}
+	}
+	raw, _ := json.Marshal(scopes)
+	token, hash := GenerateToken()
+	stored := &models.APIToken{
+		Name:    name,
+		Prefix:  DisplayPrefix(token),
+		Hash:    hash,
+		Scopes:  raw,
+		Created: time.Now().UTC(),
+	}
+	if err := ds.CreateToken(stored); err != nil {
+		return "", nil, err
+	}
+	return token, stored, nil
+}
+
+// Grant is the decoded scopes of a token, or the access of a signed in user.
+type Grant struct {
+	Token    *models.APIToken // nil for sessions
+	User     *models.User     // nil for tokens
+	scopes   map[Scope]bool
+	prefixes []string
+}
+
+// NewGrant decodes the scopes of a stored token.
+func NewGrant(token *models.APIToken) (*Grant, error) {
+	var scopes []string
+	if err := json.Unmarshal(token.Scopes, &scopes); err != nil {
+		return nil, fmt.Errorf("token %d has invalid scopes: %w", token.ID, err)
+	}
+	g := &Grant{Token: token, scopes: map[Scope]bool{}}
+	for _, s := range scopes {
+		if strings.HasPrefix(s, BucketPrefix) {
+			g.prefixes = append(g.prefixes, strings.TrimPrefix(s, BucketPrefix))
+		} else {
+			g.scopes[Scope(s)] = true
+		}
+	}
+	return g, nil
+}
+
+// UserGrant returns the grant of a user signed in to the web UI.
+func UserGrant(user *models.User) *Grant {
+	return &Grant{User: user, scopes: map[Scope]bool{Admin: true}}
+}
+
+// Name describes who the grant belongs to, for messages.
+func (g *Grant) Name() string {
+	if g.User != nil {
+		return g.User.Email
+	}
+	return g.Token.Name
+}
+
+// Owner returns the user whose data the grant is limited to, or nil if it
+// reaches every bucket.
+func (g *Grant) Owner() *uint {
+	if g.User != nil {
+		return &g.User.ID
+	}
+	return g.Token.UserID
+}
+
+// IsAdmin reports whether the grant may change what affects every user.
+func (g *Grant) IsAdmin() bool {
+	if g.User != nil {
+		return g.User.Admin
+	}
+	return g.scopes[Admin] && g.Token.UserID == nil
+}
+
+// Allows reports whether the grant covers scope for bucketID, which is empty
+// for routes that are not about a single bucket.
+func (g *Grant) Allows(scope Scope, bucketID string) bool {
+	switch {
+	case scope == Server:
+		if !g.IsAdmin() {
+			return false
+		}
+	case g.scopes[Admin]:
+	case scope == Read && (g.scopes[Read] || g.scopes[WriteEvents]):
+	case scope == WriteEvents && g.scopes[WriteEvents]:
+	default:
+		return false
+	}
+	if len(g.prefixes) == 0 {
+		return true
+	}
+	for _, p := range g.prefixes {
+		if bucketID != "" && strings.HasPrefix(bucketID, p) {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// FromContext returns the grant of the authenticated request, or nil if
+// authentication is disabled.
+func FromContext(ctx context.Context) *Grant {
+	g, _ := ctx.Value(contextKey{}).(*Grant)
+	return g
+}
+
+// Authenticator checks request tokens and session cookies against the
+// datastore.
+type Authenticator struct {
+	ds *database.Datastore
+
+	// Sessions accepts session cookies as well as tokens if not nil.
+	Sessions *Sessions
+	// TrustedOrigin reports whether pages from an origin other than the
+	// server may change data with the session cookie.
+	TrustedOrigin func(origin string) bool
+
+	mu      sync.Mutex
+	touched map[uint]time.Time
+}
+
+// NewAuthenticator creates an authenticator for the tokens stored in ds.
+func NewAuthenticator(ds *database.Datastore) *Authenticator {
+	return &Authenticator{ds: ds, touched: map[uint]time.Time{}}
+}
+
+// Authenticate returns the grant of a token.
+func (a *Authenticator) Authenticate(token string) (*Grant, error) {
+	stored, err := a.ds.TokenByHash(HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	a.touch(stored.ID)
+	return NewGrant(stored)
+}
+
+func (a *Authenticator) touch(id uint) {
+	now := time.Now().UTC()
+	a.mu.Lock()
+	last := a.touched[id]
+	if now.Sub(last) < touchInterval {
+		a.mu.Unlock()
+		return
+	}
+	a.touched[id] = now
+	a.mu.Unlock()
+	if err := a.ds.TouchToken(id, now); err != nil {
+		log.Printf("Could not record use of token %d: %v\n", id, err)
+	}
+}
+
+func requestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if token, ok := strings.CutPrefix(h, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if r.Method == http.MethodGet {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// Middleware rejects requests without a token or session granting the scope
+// that required returns for them. It must run after routing so that the
+// bucket_id route variable is available.
+func (a *Authenticator) Middleware(required func(r *http.Request) Scope) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scope := required(r)
+			if r.Method == http.MethodOptions || scope == Public {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var grant *Grant
+			if token := requestToken(r); token != "" {
+				var err error
+				grant, err = a.Authenticate(token)
+				if err != nil {
+					if utils.IsNotFound(err) {
+						w.Header().Set("WWW-Authenticate", `Bearer realm="timelygator", error="invalid_token"`)
+						errors.HttpErrorString(w, "Invalid API token", http.StatusUnauthorized)
+					} else {
+						errors.HttpError(w, err, http.StatusInternalServerError)
+					}
+					return
+				}
+			} else if a.Sessions != nil {
+				user, err := a.Sessions.User(r)
+				if err != nil {
+					if utils.IsNotFound(err) {
+						w.Header().Set("WWW-Authenticate", `Bearer realm="timelygator"`)
+						errors.HttpErrorString(w, "Sign in or send an API token", http.StatusUnauthorized)
+					} else {
+						errors.HttpError(w, err, http.StatusInternalServerError)
+					}
+					return
+				}
+				safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+				if !safe && !a.sameOrigin(r) {
+					errors.HttpErrorString(w, "Cross-origin request rejected", http.StatusForbidden)
+					return
+				}
+				grant = UserGrant(user)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="timelygator"`)
+				errors.HttpErrorString(w, "Missing API token", http.StatusUnauthorized)
+				return
+			}
+			if !grant.Allows(scope, mux.Vars(r)["bucket_id"]) {
+				errors.HttpErrorString(w, fmt.Sprintf("%s does not grant %s access to this resource", grant.Name(), scope), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, grant)))
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"timelygator/server/database/models"
+)
+
+func grant(t *testing.T, scopes ...string) *Grant {
+	t.Helper()
+	raw, _ := json.Marshal(scopes)
+	g, err := NewGrant(&models.APIToken{Name: "test", Scopes: raw})
+	if err != nil {
+		t.Fatalf("NewGrant: %v", err)
+	}
+	return g
+}
+
+func TestAllows(t *testing.T) {
+	cases := []struct {
+		scopes   []string
+		scope    Scope
+		bucketID string
+		want     bool
+	}{
+		{[]string{"read"}, Read, "", true},
+		{[]string{"read"}, WriteEvents, "b", false},
+		{[]string{"read"}, Admin, "", false},
+		{[]string{"write-events"}, Read, "b", true},
+		{[]string{"write-events"}, WriteEvents, "b", true},
+		{[]string{"write-events"}, Admin, "b", false},
+		{[]string{"admin"}, Admin, "", true},
+		{[]string{"admin"}, WriteEvents, "b", true},
+		{[]string{"write-events", "bucket:tg-"}, WriteEvents, "tg-observer-window", true},
+		{[]string{"write-events", "bucket:tg-"}, WriteEvents, "other", false},
+		{[]string{"write-events", "bucket:tg-"}, Read, "", false},
+		{[]string{"read", "bucket:a", "bucket:b"}, Read, "b1", true},
+	}
+	for _, c := range cases {
+		if got := grant(t, c.scopes...).Allows(c.scope, c.bucketID); got != c.want {
+			t.Errorf("%v allows %s on %q: expected %v, got %v", c.scopes, c.scope, c.bucketID, c.want, got)
+		}
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	for _, ok := range [][]string{{"read"}, {"write-events", "bucket:x"}, {"admin"}} {
+		if err := ValidateScopes(ok); err != nil {
+			t.Errorf("%v: unexpected error %v", ok, err)
+		}
+	}
+	for _, bad := range [][]string{nil, {"bucket:"}, {"write"}, {"read", "Admin"}} {
+		if err := ValidateScopes(bad); err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+}
+
+func TestGenerateToken(t *testing.T) {
+	a, hashA := GenerateToken()
+	b, _ := GenerateToken()
+	if a == b {
+		t.Fatal("expected different tokens")
+	}
+	if !strings.HasPrefix(a, tokenPrefix) || len(a) != len(tokenPrefix)+64 {
+		t.Errorf("unexpected token format %q", a)
+	}
+	if HashToken(a) != hashA || strings.Contains(hashA, a) {
+		t.Errorf("unexpected hash %q", hashA)
+	}
+	if p := DisplayPrefix(a); !strings.HasPrefix(a, p) || len(p) >= len(a) {
+		t.Errorf("unexpected display prefix %q", p)
+	}
+}
+
+func TestOriginMatcher(t *testing.T) {
+	match := OriginMatcher([]string{"http://localhost:*", "https://tg.example.com"})
+	for origin, want := range map[string]bool{
+		"http://localhost:5173":       true,
+		"http://localhost:":           true,
+		"https://localhost:5173":      false,
+		"https://tg.example.com":      true,
+		"https://tg.example.com.evil": false,
+		"":                            false,
+	} {
+		if got := match(origin); got != want {
+			t.Errorf("%q: expected %v, got %v", origin, want, got)
+		}
+	}
+	if !OriginMatcher([]string{"*"})("https://anything") {
+		t.Error("expected * to match any origin")
+	}
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+	"timelygator/server/utils/types"
+)
+
+// SessionCookie holds the session of a browser signed in to the web UI.
+const SessionCookie = "tg_session"
+
+// Sessions keeps track of signed in browsers.
+type Sessions struct {
+	ds  *database.Datastore
+	ttl time.Duration
+}
+
+// NewSessions creates a session store whose sessions last for ttl.
+func NewSessions(ds *database.Datastore, ttl time.Duration) *Sessions {
+	return &Sessions{ds: ds, ttl: ttl}
+}
+
+// IsSecure reports whether the browser reached the server over HTTPS,
+// directly or through a proxy.
+func IsSecure(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// Start signs user in, setting the session cookie on w.
+func (s *Sessions) Start(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now().UTC()
+	if err := s.ds.DeleteExpiredSessions(now); err != nil {
+		return err
+	}
+	session := &models.Session{UserID: user.ID, Hash: HashToken(token), Created: now, Expires: now.Add(s.ttl)}
+	if err := s.ds.CreateSession(session); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.Expires,
+		MaxAge:   int(s.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   IsSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// User returns the signed in user of the request.
+func (s *Sessions) User(r *http.Request) (*models.User, error) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, &types.NotFound{Code: "NoSuchSession", Message: "Not signed in"}
+	}
+	return s.ds.SessionUser(HashToken(cookie.Value), time.Now().UTC())
+}
+
+// End signs the browser out and clears its session cookie.
+func (s *Sessions) End(w http.ResponseWriter, r *http.Request) error {
+	if cookie, err := r.Cookie(SessionCookie); err == nil && cookie.Value != "" {
+		if err := s.ds.DeleteSession(HashToken(cookie.Value)); err != nil {
+			return err
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   IsSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// OriginMatcher returns a function reporting whether an origin such as
+// "http://localhost:5173" matches one of patterns. A pattern may contain a
+// single "*" matching any characters, like the CORS_ORIGINS setting.
+func OriginMatcher(patterns []string) func(origin string) bool {
+	return func(origin string) bool {
+		for _, p := range patterns {
+			if p == "*" || p == origin {
+				return true
+			}
+			if prefix, suffix, ok := strings.Cut(p, "*"); ok &&
+				len(origin) >= len(prefix)+len(suffix) &&
+				strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// sameOrigin reports whether the Origin header of a request is the server
+// itself or trusted. Requests authenticated by cookie must pass this check
+// before changing anything, as browsers attach cookies to forged requests too.
+func (a *Authenticator) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	return a.TrustedOrigin != nil && a.TrustedOrigin(origin)
+}
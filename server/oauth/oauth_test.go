@@ -0,0 +1,104 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// newTestProvider returns a provider backed by a local authorization server.
+// The server accepts the code "good" if the verifier matches the challenge of
+// the last authorization URL.
+func newTestProvider(t *testing.T, userinfo map[string]interface{}) *OIDC {
+	t.Helper()
+	p := NewGoogle("id", "secret")
+	mux := http.NewServeMux()
+	var challenge string
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		challenge = r.URL.Query().Get("code_challenge")
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("code") != "good" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "at", "token_type": "Bearer", "expires_in": 3600})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer at" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(userinfo)
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	p.Config.Endpoint = oauth2.Endpoint{AuthURL: ts.URL + "/auth", TokenURL: ts.URL + "/token", AuthStyle: oauth2.AuthStyleInParams}
+	p.UserInfoURL = ts.URL + "/userinfo"
+	return p
+}
+
+// authorize visits the authorization URL like a browser would.
+func authorize(t *testing.T, p *OIDC, verifier string) {
+	t.Helper()
+	authURL := p.AuthCodeURL("state", verifier, "http://localhost/callback")
+	u, _ := url.Parse(authURL)
+	if q := u.Query(); q.Get("state") != "state" || q.Get("redirect_uri") != "http://localhost/callback" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+	res, err := http.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorization request failed: %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestExchange(t *testing.T) {
+	p := newTestProvider(t, map[string]interface{}{
+		"sub": "123", "email": "ada@example.com", "email_verified": true, "name": "Ada",
+	})
+	verifier := GenerateVerifier()
+	authorize(t, p, verifier)
+
+	id, err := p.Exchange(context.Background(), "good", verifier, "http://localhost/callback")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if id.Subject != "123" || id.Email != "ada@example.com" || id.Name != "Ada" {
+		t.Errorf("unexpected identity %+v", id)
+	}
+
+	if _, err := p.Exchange(context.Background(), "bad", verifier, "http://localhost/callback"); err == nil {
+		t.Error("expected an error for an invalid code")
+	}
+	if _, err := p.Exchange(context.Background(), "good", GenerateVerifier(), "http://localhost/callback"); err == nil {
+		t.Error("expected an error for a wrong verifier")
+	}
+}
+
+func TestExchangeUnverifiedEmail(t *testing.T) {
+	p := newTestProvider(t, map[string]interface{}{"sub": "123", "email": "ada@example.com", "email_verified": false})
+	verifier := GenerateVerifier()
+	authorize(t, p, verifier)
+
+	id, err := p.Exchange(context.Background(), "good", verifier, "http://localhost/callback")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if id.Email != "" {
+		t.Errorf("expected unverified email to be dropped, got %q", id.Email)
+	}
+}
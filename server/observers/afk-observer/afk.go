@@ -32,7 +32,7 @@ func NewAFKWatcher(timeout, pollTime time.Duration, host, port string, testing,
 		testing,
 		&host,
 		&port,
-		"http",
+		"", // PROTOCOL from the environment
 	)
 
 	bucketName := fmt.Sprintf("%s_%s", tgClient.ClientName, tgClient.ClientHostname)
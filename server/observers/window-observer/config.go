@@ -18,6 +18,11 @@ import (
 //   EXCLUDE_TITLES   → comma‑separated list of regexp strings to ignore
 //   POLL_TIME        → sampling interval in seconds (float, default 1.0)
 //   STRATEGY         → macOS only: jxa | applescript | swift  (default swift)
+//   API_TOKEN        → token with write-events scope, if the server requires one
+//   PROTOCOL         → http | https (default http)
+//   TLS_CA           → CA bundle to trust for https, e.g. the server's self-signed cert
+//   TLS_CLIENT_CERT  → client certificate, if the server requires one
+//   TLS_CLIENT_KEY   → key of the client certificate
 //
 // You can override any of these at runtime with CLI flags if desired; the
 // observer’s flag parser should fall back to the values supplied here.
@@ -34,6 +39,8 @@ type WindowObserverConfig struct {
 	ExcludeTitles []string `env:"EXCLUDE_TITLES" envSeparator:","`
 	PollTime      float64  `env:"POLL_TIME"    envDefault:"1.0"`
 	Strategy      string   `env:"STRATEGY"     envDefault:"swift"`
+	Token         string   `env:"API_TOKEN"`
+	Protocol      string   `env:"PROTOCOL"     envDefault:"http"`
 }
 
 // LoadConfig reads .env (if present) and environment variables into the struct.
@@ -48,6 +48,8 @@ func main() {
 		excludeTitles = flag.String("exclude-titles", strings.Join(cfg.ExcludeTitles, ","), "Comma‑separated regex list to anonymize titles")
 		pollTime      = flag.Float64("poll-time", cfg.PollTime, "Polling interval in seconds")
 		strategy      = flag.String("strategy", cfg.Strategy, "macOS only: jxa | applescript | swift")
+		token         = flag.String("token", cfg.Token, "API token, if the server requires one")
+		protocol      = flag.String("protocol", cfg.Protocol, "Server protocol: http | https")
 	)
 	flag.Parse()
 
@@ -61,7 +63,10 @@ func main() {
 	}
 
 	// ----- TimelyGator client --------------------------------------
-	tg := client.NewTimelyGatorClient("tg-observer-window", *testing, host, port, "http")
+	tg := client.NewTimelyGatorClient("tg-observer-window", *testing, host, port, *protocol)
+	if *token != "" {
+		tg.APIToken = *token
+	}
 	if err := tg.WaitForStart(10); err != nil {
 		log.Fatalf("server not ready: %v", err)
 	}
@@ -0,0 +1,194 @@
+package query
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"timelygator/server/database"
+)
+
+// DefaultCacheSize is the number of results a Cache keeps by default.
+const DefaultCacheSize = 1000
+
+// Cache stores results of named queries for time periods that have fully
+// elapsed, so dashboards re-running the same query over past days do not
+// recompute history. Entries are dropped when events that overlap their
+// period change in one of the buckets the query read.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // least recently used at the back
+
+	// Invalidations are numbered, so that results evaluated while one
+	// arrived are not cached. changed holds the number of the last one of
+	// each bucket, bucketsChanged of any bucket, and classesChanged of the
+	// classes.
+	generation     uint64
+	changed        map[string]uint64
+	bucketsChanged uint64
+	classesChanged uint64
+
+	// now and evaluated are overridden in tests
+	now       func() time.Time
+	evaluated func()
+}
+
+type cacheEntry struct {
+	key          string
+	start, end   time.Time
+	buckets      map[string]struct{}
+	findsBuckets bool
+	usesClasses  bool
+	result       interface{}
+}
+
+// NewCache creates a cache holding at most size results.
+func NewCache(size int) *Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	return &Cache{
+		size:      size,
+		entries:   make(map[string]*list.Element),
+		order:     list.New(),
+		changed:   make(map[string]uint64),
+		now:       time.Now,
+		evaluated: func() {},
+	}
+}
+
+// cacheKey identifies a result. Users see different buckets, so the owner the
+// datastore is restricted to is part of the key.
+func cacheKey(s *Script, ds *database.Datastore, start, end time.Time) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%d/%d", s.name, s.hash, ds.Scope(), start.UnixNano(), end.UnixNano())
+}
+
+// Eval returns the cached result of the script for [start, end] if there is
+// one, and otherwise evaluates it, caching the result if the period has
+// already ended.
+func (c *Cache) Eval(s *Script, ds *database.Datastore, start, end time.Time) (interface{}, error) {
+	key := cacheKey(s, ds, start, end)
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		log.Printf("Using cached result of query '%s' for %s/%s\n", s.name, start.Format(time.RFC3339), end.Format(time.RFC3339))
+		return el.Value.(*cacheEntry).result, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	result, ns, err := s.eval(ds, start, end)
+	if err != nil {
+		return nil, err
+	}
+	c.evaluated()
+	if !end.Before(c.now()) {
+		// The period is still ongoing, new events may arrive at any time
+		return result, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok || c.changedSince(generation, ns) {
+		return result, nil
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{
+		key:          key,
+		start:        start,
+		end:          end,
+		buckets:      ns.buckets,
+		findsBuckets: ns.findsBuckets,
+		usesClasses:  ns.usesClasses,
+		result:       result,
+	})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+	return result, nil
+}
+
+// changedSince reports whether the data a result was evaluated from may have
+// changed after invalidation generation, in which case it may be stale.
+func (c *Cache) changedSince(generation uint64, ns *namespace) bool {
+	if ns.findsBuckets && c.bucketsChanged > generation {
+		return true
+	}
+	if ns.usesClasses && c.classesChanged > generation {
+		return true
+	}
+	for bucketID := range ns.buckets {
+		if c.changed[bucketID] > generation {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// InvalidateEvents drops results that read bucketID and whose period overlaps
+// [start, end], the time span of events that were added, changed or removed.
+func (c *Cache) InvalidateEvents(bucketID string, start, end time.Time) {
+	c.invalidate(func() {
+		c.changed[bucketID] = c.generation
+	}, func(e *cacheEntry) bool {
+		if _, ok := e.buckets[bucketID]; !ok {
+			return false
+		}
+		return !start.After(e.end) && !end.Before(e.start)
+	})
+}
+
+// InvalidateBucket drops all results that read bucketID or looked up buckets
+// with find_bucket, for when a bucket is created, changed or deleted.
+func (c *Cache) InvalidateBucket(bucketID string) {
+	c.invalidate(func() {
+		c.changed[bucketID] = c.generation
+		c.bucketsChanged = c.generation
+	}, func(e *cacheEntry) bool {
+		_, ok := e.buckets[bucketID]
+		return ok || e.findsBuckets
+	})
+}
+
+// InvalidateClasses drops all results that categorized events with the
+// classes stored in the settings.
+func (c *Cache) InvalidateClasses() {
+	c.invalidate(func() {
+		c.classesChanged = c.generation
+	}, func(e *cacheEntry) bool {
+		return e.usesClasses
+	})
+}
+
+// invalidate numbers the invalidation, records it with record and drops the
+// results that match.
+func (c *Cache) invalidate(record func(), match func(e *cacheEntry) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	record()
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*cacheEntry)) {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// Len returns the number of cached results.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,152 @@
+package query
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	ds := newTestDatastore(t)
+	if _, err := ds.CreateBucket("window", "currentwindow", "test", "host", t0, nil, nil); err != nil {
+		t.Fatalf("CreateBucket error: %v", err)
+	}
+	if _, err := ds.CreateBucket("other", "currentwindow", "test", "host", t0, nil, nil); err != nil {
+		t.Fatalf("CreateBucket error: %v", err)
+	}
+	insert(t, ds, "window", 0, 10, map[string]interface{}{"app": "a"})
+
+	script, err := Parse("count", []string{`RETURN = sum_durations(query_bucket("window"));`})
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	cache := NewCache(10)
+	cache.now = func() time.Time { return t0.Add(24 * time.Hour) }
+
+	start, end := t0.Add(-time.Hour), t0.Add(time.Hour)
+	eval := func() float64 {
+		t.Helper()
+		res, err := cache.Eval(script, ds, start, end)
+		if err != nil {
+			t.Fatalf("Eval error: %v", err)
+		}
+		return res.(float64)
+	}
+
+	if got := eval(); got != 10 {
+		t.Fatalf("expected 10, got %v", got)
+	}
+	insert(t, ds, "window", 20, 5, map[string]interface{}{"app": "b"})
+	if got := eval(); got != 10 {
+		t.Errorf("expected cached result 10, got %v", got)
+	}
+
+	// Changes in other buckets or outside the period keep the result
+	cache.InvalidateEvents("other", t0, t0.Add(time.Minute))
+	cache.InvalidateEvents("window", t0.Add(2*time.Hour), t0.Add(3*time.Hour))
+	if cache.Len() != 1 {
+		t.Fatalf("expected result to stay cached")
+	}
+
+	cache.InvalidateEvents("window", t0.Add(20*time.Second), t0.Add(25*time.Second))
+	if got := eval(); got != 15 {
+		t.Errorf("expected recomputed result 15, got %v", got)
+	}
+
+	// Results evaluated while their events change are not cached
+	cache.InvalidateBucket("window")
+	cache.evaluated = func() {
+		cache.InvalidateEvents("window", t0, t0.Add(time.Minute))
+	}
+	eval()
+	cache.evaluated = func() {}
+	if cache.Len() != 0 {
+		t.Errorf("expected a result invalidated during evaluation not to be cached, got %d entries", cache.Len())
+	}
+	cache.evaluated = func() {
+		cache.InvalidateEvents("other", t0, t0.Add(time.Minute))
+	}
+	eval()
+	cache.evaluated = func() {}
+	if cache.Len() != 1 {
+		t.Errorf("expected changes to other buckets during evaluation to keep the result, got %d entries", cache.Len())
+	}
+
+	// Periods that have not ended yet are never cached
+	cache.now = func() time.Time { return t0 }
+	cache.InvalidateBucket("window")
+	eval()
+	if cache.Len() != 0 {
+		t.Errorf("expected ongoing period not to be cached, got %d entries", cache.Len())
+	}
+}
+
+func TestCacheStoredClasses(t *testing.T) {
+	ds := newTestDatastore(t)
+	if _, err := ds.CreateBucket("window", "currentwindow", "test", "host", t0, nil, nil); err != nil {
+		t.Fatalf("CreateBucket error: %v", err)
+	}
+	insert(t, ds, "window", 0, 10, map[string]interface{}{"app": "Code"})
+	setClasses := func(raw string) {
+		t.Helper()
+		if err := ds.SetSetting("classes", []byte(raw)); err != nil {
+			t.Fatalf("SetSetting error: %v", err)
+		}
+	}
+	setClasses(`[{"name": ["Work"], "rule": {"type": "regex", "regex": "Code"}}]`)
+
+	script, err := Parse("categories", []string{`RETURN = categorize(query_bucket("window"));`})
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	cache := NewCache(10)
+	cache.now = func() time.Time { return t0.Add(24 * time.Hour) }
+	category := func() interface{} {
+		t.Helper()
+		res, err := cache.Eval(script, ds, t0, t0.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("Eval error: %v", err)
+		}
+		return res.([]*Event)[0].Data["$category"].([]interface{})[0]
+	}
+
+	if got := category(); got != "Work" {
+		t.Fatalf("expected stored classes to be applied, got %v", got)
+	}
+	setClasses(`[{"name": ["Editing"], "rule": {"type": "regex", "regex": "Code"}}]`)
+	cache.InvalidateBucket("other")
+	if got := category(); got != "Work" {
+		t.Errorf("expected cached result, got %v", got)
+	}
+	cache.InvalidateClasses()
+	if got := category(); got != "Editing" {
+		t.Errorf("expected result with new classes, got %v", got)
+	}
+}
+
+func TestCacheOwners(t *testing.T) {
+	ds := newTestDatastore(t)
+	alice, bob := ds.ForOwner(1, false), ds.ForOwner(2, false)
+	if _, err := alice.CreateBucket("window", "currentwindow", "test", "host", t0, nil, nil); err != nil {
+		t.Fatalf("CreateBucket error: %v", err)
+	}
+	insert(t, ds, "window", 0, 10, map[string]interface{}{"app": "a"})
+
+	script, err := Parse("count", []string{`RETURN = sum_durations(query_bucket(find_bucket("window")));`})
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	cache := NewCache(10)
+	cache.now = func() time.Time { return t0.Add(24 * time.Hour) }
+	start, end := t0.Add(-time.Hour), t0.Add(time.Hour)
+
+	if res, err := cache.Eval(script, alice, start, end); err != nil || res.(float64) != 10 {
+		t.Fatalf("expected 10 for the owner, got %v, %v", res, err)
+	}
+	// A cached result of one user must not be served to another
+	if _, err := cache.Eval(script, bob, start, end); err == nil {
+		t.Errorf("expected other users not to find the bucket")
+	}
+	if res, err := cache.Eval(script, ds, start, end); err != nil || res.(float64) != 10 {
+		t.Errorf("expected 10 without owner, got %v, %v", res, err)
+	}
+}
@@ -0,0 +1,58 @@
+package query
+
+import (
+	"timelygator/server/categories"
+)
+
+// classifierArg compiles the classes passed to categorize() and tag(). Without
+// them the rule set stored in the "classes" setting is used.
+func classifierArg(ns *namespace, args []interface{}, i int) (*categories.Classifier, error) {
+	if len(args) <= i || args[i] == nil {
+		ns.usesClasses = true
+		c, err := categories.Load(ns.ds)
+		if err != nil {
+			return nil, errorf("could not load stored classes: %v", err)
+		}
+		return c, nil
+	}
+	classes, err := categories.Parse(args[i])
+	if err != nil {
+		return nil, errorf("%v", err)
+	}
+	c, err := categories.Compile(classes)
+	if err != nil {
+		return nil, errorf("%v", err)
+	}
+	return c, nil
+}
+
+func stringList(s []string) []interface{} {
+	l := make([]interface{}, len(s))
+	for i, v := range s {
+		l[i] = v
+	}
+	return l
+}
+
+// categorize sets data["$category"] to the deepest matching class name, or
+// ["Uncategorized"] when nothing matches.
+func categorize(events []*Event, c *categories.Classifier) []*Event {
+	out := make([]*Event, 0, len(events))
+	for _, e := range events {
+		cp := e.copy()
+		cp.Data[categories.Key] = stringList(c.Categorize(e.Data))
+		out = append(out, cp)
+	}
+	return out
+}
+
+// tag sets data["$tags"] to the names of all matching classes.
+func tag(events []*Event, c *categories.Classifier) []*Event {
+	out := make([]*Event, 0, len(events))
+	for _, e := range events {
+		cp := e.copy()
+		cp.Data["$tags"] = stringList(c.Tags(e.Data))
+		out = append(out, cp)
+	}
+	return out
+}
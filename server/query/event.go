@@ -0,0 +1,90 @@
+package query
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"timelygator/server/database/models"
+)
+
+// Event is the in-memory representation of an event while a script runs.
+// Unlike models.Event its data is decoded so transforms can inspect and
+// rewrite it.
+type Event struct {
+	ID        uint
+	Timestamp time.Time
+	Duration  float64 // seconds
+	Data      map[string]interface{}
+}
+
+// FromModel decodes a stored event.
+func FromModel(e *models.Event) *Event {
+	data := map[string]interface{}{}
+	if len(e.Data) > 0 {
+		if err := json.Unmarshal(e.Data, &data); err != nil || data == nil {
+			data = map[string]interface{}{}
+		}
+	}
+	return &Event{
+		ID:        e.ID,
+		Timestamp: e.Timestamp,
+		Duration:  e.Duration,
+		Data:      data,
+	}
+}
+
+// End returns the time the event ends.
+func (e *Event) End() time.Time {
+	return e.Timestamp.Add(seconds(e.Duration))
+}
+
+// copy returns a copy of the event with its own data map.
+func (e *Event) copy() *Event {
+	data := make(map[string]interface{}, len(e.Data))
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	return &Event{ID: e.ID, Timestamp: e.Timestamp, Duration: e.Duration, Data: data}
+}
+
+func (e *Event) dataEqual(other *Event) bool {
+	return reflect.DeepEqual(e.Data, other.Data)
+}
+
+// MarshalJSON serializes events in the same shape that clients send them.
+func (e *Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"id":        e.ID,
+		"timestamp": e.Timestamp.Format(time.RFC3339Nano),
+		"duration":  e.Duration,
+		"data":      e.Data,
+	})
+}
+
+// fromMap converts a dict value (e.g. an event that was serialized into a
+// variable by a previous step) back into an Event.
+func fromMap(m map[string]interface{}) (*Event, error) {
+	e := &Event{Data: map[string]interface{}{}}
+	if id, ok := m["id"].(float64); ok {
+		e.ID = uint(id)
+	}
+	if ts, ok := m["timestamp"].(string); ok {
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return nil, errorf("invalid event timestamp %q", ts)
+		}
+		e.Timestamp = t
+	}
+	if d, ok := m["duration"].(float64); ok {
+		e.Duration = d
+	}
+	if data, ok := m["data"].(map[string]interface{}); ok {
+		e.Data = data
+	}
+	return e, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
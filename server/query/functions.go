@@ -0,0 +1,357 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"timelygator/server/categories"
+)
+
+type function func(ns *namespace, args []interface{}) (interface{}, error)
+
+var functions = map[string]function{
+	"query_bucket":            qQueryBucket,
+	"query_bucket_eventcount": qQueryBucketEventcount,
+	"find_bucket":             qFindBucket,
+	"flood":                   qFlood,
+	"filter_keyvals":          qFilterKeyvals(false),
+	"exclude_keyvals":         qFilterKeyvals(true),
+	"filter_keyvals_regex":    qFilterKeyvalsRegex,
+	"filter_period_intersect": qEventPair(filterPeriodIntersect),
+	"period_union":            qEventPair(periodUnion),
+	"concat":                  qEventPair(concat),
+	"categorize":              qClasses(categorize),
+	"tag":                     qClasses(tag),
+	"merge_events_by_keys":    qMergeEventsByKeys,
+	"sort_by_duration":        qEvents(sortByDuration),
+	"sort_by_timestamp":       qEvents(sortByTimestamp),
+	"split_url_events":        qEvents(splitURLEvents),
+	"limit_events":            qLimitEvents,
+	"sum_durations":           qSumDurations,
+	"nop":                     qNop,
+}
+
+// -- argument helpers --
+
+func checkArgs(args []interface{}, min, max int) error {
+	if len(args) < min || len(args) > max {
+		if min == max {
+			return errorf("expected %d arguments, got %d", min, len(args))
+		}
+		return errorf("expected %d to %d arguments, got %d", min, max, len(args))
+	}
+	return nil
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	case []*Event, []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "dict"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func stringArg(args []interface{}, i int) (string, error) {
+	s, ok := args[i].(string)
+	if !ok {
+		return "", errorf("argument %d must be a string, got %s", i+1, typeName(args[i]))
+	}
+	return s, nil
+}
+
+func numberArg(args []interface{}, i int) (float64, error) {
+	f, ok := args[i].(float64)
+	if !ok {
+		return 0, errorf("argument %d must be a number, got %s", i+1, typeName(args[i]))
+	}
+	return f, nil
+}
+
+func listArg(args []interface{}, i int) ([]interface{}, error) {
+	switch l := args[i].(type) {
+	case []interface{}:
+		return l, nil
+	case []*Event:
+		items := make([]interface{}, len(l))
+		for j, e := range l {
+			items[j] = e
+		}
+		return items, nil
+	}
+	return nil, errorf("argument %d must be a list, got %s", i+1, typeName(args[i]))
+}
+
+// eventsArg accepts an event list, including an empty list literal and lists
+// of events stored inside other lists.
+func eventsArg(args []interface{}, i int) ([]*Event, error) {
+	switch l := args[i].(type) {
+	case []*Event:
+		return l, nil
+	case []interface{}:
+		events := make([]*Event, 0, len(l))
+		for _, item := range l {
+			switch e := item.(type) {
+			case *Event:
+				events = append(events, e)
+			case map[string]interface{}:
+				ev, err := fromMap(e)
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, ev)
+			default:
+				return nil, errorf("argument %d must be a list of events, found %s", i+1, typeName(item))
+			}
+		}
+		return events, nil
+	}
+	return nil, errorf("argument %d must be a list of events, got %s", i+1, typeName(args[i]))
+}
+
+// -- functions --
+
+func qQueryBucket(ns *namespace, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	bucketID, err := stringArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	ns.buckets[bucketID] = struct{}{}
+	bucket, err := ns.ds.GetBucket(bucketID)
+	if err != nil {
+		return nil, errorf("there is no bucket named %q", bucketID)
+	}
+	// Bucket.Get rounds the times it is given in place
+	start, end := ns.start, ns.end
+	stored, err := bucket.Get(-1, &start, &end)
+	if err != nil {
+		return nil, err
+	}
+	// Count only the part of events that run over the edges of the period
+	events := make([]*Event, 0, len(stored))
+	for _, e := range stored {
+		events = append(events, FromModel(e.Clip(&ns.start, &ns.end)))
+	}
+	return events, nil
+}
+
+func qQueryBucketEventcount(ns *namespace, args []interface{}) (interface{}, error) {
+	events, err := qQueryBucket(ns, args)
+	if err != nil {
+		return nil, err
+	}
+	return float64(len(events.([]*Event))), nil
+}
+
+// find_bucket(filter[, hostname]) returns the first bucket ID containing filter.
+func qFindBucket(ns *namespace, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	filter, err := stringArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	hostname := ""
+	if len(args) == 2 && args[1] != nil {
+		if hostname, err = stringArg(args, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	ns.findsBuckets = true
+	buckets := ns.ds.Buckets()
+	ids := make([]string, 0, len(buckets))
+	for id := range buckets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if !strings.Contains(id, filter) {
+			continue
+		}
+		if hostname != "" && buckets[id]["hostname"] != hostname {
+			continue
+		}
+		return id, nil
+	}
+	return nil, errorf("unable to find bucket matching %q", filter)
+}
+
+func qFlood(ns *namespace, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	events, err := eventsArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	pulsetime := 5.0
+	if len(args) == 2 {
+		if pulsetime, err = numberArg(args, 1); err != nil {
+			return nil, err
+		}
+	}
+	return flood(events, pulsetime), nil
+}
+
+func qFilterKeyvals(exclude bool) function {
+	return func(ns *namespace, args []interface{}) (interface{}, error) {
+		if err := checkArgs(args, 3, 3); err != nil {
+			return nil, err
+		}
+		events, err := eventsArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		key, err := stringArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		vals, err := listArg(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return filterKeyvals(events, key, vals, exclude), nil
+	}
+}
+
+func qFilterKeyvalsRegex(ns *namespace, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	events, err := eventsArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	key, err := stringArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := stringArg(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errorf("invalid regex %q: %v", pattern, err)
+	}
+	return filterKeyvalsRegex(events, key, re), nil
+}
+
+func qEventPair(fn func(a, b []*Event) []*Event) function {
+	return func(ns *namespace, args []interface{}) (interface{}, error) {
+		if err := checkArgs(args, 2, 2); err != nil {
+			return nil, err
+		}
+		a, err := eventsArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		b, err := eventsArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return fn(a, b), nil
+	}
+}
+
+func qEvents(fn func(events []*Event) []*Event) function {
+	return func(ns *namespace, args []interface{}) (interface{}, error) {
+		if err := checkArgs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		events, err := eventsArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return fn(events), nil
+	}
+}
+
+// qClasses wraps categorize and tag, which take the classes to apply as an
+// optional second argument.
+func qClasses(fn func(events []*Event, c *categories.Classifier) []*Event) function {
+	return func(ns *namespace, args []interface{}) (interface{}, error) {
+		if err := checkArgs(args, 1, 2); err != nil {
+			return nil, err
+		}
+		events, err := eventsArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		c, err := classifierArg(ns, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return fn(events, c), nil
+	}
+}
+
+func qMergeEventsByKeys(ns *namespace, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	events, err := eventsArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	rawKeys, err := listArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(rawKeys))
+	for _, k := range rawKeys {
+		s, ok := k.(string)
+		if !ok {
+			return nil, errorf("keys must be strings, got %s", typeName(k))
+		}
+		keys = append(keys, s)
+	}
+	return mergeEventsByKeys(events, keys), nil
+}
+
+func qLimitEvents(ns *namespace, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	events, err := eventsArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	count, err := numberArg(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return limitEvents(events, int(count)), nil
+}
+
+func qSumDurations(ns *namespace, args []interface{}) (interface{}, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	events, err := eventsArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return sumDurations(events), nil
+}
+
+func qNop(ns *namespace, args []interface{}) (interface{}, error) {
+	return nil, nil
+}
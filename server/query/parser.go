@@ -0,0 +1,349 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The query language is a small, JSON-flavoured scripting language:
+//
+//	events = flood(query_bucket(find_bucket("tg-observer-window_")));
+//	events = merge_events_by_keys(events, ["app"]);
+//	RETURN = {"events": events, "duration": sum_durations(events)};
+//
+// A script is a list of assignments separated by semicolons. Expressions are
+// literals (strings, numbers, true/false/null, lists and dicts), variable
+// references and function calls.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// lex splits a script into tokens.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '#':
+			// Comment until end of line
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.IndexByte("=;,()[]{}:", c) >= 0:
+			tokens = append(tokens, token{kind: tokPunct, text: string(c), pos: i})
+			i++
+		case c == '"' || c == '\'':
+			s, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, &Error{Pos: i, Message: err.Error()}
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, pos: i})
+			i += n
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(src) && strings.IndexByte("0123456789.eE+-", src[i]) >= 0 {
+				// A sign is only part of the number directly after an exponent
+				if (src[i] == '+' || src[i] == '-') && src[i-1] != 'e' && src[i-1] != 'E' {
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[start:i], pos: start})
+		case c == '_' || c == '$' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '$' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[start:i], pos: start})
+		default:
+			return nil, &Error{Pos: i, Message: fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	tokens = append(tokens, token{kind: tokEOF, pos: len(src)})
+	return tokens, nil
+}
+
+// lexString reads a quoted string literal at the start of s and returns the
+// unescaped value along with the number of bytes consumed. Unknown escapes are
+// kept verbatim so regexes like "\d+" survive without double escaping.
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == quote {
+			return b.String(), i + 1, nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(s) {
+			break
+		}
+		switch s[i] {
+		case '"', '\'', '\\', '/':
+			b.WriteByte(s[i])
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+4 >= len(s) {
+				return "", 0, fmt.Errorf("invalid unicode escape in string")
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid unicode escape in string: %w", err)
+			}
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// node is an expression in the parsed script.
+type node interface {
+	eval(ns *namespace) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+type variable struct {
+	name string
+	pos  int
+}
+
+type call struct {
+	name string
+	args []node
+	pos  int
+}
+
+type listLit struct {
+	items []node
+}
+
+type dictLit struct {
+	keys   []string
+	values []node
+}
+
+type assignment struct {
+	name string
+	expr node
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse turns a script into a list of assignments.
+func parse(src string) ([]assignment, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+
+	var stmts []assignment
+	for p.peek().kind != tokEOF {
+		if p.accept(";") {
+			continue
+		}
+		stmt, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if p.peek().kind != tokEOF && !p.accept(";") {
+			return nil, p.errorf("expected ';' after assignment to %s, got %s", stmt.name, p.peek())
+		}
+	}
+	return stmts, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the given punctuation.
+func (p *parser) accept(punct string) bool {
+	t := p.peek()
+	if t.kind == tokPunct && t.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(punct string) error {
+	if !p.accept(punct) {
+		return p.errorf("expected %q, got %s", punct, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &Error{Pos: p.peek().pos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) assignment() (assignment, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return assignment{}, &Error{Pos: t.pos, Message: fmt.Sprintf("expected variable name, got %s", t)}
+	}
+	if err := p.expect("="); err != nil {
+		return assignment{}, err
+	}
+	expr, err := p.expr()
+	if err != nil {
+		return assignment{}, err
+	}
+	return assignment{name: t.text, expr: expr}, nil
+}
+
+func (p *parser) expr() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return literal{value: t.text}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &Error{Pos: t.pos, Message: fmt.Sprintf("invalid number %q", t.text)}
+		}
+		return literal{value: f}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "True":
+			return literal{value: true}, nil
+		case "false", "False":
+			return literal{value: false}, nil
+		case "null", "None":
+			return literal{value: nil}, nil
+		}
+		if p.accept("(") {
+			args, err := p.items(")")
+			if err != nil {
+				return nil, err
+			}
+			return call{name: t.text, args: args, pos: t.pos}, nil
+		}
+		return variable{name: t.text, pos: t.pos}, nil
+	case tokPunct:
+		switch t.text {
+		case "[":
+			items, err := p.items("]")
+			if err != nil {
+				return nil, err
+			}
+			return listLit{items: items}, nil
+		case "{":
+			return p.dict()
+		}
+	}
+	return nil, &Error{Pos: t.pos, Message: fmt.Sprintf("unexpected %s", t)}
+}
+
+// items parses a comma separated list of expressions up to the closing token.
+func (p *parser) items(closing string) ([]node, error) {
+	var items []node
+	for !p.accept(closing) {
+		if len(items) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			// Allow a trailing comma
+			if p.accept(closing) {
+				break
+			}
+		}
+		item, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (p *parser) dict() (node, error) {
+	d := dictLit{}
+	for !p.accept("}") {
+		if len(d.keys) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if p.accept("}") {
+				break
+			}
+		}
+		key := p.next()
+		if key.kind != tokString {
+			return nil, &Error{Pos: key.pos, Message: fmt.Sprintf("dict keys must be strings, got %s", key)}
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		d.keys = append(d.keys, key.text)
+		d.values = append(d.values, value)
+	}
+	return d, nil
+}
@@ -0,0 +1,178 @@
+// Package query implements the TimelyGator query language that clients send to
+// /v1/query. A script is evaluated once per requested time period against the
+// buckets in the datastore and must assign its result to RETURN.
+package query
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"timelygator/server/database"
+)
+
+// Error is returned for scripts that fail to parse or evaluate. It is a
+// client error, as opposed to datastore failures.
+type Error struct {
+	Pos     int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Pos >= 0 {
+		return fmt.Sprintf("query error at offset %d: %s", e.Pos, e.Message)
+	}
+	return fmt.Sprintf("query error: %s", e.Message)
+}
+
+func errorf(format string, args ...interface{}) *Error {
+	return &Error{Pos: -1, Message: fmt.Sprintf(format, args...)}
+}
+
+// namespace holds the variables of a running script and the context it runs in.
+type namespace struct {
+	ds    *database.Datastore
+	start time.Time
+	end   time.Time
+	vars  map[string]interface{}
+
+	// Recorded for the result cache: which buckets the script read, whether
+	// it depended on the list of buckets and on the stored classes.
+	buckets      map[string]struct{}
+	findsBuckets bool
+	usesClasses  bool
+}
+
+// Script is a parsed query that can be evaluated for several periods.
+type Script struct {
+	name  string
+	hash  string
+	stmts []assignment
+}
+
+// Parse parses a query script. The client sends scripts as a list of lines,
+// which are joined before parsing.
+func Parse(name string, lines []string) (*Script, error) {
+	src := strings.Join(lines, "\n")
+	stmts, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(src))
+	return &Script{name: name, hash: hex.EncodeToString(sum[:]), stmts: stmts}, nil
+}
+
+// Eval runs the script for the period [start, end] and returns the value
+// assigned to RETURN.
+func (s *Script) Eval(ds *database.Datastore, start, end time.Time) (interface{}, error) {
+	result, _, err := s.eval(ds, start, end)
+	return result, err
+}
+
+func (s *Script) eval(ds *database.Datastore, start, end time.Time) (interface{}, *namespace, error) {
+	ns := &namespace{
+		ds:    ds,
+		start: start,
+		end:   end,
+		vars: map[string]interface{}{
+			"TIMEINTERVAL": fmt.Sprintf("%s/%s", start.Format(time.RFC3339), end.Format(time.RFC3339)),
+			"NAME":         s.name,
+		},
+		buckets: map[string]struct{}{},
+	}
+	for _, stmt := range s.stmts {
+		val, err := stmt.expr.eval(ns)
+		if err != nil {
+			return nil, nil, err
+		}
+		ns.vars[stmt.name] = val
+	}
+	result, ok := ns.vars["RETURN"]
+	if !ok {
+		return nil, nil, errorf("query does not assign a value to RETURN")
+	}
+	return result, ns, nil
+}
+
+// ParsePeriod parses a time period of the form "<start>/<end>" with both ends
+// in RFC3339 format.
+func ParsePeriod(period string) (time.Time, time.Time, error) {
+	parts := strings.Split(period, "/")
+	if len(parts) != 2 {
+		return time.Time{}, time.Time{}, errorf("invalid time period %q, expected <start>/<end>", period)
+	}
+	start, err := time.Parse(time.RFC3339, parts[0])
+	if err != nil {
+		return time.Time{}, time.Time{}, errorf("invalid start of time period %q: %v", period, err)
+	}
+	end, err := time.Parse(time.RFC3339, parts[1])
+	if err != nil {
+		return time.Time{}, time.Time{}, errorf("invalid end of time period %q: %v", period, err)
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, errorf("time period %q ends before it starts", period)
+	}
+	return start, end, nil
+}
+
+func (l literal) eval(ns *namespace) (interface{}, error) {
+	return l.value, nil
+}
+
+func (v variable) eval(ns *namespace) (interface{}, error) {
+	val, ok := ns.vars[v.name]
+	if !ok {
+		return nil, &Error{Pos: v.pos, Message: fmt.Sprintf("undefined variable %s", v.name)}
+	}
+	return val, nil
+}
+
+func (l listLit) eval(ns *namespace) (interface{}, error) {
+	items := make([]interface{}, 0, len(l.items))
+	for _, item := range l.items {
+		val, err := item.eval(ns)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, val)
+	}
+	return items, nil
+}
+
+func (d dictLit) eval(ns *namespace) (interface{}, error) {
+	m := make(map[string]interface{}, len(d.keys))
+	for i, key := range d.keys {
+		val, err := d.values[i].eval(ns)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = val
+	}
+	return m, nil
+}
+
+func (c call) eval(ns *namespace) (interface{}, error) {
+	fn, ok := functions[c.name]
+	if !ok {
+		return nil, &Error{Pos: c.pos, Message: fmt.Sprintf("unknown function %s", c.name)}
+	}
+	args := make([]interface{}, 0, len(c.args))
+	for _, arg := range c.args {
+		val, err := arg.eval(ns)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, val)
+	}
+	result, err := fn(ns, args)
+	if err != nil {
+		if qerr, ok := err.(*Error); ok && qerr.Pos < 0 {
+			qerr.Pos = c.pos
+			qerr.Message = fmt.Sprintf("%s: %s", c.name, qerr.Message)
+		}
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,288 @@
+package query
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"timelygator/server/categories"
+	"timelygator/server/client"
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+)
+
+var t0 = time.Date(2024, 3, 20, 9, 0, 0, 0, time.UTC)
+
+func ev(offset, duration float64, data map[string]interface{}) *Event {
+	return &Event{Timestamp: t0.Add(seconds(offset)), Duration: duration, Data: data}
+}
+
+func TestParse(t *testing.T) {
+	script := `
+# comment
+a = "it's";
+b = ['x', 1.5, -2, true, null];
+c = {"k": b, "nested": {"x": []},};
+RETURN = c
+`
+	s, err := Parse("test", strings.Split(script, "\n"))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	res, err := s.Eval(nil, t0, t0)
+	if err != nil {
+		t.Fatalf("Eval error: %v", err)
+	}
+	out, _ := json.Marshal(res)
+	if string(out) != `{"k":["x",1.5,-2,true,null],"nested":{"x":[]}}` {
+		t.Errorf("unexpected result %s", out)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"missing semicolon": `a = 1 b = 2`,
+		"unterminated":      `a = "abc`,
+		"bad dict key":      `a = {1: 2}`,
+		"no assignment":     `a`,
+	}
+	for name, script := range cases {
+		if _, err := Parse("test", []string{script}); err == nil {
+			t.Errorf("%s: expected error for %q", name, script)
+		}
+	}
+
+	s, err := Parse("test", []string{`x = 1;`})
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if _, err := s.Eval(nil, t0, t0); err == nil || !strings.Contains(err.Error(), "RETURN") {
+		t.Errorf("expected missing RETURN error, got %v", err)
+	}
+
+	s, _ = Parse("test", []string{`RETURN = nope(1);`})
+	if _, err := s.Eval(nil, t0, t0); err == nil || !strings.Contains(err.Error(), "unknown function") {
+		t.Errorf("expected unknown function error, got %v", err)
+	}
+}
+
+func TestFlood(t *testing.T) {
+	a := map[string]interface{}{"app": "a"}
+	b := map[string]interface{}{"app": "b"}
+	events := []*Event{
+		ev(0, 10, a),
+		ev(12, 10, a), // same data, 2s gap => merged
+		ev(26, 5, b),  // different data, 4s gap => longer event is extended
+		ev(100, 5, b), // gap too large
+	}
+	out := flood(events, 5)
+	if len(out) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(out))
+	}
+	if !out[0].Timestamp.Equal(t0) || out[0].Duration != 26 {
+		t.Errorf("unexpected merged event %v %v", out[0].Timestamp, out[0].Duration)
+	}
+	if out[1].Duration != 5 || !out[1].Timestamp.Equal(t0.Add(26*time.Second)) {
+		t.Errorf("unexpected event after gap %v %v", out[1].Timestamp, out[1].Duration)
+	}
+	if events[0].Duration != 10 {
+		t.Errorf("flood modified its input")
+	}
+}
+
+func TestFilterPeriodIntersect(t *testing.T) {
+	events := []*Event{ev(0, 10, nil), ev(20, 10, nil)}
+	filters := []*Event{ev(5, 20, nil)}
+	out := filterPeriodIntersect(events, filters)
+	if len(out) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(out))
+	}
+	if out[0].Duration != 5 || out[1].Duration != 5 {
+		t.Errorf("unexpected durations %v, %v", out[0].Duration, out[1].Duration)
+	}
+}
+
+func TestPeriodUnion(t *testing.T) {
+	out := periodUnion([]*Event{ev(0, 10, nil), ev(30, 5, nil)}, []*Event{ev(5, 10, nil)})
+	if len(out) != 2 || out[0].Duration != 15 || out[1].Duration != 5 {
+		t.Errorf("unexpected union %+v", out)
+	}
+}
+
+func TestMergeEventsByKeys(t *testing.T) {
+	events := []*Event{
+		ev(0, 10, map[string]interface{}{"app": "a", "title": "1"}),
+		ev(10, 5, map[string]interface{}{"app": "b", "title": "2"}),
+		ev(15, 1, map[string]interface{}{"app": "a", "title": "3"}),
+		ev(16, 1, map[string]interface{}{"title": "4"}),
+	}
+	out := mergeEventsByKeys(events, []string{"app"})
+	if len(out) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(out))
+	}
+	if out[0].Data["app"] != "a" || out[0].Duration != 11 {
+		t.Errorf("unexpected merge %+v", out[0])
+	}
+	if _, ok := out[0].Data["title"]; ok {
+		t.Errorf("merged event should only keep merge keys")
+	}
+}
+
+func TestCategorize(t *testing.T) {
+	classes, err := categories.Parse([]interface{}{
+		map[string]interface{}{"name": []interface{}{"Work"}, "rule": map[string]interface{}{"type": "regex", "regex": "Code"}},
+		map[string]interface{}{"name": []interface{}{"Work", "Programming"}, "rule": map[string]interface{}{"type": "regex", "regex": "github", "ignore_case": true}},
+		[]interface{}{[]interface{}{"Media"}, map[string]interface{}{"type": "regex", "regex": "YouTube"}},
+	})
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	c, err := categories.Compile(classes)
+	if err != nil {
+		t.Fatalf("Compile error: %v", err)
+	}
+	out := categorize([]*Event{
+		ev(0, 1, map[string]interface{}{"app": "Code", "title": "GitHub - repo"}),
+		ev(1, 1, map[string]interface{}{"app": "Firefox", "title": "YouTube"}),
+		ev(2, 1, map[string]interface{}{"app": "Terminal"}),
+	}, c)
+	want := []string{`["Work","Programming"]`, `["Media"]`, `["Uncategorized"]`}
+	for i, w := range want {
+		got, _ := json.Marshal(out[i].Data["$category"])
+		if string(got) != w {
+			t.Errorf("event %d: expected category %s, got %s", i, w, got)
+		}
+	}
+	filtered := filterKeyvals(out, "$category", []interface{}{[]interface{}{"Media"}}, false)
+	if len(filtered) != 1 {
+		t.Errorf("expected 1 event in Media, got %d", len(filtered))
+	}
+}
+
+func TestSplitURLEvents(t *testing.T) {
+	out := splitURLEvents([]*Event{ev(0, 1, map[string]interface{}{"url": "https://www.example.com/a/b?x=1#top"})})
+	d := out[0].Data
+	if d["$domain"] != "example.com" || d["$path"] != "/a/b" || d["$params"] != "x=1" || d["$protocol"] != "https" {
+		t.Errorf("unexpected url split %+v", d)
+	}
+}
+
+func newTestDatastore(t *testing.T) *database.Datastore {
+	t.Helper()
+	ds, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open datastore: %v", err)
+	}
+	return ds
+}
+
+func insert(t *testing.T, ds *database.Datastore, bucketID string, offset, duration float64, data map[string]interface{}) {
+	t.Helper()
+	bucket, err := ds.GetBucket(bucketID)
+	if err != nil {
+		t.Fatalf("GetBucket error: %v", err)
+	}
+	e := models.NewEvent(0, t0.Add(seconds(offset)), duration, data)
+	e.BucketID = bucketID
+	if _, err := bucket.Insert(e); err != nil {
+		t.Fatalf("Insert error: %v", err)
+	}
+}
+
+func TestFullDesktopQuery(t *testing.T) {
+	ds := newTestDatastore(t)
+	for _, b := range []struct{ id, typ string }{
+		{"tg-observer-window_host", "currentwindow"},
+		{"tg-observer-afk_host", "afkstatus"},
+	} {
+		if _, err := ds.CreateBucket(b.id, b.typ, "test", "host", t0, nil, nil); err != nil {
+			t.Fatalf("CreateBucket error: %v", err)
+		}
+	}
+	insert(t, ds, "tg-observer-window_host", 0, 60, map[string]interface{}{"app": "Code", "title": "main.go"})
+	insert(t, ds, "tg-observer-window_host", 60, 30, map[string]interface{}{"app": "Slack", "title": "general"})
+	insert(t, ds, "tg-observer-window_host", 90, 30, map[string]interface{}{"app": "Code", "title": "query.go"})
+	insert(t, ds, "tg-observer-afk_host", 0, 100, map[string]interface{}{"status": "not-afk"})
+	insert(t, ds, "tg-observer-afk_host", 100, 20, map[string]interface{}{"status": "afk"})
+
+	params := &client.DesktopQueryParams{
+		QueryParams: client.QueryParams{
+			Classes: []client.ClassItem{
+				{Name: []string{"Work"}, Rule: client.CategorySpec{"type": "regex", "regex": "Code"}},
+				{Name: []string{"Comms"}, Rule: client.CategorySpec{"type": "regex", "regex": "Slack"}},
+			},
+			FilterAfk: true,
+		},
+		BidWindow: "tg-observer-window_host",
+		BidAfk:    "tg-observer-afk_host",
+	}
+	q := client.FullDesktopQuery(nil, params)
+
+	script, err := Parse("desktop", strings.Split(q, "\n"))
+	if err != nil {
+		t.Fatalf("Parse error: %v\n%s", err, q)
+	}
+	res, err := script.Eval(ds, t0.Add(-time.Hour), t0.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Eval error: %v", err)
+	}
+	out, _ := json.Marshal(res)
+	var decoded struct {
+		Window struct {
+			AppEvents []struct {
+				Duration float64                `json:"duration"`
+				Data     map[string]interface{} `json:"data"`
+			} `json:"app_events"`
+			CatEvents []struct {
+				Data map[string]interface{} `json:"data"`
+			} `json:"cat_events"`
+			Duration float64 `json:"duration"`
+		} `json:"window"`
+	}
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	if decoded.Window.Duration != 120 {
+		t.Errorf("expected total duration 120, got %v", decoded.Window.Duration)
+	}
+	if len(decoded.Window.AppEvents) != 2 || decoded.Window.AppEvents[0].Data["app"] != "Code" {
+		t.Errorf("unexpected app events %s", out)
+	}
+	if len(decoded.Window.CatEvents) != 2 {
+		t.Errorf("expected 2 categories, got %d", len(decoded.Window.CatEvents))
+	}
+}
+
+func TestQueryBucketOverlap(t *testing.T) {
+	ds := newTestDatastore(t)
+	if _, err := ds.CreateBucket("afk", "afkstatus", "test", "host", t0, nil, nil); err != nil {
+		t.Fatalf("CreateBucket error: %v", err)
+	}
+	// A two hour span that starts an hour before the period, one that ends
+	// before it and one that runs past its end
+	insert(t, ds, "afk", -3600, 7200, map[string]interface{}{"status": "not-afk"})
+	insert(t, ds, "afk", -7200, 600, map[string]interface{}{"status": "afk"})
+	insert(t, ds, "afk", 3*3600, 2*3600, map[string]interface{}{"status": "afk"})
+
+	script, err := Parse("overlap", []string{
+		`events = query_bucket("afk");`,
+		`RETURN = {"count": query_bucket_eventcount("afk"), "total": sum_durations(events)};`,
+	})
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	res, err := script.Eval(ds, t0, t0.Add(4*time.Hour))
+	if err != nil {
+		t.Fatalf("Eval error: %v", err)
+	}
+	got := res.(map[string]interface{})
+	if got["count"] != float64(2) {
+		t.Errorf("expected the 2 overlapping events, got %v", got["count"])
+	}
+	// One hour of the first event and one of the last fall in the period
+	if got["total"] != float64(7200) {
+		t.Errorf("expected events clipped to 7200 seconds, got %v", got["total"])
+	}
+}
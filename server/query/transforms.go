@@ -0,0 +1,275 @@
+package query
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The transforms below operate on event lists and mirror the semantics of the
+// ActivityWatch query functions that the client's canned queries are written
+// against. They never modify their input events in place.
+
+func copyEvents(events []*Event) []*Event {
+	out := make([]*Event, len(events))
+	for i, e := range events {
+		out[i] = e.copy()
+	}
+	return out
+}
+
+func sortByTimestamp(events []*Event) []*Event {
+	out := append([]*Event{}, events...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Timestamp.Before(out[j].Timestamp)
+	})
+	return out
+}
+
+func sortByDuration(events []*Event) []*Event {
+	out := append([]*Event{}, events...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Duration > out[j].Duration
+	})
+	return out
+}
+
+func limitEvents(events []*Event, count int) []*Event {
+	if count < 0 || count >= len(events) {
+		return events
+	}
+	return events[:count]
+}
+
+func sumDurations(events []*Event) float64 {
+	total := 0.0
+	for _, e := range events {
+		total += e.Duration
+	}
+	return total
+}
+
+// flood fills gaps of at most pulsetime seconds between consecutive events.
+// Neighbours with equal data are merged, otherwise the longer of the two is
+// extended over the gap.
+func flood(events []*Event, pulsetime float64) []*Event {
+	events = copyEvents(sortByTimestamp(events))
+	for i := 0; i+1 < len(events); i++ {
+		e1, e2 := events[i], events[i+1]
+		gap := e2.Timestamp.Sub(e1.End()).Seconds()
+		if gap == 0 || gap > pulsetime {
+			continue
+		}
+		if e1.dataEqual(e2) {
+			// Covers overlapping events with equal data as well as small gaps.
+			// The merged event continues as e2 so it can merge again.
+			end := latest(e1.End(), e2.End())
+			e2.Timestamp = e1.Timestamp
+			e2.Duration = end.Sub(e1.Timestamp).Seconds()
+			e1.Duration = 0
+		} else if gap > 0 {
+			if e1.Duration > e2.Duration {
+				e1.Duration += gap
+			} else {
+				e2.Timestamp = e2.Timestamp.Add(-seconds(gap))
+				e2.Duration += gap
+			}
+		}
+	}
+	out := []*Event{}
+	for _, e := range events {
+		if e.Duration > 0 {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// filterPeriodIntersect returns the parts of events that overlap any of the
+// filter events.
+func filterPeriodIntersect(events, filters []*Event) []*Event {
+	events = sortByTimestamp(events)
+	filters = sortByTimestamp(filters)
+
+	out := []*Event{}
+	i, j := 0, 0
+	for i < len(events) && j < len(filters) {
+		e, f := events[i], filters[j]
+		start := latest(e.Timestamp, f.Timestamp)
+		end := earliest(e.End(), f.End())
+		if start.Before(end) {
+			c := e.copy()
+			c.Timestamp = start
+			c.Duration = end.Sub(start).Seconds()
+			out = append(out, c)
+		}
+		if !e.End().After(f.End()) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return out
+}
+
+// periodUnion merges the periods covered by both lists into non-overlapping
+// events without data.
+func periodUnion(a, b []*Event) []*Event {
+	all := sortByTimestamp(append(append([]*Event{}, a...), b...))
+
+	out := []*Event{}
+	for _, e := range all {
+		if n := len(out); n > 0 && !e.Timestamp.After(out[n-1].End()) {
+			last := out[n-1]
+			if e.End().After(last.End()) {
+				last.Duration = e.End().Sub(last.Timestamp).Seconds()
+			}
+			continue
+		}
+		out = append(out, &Event{Timestamp: e.Timestamp, Duration: e.Duration, Data: map[string]interface{}{}})
+	}
+	return out
+}
+
+func concat(a, b []*Event) []*Event {
+	return append(append([]*Event{}, a...), b...)
+}
+
+// filterKeyvals keeps (or with exclude, drops) events whose data[key] equals
+// one of vals.
+func filterKeyvals(events []*Event, key string, vals []interface{}, exclude bool) []*Event {
+	out := []*Event{}
+	for _, e := range events {
+		match := false
+		if v, ok := e.Data[key]; ok {
+			for _, want := range vals {
+				if valuesEqual(v, want) {
+					match = true
+					break
+				}
+			}
+		}
+		if match != exclude {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func filterKeyvalsRegex(events []*Event, key string, re *regexp.Regexp) []*Event {
+	out := []*Event{}
+	for _, e := range events {
+		if s, ok := e.Data[key].(string); ok && re.MatchString(s) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// mergeEventsByKeys groups events by the values of keys and sums their
+// durations. Events missing any of the keys are dropped.
+func mergeEventsByKeys(events []*Event, keys []string) []*Event {
+	if len(keys) == 0 {
+		return events
+	}
+	out := []*Event{}
+	groups := map[string]*Event{}
+	for _, e := range events {
+		vals := make([]interface{}, 0, len(keys))
+		for _, k := range keys {
+			v, ok := e.Data[k]
+			if !ok {
+				break
+			}
+			vals = append(vals, v)
+		}
+		if len(vals) != len(keys) {
+			continue
+		}
+		b, err := json.Marshal(vals)
+		if err != nil {
+			continue
+		}
+		groupKey := string(b)
+		if merged, ok := groups[groupKey]; ok {
+			merged.Duration += e.Duration
+			continue
+		}
+		merged := &Event{Timestamp: e.Timestamp, Duration: e.Duration, Data: map[string]interface{}{}}
+		for i, k := range keys {
+			merged.Data[k] = vals[i]
+		}
+		groups[groupKey] = merged
+		out = append(out, merged)
+	}
+	return out
+}
+
+// splitURLEvents adds the parsed components of data["url"] as $-prefixed keys.
+func splitURLEvents(events []*Event) []*Event {
+	out := make([]*Event, 0, len(events))
+	for _, e := range events {
+		raw, ok := e.Data["url"].(string)
+		if !ok {
+			out = append(out, e)
+			continue
+		}
+		c := e.copy()
+		if u, err := url.Parse(raw); err == nil {
+			c.Data["$protocol"] = u.Scheme
+			c.Data["$domain"] = strings.TrimPrefix(u.Host, "www.")
+			c.Data["$path"] = u.Path
+			c.Data["$params"] = u.RawQuery
+			c.Data["$identifier"] = u.Fragment
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// valuesEqual compares two decoded JSON values.
+func valuesEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !valuesEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if !valuesEqual(v, bv[k]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
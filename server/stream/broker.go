@@ -0,0 +1,170 @@
+// Package stream fans out changes to the events of buckets to live
+// subscribers, such as the Server-Sent Events endpoints under /v1/stream.
+//
+// Every message gets a sequence number. The broker keeps the most recent
+// messages in a ring buffer so that a client which lost its connection can
+// reconnect with the cursor of the last message it saw and receive what it
+// missed. Cursors include the start time of the broker, so a cursor from before
+// a server restart is recognized as stale instead of silently skipping events.
+package stream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind says what happened to an event.
+type Kind string
+
+const (
+	Inserted Kind = "inserted" // a new event was stored
+	Merged   Kind = "merged"   // a heartbeat extended an existing event
+	Deleted  Kind = "deleted"  // an event was removed
+	Updated  Kind = "updated"  // an event was edited
+)
+
+// DefaultHistory is the number of messages kept for resuming by default.
+const DefaultHistory = 1000
+
+// subscriberBuffer is the number of messages a subscriber may fall behind by
+// before it is disconnected.
+const subscriberBuffer = 256
+
+// Message is a single change to an event.
+type Message struct {
+	ID       uint64                 `json:"id"`
+	Kind     Kind                   `json:"kind"`
+	BucketID string                 `json:"bucket_id"`
+	Time     time.Time              `json:"time"`
+	Event    map[string]interface{} `json:"event"`
+}
+
+// Broker distributes messages to subscribers.
+type Broker struct {
+	mu      sync.Mutex
+	epoch   string
+	nextID  uint64
+	history []Message // ring buffer, oldest at start
+	first   int       // index of the oldest message in history
+	size    int
+	subs    map[*Subscription]struct{}
+}
+
+// Subscription receives messages published after it was created. C is closed
+// when the subscription is cancelled or the subscriber fell too far behind.
+type Subscription struct {
+	C        <-chan Message
+	c        chan Message
+	bucketID string
+	broker   *Broker
+}
+
+// NewBroker creates a broker that keeps the last history messages for resuming.
+func NewBroker(history int) *Broker {
+	if history <= 0 {
+		history = DefaultHistory
+	}
+	return &Broker{
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		nextID:  1,
+		history: make([]Message, 0, history),
+		size:    history,
+		subs:    make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns the message the next sequence number and delivers it.
+func (b *Broker) Publish(kind Kind, bucketID string, event map[string]interface{}) Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	msg := Message{ID: b.nextID, Kind: kind, BucketID: bucketID, Time: time.Now().UTC(), Event: event}
+	b.nextID++
+	if len(b.history) < b.size {
+		b.history = append(b.history, msg)
+	} else {
+		b.history[b.first] = msg
+		b.first = (b.first + 1) % b.size
+	}
+
+	for sub := range b.subs {
+		if sub.bucketID != "" && sub.bucketID != bucketID {
+			continue
+		}
+		select {
+		case sub.c <- msg:
+		default:
+			// Never block publishers on a slow client, it can resume later
+			b.cancel(sub)
+		}
+	}
+	return msg
+}
+
+// Cursor returns the resume cursor of a message.
+func (b *Broker) Cursor(msg Message) string {
+	return fmt.Sprintf("%s-%d", b.epoch, msg.ID)
+}
+
+// Subscribe returns a subscription to the messages of bucketID, or of all
+// buckets if bucketID is empty. If cursor is not empty, messages published
+// after it that are still in the history are returned as backlog. complete is
+// false if some of them were already discarded or the cursor is from another
+// run of the server, in which case clients should reload their state.
+func (b *Broker) Subscribe(bucketID string, cursor string) (sub *Subscription, backlog []Message, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := make(chan Message, subscriberBuffer)
+	sub = &Subscription{C: c, c: c, bucketID: bucketID, broker: b}
+	b.subs[sub] = struct{}{}
+
+	if cursor == "" {
+		return sub, nil, true
+	}
+	lastID, ok := b.parseCursor(cursor)
+	if !ok {
+		return sub, nil, false
+	}
+	if lastID >= b.nextID-1 {
+		return sub, nil, true
+	}
+	complete = len(b.history) > 0 && b.history[b.first].ID <= lastID+1
+	for i := 0; i < len(b.history); i++ {
+		msg := b.history[(b.first+i)%len(b.history)]
+		if msg.ID > lastID && (bucketID == "" || msg.BucketID == bucketID) {
+			backlog = append(backlog, msg)
+		}
+	}
+	return sub, backlog, complete
+}
+
+// parseCursor returns the sequence number of a cursor issued by this broker.
+func (b *Broker) parseCursor(cursor string) (uint64, bool) {
+	epoch, seq, found := strings.Cut(cursor, "-")
+	if !found || epoch != b.epoch {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || id >= b.nextID {
+		return 0, false
+	}
+	return id, true
+}
+
+// Cancel stops the subscription and closes its channel.
+func (s *Subscription) Cancel() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.cancel(s)
+}
+
+func (b *Broker) cancel(sub *Subscription) {
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.c)
+	}
+}
@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"testing"
+)
+
+func publishN(b *Broker, bucketID string, n int) []Message {
+	var msgs []Message
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, b.Publish(Inserted, bucketID, map[string]interface{}{"n": i}))
+	}
+	return msgs
+}
+
+func TestSubscribe(t *testing.T) {
+	b := NewBroker(4)
+	all, _, _ := b.Subscribe("", "")
+	defer all.Cancel()
+	window, _, _ := b.Subscribe("window", "")
+	defer window.Cancel()
+
+	b.Publish(Inserted, "window", nil)
+	b.Publish(Deleted, "afk", nil)
+
+	if msg := <-all.C; msg.BucketID != "window" || msg.ID != 1 {
+		t.Errorf("unexpected first message %+v", msg)
+	}
+	if msg := <-all.C; msg.BucketID != "afk" || msg.Kind != Deleted {
+		t.Errorf("unexpected second message %+v", msg)
+	}
+	if msg := <-window.C; msg.BucketID != "window" {
+		t.Errorf("unexpected bucket message %+v", msg)
+	}
+	select {
+	case msg := <-window.C:
+		t.Errorf("expected no message from other buckets, got %+v", msg)
+	default:
+	}
+}
+
+func TestResume(t *testing.T) {
+	b := NewBroker(4)
+	msgs := publishN(b, "window", 3)
+
+	sub, backlog, complete := b.Subscribe("", b.Cursor(msgs[0]))
+	sub.Cancel()
+	if !complete || len(backlog) != 2 || backlog[0].ID != msgs[1].ID {
+		t.Errorf("expected the 2 later messages, got %v (complete %v)", backlog, complete)
+	}
+
+	sub, backlog, complete = b.Subscribe("", b.Cursor(msgs[2]))
+	sub.Cancel()
+	if !complete || len(backlog) != 0 {
+		t.Errorf("expected nothing to resume when up to date, got %v", backlog)
+	}
+
+	// Overflow the history so the message after msgs[0] is discarded
+	msgs = append(msgs, publishN(b, "window", 3)...)
+	sub, backlog, complete = b.Subscribe("", b.Cursor(msgs[0]))
+	sub.Cancel()
+	if complete || len(backlog) != 4 || backlog[0].ID != msgs[2].ID {
+		t.Errorf("expected incomplete backlog of 4, got %v (complete %v)", backlog, complete)
+	}
+
+	// Cursors from another broker (a previous server run) cannot be resumed
+	other := NewBroker(4)
+	other.epoch = "other"
+	sub, backlog, complete = b.Subscribe("", other.Cursor(msgs[5]))
+	sub.Cancel()
+	if complete || len(backlog) != 0 {
+		t.Errorf("expected stale cursor to be rejected, got %v (complete %v)", backlog, complete)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	b := NewBroker(0)
+	sub, _, _ := b.Subscribe("", "")
+	publishN(b, "window", subscriberBuffer+1)
+
+	n := 0
+	for range sub.C {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("expected %d buffered messages before disconnect, got %d", subscriberBuffer, n)
+	}
+	sub.Cancel() // cancelling twice is harmless
+}
@@ -0,0 +1,87 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// KeepAlive is how often an idle stream sends a comment so that proxies do
+// not close the connection.
+var KeepAlive = 15 * time.Second
+
+// ServeSSE streams the messages of bucketID (or all buckets if empty) to the
+// client as Server-Sent Events until it disconnects. If visible is not nil,
+// only messages of buckets it returns true for are sent. Clients resume with the
+// standard Last-Event-ID header or, where they cannot set headers, the
+// last_event_id query parameter. If events were lost a "reset" event is sent
+// first, after which clients should reload the events they display.
+func (b *Broker) ServeSSE(w http.ResponseWriter, r *http.Request, bucketID string, visible func(bucketID string) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("last_event_id")
+	}
+
+	sub, backlog, complete := b.Subscribe(bucketID, cursor)
+	defer sub.Cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, msg := range backlog {
+		if visible != nil && !visible(msg.BucketID) {
+			continue
+		}
+		if err := b.writeEvent(w, msg); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-sub.C:
+			if !ok {
+				// Dropped for falling behind, the client reconnects and resumes
+				return
+			}
+			if visible != nil && !visible(msg.BucketID) {
+				continue
+			}
+			if err := b.writeEvent(w, msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (b *Broker) writeEvent(w http.ResponseWriter, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", b.Cursor(msg), msg.Kind, data)
+	return err
+}
@@ -0,0 +1,148 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func selfSigned(t *testing.T, hosts ...string) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "tls", "cert.pem")
+	keyFile = filepath.Join(dir, "tls", "key.pem")
+	created, err := EnsureSelfSigned(certFile, keyFile, hosts)
+	if err != nil || !created {
+		t.Fatalf("EnsureSelfSigned = %v, %v", created, err)
+	}
+	return certFile, keyFile
+}
+
+func TestEnsureSelfSigned(t *testing.T) {
+	certFile, keyFile := selfSigned(t, "localhost", "127.0.0.1", "tg.example")
+
+	raw, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(raw)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(cert.DNSNames, ",") != "localhost,tg.example" {
+		t.Errorf("DNS names = %v", cert.DNSNames)
+	}
+	if len(cert.IPAddresses) != 1 || cert.IPAddresses[0].String() != "127.0.0.1" {
+		t.Errorf("IP addresses = %v", cert.IPAddresses)
+	}
+	if err := cert.VerifyHostname("tg.example"); err != nil {
+		t.Error(err)
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("key mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// An existing certificate is kept
+	created, err := EnsureSelfSigned(certFile, keyFile, []string{"other"})
+	if err != nil || created {
+		t.Fatalf("second EnsureSelfSigned = %v, %v", created, err)
+	}
+	again, _ := os.ReadFile(certFile)
+	if string(again) != string(raw) {
+		t.Error("existing certificate was replaced")
+	}
+
+	fp, err := Fingerprint(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fp) != 32*3-1 || strings.Count(fp, ":") != 31 {
+		t.Errorf("fingerprint = %q", fp)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	serverCert, serverKey := selfSigned(t, "127.0.0.1")
+	clientCert, clientKey := selfSigned(t, "laptop")
+	otherCert, otherKey := selfSigned(t, "intruder")
+
+	serverConfig, err := ServerConfig(serverCert, serverKey, clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.TLS = serverConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(cfg *tls.Config) (string, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		res, err := c.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	cases := []struct {
+		name      string
+		ca        string
+		cert, key string
+		want      string
+	}{
+		{"untrusted server", "", clientCert, clientKey, ""},
+		{"no client certificate", serverCert, "", "", ""},
+		{"unknown client certificate", serverCert, otherCert, otherKey, ""},
+		{"trusted", serverCert, clientCert, clientKey, "laptop"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := ClientConfig(c.ca, c.cert, c.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := get(cfg)
+			if c.want == "" {
+				if err == nil {
+					t.Fatalf("request succeeded with %q", got)
+				}
+				return
+			}
+			if err != nil || got != c.want {
+				t.Fatalf("got %q, %v, want %q", got, err, c.want)
+			}
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := ServerConfig(missing, missing, ""); err == nil {
+		t.Error("ServerConfig accepted a missing certificate")
+	}
+	if _, err := ClientConfig(missing, "", ""); err == nil {
+		t.Error("ClientConfig accepted missing CAs")
+	}
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0o644)
+	if _, err := ClientConfig(empty, "", ""); err == nil {
+		t.Error("ClientConfig accepted a file without certificates")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 	"timelygator/server/database/models"
 	"timelygator/server/utils/types"
@@ -56,8 +57,18 @@ func MapToJSON(data map[string]interface{}) (datatypes.JSON, error) {
 }
 
 func IsNotFound(err error) bool {
-	// Return true if it matches
-	return false
+	var notFound *types.NotFound
+	return errors.As(err, &notFound)
+}
+
+func IsBadRequest(err error) bool {
+	var badRequest *types.BadRequest
+	return errors.As(err, &badRequest)
+}
+
+func IsForbidden(err error) bool {
+	var forbidden *types.Forbidden
+	return errors.As(err, &forbidden)
 }
 
 // parseIso8601 tries time.Parse with RFC3339 or similar
@@ -137,3 +148,32 @@ func HeartbeatMerge(lastEvent, heartbeat models.Event, pulsetime float64) *model
     // Otherwise, do not merge
     return nil
 }
+
+// TokenFile returns the path of the token file of the config.
+func TokenFile(cfg types.Config) (string, error) {
+	if cfg.APITokenFile != "" {
+		return cfg.APITokenFile, nil
+	}
+	dir, err := GetDir("config")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "api-token"), nil
+}
+
+// LocalToken returns the token clients send: API_TOKEN if set, otherwise the
+// one the server wrote to its token file on this machine, if readable.
+func LocalToken(cfg types.Config) string {
+	if cfg.APIToken != "" {
+		return cfg.APIToken
+	}
+	path, err := TokenFile(cfg)
+	if err != nil {
+		return ""
+	}
+	token, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(token))
+}
@@ -0,0 +1,356 @@
+// Package webhooks delivers bucket and event changes to the HTTP endpoints
+// registered under /v1/webhooks.
+//
+// Every delivery is a JSON POST signed with the webhook's secret: the
+// X-TimelyGator-Signature header holds "sha256=" followed by the hex encoded
+// HMAC-SHA256 of the request body. Failed deliveries are retried with
+// exponential backoff and stored as dead letters once all attempts are used.
+// Every webhook has a queue worked by a few deliverers, so receivers should
+// not rely on the order of deliveries. Deliveries that do not fit in the
+// queue of a slow receiver are stored as dead letters right away.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+)
+
+// Kind is the kind of change a webhook is notified about.
+type Kind string
+
+const (
+	Created         Kind = "created"          // an event was inserted
+	HeartbeatMerged Kind = "heartbeat-merged" // a heartbeat extended an event
+	Deleted         Kind = "deleted"          // an event was deleted
+	BucketDeleted   Kind = "bucket-deleted"   // a bucket and its events were deleted
+	Updated         Kind = "updated"          // an event was edited
+)
+
+// Kinds are all kinds a webhook can subscribe to.
+var Kinds = []Kind{Created, HeartbeatMerged, Deleted, BucketDeleted, Updated}
+
+// Headers sent with every delivery.
+const (
+	SignatureHeader = "X-TimelyGator-Signature"
+	KindHeader      = "X-TimelyGator-Event"
+	DeliveryHeader  = "X-TimelyGator-Delivery"
+)
+
+// Payload is the body of a delivery.
+type Payload struct {
+	DeliveryID string                 `json:"delivery_id"`
+	Kind       Kind                   `json:"kind"`
+	BucketID   string                 `json:"bucket_id"`
+	BucketType string                 `json:"bucket_type"`
+	Time       time.Time              `json:"time"`
+	Event      map[string]interface{} `json:"event,omitempty"`
+}
+
+// subscription is a webhook with its filters decoded.
+type subscription struct {
+	hook  *models.Webhook
+	types map[string]bool
+	kinds map[Kind]bool
+}
+
+func (s *subscription) matches(kind Kind, bucketID, bucketType string) bool {
+	if !s.hook.Active {
+		return false
+	}
+	if len(s.kinds) > 0 && !s.kinds[kind] {
+		return false
+	}
+	if len(s.types) > 0 && !s.types[bucketType] {
+		return false
+	}
+	if s.hook.BucketPattern != "" {
+		if ok, _ := path.Match(s.hook.BucketPattern, bucketID); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Dispatcher matches changes against the stored webhooks and delivers them.
+type Dispatcher struct {
+	ds     *database.Datastore
+	client *http.Client
+
+	// MaxAttempts is the number of times a delivery is tried.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled for every retry after.
+	Backoff time.Duration
+	// QueueSize is the number of deliveries waiting for a webhook, and Workers
+	// the number delivered at once, read when the webhook is first notified.
+	QueueSize int
+	Workers   int
+
+	mu     sync.RWMutex
+	subs   []*subscription
+	queues map[uint]chan delivery
+	wg     sync.WaitGroup
+}
+
+// delivery is a payload waiting in the queue of a webhook.
+type delivery struct {
+	hook    *models.Webhook
+	payload Payload
+}
+
+// Default queue settings of a Dispatcher.
+const (
+	DefaultQueueSize = 100
+	DefaultWorkers   = 2
+)
+
+// NewDispatcher creates a dispatcher for the webhooks stored in ds.
+func NewDispatcher(ds *database.Datastore, maxAttempts int, timeout time.Duration) (*Dispatcher, error) {
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	d := &Dispatcher{
+		ds:          ds,
+		client:      &http.Client{Timeout: timeout},
+		MaxAttempts: maxAttempts,
+		Backoff:     time.Second,
+		QueueSize:   DefaultQueueSize,
+		Workers:     DefaultWorkers,
+		queues:      make(map[uint]chan delivery),
+	}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reload reads the webhooks from the datastore, to be called after they change.
+func (d *Dispatcher) Reload() error {
+	hooks, err := d.ds.Webhooks()
+	if err != nil {
+		return err
+	}
+	subs := make([]*subscription, 0, len(hooks))
+	for _, hook := range hooks {
+		sub := &subscription{hook: hook, types: map[string]bool{}, kinds: map[Kind]bool{}}
+		var bucketTypes []string
+		var kinds []Kind
+		if len(hook.BucketTypes) > 0 {
+			if err := json.Unmarshal(hook.BucketTypes, &bucketTypes); err != nil {
+				return fmt.Errorf("webhook %d has invalid bucket types: %w", hook.ID, err)
+			}
+		}
+		if len(hook.Kinds) > 0 {
+			if err := json.Unmarshal(hook.Kinds, &kinds); err != nil {
+				return fmt.Errorf("webhook %d has invalid kinds: %w", hook.ID, err)
+			}
+		}
+		for _, t := range bucketTypes {
+			sub.types[t] = true
+		}
+		for _, k := range kinds {
+			sub.kinds[k] = true
+		}
+		subs = append(subs, sub)
+	}
+	d.mu.Lock()
+	d.subs = subs
+	// Workers of deleted webhooks stop once their queue is drained
+	for id, queue := range d.queues {
+		if !slices.ContainsFunc(subs, func(sub *subscription) bool { return sub.hook.ID == id }) {
+			close(queue)
+			delete(d.queues, id)
+		}
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+// Enabled reports whether any webhook is active, so callers can skip
+// preparing notifications nobody receives.
+func (d *Dispatcher) Enabled() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, sub := range d.subs {
+		if sub.hook.Active {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify queues a change for delivery to every matching webhook.
+func (d *Dispatcher) Notify(kind Kind, bucketID, bucketType string, event map[string]interface{}) {
+	var dropped []delivery
+	d.mu.Lock()
+	for _, sub := range d.subs {
+		if !sub.matches(kind, bucketID, bucketType) {
+			continue
+		}
+		payload := Payload{
+			DeliveryID: newDeliveryID(),
+			Kind:       kind,
+			BucketID:   bucketID,
+			BucketType: bucketType,
+			Time:       time.Now().UTC(),
+			Event:      event,
+		}
+		d.wg.Add(1)
+		select {
+		case d.queue(sub.hook.ID) <- delivery{sub.hook, payload}:
+		default:
+			d.wg.Done()
+			dropped = append(dropped, delivery{sub.hook, payload})
+		}
+	}
+	d.mu.Unlock()
+	for _, job := range dropped {
+		d.overflow(job.hook, job.payload)
+	}
+}
+
+// queue returns the queue of a webhook, starting its workers on first use.
+// It must be called with d.mu held.
+func (d *Dispatcher) queue(hookID uint) chan delivery {
+	queue, ok := d.queues[hookID]
+	if ok {
+		return queue
+	}
+	queue = make(chan delivery, max(d.QueueSize, 1))
+	d.queues[hookID] = queue
+	for i := 0; i < max(d.Workers, 1); i++ {
+		go func() {
+			for job := range queue {
+				d.deliver(job.hook, job.payload)
+				d.wg.Done()
+			}
+		}()
+	}
+	return queue
+}
+
+// overflow stores a delivery that did not fit in the queue as a dead letter.
+func (d *Dispatcher) overflow(hook *models.Webhook, payload Payload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Could not encode webhook payload: %v\n", err)
+		return
+	}
+	log.Printf("Queue of webhook %d is full, dropping delivery %s\n", hook.ID, payload.DeliveryID)
+	d.deadLetter(hook, payload, body, 0, 0, "delivery queue is full")
+}
+
+// Wait blocks until all pending deliveries have finished.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// Sign returns the signature header value for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewSecret generates a random secret for webhooks created without one.
+func NewSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (d *Dispatcher) deliver(hook *models.Webhook, payload Payload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Could not encode webhook payload: %v\n", err)
+		return
+	}
+
+	var status int
+	backoff := d.Backoff
+	attempt := 1
+	for ; ; attempt++ {
+		var retry bool
+		status, retry, err = d.post(hook, payload, body)
+		if err == nil {
+			return
+		}
+		log.Printf("Delivery %s to webhook %d failed (attempt %d/%d): %v\n", payload.DeliveryID, hook.ID, attempt, d.MaxAttempts, err)
+		if !retry || attempt >= d.MaxAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	d.deadLetter(hook, payload, body, attempt, status, err.Error())
+}
+
+// deadLetter stores a delivery that was given up on.
+func (d *Dispatcher) deadLetter(hook *models.Webhook, payload Payload, body []byte, attempts, status int, lastError string) {
+	dead := &models.WebhookDelivery{
+		WebhookID:  hook.ID,
+		DeliveryID: payload.DeliveryID,
+		Kind:       string(payload.Kind),
+		Payload:    body,
+		Attempts:   attempts,
+		LastStatus: status,
+		LastError:  lastError,
+		Failed:     time.Now().UTC(),
+	}
+	if err := d.ds.AddDeadLetter(dead); err != nil {
+		log.Printf("Could not store dead letter for webhook %d: %v\n", hook.ID, err)
+	}
+}
+
+// post makes a single delivery attempt. It returns whether a failure is worth
+// retrying: network errors, server errors and rate limiting are, other client
+// errors are not.
+func (d *Dispatcher) post(hook *models.Webhook, payload Payload, body []byte) (int, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TimelyGator-Webhook")
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+	req.Header.Set(KindHeader, string(payload.Kind))
+	req.Header.Set(DeliveryHeader, payload.DeliveryID)
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res.StatusCode, false, nil
+	}
+	retry := res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests
+	return res.StatusCode, retry, fmt.Errorf("receiver responded with %s", res.Status)
+}
@@ -0,0 +1,165 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"timelygator/server/database"
+	"timelygator/server/database/models"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	payloads []Payload
+	statuses []int // responses to return, 200 once exhausted
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	if r.Header.Get(SignatureHeader) == Sign("secret", body) && status == http.StatusOK {
+		var p Payload
+		json.Unmarshal(body, &p)
+		rc.payloads = append(rc.payloads, p)
+	}
+	w.WriteHeader(status)
+}
+
+func newTestDispatcher(t *testing.T, hooks ...*models.Webhook) (*Dispatcher, *database.Datastore) {
+	t.Helper()
+	ds, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open datastore: %v", err)
+	}
+	for _, hook := range hooks {
+		if err := ds.SaveWebhook(hook); err != nil {
+			t.Fatalf("SaveWebhook error: %v", err)
+		}
+	}
+	d, err := NewDispatcher(ds, 3, time.Second)
+	if err != nil {
+		t.Fatalf("NewDispatcher error: %v", err)
+	}
+	d.Backoff = time.Millisecond
+	return d, ds
+}
+
+func TestFilters(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d, _ := newTestDispatcher(t,
+		&models.Webhook{URL: srv.URL, Secret: "secret", Active: true, BucketPattern: "tg-observer-window_*",
+			BucketTypes: []byte(`["currentwindow"]`), Kinds: []byte(`["created", "bucket-deleted"]`)},
+		&models.Webhook{URL: srv.URL, Secret: "secret", Active: false},
+	)
+	d.Notify(Created, "tg-observer-window_host", "currentwindow", map[string]interface{}{"app": "Code"})
+	d.Notify(HeartbeatMerged, "tg-observer-window_host", "currentwindow", nil)
+	d.Notify(Created, "tg-observer-afk_host", "currentwindow", nil)
+	d.Notify(Created, "tg-observer-window_host", "afkstatus", nil)
+	d.Notify(BucketDeleted, "tg-observer-window_host", "currentwindow", nil)
+	d.Wait()
+
+	if len(rc.payloads) != 2 {
+		t.Fatalf("expected 2 deliveries, got %d: %+v", len(rc.payloads), rc.payloads)
+	}
+	kinds := map[Kind]bool{}
+	for _, p := range rc.payloads {
+		kinds[p.Kind] = true
+		if p.BucketID != "tg-observer-window_host" || p.DeliveryID == "" {
+			t.Errorf("unexpected payload %+v", p)
+		}
+	}
+	if !kinds[Created] || !kinds[BucketDeleted] {
+		t.Errorf("expected created and bucket-deleted deliveries, got %v", kinds)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	hook := &models.Webhook{URL: srv.URL, Secret: "secret", Active: true}
+	d, ds := newTestDispatcher(t, hook)
+
+	// Succeeds on the third and last attempt
+	d.Notify(Deleted, "window", "currentwindow", nil)
+	d.Wait()
+	if len(rc.payloads) != 1 {
+		t.Fatalf("expected delivery after retries, got %d", len(rc.payloads))
+	}
+
+	// Fails all attempts
+	rc.mu.Lock()
+	rc.statuses = []int{500, 500, 500}
+	rc.mu.Unlock()
+	d.Notify(Deleted, "window", "currentwindow", nil)
+	d.Wait()
+
+	// Client errors are not retried
+	rc.mu.Lock()
+	rc.statuses = []int{http.StatusGone}
+	rc.mu.Unlock()
+	d.Notify(Created, "window", "currentwindow", nil)
+	d.Wait()
+
+	dead, err := ds.DeadLetters(hook.ID)
+	if err != nil {
+		t.Fatalf("DeadLetters error: %v", err)
+	}
+	if len(dead) != 2 {
+		t.Fatalf("expected 2 dead letters, got %d", len(dead))
+	}
+	if dead[0].Kind != "created" || dead[0].Attempts != 1 || dead[0].LastStatus != http.StatusGone {
+		t.Errorf("unexpected dead letter for client error %+v", dead[0])
+	}
+	if dead[1].Kind != "deleted" || dead[1].Attempts != 3 || dead[1].LastStatus != 500 {
+		t.Errorf("unexpected dead letter after retries %+v", dead[1])
+	}
+	var p Payload
+	if err := json.Unmarshal(dead[1].Payload, &p); err != nil || p.DeliveryID != dead[1].DeliveryID {
+		t.Errorf("expected dead letter to keep the payload, got %s", dead[1].Payload)
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	hook := &models.Webhook{URL: srv.URL, Secret: "secret", Active: true}
+	d, ds := newTestDispatcher(t, hook)
+	d.QueueSize = 2
+	d.Workers = 1
+
+	// One delivery is in progress and two wait, the rest overflow
+	for i := 0; i < 10; i++ {
+		d.Notify(Created, "window", "currentwindow", nil)
+	}
+	close(release)
+	d.Wait()
+
+	dead, err := ds.DeadLetters(hook.ID)
+	if err != nil {
+		t.Fatalf("DeadLetters error: %v", err)
+	}
+	if len(dead) < 7 || len(dead) > 8 {
+		t.Fatalf("expected the deliveries that did not fit in the queue as dead letters, got %d", len(dead))
+	}
+	if dead[0].Attempts != 0 || dead[0].LastError != "delivery queue is full" {
+		t.Errorf("unexpected dead letter for overflow %+v", dead[0])
+	}
+}